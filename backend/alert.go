@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 这个文件实现了可选的流量告警：当活跃连接数或单个写入周期内的流量超过阈值时，
+// 向配置的 Webhook 地址 POST 一条 JSON 告警。请求体同时包含 `text`（Slack）和 `content`（Discord）字段，
+// 因此可以直接使用这两种平台的 Incoming Webhook，其余字段供通用的 Webhook 接收方使用。
+// 两次告警之间至少间隔一个冷却时间，避免在持续高峰期间刷屏。
+
+// alertWebhookTimeout 是发送告警请求的超时时间。
+const alertWebhookTimeout = 10 * time.Second
+
+// AlertPayload 是发送到 Webhook 的告警内容。
+type AlertPayload struct {
+	Text      string `json:"text"`      // Slack 使用的消息文本。
+	Content   string `json:"content"`   // Discord 使用的消息文本，与 text 相同。
+	Kind      string `json:"kind"`      // 告警类型：connections、traffic 或 rule（告警规则，见 alertrules.go）。
+	Value     uint64 `json:"value"`     // 触发告警的实际值。
+	Threshold uint64 `json:"threshold"` // 配置的阈值。
+	Time      int64  `json:"time"`      // 触发时间（Unix 时间戳，秒）。
+}
+
+// trafficAlerter 检查连接数和流量是否超过阈值，并在超过时发送告警。
+type trafficAlerter struct {
+	webhookURL     string
+	maxConnections uint64
+	maxBytes       uint64
+	cooldown       time.Duration
+	client         *http.Client
+
+	mu        sync.Mutex
+	lastFired time.Time
+	hasLast   bool   // 是否已有上一次的 Clash 计数器采样。
+	lastTotal uint64 // 上一次采样的 uploadTotal + downloadTotal。
+	bytes     uint64 // 当前写入周期内累计的流量。
+}
+
+// alerter 是全局的告警器。为 nil 时表示未开启告警。
+var alerter *trafficAlerter
+
+// newTrafficAlerter 根据配置创建告警器。
+func newTrafficAlerter(cfg *Config) *trafficAlerter {
+	return &trafficAlerter{
+		webhookURL:     cfg.AlertWebhookURL,
+		maxConnections: cfg.AlertMaxConnections,
+		maxBytes:       cfg.AlertMaxBytesPerInterval,
+		cooldown:       cfg.AlertCooldown,
+		client:         &http.Client{Timeout: alertWebhookTimeout},
+	}
+}
+
+// ObserveSync 在每次从 Clash API 同步后调用，检查活跃连接数并累加本周期的流量。
+func (a *trafficAlerter) ObserveSync(activeConnections int, uploadTotal, downloadTotal uint64) {
+	a.mu.Lock()
+	total := uploadTotal + downloadTotal
+	if a.hasLast {
+		a.bytes += counterDelta(a.lastTotal, total)
+	}
+	a.lastTotal = total
+	a.hasLast = true
+	a.mu.Unlock()
+
+	if a.maxConnections > 0 && uint64(activeConnections) > a.maxConnections {
+		a.fire("connections", uint64(activeConnections), a.maxConnections,
+			fmt.Sprintf("infoclash 告警：当前活跃连接数 %d 超过阈值 %d", activeConnections, a.maxConnections))
+	}
+}
+
+// CheckInterval 在每个数据库写入周期结束时调用，检查本周期的流量是否超过阈值，然后重新开始计数。
+func (a *trafficAlerter) CheckInterval() {
+	a.mu.Lock()
+	bytes := a.bytes
+	a.bytes = 0
+	a.mu.Unlock()
+
+	if a.maxBytes > 0 && bytes > a.maxBytes {
+		a.fire("traffic", bytes, a.maxBytes,
+			fmt.Sprintf("infoclash 告警：最近一个写入周期的流量 %d 字节超过阈值 %d 字节", bytes, a.maxBytes))
+	}
+}
+
+// fire 在冷却时间之外时异步发送一条告警，不会阻塞调用方。
+func (a *trafficAlerter) fire(kind string, value, threshold uint64, text string) {
+	now := time.Now()
+	a.mu.Lock()
+	if !a.lastFired.IsZero() && now.Sub(a.lastFired) < a.cooldown {
+		a.mu.Unlock()
+		return
+	}
+	a.lastFired = now
+	a.mu.Unlock()
+
+	log.Println(text)
+	payload := AlertPayload{
+		Text:      text,
+		Content:   text,
+		Kind:      kind,
+		Value:     value,
+		Threshold: threshold,
+		Time:      now.Unix(),
+	}
+	go func() {
+		if err := a.send(payload); err != nil {
+			log.Printf("发送告警失败: %v", err)
+		}
+	}()
+}
+
+// send 把告警以 JSON 形式 POST 到 Webhook 地址。
+func (a *trafficAlerter) send(payload AlertPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return postWebhook(a.client, a.webhookURL, body)
+}
+
+// postWebhook 把 JSON 请求体 POST 到 Webhook 地址，返回非 2xx 状态码时视为失败。
+func postWebhook(client *http.Client, webhookURL string, body []byte) error {
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook 返回了非 2xx 状态码: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// 这个文件实现了按规则的流量配额告警（`alert_rules` 表和 `/api/alerts`）。
+// 与 alert.go 中基于环境变量的瞬时告警不同，每条规则描述一个配额：某个范围（全部、单个主机或单个代理链）
+// 在一个周期（本地时间的当天或当月）内的流量超过阈值时，向规则的 Webhook 地址 POST 一条 JSON 消息，
+// 例如提醒 VPS 的每月流量即将用完。每次写入数据库之后在后台检查一次，同一条规则在同一个周期内最多告警一次。
+// 请求体默认同时包含 `text`（Slack）和 `content`（Discord）字段；其他平台（Telegram、ntfy 等）可以通过
+// payloadTemplate 自定义请求体。
+
+// 告警规则的统计范围。
+const (
+	AlertScopeTotal = "total" // 所有连接的流量。
+	AlertScopeHost  = "host"  // 主机名等于 target 的连接的流量。
+	AlertScopeChain = "chain" // chain 列（规则选中的策略组，即代理链的最后一个元素）等于 target 的连接的流量。
+)
+
+// 告警规则的周期，按服务器的本地时区划分。
+const (
+	AlertPeriodDay   = "day"
+	AlertPeriodMonth = "month"
+)
+
+// alertRetryDelay 是 Webhook 第一次发送失败后等待重试的时间。只重试一次，仍然失败时等下一次检查再试。
+// 声明为变量以便测试缩短等待。
+var alertRetryDelay = 5 * time.Second
+
+// AlertRule 是一条告警规则，由 `/api/alerts` 返回。
+type AlertRule struct {
+	ID              int64  `json:"id"`
+	Name            string `json:"name"`            // 规则名称，用于告警消息。
+	Scope           string `json:"scope"`           // total、host 或 chain。
+	Target          string `json:"target"`          // scope 为 host 或 chain 时的主机名或策略组名称。
+	Threshold       uint64 `json:"threshold"`       // 流量阈值（字节），周期内的上传 + 下载流量超过该值时告警。
+	Period          string `json:"period"`          // day 或 month。
+	WebhookURL      string `json:"webhookURL"`      // Webhook 地址。地址本身就是凭据，接口返回时只保留前几个字符。
+	PayloadTemplate string `json:"payloadTemplate"` // 自定义请求体的 Go 模板，为空时使用默认的请求体。
+	Enabled         bool   `json:"enabled"`
+	LastFiredPeriod string `json:"lastFiredPeriod"` // 最近一次告警的周期，例如 `2024-01-31`（day）或 `2024-01`（month）。
+	LastFiredAt     int64  `json:"lastFiredAt"`     // 最近一次告警的时间 (Unix 时间戳, 秒)，从未告警时为 0。
+	Usage           uint64 `json:"usage"`           // 当前周期内已使用的流量（字节），只在列表和详情中返回。
+}
+
+// AlertRuleRequest 是创建和修改告警规则的请求体。
+type AlertRuleRequest struct {
+	Name            string `json:"name"`
+	Scope           string `json:"scope"`
+	Target          string `json:"target"`
+	Threshold       uint64 `json:"threshold"`
+	Period          string `json:"period"`
+	WebhookURL      string `json:"webhookURL"` // 修改时为空表示保留原来的地址。
+	PayloadTemplate string `json:"payloadTemplate"`
+	Enabled         *bool  `json:"enabled"` // 未提供时，创建的规则默认开启，修改时保持原样。
+}
+
+// AlertRuleEvent 是一次告警的内容，也是 payloadTemplate 中可以使用的字段，例如 `{{json .Text}}`。
+type AlertRuleEvent struct {
+	RuleID        int64  `json:"ruleId"`
+	Rule          string `json:"rule"`          // 规则名称。
+	Scope         string `json:"scope"`         // total、host 或 chain。
+	Target        string `json:"target"`        // 主机名或策略组名称，scope 为 total 时为空。
+	Period        string `json:"period"`        // day 或 month。
+	PeriodKey     string `json:"periodKey"`     // 触发告警的周期，例如 `2024-01`。
+	Usage         uint64 `json:"usage"`         // 周期内已使用的流量（字节）。
+	Threshold     uint64 `json:"threshold"`     // 阈值（字节）。
+	UsageText     string `json:"usageText"`     // 易读的流量，例如 `1.0 TiB`。
+	ThresholdText string `json:"thresholdText"` // 易读的阈值。
+	Text          string `json:"text"`          // 完整的告警消息。
+	Time          int64  `json:"time"`          // 触发时间 (Unix 时间戳, 秒)。
+	Test          bool   `json:"test"`          // 是否为 `/api/alerts/{id}/test` 发送的测试告警。
+}
+
+// alertRulePayload 是没有配置 payloadTemplate 时的请求体：与 AlertPayload 相同的 text、content 等字段，再加上规则的详细信息。
+type alertRulePayload struct {
+	AlertPayload
+	RuleID    int64  `json:"ruleId"`
+	Rule      string `json:"rule"`
+	Scope     string `json:"scope"`
+	Target    string `json:"target"`
+	Period    string `json:"period"`
+	PeriodKey string `json:"periodKey"`
+	Test      bool   `json:"test"`
+}
+
+// alertTemplateFuncs 是 payloadTemplate 中可以使用的函数。`json` 把值编码为 JSON（字符串会加上引号并转义），
+// 用于在模板中安全地嵌入告警消息等文本。
+var alertTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// alertPeriod 返回 t 所在周期的标识和开始时间（本地时间零点）。
+func alertPeriod(period string, t time.Time) (string, time.Time) {
+	if period == AlertPeriodMonth {
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		return start.Format("2006-01"), start
+	}
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return start.Format("2006-01-02"), start
+}
+
+// newAlertRuleEvent 生成规则在周期 periodKey 内使用了 usage 字节时的告警内容。
+func newAlertRuleEvent(rule AlertRule, periodKey string, usage uint64, now time.Time, test bool) AlertRuleEvent {
+	scope := "总流量"
+	switch rule.Scope {
+	case AlertScopeHost:
+		scope = fmt.Sprintf("主机 %s 的流量", rule.Target)
+	case AlertScopeChain:
+		scope = fmt.Sprintf("策略组 %s 的流量", rule.Target)
+	}
+	period := "今天"
+	if rule.Period == AlertPeriodMonth {
+		period = "本月"
+	}
+	name := rule.Name
+	if name == "" {
+		name = fmt.Sprintf("#%d", rule.ID)
+	}
+	text := fmt.Sprintf("infoclash 告警：规则「%s」%s（%s）%s %s，超过阈值 %s", name, period, periodKey, scope, humanizeBytes(usage), humanizeBytes(rule.Threshold))
+	if test {
+		text = "[测试] " + text
+	}
+	return AlertRuleEvent{
+		RuleID:        rule.ID,
+		Rule:          rule.Name,
+		Scope:         rule.Scope,
+		Target:        rule.Target,
+		Period:        rule.Period,
+		PeriodKey:     periodKey,
+		Usage:         usage,
+		Threshold:     rule.Threshold,
+		UsageText:     humanizeBytes(usage),
+		ThresholdText: humanizeBytes(rule.Threshold),
+		Text:          text,
+		Time:          now.Unix(),
+		Test:          test,
+	}
+}
+
+// renderAlertPayload 生成发送到 Webhook 的请求体。自定义模板的结果必须是合法的 JSON。
+func renderAlertPayload(payloadTemplate string, event AlertRuleEvent) ([]byte, error) {
+	if payloadTemplate == "" {
+		return json.Marshal(alertRulePayload{
+			AlertPayload: AlertPayload{
+				Text:      event.Text,
+				Content:   event.Text,
+				Kind:      "rule",
+				Value:     event.Usage,
+				Threshold: event.Threshold,
+				Time:      event.Time,
+			},
+			RuleID:    event.RuleID,
+			Rule:      event.Rule,
+			Scope:     event.Scope,
+			Target:    event.Target,
+			Period:    event.Period,
+			PeriodKey: event.PeriodKey,
+			Test:      event.Test,
+		})
+	}
+
+	tmpl, err := template.New("payload").Funcs(alertTemplateFuncs).Option("missingkey=error").Parse(payloadTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("解析 payloadTemplate 失败: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, event); err != nil {
+		return nil, fmt.Errorf("渲染 payloadTemplate 失败: %w", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, errors.New("payloadTemplate 渲染的结果不是合法的 JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+// postWebhookWithRetry 发送 Webhook，第一次失败时等待 alertRetryDelay 后重试一次。
+func postWebhookWithRetry(ctx context.Context, client *http.Client, webhookURL string, body []byte) error {
+	err := postWebhook(client, webhookURL, body)
+	if err == nil {
+		return nil
+	}
+	log.Printf("发送告警失败，将在 %v 后重试: %v", alertRetryDelay, err)
+	select {
+	case <-ctx.Done():
+		return err
+	case <-time.After(alertRetryDelay):
+	}
+	return postWebhook(client, webhookURL, body)
+}
+
+// validateAlertRule 校验并规范化告警规则的请求。requireURL 为 false（修改规则）时允许 webhookURL 为空。
+// 校验失败时返回出错的字段名和错误描述。
+func validateAlertRule(req *AlertRuleRequest, requireURL bool) (string, string) {
+	req.Name = strings.TrimSpace(req.Name)
+	req.Target = strings.TrimSpace(req.Target)
+	req.WebhookURL = strings.TrimSpace(req.WebhookURL)
+
+	switch req.Scope {
+	case AlertScopeTotal:
+		if req.Target != "" {
+			return "target", "scope 为 total 时不能指定 target"
+		}
+	case AlertScopeHost, AlertScopeChain:
+		if req.Target == "" {
+			return "target", fmt.Sprintf("scope 为 %s 时必须指定 target", req.Scope)
+		}
+	default:
+		return "scope", fmt.Sprintf("无效的 scope: %s，可选值为 total、host、chain", req.Scope)
+	}
+	if req.Threshold == 0 {
+		return "threshold", "threshold 必须是正整数（字节）"
+	}
+	if req.Period != AlertPeriodDay && req.Period != AlertPeriodMonth {
+		return "period", fmt.Sprintf("无效的 period: %s，可选值为 day、month", req.Period)
+	}
+	if req.WebhookURL != "" || requireURL {
+		u, err := url.Parse(req.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "webhookURL", "webhookURL 必须是 http 或 https 地址"
+		}
+	}
+	// 用示例数据渲染一次模板，在保存之前发现语法错误或无法生成合法 JSON 的模板。
+	if req.PayloadTemplate != "" {
+		sample := newAlertRuleEvent(AlertRule{Name: req.Name, Scope: req.Scope, Target: req.Target, Threshold: req.Threshold, Period: req.Period}, "2024-01", req.Threshold, time.Now(), true)
+		if _, err := renderAlertPayload(req.PayloadTemplate, sample); err != nil {
+			return "payloadTemplate", err.Error()
+		}
+	}
+	return "", ""
+}
+
+// alertRuleColumns 是查询告警规则时的列，与 scanAlertRule 的顺序一致。
+const alertRuleColumns = "id, name, scope, target, threshold, period, webhook_url, payload_template, enabled, last_fired_period, last_fired_at"
+
+// scanAlertRule 把一行查询结果扫描为 AlertRule。
+func scanAlertRule(row rowScanner) (AlertRule, error) {
+	var rule AlertRule
+	err := row.Scan(&rule.ID, &rule.Name, &rule.Scope, &rule.Target, &rule.Threshold, &rule.Period, &rule.WebhookURL,
+		&rule.PayloadTemplate, &rule.Enabled, &rule.LastFiredPeriod, &rule.LastFiredAt)
+	return rule, err
+}
+
+// loadAlertRules 返回所有告警规则，onlyEnabled 为 true 时只返回开启的规则。
+func loadAlertRules(ctx context.Context, db *sql.DB, onlyEnabled bool) ([]AlertRule, error) {
+	query := "SELECT " + alertRuleColumns + " FROM alert_rules"
+	if onlyEnabled {
+		query += " WHERE enabled = 1"
+	}
+	rows, err := db.QueryContext(ctx, query+" ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []AlertRule{}
+	for rows.Next() {
+		rule, err := scanAlertRule(rows)
+		if err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// loadAlertRule 返回 ID 为 id 的告警规则，不存在时返回 sql.ErrNoRows。
+func loadAlertRule(ctx context.Context, db *sql.DB, id int64) (AlertRule, error) {
+	return scanAlertRule(db.QueryRowContext(ctx, "SELECT "+alertRuleColumns+" FROM alert_rules WHERE id = ?", id))
+}
+
+// alertRuleUsage 返回规则在从 periodStart 开始的周期内已使用的流量（字节），开启抽样时按采样率放大为估计值。
+// 按天汇总表可用时，完整的日期从 daily_rollup 读取，月度规则不必每次扫描整月的连接记录。
+func alertRuleUsage(ctx context.Context, db *sql.DB, rule AlertRule, periodStart time.Time, scale sampleScaler) (uint64, error) {
+	var where string
+	var args []interface{}
+	switch rule.Scope {
+	case AlertScopeHost:
+		where, args = " AND host = ?", []interface{}{rule.Target}
+	case AlertScopeChain:
+		where, args = " AND chain = ?", []interface{}{rule.Target}
+	}
+	source, sourceArgs := summarySource("%Y-%m-%d", true, where, args, periodStart.Unix(), 0)
+	var usage uint64
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(SUM(upload + download), 0) FROM "+source, sourceArgs...).Scan(&usage); err != nil {
+		return 0, err
+	}
+	return uint64(float64(usage) * float64(scale)), nil
+}
+
+// alertRuleChecker 在每次写入数据库之后检查所有开启的告警规则。
+type alertRuleChecker struct {
+	db     *sql.DB
+	scale  sampleScaler
+	client *http.Client
+	notify chan struct{}
+}
+
+// ruleAlerter 是全局的告警规则检查器，由 serve 创建。
+var ruleAlerter *alertRuleChecker
+
+// newAlertRuleChecker 创建告警规则检查器。
+func newAlertRuleChecker(db *sql.DB, cfg *Config) *alertRuleChecker {
+	scale := sampleScaler(1)
+	if cfg.SampleRate > 0 && cfg.SampleRate < 1 {
+		scale = sampleScaler(1 / cfg.SampleRate)
+	}
+	return &alertRuleChecker{
+		db:     db,
+		scale:  scale,
+		client: &http.Client{Timeout: alertWebhookTimeout},
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Notify 通知检查器在后台检查一次规则，不会阻塞调用方。上一次检查尚未开始时，多次通知合并为一次。
+func (c *alertRuleChecker) Notify() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run 每次收到通知时检查一次规则，直到 ctx 被取消。它会一直阻塞，应在 Goroutine 中调用。
+func (c *alertRuleChecker) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.notify:
+			c.Check(ctx, time.Now())
+		}
+	}
+}
+
+// Check 检查所有开启的规则，对本周期尚未告警且流量超过阈值的规则发送告警。
+// 各规则的告警并发发送，一个 Webhook 失败后的重试等待不会推迟其他规则的告警；所有发送结束后才返回。
+// 发送成功后才记录本周期已告警；重试后仍然失败时，下一次检查会再次尝试。
+func (c *alertRuleChecker) Check(ctx context.Context, now time.Time) {
+	rules, err := loadAlertRules(ctx, c.db, true)
+	if err != nil {
+		log.Printf("读取告警规则失败: %v", err)
+		return
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, rule := range rules {
+		periodKey, periodStart := alertPeriod(rule.Period, now)
+		if rule.LastFiredPeriod == periodKey {
+			continue
+		}
+		usage, err := alertRuleUsage(ctx, c.db, rule, periodStart, c.scale)
+		if err != nil {
+			log.Printf("计算告警规则 #%d 的流量失败: %v", rule.ID, err)
+			continue
+		}
+		if usage <= rule.Threshold {
+			continue
+		}
+
+		event := newAlertRuleEvent(rule, periodKey, usage, now, false)
+		log.Println(event.Text)
+		wg.Add(1)
+		go func(rule AlertRule) {
+			defer wg.Done()
+			if err := c.send(ctx, rule, event); err != nil {
+				log.Printf("发送告警规则 #%d 的告警失败: %v", rule.ID, err)
+				return
+			}
+			if _, err := c.db.ExecContext(ctx, "UPDATE alert_rules SET last_fired_period = ?, last_fired_at = ? WHERE id = ?", event.PeriodKey, now.Unix(), rule.ID); err != nil {
+				log.Printf("记录告警规则 #%d 的告警时间失败: %v", rule.ID, err)
+			}
+		}(rule)
+	}
+}
+
+// send 生成请求体并发送到规则的 Webhook 地址，失败时重试一次。
+func (c *alertRuleChecker) send(ctx context.Context, rule AlertRule, event AlertRuleEvent) error {
+	body, err := renderAlertPayload(rule.PayloadTemplate, event)
+	if err != nil {
+		return err
+	}
+	return postWebhookWithRetry(ctx, c.client, rule.WebhookURL, body)
+}
+
+// alertRuleID 从 URL 路径中解析规则 ID，无效时返回 0。
+func alertRuleID(r *http.Request) int64 {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || id <= 0 {
+		return 0
+	}
+	return id
+}
+
+// presentAlertRule 为接口返回准备一条规则：填入当前周期已使用的流量，Webhook 地址只保留前几个字符。
+func presentAlertRule(ctx context.Context, db *sql.DB, rule AlertRule) AlertRule {
+	rule.WebhookURL = redactSecret(rule.WebhookURL)
+	if ruleAlerter != nil {
+		_, periodStart := alertPeriod(rule.Period, time.Now())
+		if usage, err := alertRuleUsage(ctx, db, rule, periodStart, ruleAlerter.scale); err == nil {
+			rule.Usage = usage
+		}
+	}
+	return rule
+}
+
+// writeAlertRule 以 JSON 形式返回一条规则。
+func writeAlertRule(w http.ResponseWriter, r *http.Request, db *sql.DB, rule AlertRule) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(presentAlertRule(r.Context(), db, rule))
+}
+
+// getAlertRulesHandler 是处理 `/api/alerts` GET 请求的 HTTP Handler。它返回所有告警规则，附带当前周期已使用的流量。
+func getAlertRulesHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+	rules, err := loadAlertRules(r.Context(), db, false)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for i := range rules {
+		rules[i] = presentAlertRule(r.Context(), db, rules[i])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// getAlertRuleHandler 是处理 `/api/alerts/{id}` GET 请求的 HTTP Handler。
+func getAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+	rule, err := loadAlertRule(r.Context(), db, alertRuleID(r))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "id", "告警规则不存在")
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeAlertRule(w, r, db, rule)
+}
+
+// createAlertRuleHandler 是处理 `/api/alerts` POST 请求的 HTTP Handler。它创建一条告警规则并返回。
+func createAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var req AlertRuleRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		status, msg := requestBodyError(err)
+		writeJSONError(w, status, "", msg)
+		return
+	}
+	if field, msg := validateAlertRule(&req, true); field != "" {
+		writeJSONError(w, http.StatusBadRequest, field, msg)
+		return
+	}
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	enabled := req.Enabled == nil || *req.Enabled
+	result, err := db.Exec("INSERT INTO alert_rules (name, scope, target, threshold, period, webhook_url, payload_template, enabled) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		req.Name, req.Scope, req.Target, req.Threshold, req.Period, req.WebhookURL, req.PayloadTemplate, enabled)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("保存告警规则失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	id, _ := result.LastInsertId()
+	rule, err := loadAlertRule(r.Context(), db, id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// 新规则可能已经超过阈值，不必等到下一次写入数据库才检查。
+	if ruleAlerter != nil {
+		ruleAlerter.Notify()
+	}
+	writeAlertRule(w, r, db, rule)
+}
+
+// updateAlertRuleHandler 是处理 `/api/alerts/{id}` PUT 请求的 HTTP Handler。
+// 请求体与创建时相同，webhookURL 为空时保留原来的地址（列表中返回的地址已被隐藏，无法原样传回）。
+// scope、target、threshold 或 period 有变化时清除本周期的告警记录，按新的条件重新判断本周期是否需要告警；
+// 只修改名称、Webhook 地址、模板或开关时保留告警记录，避免同一周期重复告警。
+func updateAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var req AlertRuleRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		status, msg := requestBodyError(err)
+		writeJSONError(w, status, "", msg)
+		return
+	}
+	if field, msg := validateAlertRule(&req, false); field != "" {
+		writeJSONError(w, http.StatusBadRequest, field, msg)
+		return
+	}
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	id := alertRuleID(r)
+	rule, err := loadAlertRule(r.Context(), db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "id", "告警规则不存在")
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if req.WebhookURL == "" {
+		req.WebhookURL = rule.WebhookURL
+	}
+	enabled := rule.Enabled
+	if req.Enabled != nil {
+		enabled = *req.Enabled
+	}
+	lastFiredPeriod, lastFiredAt := rule.LastFiredPeriod, rule.LastFiredAt
+	if req.Scope != rule.Scope || req.Target != rule.Target || req.Threshold != rule.Threshold || req.Period != rule.Period {
+		lastFiredPeriod, lastFiredAt = "", 0
+	}
+
+	_, err = db.Exec(`UPDATE alert_rules SET name = ?, scope = ?, target = ?, threshold = ?, period = ?, webhook_url = ?, payload_template = ?, enabled = ?,
+		last_fired_period = ?, last_fired_at = ? WHERE id = ?`,
+		req.Name, req.Scope, req.Target, req.Threshold, req.Period, req.WebhookURL, req.PayloadTemplate, enabled, lastFiredPeriod, lastFiredAt, id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("保存告警规则失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if rule, err = loadAlertRule(r.Context(), db, id); err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if ruleAlerter != nil {
+		ruleAlerter.Notify()
+	}
+	writeAlertRule(w, r, db, rule)
+}
+
+// deleteAlertRuleHandler 是处理 `/api/alerts/{id}` DELETE 请求的 HTTP Handler。
+func deleteAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+	result, err := db.Exec("DELETE FROM alert_rules WHERE id = ?", alertRuleID(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("删除告警规则失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeJSONError(w, http.StatusNotFound, "id", "告警规则不存在")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "删除成功"})
+}
+
+// testAlertRuleHandler 是处理 `/api/alerts/{id}/test` POST 请求的 HTTP Handler。
+// 它使用当前周期的实际流量立即发送一条测试告警（`test` 为 true，消息以「[测试]」开头），用于检查 Webhook 地址和模板，
+// 无论是否超过阈值、本周期是否已经告警过，也不会记录为本周期的告警。Webhook 发送失败（重试一次后）时返回 502。
+func testAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+	rule, err := loadAlertRule(r.Context(), db, alertRuleID(r))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "id", "告警规则不存在")
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if ruleAlerter == nil {
+		http.Error(w, "告警规则检查器未启动", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	periodKey, periodStart := alertPeriod(rule.Period, now)
+	usage, err := alertRuleUsage(r.Context(), db, rule, periodStart, ruleAlerter.scale)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("计算流量失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	event := newAlertRuleEvent(rule, periodKey, usage, now, true)
+	if err := ruleAlerter.send(r.Context(), rule, event); err != nil {
+		writeJSONError(w, http.StatusBadGateway, "", fmt.Sprintf("发送测试告警失败: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "测试告警已发送",
+		"event":   event,
+	})
+}
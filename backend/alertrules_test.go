@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAlertPeriod(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	tests := []struct {
+		period    string
+		t         time.Time
+		wantKey   string
+		wantStart time.Time
+	}{
+		{AlertPeriodDay, time.Date(2024, 2, 29, 23, 59, 59, 0, loc), "2024-02-29", time.Date(2024, 2, 29, 0, 0, 0, 0, loc)},
+		{AlertPeriodDay, time.Date(2024, 3, 1, 0, 0, 0, 0, loc), "2024-03-01", time.Date(2024, 3, 1, 0, 0, 0, 0, loc)},
+		{AlertPeriodMonth, time.Date(2024, 2, 29, 23, 59, 59, 0, loc), "2024-02", time.Date(2024, 2, 1, 0, 0, 0, 0, loc)},
+		{AlertPeriodMonth, time.Date(2024, 12, 31, 12, 0, 0, 0, loc), "2024-12", time.Date(2024, 12, 1, 0, 0, 0, 0, loc)},
+	}
+	for _, tt := range tests {
+		key, start := alertPeriod(tt.period, tt.t)
+		if key != tt.wantKey || !start.Equal(tt.wantStart) {
+			t.Errorf("alertPeriod(%q, %v) = %q, %v, want %q, %v", tt.period, tt.t, key, start, tt.wantKey, tt.wantStart)
+		}
+	}
+}
+
+func TestRenderAlertPayload(t *testing.T) {
+	event := newAlertRuleEvent(AlertRule{ID: 1, Name: "vps", Scope: AlertScopeTotal, Threshold: 100, Period: AlertPeriodMonth},
+		"2024-01", 200, time.Unix(1700000000, 0), false)
+
+	tests := []struct {
+		name     string
+		template string
+		wantErr  bool
+		want     string // 渲染结果中 msg（自定义模板）或 text（默认请求体）字段的值。
+	}{
+		{"default", "", false, event.Text},
+		{"template", `{"msg": {{json .Text}}}`, false, event.Text},
+		{"missing key", `{"msg": {{json .Missing}}}`, true, ""},
+		{"invalid json", `{"msg": {{.Text}}}`, true, ""},
+		{"parse error", `{"msg": {{json .Text}`, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := renderAlertPayload(tt.template, event)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renderAlertPayload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("payload is not JSON: %v", err)
+			}
+			key := "msg"
+			if tt.template == "" {
+				key = "text"
+			}
+			if got[key] != tt.want {
+				t.Errorf("%s = %v, want %q", key, got[key], tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAlertRule(t *testing.T) {
+	valid := func() AlertRuleRequest {
+		return AlertRuleRequest{Name: " vps ", Scope: AlertScopeTotal, Threshold: 100, Period: AlertPeriodDay, WebhookURL: " https://example.com/hook "}
+	}
+	tests := []struct {
+		name       string
+		modify     func(*AlertRuleRequest)
+		requireURL bool
+		wantField  string
+	}{
+		{"valid", func(r *AlertRuleRequest) {}, true, ""},
+		{"total with target", func(r *AlertRuleRequest) { r.Target = "example.com" }, true, "target"},
+		{"host without target", func(r *AlertRuleRequest) { r.Scope = AlertScopeHost }, true, "target"},
+		{"chain with target", func(r *AlertRuleRequest) { r.Scope, r.Target = AlertScopeChain, "Proxy" }, true, ""},
+		{"unknown scope", func(r *AlertRuleRequest) { r.Scope = "device" }, true, "scope"},
+		{"zero threshold", func(r *AlertRuleRequest) { r.Threshold = 0 }, true, "threshold"},
+		{"unknown period", func(r *AlertRuleRequest) { r.Period = "week" }, true, "period"},
+		{"missing url on create", func(r *AlertRuleRequest) { r.WebhookURL = "" }, true, "webhookURL"},
+		{"missing url on update", func(r *AlertRuleRequest) { r.WebhookURL = "" }, false, ""},
+		{"non-http url", func(r *AlertRuleRequest) { r.WebhookURL = "ftp://example.com" }, false, "webhookURL"},
+		{"valid template", func(r *AlertRuleRequest) { r.PayloadTemplate = `{"text": {{json .Text}}}` }, true, ""},
+		{"invalid template", func(r *AlertRuleRequest) { r.PayloadTemplate = `{"text": {{.Text}}}` }, true, "payloadTemplate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := valid()
+			tt.modify(&req)
+			if field, msg := validateAlertRule(&req, tt.requireURL); field != tt.wantField {
+				t.Errorf("validateAlertRule() field = %q (%s), want %q", field, msg, tt.wantField)
+			}
+		})
+	}
+
+	req := valid()
+	validateAlertRule(&req, true)
+	if req.Name != "vps" || req.WebhookURL != "https://example.com/hook" {
+		t.Errorf("validateAlertRule() did not trim fields: %+v", req)
+	}
+}
+
+func TestPostWebhookWithRetry(t *testing.T) {
+	defer func(d time.Duration) { alertRetryDelay = d }(alertRetryDelay)
+	alertRetryDelay = 10 * time.Millisecond
+
+	tests := []struct {
+		name      string
+		failures  int32 // 前几次请求返回 500。
+		wantErr   bool
+		wantCalls int32
+	}{
+		{"success", 0, false, 1},
+		{"retry once", 1, false, 2},
+		{"give up after retry", 2, true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&calls, 1) <= tt.failures {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			}))
+			defer server.Close()
+
+			err := postWebhookWithRetry(context.Background(), server.Client(), server.URL, []byte(`{}`))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("postWebhookWithRetry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+// insertAlertRule 直接写入一条开启的月度告警规则并返回其 ID。
+func insertAlertRule(t *testing.T, db *sql.DB, threshold uint64, webhookURL string) int64 {
+	t.Helper()
+	result, err := db.Exec("INSERT INTO alert_rules (name, scope, target, threshold, period, webhook_url, payload_template, enabled) VALUES ('', ?, '', ?, ?, ?, '', 1)",
+		AlertScopeTotal, threshold, AlertPeriodMonth, webhookURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+	return id
+}
+
+// TestAlertRuleCheckerFiresOncePerPeriod 检查同一条规则在同一个周期内只告警一次。
+func TestAlertRuleCheckerFiresOncePerPeriod(t *testing.T) {
+	db := newTestDB(t)
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	id := insertAlertRule(t, db, 100, server.URL)
+	seedConnections(t, db, Connection{ID: "1", Metadata: Metadata{Host: "example.com", SourceIP: "10.0.0.1"}, Upload: 200, Start: now})
+
+	checker := newAlertRuleChecker(db, &Config{})
+	checker.Check(context.Background(), now)
+	checker.Check(context.Background(), now)
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("webhook calls = %d, want 1", got)
+	}
+
+	rule, err := loadAlertRule(context.Background(), db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wantKey, _ := alertPeriod(AlertPeriodMonth, now); rule.LastFiredPeriod != wantKey || rule.LastFiredAt != now.Unix() {
+		t.Errorf("lastFiredPeriod = %q, lastFiredAt = %d, want %q, %d", rule.LastFiredPeriod, rule.LastFiredAt, wantKey, now.Unix())
+	}
+}
+
+// TestAlertRuleCheckerSendsConcurrently 检查一个 Webhook 失败后的重试等待不会推迟其他规则的告警。
+func TestAlertRuleCheckerSendsConcurrently(t *testing.T) {
+	defer func(d time.Duration) { alertRetryDelay = d }(alertRetryDelay)
+	alertRetryDelay = time.Second
+
+	db := newTestDB(t)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	received := make(chan time.Time, 1)
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- time.Now()
+	}))
+	defer ok.Close()
+
+	now := time.Now()
+	// 失败的规则 ID 更小，顺序发送时会先等待它的重试。
+	insertAlertRule(t, db, 100, failing.URL)
+	insertAlertRule(t, db, 100, ok.URL)
+	seedConnections(t, db, Connection{ID: "1", Metadata: Metadata{Host: "example.com", SourceIP: "10.0.0.1"}, Upload: 200, Start: now})
+
+	started := time.Now()
+	newAlertRuleChecker(db, &Config{}).Check(context.Background(), now)
+	select {
+	case at := <-received:
+		if d := at.Sub(started); d >= alertRetryDelay {
+			t.Errorf("second rule was sent after %v, want before the first rule's retry", d)
+		}
+	default:
+		t.Fatal("second rule was not sent")
+	}
+}
+
+// TestUpdateAlertRuleKeepsLastFiredPeriod 检查只有修改告警条件时才清除本周期的告警记录。
+func TestUpdateAlertRuleKeepsLastFiredPeriod(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantReset bool
+	}{
+		{"rename", `{"name":"renamed","scope":"total","threshold":100,"period":"month"}`, false},
+		{"disable", `{"scope":"total","threshold":100,"period":"month","enabled":false}`, false},
+		{"threshold", `{"scope":"total","threshold":200,"period":"month"}`, true},
+		{"period", `{"scope":"total","threshold":100,"period":"day"}`, true},
+		{"scope", `{"scope":"host","target":"example.com","threshold":100,"period":"month"}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			id := insertAlertRule(t, db, 100, "https://example.com/hook")
+			if _, err := db.Exec("UPDATE alert_rules SET last_fired_period = '2024-01', last_fired_at = 1 WHERE id = ?", id); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPut, "/api/alerts/1", strings.NewReader(tt.body))
+			req = mux.SetURLVars(req, map[string]string{"id": "1"})
+			if w := serveWithDB(db, updateAlertRuleHandler, req); w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+
+			rule, err := loadAlertRule(context.Background(), db, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reset := rule.LastFiredPeriod == ""; reset != tt.wantReset {
+				t.Errorf("lastFiredPeriod = %q, want reset %v", rule.LastFiredPeriod, tt.wantReset)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// 这个文件实现了源 IP 匿名化（假名化）功能。
+// 开启后，采集到的每个 sourceIP 都会被替换为一个基于 HMAC 的稳定标记（如 `device-a1b2c3d4`），
+// 同一个 IP 总是得到同一个标记，因此按设备统计和筛选依然有效，但截图中不再暴露真实 IP。
+
+// metaAnonymizeKey 是 metadata 表中保存 HMAC 密钥的 key。
+// 密钥持久化在数据库中，保证程序重启后生成的标记保持一致。
+const metaAnonymizeKey = "anonymize_key"
+
+// anonymizedIPPrefix 是匿名化标记的前缀，也用于识别哪些记录已经被匿名化。
+const anonymizedIPPrefix = "device-"
+
+// ipAnonymizer 使用 HMAC-SHA256 将 IP 地址映射为稳定的匿名标记。
+type ipAnonymizer struct {
+	key []byte
+}
+
+// sourceIPAnonymizer 是全局的源 IP 匿名化器。为 nil 时表示未开启匿名化。
+var sourceIPAnonymizer *ipAnonymizer
+
+// Token 返回 IP 地址对应的匿名标记。空字符串和已经匿名化的值会原样返回。
+func (a *ipAnonymizer) Token(ip string) string {
+	if ip == "" || strings.HasPrefix(ip, anonymizedIPPrefix) {
+		return ip
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(ip))
+	return anonymizedIPPrefix + hex.EncodeToString(mac.Sum(nil))[:8]
+}
+
+// initSourceIPAnonymizer 从数据库加载 HMAC 密钥（不存在时随机生成并保存），并开启源 IP 匿名化。
+func initSourceIPAnonymizer(db *sql.DB) error {
+	value, ok, err := getMetadata(db, metaAnonymizeKey)
+	if err != nil {
+		return fmt.Errorf("读取匿名化密钥失败: %w", err)
+	}
+
+	var key []byte
+	if ok {
+		key, err = hex.DecodeString(value)
+		if err != nil {
+			return fmt.Errorf("解析匿名化密钥失败: %w", err)
+		}
+	} else {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return fmt.Errorf("生成匿名化密钥失败: %w", err)
+		}
+		if err := setMetadata(db, metaAnonymizeKey, hex.EncodeToString(key)); err != nil {
+			return fmt.Errorf("保存匿名化密钥失败: %w", err)
+		}
+	}
+
+	sourceIPAnonymizer = &ipAnonymizer{key: key}
+	return nil
+}
+
+// anonymizeExistingSourceIPs 将表中尚未匿名化的 sourceIP 全部替换为匿名标记，返回更新的行数。
+func anonymizeExistingSourceIPs(db *sql.DB, table string) (updated int64, err error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT DISTINCT sourceIP FROM %s WHERE sourceIP != '' AND sourceIP NOT LIKE ?", table), anonymizedIPPrefix+"%")
+	if err != nil {
+		return 0, err
+	}
+	var ips []string
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	rows.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("开启事务失败: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	stmt, err := tx.Prepare(fmt.Sprintf("UPDATE %s SET sourceIP = ? WHERE sourceIP = ?", table))
+	if err != nil {
+		return 0, fmt.Errorf("准备更新语句失败: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, ip := range ips {
+		result, err := stmt.Exec(sourceIPAnonymizer.Token(ip), ip)
+		if err != nil {
+			return updated, fmt.Errorf("更新 sourceIP 失败: %w", err)
+		}
+		n, _ := result.RowsAffected()
+		updated += n
+	}
+	return updated, nil
+}
+
+// anonymizeSourceIPsHandler 是处理 `/api/maintenance/anonymize-source-ips` POST 请求的 HTTP Handler。
+// 开启匿名化之前写入的记录仍保留明文 IP，调用此接口可以把主数据库和归档数据库中的历史记录一并匿名化。
+func anonymizeSourceIPsHandler(w http.ResponseWriter, r *http.Request) {
+	if sourceIPAnonymizer == nil {
+		writeJSONError(w, http.StatusBadRequest, "", "未开启源 IP 匿名化 (ANONYMIZE_SOURCE_IP)")
+		return
+	}
+
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	updated, err := anonymizeExistingSourceIPs(db, "connections")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("匿名化失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// 按天汇总表中同样保存了 sourceIP，需要重新生成。
+	if updated > 0 {
+		updateDailyRollup(db, 0, 0)
+	}
+	// 关闭归档数据库时没有归档数据需要处理。
+	var archiveUpdated int64
+	if archiveDB := archiveDBFromContext(r); archiveDB != nil {
+		archiveUpdated, err = anonymizeExistingSourceIPs(archiveDB, "connections_archive")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("匿名化归档数据失败: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	log.Printf("历史数据匿名化完成：主数据库 %d 条，归档数据库 %d 条。", updated, archiveUpdated)
+	summaryCache.Invalidate()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":             "匿名化成功",
+		"rowsAffected":        updated,
+		"archiveRowsAffected": archiveUpdated,
+	})
+}
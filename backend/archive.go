@@ -0,0 +1,510 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 这个文件包含了直接操作归档数据库 (`connections_archive` 表) 的 HTTP Handler 和业务逻辑。
+
+// archivedConnection 表示归档表中的一行记录。
+// 归档表的 id 并不唯一，因此额外保存 SQLite 的 rowid 用于精确定位要删除的行。
+type archivedConnection struct {
+	RowID int64
+	Conn  Connection
+}
+
+// compactArchiveHandler 是处理 `/api/archive/merge` POST 请求的 HTTP Handler。
+// 它将归档表中指定时间范围内的细粒度记录按更粗的时间窗口重新聚合（例如把按天的归档合并为按月），
+// 以防止归档数据库无限膨胀。请求体与 `/api/connections/merge` 相同，也支持 dryRun。
+func compactArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	var req MergeRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		status, msg := requestBodyError(err)
+		writeJSONError(w, status, "", msg)
+		return
+	}
+	if field, msg := validateMergeRequest(req, time.Now()); field != "" {
+		writeJSONError(w, http.StatusBadRequest, field, msg)
+		return
+	}
+
+	archiveDB := archiveDBFromContext(r)
+	if archiveDB == nil {
+		writeJSONError(w, http.StatusBadRequest, "", errArchiveDisabled)
+		return
+	}
+
+	result, err := compactArchive(archiveDB, req.StartDate, req.EndDate, req.Interval, req.Hosts, req.DryRun)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("归档数据合并失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	message := "归档数据合并成功"
+	if req.DryRun {
+		message = "试运行完成，未修改数据"
+	} else {
+		log.Printf("归档数据合并成功：%d 条记录被合并为 %d 条。", result.MergedRows, result.CreatedRows)
+		// includeArchive=true 的流量汇总读取归档数据。
+		summaryCache.Invalidate()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":     message,
+		"dryRun":      req.DryRun,
+		"mergedRows":  result.MergedRows,
+		"createdRows": result.CreatedRows,
+	})
+}
+
+// compactArchive 在归档数据库的单个事务中完成重新聚合：
+// 1. 查询指定时间范围内的归档记录，hosts 不为空时只查询这些主机的记录。
+// 2. 按主机和新的时间窗口分组聚合。
+// 3. 删除原有的细粒度记录，插入聚合后的记录。
+// 当 dryRun 为 true 时，只返回统计结果，不修改数据库。
+func compactArchive(archiveDB *sql.DB, startDate, endDate int64, interval int, hosts []string, dryRun bool) (result MergeResult, err error) {
+	hostClause, hostArgs := listFilterClause("host", hosts, false)
+	rows, err := archiveDB.Query("SELECT "+connectionColumns+", rowid FROM connections_archive WHERE start >= ? AND start <= ?"+hostClause,
+		append([]interface{}{startDate, endDate}, hostArgs...)...)
+	if err != nil {
+		return result, fmt.Errorf("查询归档数据失败: %w", err)
+	}
+	archived, err := scanArchivedConnections(rows)
+	if err != nil {
+		return result, err
+	}
+
+	if len(archived) == 0 {
+		return result, nil
+	}
+
+	connections := make([]Connection, 0, len(archived))
+	for _, row := range archived {
+		connections = append(connections, row.Conn)
+	}
+	mergedConnections := groupConnections(connections, interval)
+
+	result.MergedRows = len(archived)
+	result.CreatedRows = len(mergedConnections)
+	if dryRun {
+		return result, nil
+	}
+
+	tx, err := archiveDB.Begin()
+	if err != nil {
+		return result, fmt.Errorf("开启归档数据库事务失败: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	deleteStmt, err := tx.Prepare("DELETE FROM connections_archive WHERE rowid = ?")
+	if err != nil {
+		return result, fmt.Errorf("准备删除语句失败: %w", err)
+	}
+	defer deleteStmt.Close()
+
+	for _, row := range archived {
+		if _, err = deleteStmt.Exec(row.RowID); err != nil {
+			return result, fmt.Errorf("删除归档数据失败: %w", err)
+		}
+	}
+
+	insertStmt, err := tx.Prepare("INSERT INTO connections_archive (" + connectionColumns + ", archived_at) VALUES (" + connectionPlaceholders + ", ?)")
+	if err != nil {
+		return result, fmt.Errorf("准备插入语句失败: %w", err)
+	}
+	defer insertStmt.Close()
+
+	now := time.Now().Unix()
+	for _, conn := range mergedConnections {
+		conn.ID = uuid.New().String()
+		_, err = insertStmt.Exec(append(connectionArgs(conn), now)...)
+		if err != nil {
+			return result, fmt.Errorf("插入聚合后的归档数据失败: %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+// RestoreArchiveRequest 定义了从归档中恢复数据的请求结构。
+// ArchivedAt 与时间范围至少提供一个，同时提供时只恢复该批次中落在时间范围内的记录。
+type RestoreArchiveRequest struct {
+	ArchivedAt   int64 `json:"archivedAt"`   // 要恢复的归档批次（见 `/api/archive/batches`），为 0 时不按批次筛选。
+	StartDate    int64 `json:"startDate"`    // 恢复范围的开始时间戳（秒），匹配归档记录的 start 字段。
+	EndDate      int64 `json:"endDate"`      // 恢复范围的结束时间戳（秒），匹配归档记录的 start 字段。
+	RemoveMerged bool  `json:"removeMerged"` // 是否同时删除主数据库中对应的合并记录。
+}
+
+// validateRestoreArchiveRequest 校验恢复请求的参数，返回出错的字段名和错误信息；参数有效时返回两个空字符串。
+func validateRestoreArchiveRequest(req RestoreArchiveRequest) (field, msg string) {
+	if req.ArchivedAt < 0 {
+		return "archivedAt", "archivedAt 必须是归档批次的 Unix 时间戳（秒）"
+	}
+	// 只按批次恢复时不需要时间范围。
+	if req.ArchivedAt > 0 && req.StartDate == 0 && req.EndDate == 0 {
+		return "", ""
+	}
+	if req.StartDate >= req.EndDate {
+		return "startDate", "startDate 必须早于 endDate"
+	}
+	return "", ""
+}
+
+// where 返回筛选要恢复的归档记录的 WHERE 条件及其参数，以及筛选主数据库中对应合并记录的条件及其参数。
+// 指定了批次时，合并记录按 merged_at 精确匹配该批次；否则删除时间范围内的所有合并记录。
+func (req RestoreArchiveRequest) where() (archiveWhere string, archiveArgs []interface{}, mergedWhere string, mergedArgs []interface{}) {
+	archiveWhere, mergedWhere = "1=1", "merged_at IS NOT NULL"
+	if req.ArchivedAt > 0 {
+		archiveWhere += " AND archived_at = ?"
+		archiveArgs = append(archiveArgs, req.ArchivedAt)
+		mergedWhere = "merged_at = ?"
+		mergedArgs = append(mergedArgs, req.ArchivedAt)
+	}
+	if req.StartDate != 0 || req.EndDate != 0 {
+		archiveWhere += " AND start >= ? AND start <= ?"
+		archiveArgs = append(archiveArgs, req.StartDate, req.EndDate)
+		mergedWhere += " AND start >= ? AND start <= ?"
+		mergedArgs = append(mergedArgs, req.StartDate, req.EndDate)
+	}
+	return archiveWhere, archiveArgs, mergedWhere, mergedArgs
+}
+
+// RestoreResult 描述了一次恢复操作的结果。
+type RestoreResult struct {
+	RestoredRows int `json:"restoredRows"` // 从归档恢复到主数据库的记录数。
+	RemovedRows  int `json:"removedRows"`  // 从主数据库删除的合并记录数。
+}
+
+// restoreArchiveHandler 是处理 `/api/archive/restore` POST 请求的 HTTP Handler。
+// 它把指定批次或时间范围内的归档原始记录移回主数据库，用于撤销某次合并或过于激进的合并。
+func restoreArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	var req RestoreArchiveRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		status, msg := requestBodyError(err)
+		writeJSONError(w, status, "", msg)
+		return
+	}
+	if field, msg := validateRestoreArchiveRequest(req); field != "" {
+		writeJSONError(w, http.StatusBadRequest, field, msg)
+		return
+	}
+
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+	archiveDB := archiveDBFromContext(r)
+	if archiveDB == nil {
+		writeJSONError(w, http.StatusBadRequest, "", errArchiveDisabled)
+		return
+	}
+
+	result, err := restoreFromArchive(db, archiveDB, req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("恢复失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("从归档恢复数据成功：恢复 %d 条记录，删除 %d 条合并记录。", result.RestoredRows, result.RemovedRows)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":      "恢复成功",
+		"restoredRows": result.RestoredRows,
+		"removedRows":  result.RemovedRows,
+	})
+}
+
+// restoreFromArchive 包含了从归档恢复数据的核心逻辑，与 mergeAndArchiveConnections 一样，
+// 它同时在主数据库和归档数据库上开启事务，确保两边的操作要么全部成功，要么全部回滚：
+// 1. 查询归档中指定批次和（或）时间范围内的记录。
+// 2. （可选）删除主数据库中对应的合并记录（merged_at 不为空，指定了批次时 merged_at 等于该批次）。
+// 3. 将归档记录插入主数据库，id 冲突时生成新的 id。
+// 4. 从归档数据库中删除已恢复的记录。
+func restoreFromArchive(db, archiveDB *sql.DB, req RestoreArchiveRequest) (result RestoreResult, err error) {
+	archiveWhere, archiveArgs, mergedWhere, mergedArgs := req.where()
+	rows, err := archiveDB.Query("SELECT "+connectionColumns+", rowid FROM connections_archive WHERE "+archiveWhere, archiveArgs...)
+	if err != nil {
+		return result, fmt.Errorf("查询归档数据失败: %w", err)
+	}
+	archived, err := scanArchivedConnections(rows)
+	if err != nil {
+		return result, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, fmt.Errorf("开启主数据库事务失败: %w", err)
+	}
+	archiveTx, err := archiveDB.Begin()
+	if err != nil {
+		tx.Rollback()
+		return result, fmt.Errorf("开启归档数据库事务失败: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			archiveTx.Rollback()
+		} else {
+			err = tx.Commit()
+			if err == nil {
+				archiveTx.Commit()
+				// 恢复的记录和删除的合并记录都在时间范围内；只按批次恢复时没有时间范围，重算所有日期。
+				updateDailyRollup(db, req.StartDate, req.EndDate)
+				summaryCache.Invalidate()
+			}
+		}
+	}()
+
+	if req.RemoveMerged {
+		res, err := tx.Exec("DELETE FROM connections WHERE "+mergedWhere, mergedArgs...)
+		if err != nil {
+			return result, fmt.Errorf("删除合并记录失败: %w", err)
+		}
+		removed, _ := res.RowsAffected()
+		result.RemovedRows = int(removed)
+	}
+
+	// 先尝试使用原有的 id 插入；如果 id 已存在（例如数据被重复归档过），则换一个新的 id 重新插入。
+	insertStmt, err := tx.Prepare("INSERT INTO connections (" + connectionColumns + ") VALUES (" + connectionPlaceholders + ") ON CONFLICT(id) DO NOTHING")
+	if err != nil {
+		return result, fmt.Errorf("准备插入语句失败: %w", err)
+	}
+	defer insertStmt.Close()
+
+	deleteStmt, err := archiveTx.Prepare("DELETE FROM connections_archive WHERE rowid = ?")
+	if err != nil {
+		return result, fmt.Errorf("准备删除语句失败: %w", err)
+	}
+	defer deleteStmt.Close()
+
+	for _, row := range archived {
+		conn := row.Conn
+		res, err := insertStmt.Exec(connectionArgs(conn)...)
+		if err != nil {
+			return result, fmt.Errorf("恢复数据失败 (ID: %s): %w", conn.ID, err)
+		}
+		if inserted, _ := res.RowsAffected(); inserted == 0 {
+			conn.ID = uuid.New().String()
+			_, err = insertStmt.Exec(connectionArgs(conn)...)
+			if err != nil {
+				return result, fmt.Errorf("恢复数据失败 (ID: %s): %w", conn.ID, err)
+			}
+		}
+		if _, err = deleteStmt.Exec(row.RowID); err != nil {
+			return result, fmt.Errorf("删除归档数据失败: %w", err)
+		}
+	}
+
+	result.RestoredRows = len(archived)
+	return result, nil
+}
+
+// scanArchivedConnections 将归档表的查询结果扫描为 archivedConnection 切片，并关闭 rows。
+// 查询的列必须为 connectionColumns 后接 rowid。
+func scanArchivedConnections(rows *sql.Rows) ([]archivedConnection, error) {
+	defer rows.Close()
+
+	var archived []archivedConnection
+	for rows.Next() {
+		var row archivedConnection
+		conn, err := scanConnection(rows, &row.RowID)
+		if err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		row.Conn = conn
+		archived = append(archived, row)
+	}
+	return archived, rows.Err()
+}
+
+// ArchiveBatch 是归档表中的一个批次，即一次合并（或重新聚合）写入归档的所有记录，由相同的 archived_at 标识。
+// 合并主数据库时，主数据库中聚合记录的 merged_at 与归档记录的 archived_at 相同。
+type ArchiveBatch struct {
+	ArchivedAt  int64  `json:"archivedAt"`  // 归档时间（Unix 时间戳，秒）。
+	Rows        int64  `json:"rows"`        // 该批次的归档记录数。
+	Connections int64  `json:"connections"` // 这些记录代表的原始连接数。
+	Upload      uint64 `json:"upload"`
+	Download    uint64 `json:"download"`
+	FirstStart  int64  `json:"firstStart"` // 最早一条记录的开始时间（Unix 时间戳，秒）。
+	LastStart   int64  `json:"lastStart"`  // 最晚一条记录的开始时间（Unix 时间戳，秒）。
+	MergedRows  int64  `json:"mergedRows"` // 主数据库中由这次合并生成的聚合记录数，重新聚合归档生成的批次为 0。
+}
+
+// getArchiveBatchesHandler 是处理 `/api/archive/batches` GET 请求的 HTTP Handler。
+// 它按 archived_at 列出归档表中的所有批次，最近的批次在前，用于查看每次合并归档了哪些数据。
+func getArchiveBatchesHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+	archiveDB := archiveDBFromContext(r)
+	if archiveDB == nil {
+		writeJSONError(w, http.StatusBadRequest, "", errArchiveDisabled)
+		return
+	}
+
+	rows, err := timedQuery(r.Context(), archiveDB, `SELECT archived_at, COUNT(*), COALESCE(SUM(connections), 0), COALESCE(SUM(upload), 0), COALESCE(SUM(download), 0), MIN(start), MAX(start)
+		FROM connections_archive WHERE archived_at IS NOT NULL GROUP BY archived_at ORDER BY archived_at DESC`)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("查询归档数据失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	batches := []ArchiveBatch{}
+	for rows.Next() {
+		var batch ArchiveBatch
+		if err := rows.Scan(&batch.ArchivedAt, &batch.Rows, &batch.Connections, &batch.Upload, &batch.Download, &batch.FirstStart, &batch.LastStart); err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		batches = append(batches, batch)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("查询归档数据失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// 主数据库中的聚合记录按 merged_at 与批次对应。
+	mergedRows := map[int64]int64{}
+	mergedQuery, err := timedQuery(r.Context(), db, "SELECT merged_at, COUNT(*) FROM connections WHERE merged_at IS NOT NULL GROUP BY merged_at")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer mergedQuery.Close()
+	for mergedQuery.Next() {
+		var mergedAt, count int64
+		if err := mergedQuery.Scan(&mergedAt, &count); err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		mergedRows[mergedAt] = count
+	}
+	for i := range batches {
+		batches[i].MergedRows = mergedRows[batches[i].ArchivedAt]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batches)
+}
+
+// getArchiveHandler 是处理 `/api/archive` GET 请求的 HTTP Handler。
+// 它返回 archivedAt 指定的归档批次中的记录，按开始时间升序排列。
+// 默认分页返回 JSON（参数与 `/api/connections` 相同）；`format=csv` 时以 CSV 文件下载整个批次，不分页，
+// 同时带有 `humanize=true` 时附加易读格式的流量列。
+func getArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	archivedAt, err := strconv.ParseInt(r.URL.Query().Get("archivedAt"), 10, 64)
+	if err != nil || archivedAt <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "archivedAt", "archivedAt 必须是归档批次的 Unix 时间戳（秒），可通过 /api/archive/batches 获取")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeJSONError(w, http.StatusBadRequest, "format", fmt.Sprintf("不支持的格式: %s，可选值为 json、csv", format))
+		return
+	}
+	archiveDB := archiveDBFromContext(r)
+	if archiveDB == nil {
+		writeJSONError(w, http.StatusBadRequest, "", errArchiveDisabled)
+		return
+	}
+
+	if format == "csv" {
+		rows, err := timedQuery(r.Context(), archiveDB, "SELECT "+connectionColumns+" FROM connections_archive WHERE archived_at = ? ORDER BY start, rowid", archivedAt)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("查询归档数据失败: %v", err), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="archive-%d.csv"`, archivedAt))
+		writeArchiveCSV(w, rows.Rows, archivedAt, r.URL.Query().Get("humanize") == "true")
+		return
+	}
+
+	page, pageSize, field, msg := parsePagination(r, 20)
+	if field != "" {
+		writeJSONError(w, http.StatusBadRequest, field, msg)
+		return
+	}
+	fullChain := r.URL.Query().Get("fullChain") == "true"
+
+	var total int
+	if err := timedQueryRow(r.Context(), archiveDB, "SELECT COUNT(*) FROM connections_archive WHERE archived_at = ?", archivedAt).Scan(&total); err != nil {
+		http.Error(w, fmt.Sprintf("查询归档数据失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	rows, err := timedQuery(r.Context(), archiveDB, "SELECT "+connectionColumns+" FROM connections_archive WHERE archived_at = ? ORDER BY start, rowid LIMIT ? OFFSET ?",
+		archivedAt, pageSize, (page-1)*pageSize)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("查询归档数据失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	data := []ConnectionRecord{}
+	for rows.Next() {
+		conn, err := scanConnection(rows)
+		if err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		data = append(data, ConnectionRecord{ID: conn.ID, ConnectionInfo: newConnectionInfo(conn, "", fullChain)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"archivedAt":  archivedAt,
+		"total":       total,
+		"page":        page,
+		"pageSize":    pageSize,
+		"maxPageSize": maxPageSizeFor(r),
+		"totalPages":  (total + pageSize - 1) / pageSize,
+		"data":        data,
+	})
+}
+
+// writeArchiveCSV 把查询结果逐行写为 CSV，列与 connectionCSVHeaderFor(humanize) 相同，只是在 id 之后多了 archivedAt。
+// 响应头已经发送，中途出错时只能记录日志并截断输出。
+func writeArchiveCSV(w io.Writer, rows *sql.Rows, archivedAt int64, humanize bool) {
+	writer := csv.NewWriter(w)
+	withArchivedAt := func(record []string, value string) []string {
+		return append([]string{record[0], value}, record[1:]...)
+	}
+	writer.Write(withArchivedAt(connectionCSVHeaderFor(humanize), "archivedAt"))
+	for rows.Next() {
+		conn, err := scanConnection(rows)
+		if err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		writer.Write(withArchivedAt(connectionCSVRecord(conn, humanize), strconv.FormatInt(archivedAt, 10)))
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("导出归档批次 %d 失败: %v", archivedAt, err)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("导出归档批次 %d 失败: %v", archivedAt, err)
+	}
+}
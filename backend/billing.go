@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 这个文件实现了按计费周期统计流量 (`/api/summary/billing`)。
+// 宽带和机场订阅的流量通常按月重置，但重置日不一定是每月 1 日。计费周期从每月的重置日零点（服务器本地时间）开始，
+// 到下个月重置日零点之前结束；重置日大于当月天数时（例如 31 日遇到 2 月），取当月的最后一天。
+
+// defaultBillingResetDay 是 BILLING_RESET_DAY 的默认值，即按自然月计费。
+const defaultBillingResetDay = 1
+
+// maxBillingResetDay 是重置日的上限。
+const maxBillingResetDay = 31
+
+// BillingCycle 是一个计费周期的用量。
+type BillingCycle struct {
+	Start       int64  `json:"start"` // 周期的开始时间 (Unix 时间戳, 秒)，即重置日的零点。
+	End         int64  `json:"end"`   // 周期的结束时间 (Unix 时间戳, 秒)，即下一个重置日零点的前一秒。
+	Upload      uint64 `json:"upload"`
+	Download    uint64 `json:"download"`
+	Total       uint64 `json:"total"`
+	Connections uint64 `json:"connections"`
+}
+
+// billingResetDate 返回 year 年 month 月的重置日零点，resetDay 大于当月天数时取当月的最后一天。
+func billingResetDate(year int, month time.Month, resetDay int, loc *time.Location) time.Time {
+	// 下个月的第 0 天即当月的最后一天。
+	lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day()
+	return time.Date(year, month, min(resetDay, lastDay), 0, 0, 0, 0, loc)
+}
+
+// billingCycleBounds 返回 t 所在计费周期的开始时间和下一个周期的开始时间。
+func billingCycleBounds(t time.Time, resetDay int) (time.Time, time.Time) {
+	start := billingResetDate(t.Year(), t.Month(), resetDay, t.Location())
+	if t.Before(start) {
+		start = billingResetDate(t.Year(), t.Month()-1, resetDay, t.Location())
+	}
+	return start, billingResetDate(start.Year(), start.Month()+1, resetDay, t.Location())
+}
+
+// billingCycles 返回 now 所在计费周期的上一个周期的开始时间、当前周期的开始时间和下一个周期的开始时间。
+// 上一个周期在当前周期开始之前的一秒所在的周期，两者首尾相接。
+func billingCycles(now time.Time, resetDay int) (previousStart, currentStart, next time.Time) {
+	currentStart, next = billingCycleBounds(now, resetDay)
+	previousStart, _ = billingCycleBounds(currentStart.Add(-time.Second), resetDay)
+	return previousStart, currentStart, next
+}
+
+// billingCycleUsage 统计从 start 到 next 之前的流量。chain 不为空时只统计该策略组（chain 列）的流量。
+// 与其他按天的汇总一样，daily_rollup 可用时完整的日期从按天汇总表读取。
+func billingCycleUsage(r *http.Request, db *sql.DB, chain string, start, next time.Time, scale sampleScaler) (BillingCycle, error) {
+	cycle := BillingCycle{Start: start.Unix(), End: next.Unix() - 1}
+	var where string
+	var args []interface{}
+	if chain != "" {
+		where, args = " AND chain = ?", []interface{}{chain}
+	}
+	source, sourceArgs := summarySource("%Y-%m-%d", true, where, args, cycle.Start, cycle.End)
+	err := timedQueryRow(r.Context(), db, "SELECT COALESCE(SUM(upload), 0), COALESCE(SUM(download), 0), COALESCE(SUM(connections), 0) FROM "+source, sourceArgs...).
+		Scan(&cycle.Upload, &cycle.Download, &cycle.Connections)
+	if err != nil {
+		return cycle, err
+	}
+	cycle.Total = cycle.Upload + cycle.Download
+	scale.Scale(&cycle.Upload, &cycle.Download, &cycle.Total, &cycle.Connections)
+	return cycle, nil
+}
+
+// getBillingSummaryHandler 是处理 `/api/summary/billing` GET 请求的 HTTP Handler。
+// 它返回当前和上一个计费周期的流量，可以通过 `chain` 只统计某个策略组。
+// `resetDay` 为每月的重置日 (1-31)，不提供时使用 BILLING_RESET_DAY。
+func getBillingSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	resetDay := defaultBillingResetDay
+	if cfg, ok := r.Context().Value("config").(*Config); ok && cfg.BillingResetDay > 0 {
+		resetDay = cfg.BillingResetDay
+	}
+	if value := r.URL.Query().Get("resetDay"); value != "" {
+		day, err := strconv.Atoi(value)
+		if err != nil || day < 1 || day > maxBillingResetDay {
+			writeJSONError(w, http.StatusBadRequest, "resetDay", fmt.Sprintf("resetDay 必须是 1 到 %d 之间的整数", maxBillingResetDay))
+			return
+		}
+		resetDay = day
+	}
+	chain := strings.TrimSpace(r.URL.Query().Get("chain"))
+
+	scale := sampleScalerFor(w, r)
+	previousStart, currentStart, next := billingCycles(time.Now(), resetDay)
+
+	current, err := billingCycleUsage(r, db, chain, currentStart, next, scale)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	previous, err := billingCycleUsage(r, db, chain, previousStart, currentStart, scale)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"resetDay": resetDay,
+		"chain":    chain,
+		"current":  current,
+		"previous": previous,
+	})
+}
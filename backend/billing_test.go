@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBillingCycles(t *testing.T) {
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name                                string
+		now                                 time.Time
+		resetDay                            int
+		wantPrevious, wantCurrent, wantNext time.Time
+	}{
+		{"calendar month", date(2024, 1, 1), 1, date(2023, 12, 1), date(2024, 1, 1), date(2024, 2, 1)},
+		{"day before reset", date(2024, 1, 15).Add(-time.Second), 15, date(2023, 11, 15), date(2023, 12, 15), date(2024, 1, 15)},
+		{"31 clamped to leap February", date(2024, 2, 15), 31, date(2023, 12, 31), date(2024, 1, 31), date(2024, 2, 29)},
+		{"on clamped reset day", date(2024, 2, 29), 31, date(2024, 1, 31), date(2024, 2, 29), date(2024, 3, 31)},
+		{"31 clamped to February", date(2023, 3, 1), 31, date(2023, 1, 31), date(2023, 2, 28), date(2023, 3, 31)},
+		{"31 clamped to April", date(2024, 5, 1), 31, date(2024, 3, 31), date(2024, 4, 30), date(2024, 5, 31)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous, current, next := billingCycles(tt.now, tt.resetDay)
+			if !previous.Equal(tt.wantPrevious) || !current.Equal(tt.wantCurrent) || !next.Equal(tt.wantNext) {
+				t.Errorf("billingCycles(%v, %d) = %v, %v, %v, want %v, %v, %v",
+					tt.now, tt.resetDay, previous, current, next, tt.wantPrevious, tt.wantCurrent, tt.wantNext)
+			}
+		})
+	}
+}
+
+// TestBillingSummaryCycleBoundary 检查恰好在当前周期开始时刻的连接计入当前周期，前一秒的连接计入上一个周期。
+func TestBillingSummaryCycleBoundary(t *testing.T) {
+	db := newTestDB(t)
+	_, currentStart, _ := billingCycles(time.Now(), 1)
+	seedConnections(t, db,
+		Connection{ID: "previous", Metadata: Metadata{Host: "example.com", SourceIP: "10.0.0.1"}, Upload: 1, Download: 2, Start: currentStart.Add(-time.Second)},
+		Connection{ID: "current", Metadata: Metadata{Host: "example.com", SourceIP: "10.0.0.1"}, Upload: 10, Download: 20, Start: currentStart},
+	)
+
+	w := serveWithDB(db, getBillingSummaryHandler, httptest.NewRequest(http.MethodGet, "/api/summary/billing?resetDay=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Current, Previous BillingCycle
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Current.Start != currentStart.Unix() || resp.Previous.End != currentStart.Unix()-1 {
+		t.Errorf("current.start = %d, previous.end = %d, want %d, %d", resp.Current.Start, resp.Previous.End, currentStart.Unix(), currentStart.Unix()-1)
+	}
+	if resp.Current.Total != 30 || resp.Previous.Total != 3 {
+		t.Errorf("current.total = %d, previous.total = %d, want 30, 3", resp.Current.Total, resp.Previous.Total)
+	}
+}
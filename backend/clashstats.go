@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 这个文件记录 Clash 自身的运行状态随时间的变化。
+// `/connections` 响应中的 `memory`（Clash 占用的内存）以及 `uploadTotal`、`downloadTotal` 两个全局计数器
+// 原本只用于累计流量（见 lifetime.go），这里每分钟保留一个采样写入 `clash_stats` 表，
+// 供 `/api/summary/clash` 绘制内存曲线和计数器曲线。计数器变小说明 Clash 发生了重启，
+// 对应的采样会被标记出来，前端可以据此在图上画出重启标记。
+
+const (
+	clashStatsResolution = 60                  // 一个采样代表的秒数，同一分钟内只保留最后一次同步的值。
+	clashStatsRetention  = 30 * 24 * time.Hour // 采样的保留时间，更早的采样在写入时被删除。
+)
+
+// ClashStatsSample 是 Clash 运行状态的一个采样点。
+type ClashStatsSample struct {
+	Timestamp     int64  `json:"timestamp"`     // 采样所在分钟的开始时间（Unix 时间戳，秒）。
+	Memory        uint64 `json:"memory"`        // Clash 占用的内存（字节）。旧版本的 Clash 不返回该字段，为 0。
+	UploadTotal   uint64 `json:"uploadTotal"`   // Clash 的全局上传计数器（字节），Clash 重启后归零。
+	DownloadTotal uint64 `json:"downloadTotal"` // Clash 的全局下载计数器（字节），Clash 重启后归零。
+	Restarted     bool   `json:"restarted"`     // 这一分钟内是否检测到计数器重置（Clash 重启）。
+}
+
+// clashStatsRecorder 是一个并发安全的采样记录器。
+// 采集 Goroutine 通过 Observe 喂入每次同步的值，写库 Goroutine 通过 Flush 把采样写入数据库。
+type clashStatsRecorder struct {
+	mu       sync.Mutex
+	hasLast  bool               // 是否已有上一次的观察值。
+	lastUp   uint64             // 上一次观察到的 uploadTotal。
+	lastDown uint64             // 上一次观察到的 downloadTotal。
+	pending  []ClashStatsSample // 尚未写入数据库的采样，每分钟一个。
+}
+
+// clashStats 是全局唯一的 Clash 运行状态记录器。
+var clashStats = &clashStatsRecorder{}
+
+// Load 从数据库中恢复最近一次的计数器值，这样本程序重启期间发生的 Clash 重启也能被检测到。
+func (c *clashStatsRecorder) Load(db *sql.DB) error {
+	var up, down uint64
+	err := db.QueryRow("SELECT uploadTotal, downloadTotal FROM clash_stats ORDER BY timestamp DESC LIMIT 1").Scan(&up, &down)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastUp = up
+	c.lastDown = down
+	c.hasLast = true
+	return nil
+}
+
+// Observe 记录一次同步得到的内存占用和全局计数器。同一分钟内的多次观察合并为一个采样，保留最后的值；
+// 任意一个计数器比上一次观察到的值小时，把这一分钟标记为发生了重启。
+func (c *clashStatsRecorder) Observe(now time.Time, memory, uploadTotal, downloadTotal uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	restarted := c.hasLast && (uploadTotal < c.lastUp || downloadTotal < c.lastDown)
+	c.lastUp = uploadTotal
+	c.lastDown = downloadTotal
+	c.hasLast = true
+
+	sample := ClashStatsSample{
+		Timestamp:     now.Unix() / clashStatsResolution * clashStatsResolution,
+		Memory:        memory,
+		UploadTotal:   uploadTotal,
+		DownloadTotal: downloadTotal,
+		Restarted:     restarted,
+	}
+	if n := len(c.pending); n > 0 && c.pending[n-1].Timestamp == sample.Timestamp {
+		sample.Restarted = sample.Restarted || c.pending[n-1].Restarted
+		c.pending[n-1] = sample
+		return
+	}
+	c.pending = append(c.pending, sample)
+}
+
+// Flush 在一个事务中把尚未写入的采样写入数据库，并删除超过保留时间的采样。
+// 同一分钟的采样可能分两次写入，此时覆盖为最新的值，重启标记只会被保留、不会被清除。
+// 写入成功后才会清空内存中的采样，失败时保留到下一次 Flush。
+func (c *clashStatsRecorder) Flush(db *sql.DB) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("开启事务失败: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO clash_stats (timestamp, memory, uploadTotal, downloadTotal, restarted)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(timestamp) DO UPDATE SET
+			memory = excluded.memory,
+			uploadTotal = excluded.uploadTotal,
+			downloadTotal = excluded.downloadTotal,
+			restarted = MAX(restarted, excluded.restarted)`)
+	if err != nil {
+		return fmt.Errorf("准备 SQL 语句失败: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, sample := range c.pending {
+		if _, err = stmt.Exec(sample.Timestamp, sample.Memory, sample.UploadTotal, sample.DownloadTotal, sample.Restarted); err != nil {
+			return fmt.Errorf("写入 Clash 状态采样失败: %w", err)
+		}
+	}
+	cutoff := time.Now().Add(-clashStatsRetention).Unix()
+	if _, err = tx.Exec("DELETE FROM clash_stats WHERE timestamp < ?", cutoff); err != nil {
+		return fmt.Errorf("删除过期的 Clash 状态采样失败: %w", err)
+	}
+
+	c.pending = nil
+	return nil
+}
+
+// getClashStatsSummaryHandler 是处理 `/api/summary/clash` GET 请求的 HTTP Handler。
+// 它返回 [startDate, endDate] 范围内每分钟的 Clash 内存占用和全局计数器，以及检测到的重启时间点。
+// 未指定时间范围时返回最近 24 小时。尚未写入数据库的采样（最多一个写入间隔）不包含在内。
+func getClashStatsSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	endDate, _ := strconv.ParseInt(r.URL.Query().Get("endDate"), 10, 64)
+	if endDate <= 0 {
+		endDate = time.Now().Unix()
+	}
+	startDate, _ := strconv.ParseInt(r.URL.Query().Get("startDate"), 10, 64)
+	if startDate <= 0 {
+		startDate = endDate - 24*3600
+	}
+	if startDate >= endDate {
+		writeJSONError(w, http.StatusBadRequest, "startDate", "startDate 必须早于 endDate")
+		return
+	}
+
+	rows, err := timedQuery(r.Context(), db, `
+		SELECT timestamp, memory, uploadTotal, downloadTotal, restarted
+		FROM clash_stats
+		WHERE timestamp >= ? AND timestamp <= ?
+		ORDER BY timestamp`,
+		startDate, endDate)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	samples := []ClashStatsSample{}
+	restarts := []int64{}
+	for rows.Next() {
+		var sample ClashStatsSample
+		if err := rows.Scan(&sample.Timestamp, &sample.Memory, &sample.UploadTotal, &sample.DownloadTotal, &sample.Restarted); err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		if sample.Restarted {
+			restarts = append(restarts, sample.Timestamp)
+		}
+		samples = append(samples, sample)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"interval": clashStatsResolution,
+		"restarts": restarts,
+		"data":     samples,
+	})
+}
@@ -1,40 +1,79 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
 )
 
+// defaultClashAPITimeout 是请求 Clash `/connections` 的默认超时时间，可以通过 CLASH_API_TIMEOUT_SECONDS 修改。
+const defaultClashAPITimeout = 5 * time.Second
+
+// clashTransport 是所有 Clash API 请求共用的 Transport。它会保持与 Clash 控制器的长连接，
+// 每秒一次的同步不必每次都重新建立 TCP（和 TLS）连接。
+var clashTransport = http.DefaultTransport.(*http.Transport).Clone()
+
+// clashHTTPClient 是请求 Clash `/connections` 的客户端，在所有同步之间复用。
+// 超时时间包括读取完整的响应体，Clash 没有响应时请求会在超时后失败，不会让同步一直卡住。
+// 启动时由 newClashHTTPClient 按配置的超时时间重新创建。
+var clashHTTPClient = newClashHTTPClient(defaultClashAPITimeout)
+
+// newClashHTTPClient 创建一个使用 clashTransport、超时时间为 timeout 的客户端。
+func newClashHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: clashTransport, Timeout: timeout}
+}
+
+// ClashStatusError 表示 Clash API 返回了非 200 的状态码。
+// 调用方可以通过 errors.As 取出状态码，例如区分认证失败 (401) 与其他错误。
+type ClashStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *ClashStatusError) Error() string {
+	return fmt.Sprintf("Clash API 返回错误状态: %s", e.Status)
+}
+
 // GetClashConnections 函数负责从 Clash API 获取实时的连接信息。
 // 它还会对获取到的数据进行一些初步的清洗和处理。
 // 参数:
 //
-//	apiURL: Clash API 的 /connections 端点 URL。
-//	token: 用于 API 认证的 Token（secret）。
-//	hostSuffixWhitelist: 一个字符串切片，包含主机后缀名单。
+//	ctx: 控制请求的生命周期。ctx 被取消时（例如程序退出），正在进行的请求和响应解析会立即中止。
+//	cfg: 应用程序配置，其中包含 API 地址、Token（secret）以及数据清洗相关的选项。
 //
 // 返回值:
 //
 //	*Connections: 一个指向 Connections 结构体的指针，包含了所有连接信息。
 //	error: 如果在请求或处理过程中发生错误，则返回一个错误。
-func GetClashConnections(apiURL, token string, hostSuffixWhitelist []string) (*Connections, error) {
-	// 创建一个 HTTP 客户端。
-	client := &http.Client{}
-	// 创建一个新的 GET 请求。
-	req, err := http.NewRequest("GET", apiURL, nil)
+func GetClashConnections(ctx context.Context, cfg *Config) (*Connections, error) {
+	// 创建一个新的 GET 请求，并绑定 ctx。
+	req, err := http.NewRequestWithContext(ctx, "GET", cfg.ClashAPIURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("创建请求失败: %w", err)
 	}
 
-	// 添加 `Authorization` 请求头，用于 Clash API 的认证。
-	req.Header.Add("Authorization", "Bearer "+token)
+	// 按配置的认证方式添加认证信息。
+	setClashAuth(req, cfg)
 
 	// 发送 HTTP 请求。
-	resp, err := client.Do(req)
+	// 使用共用的客户端发送请求，复用与 Clash 的长连接。
+	resp, err := clashHTTPClient.Do(req)
 	if err != nil {
+		// 错误信息中包含请求的 URL，query 认证方式下其中带有 Token，替换为原始 URL 以免写入日志。
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = redactURLPassword(cfg.ClashAPIURL)
+		}
 		return nil, fmt.Errorf("请求 Clash API 失败: %w", err)
 	}
 	// 使用 defer 确保在函数退出时关闭响应体，防止资源泄露。
@@ -42,45 +81,247 @@ func GetClashConnections(apiURL, token string, hostSuffixWhitelist []string) (*C
 
 	// 检查 HTTP 响应的状态码。如果不是 200 OK，则表示请求失败。
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Clash API 返回错误状态: %s", resp.Status)
+		return nil, &ClashStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 
-	// 读取响应体的内容。
-	body, err := io.ReadAll(resp.Body)
+	// 边读取边解析 JSON 响应体，而不是先用 io.ReadAll 读出完整的响应再 Unmarshal。
+	// 连接数上千时响应体可达数 MB，流式解析避免了每秒一次的整块内存分配。
+	connections, err := decodeConnections(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("读取响应体失败: %w", err)
+		return nil, err
 	}
+	// Decoder 读到 JSON 结束就停止，读完剩余的内容（通常只是一个换行符），底层连接才能被复用。
+	io.Copy(io.Discard, resp.Body)
 
-	// 将 JSON 格式的响应体解析（Unmarshal）到 Connections 结构体中。
-	var connections Connections
-	if err := json.Unmarshal(body, &connections); err != nil {
-		return nil, fmt.Errorf("解析 JSON 失败: %w", err)
-	}
+	cleanConnections(connections, cfg)
+
+	// 返回处理过的连接信息。
+	return connections, nil
+}
+
+// cleanConnections 对从 Clash 获取的一批连接进行清洗和规范化：补全 host、匿名化源 IP、查询国家、
+// 应用主机后缀白名单和改写规则等。除了 GetClashConnections，回放录制的数据 (`infoclash ingest`) 时也使用它。
+func cleanConnections(connections *Connections, cfg *Config) {
+	// 白名单可能被热重载，每次同步只读取一次，保证同一批连接使用同一份列表。
+	hostSuffixWhitelist := currentHostSuffixWhitelist(cfg)
 
-	// --- 数据清洗逻辑 ---
 	// 遍历所有连接，进行一些数据规范化处理。
 	for i := range connections.Connections {
 		// 使用指针直接修改切片中的元素，效率更高。
 		conn := &connections.Connections[i]
 
+		// 统一 IP 地址的写法，避免同一设备因 `[::1]`、`fe80::1%eth0`、`::ffff:1.2.3.4` 等不同形式被拆开。
+		conn.Metadata.SourceIP = normalizeIP(conn.Metadata.SourceIP)
+		conn.Metadata.DestinationIP = normalizeIP(conn.Metadata.DestinationIP)
+
 		// 1. 填充空的 host 字段。
 		// 有时 Clash API 返回的 `host` 字段为空，但 `remoteDestination` 字段有值，
 		// 我们可以用后者来填充前者。
 		if conn.Metadata.Host == "" {
 			conn.Metadata.Host = conn.Metadata.RemoteDestination
 		}
+		// 统一大小写并去掉端口，避免同一站点因 `Example.COM`、`example.com:443` 等写法被拆成多行。
+		conn.Metadata.Host = normalizeHost(conn.Metadata.Host)
+		// 仍然为空时，尝试使用目标 IP 的反向解析结果（仅在开启时生效）。
+		// 解析在后台异步进行，首次遇到的 IP 本轮拿不到结果，之后的同步会用上缓存。
+		if conn.Metadata.Host == "" && hostReverseDNS != nil {
+			conn.Metadata.Host = hostReverseDNS.Host(conn.Metadata.DestinationIP)
+		}
+		// 如果仍然为空（例如直连 IP 的连接），按配置的策略处理，并标记 host 不是真正的主机名。
+		// 策略为 skip 时保持为空；没有显式设置 EMPTY_HOST_POLICY 且开启 STORE_UNKNOWN_HOSTS（默认）时依次退回目标 IP 和 unknownHost，
+		// 否则该连接会在写入数据库时被丢弃，它的流量不会出现在任何统计中。
+		if conn.Metadata.Host == "" {
+			switch cfg.EmptyHostPolicy {
+			case EmptyHostUseDestIP:
+				conn.Metadata.Host = conn.Metadata.DestinationIP
+			case EmptyHostUseLiteral:
+				conn.Metadata.Host = cfg.EmptyHostLiteral
+			}
+			if conn.Metadata.Host == "" && cfg.StoreUnknownHosts {
+				conn.Metadata.Host = conn.Metadata.DestinationIP
+				if conn.Metadata.Host == "" {
+					conn.Metadata.Host = unknownHost
+				}
+			}
+			conn.HostUnknown = conn.Metadata.Host != ""
+		}
+
+		// 2. 源 IP 匿名化（仅在开启时生效）。
+		if sourceIPAnonymizer != nil {
+			conn.Metadata.SourceIP = sourceIPAnonymizer.Token(conn.Metadata.SourceIP)
+		}
 
-		// 2. 应用主机后缀白名单。
+		// 3. 查询目标 IP 所属的国家（仅在配置了 GeoIP 数据库时生效）。
+		if countryResolver != nil {
+			conn.Country = countryResolver.Country(conn.Metadata.DestinationIP)
+		}
+
+		// 4. 应用主机后缀白名单。
 		// 这个逻辑用于将一些 CDN 或视频服务的复杂子域名归一化。
 		// 例如，将 `v22.lscache6.googlevideo.com` 替换为 `googlevideo.com`。
+		// 匹配时要求落在域名边界上，`notgoogle.com` 不会被后缀 `google.com` 改写。
+		matched := false
 		for _, suffix := range hostSuffixWhitelist {
-			if strings.HasSuffix(conn.Metadata.Host, suffix) {
-				conn.Metadata.Host = suffix
+			if hasDomainSuffix(conn.Metadata.Host, suffix) {
+				conn.Metadata.Host = strings.TrimPrefix(suffix, ".")
+				matched = true
 				break // 匹配到第一个后缀后即可停止，避免不必要的循环。
 			}
 		}
+
+		// 5. 应用正则改写规则，处理后缀白名单无法表达的情况（如带编号的分片主机名）。
+		// 规则按顺序尝试，只应用第一条匹配的规则。
+		if len(hostRewriteRules) > 0 {
+			var rewritten bool
+			conn.Metadata.Host, rewritten = rewriteHost(hostRewriteRules, conn.Metadata.Host)
+			matched = matched || rewritten
+		}
+
+		// 6. 按配置把 host 折叠为可注册域名。白名单和正则规则优先，已被它们处理过的 host 不再处理，
+		// 这样用户仍可以指定比 eTLD+1 更粗或更细的分组。
+		if !matched && cfg.HostNormalize == HostNormalizeETLD1 {
+			conn.Metadata.Host = registrableDomain(conn.Metadata.Host)
+		}
 	}
+}
 
-	// 返回处理过的连接信息。
-	return &connections, nil
+// initConnectionCleaning 按配置初始化 cleanConnections 使用的源 IP 匿名化、GeoIP 数据库、主机后缀白名单和 host 改写规则。
+// 反向解析需要在后台持续查询，只在 serve 中开启，不在这里初始化。
+func initConnectionCleaning(cfg *Config, db *sql.DB) error {
+	// 开启源 IP 匿名化时，加载（或生成）持久化在数据库中的 HMAC 密钥。
+	if cfg.AnonymizeSourceIP {
+		if err := initSourceIPAnonymizer(db); err != nil {
+			return fmt.Errorf("初始化源 IP 匿名化失败: %w", err)
+		}
+		log.Println("已开启源 IP 匿名化。")
+	}
+
+	// 配置了 GeoIP 数据库时，为连接补充目标国家信息。
+	if cfg.GeoIPDBPath != "" {
+		resolver, err := newGeoIPResolver(cfg.GeoIPDBPath)
+		if err != nil {
+			return fmt.Errorf("加载 GeoIP 数据库失败: %w", err)
+		}
+		countryResolver = resolver
+		log.Printf("已加载 GeoIP 数据库 %s。", cfg.GeoIPDBPath)
+	}
+
+	// 加载主机后缀白名单；配置了白名单文件时会在后台监听文件变化并自动重新加载。
+	if err := initHostSuffixWhitelist(cfg); err != nil {
+		return fmt.Errorf("加载主机后缀白名单失败: %w", err)
+	}
+
+	// 加载并编译 host 正则改写规则。
+	if cfg.HostRewriteRulesFile != "" {
+		rules, err := loadHostRewriteRules(cfg.HostRewriteRulesFile)
+		if err != nil {
+			return fmt.Errorf("加载 host 改写规则失败: %w", err)
+		}
+		hostRewriteRules = rules
+		log.Printf("已加载 %d 条 host 改写规则。", len(rules))
+	}
+	return nil
+}
+
+// unknownHost 是开启 STORE_UNKNOWN_HOSTS 时，host、remoteDestination 和目标 IP 都为空的连接使用的 host。
+const unknownHost = "unknown"
+
+// hasDomainSuffix 判断 host 是否属于 suffix 这个域名：host 等于 suffix，或以 `.` + suffix 结尾。
+// suffix 开头的 `.`（如 `.googlevideo.com`）会被忽略。
+func hasDomainSuffix(host, suffix string) bool {
+	suffix = strings.TrimPrefix(suffix, ".")
+	if suffix == "" {
+		return false
+	}
+	return host == suffix || strings.HasSuffix(host, "."+suffix)
+}
+
+// matchesAnyDomainSuffix 判断 host 是否属于 suffixes 中的任意一个域名。
+func matchesAnyDomainSuffix(host string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if hasDomainSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// setClashAuth 按配置的认证方式为发往 Clash API 的请求添加认证信息。
+// 默认的 bearer 方式发送 `Authorization: Bearer <token>`；
+// 对于放在 HTTP Basic Auth 网关之后的 Clash，使用 basic 方式并把 Token 写成 `user:pass`；
+// 部分 Clash 分支和旧版本只认 `?secret=<token>`（query）或自定义请求头（header:<name>）。
+func setClashAuth(req *http.Request, cfg *Config) {
+	if name, ok := strings.CutPrefix(cfg.ClashAPIAuthStyle, ClashAuthHeaderPrefix); ok {
+		req.Header.Set(name, cfg.ClashAPIToken)
+		return
+	}
+	switch cfg.ClashAPIAuthStyle {
+	case ClashAuthNone:
+	case ClashAuthBasic:
+		user, pass, _ := strings.Cut(cfg.ClashAPIToken, ":")
+		req.SetBasicAuth(user, pass)
+	case ClashAuthQuery:
+		query := req.URL.Query()
+		query.Set("secret", cfg.ClashAPIToken)
+		req.URL.RawQuery = query.Encode()
+	default:
+		req.Header.Set("Authorization", "Bearer "+cfg.ClashAPIToken)
+	}
+}
+
+// normalizeHost 规范化 host：去掉首尾空白、转为小写，并去掉末尾的 `:端口` 和完全限定域名末尾的 `.`
+// （`example.com.` 与 `example.com` 是同一个主机）。
+// IPv6 字面量需要特殊处理：`[2001:db8::1]:443` 只去掉端口并保留方括号，
+// 不带方括号的 `2001:db8::1` 中的冒号属于地址本身，原样保留。
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+
+	if i := strings.LastIndex(host, ":"); i >= 0 && isPort(host[i+1:]) {
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host[:i], "]") || strings.Count(host, ":") == 1 {
+			host = host[:i]
+		}
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+// normalizeIP 把 IP 地址转换为 net.IP 的标准字符串形式：
+// 去掉 IPv6 的方括号和 zone ID（如 `%eth0`），IPv6 统一为小写压缩形式，
+// IPv4 映射地址（`::ffff:1.2.3.4`）转换为 IPv4 形式。无法解析为 IP 的值只去掉首尾空白后原样返回。
+func normalizeIP(ip string) string {
+	ip = strings.TrimSpace(ip)
+	candidate := strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
+	if i := strings.Index(candidate, "%"); i >= 0 {
+		candidate = candidate[:i]
+	}
+	if parsed := net.ParseIP(candidate); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// isPort 判断字符串是否为非空的纯数字端口号。
+func isPort(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// registrableDomain 使用公共后缀列表把 host 折叠为可注册域名 (eTLD+1)，
+// 例如 `r3---sn-abc.googlevideo.com` → `googlevideo.com`，`foo.bar.co.uk` → `bar.co.uk`。
+// IP 地址、单标签主机名（如 `localhost`）以及本身就是公共后缀的 host 原样返回。
+func registrableDomain(host string) string {
+	if net.ParseIP(host) != nil || !strings.Contains(host, ".") {
+		return host
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return domain
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// emptyConnectionsResponse 是没有任何连接时 Clash `/connections` 的响应。
+const emptyConnectionsResponse = `{"downloadTotal":0,"uploadTotal":0,"connections":[]}`
+
+func TestGetClashConnectionsAuthStyles(t *testing.T) {
+	tests := []struct {
+		style string
+		check func(r *http.Request) bool
+	}{
+		{ClashAuthBearer, func(r *http.Request) bool {
+			return r.Header.Get("Authorization") == "Bearer s3cret"
+		}},
+		{ClashAuthQuery, func(r *http.Request) bool {
+			return r.URL.Query().Get("secret") == "s3cret" && r.Header.Get("Authorization") == ""
+		}},
+		{ClashAuthHeaderPrefix + "X-Secret", func(r *http.Request) bool {
+			return r.Header.Get("X-Secret") == "s3cret" && r.Header.Get("Authorization") == ""
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.style, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !tt.check(r) {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Write([]byte(emptyConnectionsResponse))
+			}))
+			defer server.Close()
+
+			cfg := &Config{ClashAPIURL: server.URL + "/connections", ClashAPIToken: "s3cret", ClashAPIAuthStyle: tt.style}
+			if _, err := GetClashConnections(context.Background(), cfg); err != nil {
+				t.Fatalf("GetClashConnections() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestGetClashConnectionsQueryAuthKeepsExistingQuery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("secret") != "s3cret" || r.URL.Query().Get("foo") != "bar" {
+			t.Errorf("query = %q", r.URL.RawQuery)
+		}
+		w.Write([]byte(emptyConnectionsResponse))
+	}))
+	defer server.Close()
+
+	cfg := &Config{ClashAPIURL: server.URL + "/connections?foo=bar", ClashAPIToken: "s3cret", ClashAPIAuthStyle: ClashAuthQuery}
+	if _, err := GetClashConnections(context.Background(), cfg); err != nil {
+		t.Fatalf("GetClashConnections() error = %v", err)
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM", "example.com"},
+		{"  www.Example.com  ", "www.example.com"},
+		{"example.com:443", "example.com"},
+		{"Example.COM:8080", "example.com"},
+		{"example.com.", "example.com"},
+		{"Example.com.:443", "example.com"},
+		{"[2001:db8::1]:443", "[2001:db8::1]"},
+		{"[2001:DB8::1]", "[2001:db8::1]"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"::1", "::1"},
+		{"1.2.3.4:80", "1.2.3.4"},
+		{"example.com:http", "example.com:http"},
+		{"example.com:", "example.com:"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeHost(tt.in); got != tt.want {
+			t.Errorf("normalizeHost(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHasDomainSuffix(t *testing.T) {
+	tests := []struct {
+		host, suffix string
+		want         bool
+	}{
+		{"google.com", "google.com", true},
+		{"www.google.com", "google.com", true},
+		{"a.b.google.com", "google.com", true},
+		{"notgoogle.com", "google.com", false},
+		{"google.com.evil.org", "google.com", false},
+		{"www.google.com", ".google.com", true},
+		{"google.com", ".google.com", true},
+		{"google.com", "", false},
+		{"google.com", ".", false},
+	}
+	for _, tt := range tests {
+		if got := hasDomainSuffix(tt.host, tt.suffix); got != tt.want {
+			t.Errorf("hasDomainSuffix(%q, %q) = %v, want %v", tt.host, tt.suffix, got, tt.want)
+		}
+	}
+}
+
+// TestCleanConnectionsHostSuffixWhitelist 检查后缀白名单只改写落在域名边界上的 host。
+func TestCleanConnectionsHostSuffixWhitelist(t *testing.T) {
+	cfg := &Config{HostSuffixWhitelist: []string{"google.com"}}
+	tests := []struct {
+		host, want string
+	}{
+		{"google.com", "google.com"},
+		{"www.google.com", "google.com"},
+		{"notgoogle.com", "notgoogle.com"},
+	}
+	for _, tt := range tests {
+		connections := &Connections{Connections: []Connection{{ID: "1", Metadata: Metadata{Host: tt.host}}}}
+		cleanConnections(connections, cfg)
+		if got := connections.Connections[0].Metadata.Host; got != tt.want {
+			t.Errorf("cleanConnections() host %q -> %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"1.2.3.4", "1.2.3.4"},
+		{" 192.168.1.10 ", "192.168.1.10"},
+		{"[::1]", "::1"},
+		{"::1", "::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"[fe80::1%eth0]", "fe80::1"},
+		{"::ffff:1.2.3.4", "1.2.3.4"},
+		{"2001:DB8:0:0:0:0:0:1", "2001:db8::1"},
+		{"anon-1a2b3c", "anon-1a2b3c"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeIP(tt.in); got != tt.want {
+			t.Errorf("normalizeIP(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestCleanConnectionsNormalizesIPs 检查采集时源 IP 和目标 IP 都被统一为标准形式。
+func TestCleanConnectionsNormalizesIPs(t *testing.T) {
+	connections := &Connections{Connections: []Connection{
+		{ID: "1", Metadata: Metadata{Host: "example.com", SourceIP: "fe80::1%eth0", DestinationIP: "::ffff:1.2.3.4"}},
+		{ID: "2", Metadata: Metadata{Host: "example.com", SourceIP: "[::1]", DestinationIP: "1.2.3.4"}},
+	}}
+	cleanConnections(connections, &Config{})
+	for i, want := range [][2]string{{"fe80::1", "1.2.3.4"}, {"::1", "1.2.3.4"}} {
+		md := connections.Connections[i].Metadata
+		if md.SourceIP != want[0] || md.DestinationIP != want[1] {
+			t.Errorf("connection %d: sourceIP = %q, destinationIP = %q, want %q, %q", i, md.SourceIP, md.DestinationIP, want[0], want[1])
+		}
+	}
+}
+
+// TestNewClashHTTPClientTimeout 检查 CLASH_API_TIMEOUT_SECONDS 生效：Clash 迟迟不返回响应头或响应体时，
+// 请求在超时后失败，而不是让同步一直卡住。
+func TestNewClashHTTPClientTimeout(t *testing.T) {
+	t.Setenv("CLASH_API_TIMEOUT_SECONDS", "1")
+	cfg := LoadConfig("", "", "", "", "", 0, 0)
+	if cfg.ClashAPITimeout != time.Second {
+		t.Fatalf("ClashAPITimeout = %v, want 1s", cfg.ClashAPITimeout)
+	}
+	saved := clashHTTPClient
+	clashHTTPClient = newClashHTTPClient(cfg.ClashAPITimeout)
+	t.Cleanup(func() { clashHTTPClient = saved })
+
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter, release <-chan struct{})
+	}{
+		{"slow headers", func(w http.ResponseWriter, release <-chan struct{}) {
+			<-release
+		}},
+		{"slow body", func(w http.ResponseWriter, release <-chan struct{}) {
+			w.Write([]byte(`{"connections":[`))
+			w.(http.Flusher).Flush()
+			<-release
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 处理函数一直阻塞到测试结束（远长于超时时间），关闭服务器之前先放行。
+			release := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tt.handler(w, release)
+			}))
+			defer server.Close()
+			defer close(release)
+
+			cfg.ClashAPIURL = server.URL + "/connections"
+			started := time.Now()
+			_, err := GetClashConnections(context.Background(), cfg)
+			elapsed := time.Since(started)
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				t.Fatalf("GetClashConnections() error = %v, want a timeout", err)
+			}
+			if elapsed < cfg.ClashAPITimeout || elapsed > 5*cfg.ClashAPITimeout {
+				t.Errorf("GetClashConnections() returned after %v, want about %v", elapsed, cfg.ClashAPITimeout)
+			}
+		})
+	}
+}
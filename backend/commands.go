@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 这个文件实现了不需要启动 Web 服务的子命令，方便用 cron 等工具定期执行维护操作：
+//   - merge：合并并归档旧的连接记录，与 `POST /api/connections/merge` 相同；
+//   - export：把连接记录导出为 CSV 或 JSON；
+//   - vacuum：回收数据库文件中的空闲空间；
+//   - ingest：回放录制的 Clash `/connections` 响应并写入数据库（见 replay.go）；
+//   - rebuild-rollup：从连接记录重新生成按天汇总表（见 rollup.go），与 `POST /api/maintenance/rebuild-rollup` 相同。
+// 子命令直接打开数据库文件，执行完毕后退出。配置的读取方式与 serve 相同（命令行参数 > .env / 环境变量 > 默认值），
+// 因此 DATABASE_PATH、ARCHIVE_ENABLED、VACUUM_MODE、SQLITE_* 等设置同样生效。
+// Web 服务运行期间也可以执行子命令，SQLite 的文件锁保证两者不会同时写入；合并期间 Web 服务的写入会等待合并完成。
+
+// 子命令的退出码。
+const (
+	exitOK    = 0 // 执行成功。
+	exitError = 1 // 执行失败。
+	exitUsage = 2 // 参数错误。
+)
+
+// runCommand 执行名为 name 的子命令，args 为子命令之后的参数，返回进程的退出码。
+func runCommand(name string, args []string) int {
+	switch name {
+	case "merge":
+		return runMergeCommand(args)
+	case "export":
+		return runExportCommand(args)
+	case "vacuum":
+		return runVacuumCommand(args)
+	case "ingest":
+		return runIngestCommand(args)
+	case "rebuild-rollup":
+		return runRebuildRollupCommand(args)
+	}
+	fmt.Fprintf(os.Stderr, "未知的子命令: %s\n", name)
+	fmt.Fprintf(os.Stderr, "可用的子命令: serve（默认）、merge、export、vacuum、ingest、rebuild-rollup，使用 %s -h 查看帮助。\n", os.Args[0])
+	return exitUsage
+}
+
+// commandDatabases 是子命令打开的数据库。关闭归档 (ARCHIVE_ENABLED=false) 时 archiveDB 为 nil。
+type commandDatabases struct {
+	cfg       *Config
+	db        *sql.DB
+	archiveDB *sql.DB
+}
+
+// openCommandDatabases 加载配置并打开主数据库和归档数据库。dbPath、archivePath 为命令行参数，为空时使用配置中的路径。
+func openCommandDatabases(dbPath, archivePath string) (*commandDatabases, error) {
+	cfg := LoadConfig("", "", dbPath, archivePath, "", 0, 0)
+	debugLogging = cfg.LogLevel == LogLevelDebug
+	vacuumMode = cfg.VacuumMode
+	dailyRollupEnabled = cfg.DailyRollup
+	if err := configureSQLitePragmas(cfg); err != nil {
+		return nil, fmt.Errorf("SQLite PRAGMA 配置无效: %w", err)
+	}
+
+	db, err := InitDB(cfg.DatabasePath)
+	if err != nil {
+		return nil, fmt.Errorf("初始化数据库失败: %w", err)
+	}
+	if err := enableIncrementalVacuum(db); err != nil {
+		log.Printf("启用增量 VACUUM 失败: %v", err)
+	}
+	// 子命令运行时间较短，需要时直接生成按天汇总表，之后的修改按天增量更新。
+	needsRebuild, err := initDailyRollup(db)
+	if err == nil && needsRebuild {
+		_, err = rebuildDailyRollup(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("初始化按天汇总表失败: %w", err)
+	}
+	dbs := &commandDatabases{cfg: cfg, db: db}
+	if cfg.ArchiveEnabled {
+		dbs.archiveDB, err = InitArchiveDB(cfg.ArchiveDatabasePath)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("初始化归档数据库失败: %w", err)
+		}
+	}
+	return dbs, nil
+}
+
+// Close 关闭打开的数据库。
+func (d *commandDatabases) Close() {
+	d.db.Close()
+	if d.archiveDB != nil {
+		d.archiveDB.Close()
+	}
+}
+
+// parseAge 解析 `--older-than` 的取值。除了 time.ParseDuration 支持的格式（如 `12h`、`90m`），
+// 还支持以 `d` 结尾的天数（如 `30d`）。
+func parseAge(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("无效的时长: %s", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age <= 0 {
+		return 0, fmt.Errorf("无效的时长: %s", value)
+	}
+	return age, nil
+}
+
+// parseTimeArg 解析 `--start`、`--end` 的取值，支持 Unix 时间戳（秒）、本地时区的日期 `2006-01-02` 和 RFC 3339 时间。
+// 为空时返回 0。
+func parseTimeArg(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ts, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t.Unix(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Unix(), nil
+	}
+	return 0, fmt.Errorf("无效的时间: %s，支持 Unix 时间戳（秒）、2006-01-02 或 RFC 3339 格式", value)
+}
+
+// runMergeCommand 实现 `infoclash merge`：合并指定范围内的连接记录，原始记录写入归档数据库。
+// 合并范围由 `--older-than`（合并早于该时长之前的所有记录）或 `--start` / `--end` 指定。
+func runMergeCommand(args []string) int {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	dbPath := fs.String("db", "", "主数据库文件的路径")
+	archivePath := fs.String("adb", "", "归档数据库文件的路径")
+	olderThan := fs.String("older-than", "", "合并早于该时长之前的记录，例如 30d、12h")
+	start := fs.String("start", "", "合并范围的开始时间（Unix 时间戳、2006-01-02 或 RFC 3339）")
+	end := fs.String("end", "", "合并范围的结束时间（Unix 时间戳、2006-01-02 或 RFC 3339）")
+	interval := fs.Int("interval", 60, "合并的时间窗口大小（分钟）")
+	dryRun := fs.Bool("dry-run", false, "只统计将被合并的记录数，不修改数据库")
+	noVacuum := fs.Bool("no-vacuum", false, "合并后不回收数据库空间")
+	hosts := fs.String("hosts", "", "只合并这些主机的记录，多个主机用逗号分隔，默认合并所有主机")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s merge (--older-than 30d | --start <time> --end <time>) [options]\n\n参数说明:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	now := time.Now()
+	req := MergeRequest{Interval: *interval, DryRun: *dryRun, Hosts: parseListParam(*hosts)}
+	var err error
+	if req.StartDate, err = parseTimeArg(*start); err != nil {
+		fmt.Fprintf(os.Stderr, "-start: %v\n", err)
+		return exitUsage
+	}
+	if req.EndDate, err = parseTimeArg(*end); err != nil {
+		fmt.Fprintf(os.Stderr, "-end: %v\n", err)
+		return exitUsage
+	}
+	switch {
+	case *olderThan != "" && *end != "":
+		fmt.Fprintln(os.Stderr, "-older-than 和 -end 不能同时使用。")
+		return exitUsage
+	case *olderThan != "":
+		age, err := parseAge(*olderThan)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-older-than: %v\n", err)
+			return exitUsage
+		}
+		req.EndDate = now.Add(-age).Unix()
+		// 没有指定开始时间时合并此前的所有记录。validateMergeRequest 拒绝为 0 的 startDate，这里从 1 开始。
+		if req.StartDate == 0 {
+			req.StartDate = 1
+		}
+	case *start == "" || *end == "":
+		fmt.Fprintln(os.Stderr, "请指定 -older-than，或同时指定 -start 和 -end。")
+		fs.Usage()
+		return exitUsage
+	}
+	if field, msg := validateMergeRequest(req, now); field != "" {
+		fmt.Fprintf(os.Stderr, "参数无效 (%s): %s\n", field, msg)
+		return exitUsage
+	}
+
+	dbs, err := openCommandDatabases(*dbPath, *archivePath)
+	if err != nil {
+		log.Println(err)
+		return exitError
+	}
+	defer dbs.Close()
+
+	result, err := mergeAndArchiveConnections(dbs.db, dbs.archiveDB, req.StartDate, req.EndDate, req.Interval, req.Hosts, req.DryRun)
+	if err != nil {
+		log.Printf("合并失败: %v", err)
+		return exitError
+	}
+	if req.DryRun {
+		fmt.Printf("试运行完成，未修改数据：将合并 %d 条记录，生成 %d 条记录。\n", result.MergedRows, result.CreatedRows)
+		return exitOK
+	}
+	fmt.Printf("合并成功：合并了 %d 条记录，生成 %d 条记录。\n", result.MergedRows, result.CreatedRows)
+	if dbs.archiveDB == nil && result.MergedRows > 0 {
+		fmt.Println("已关闭归档数据库 (ARCHIVE_ENABLED=false)，原始记录已被直接删除。")
+	}
+
+	// 与 HTTP 接口一样，删除的记录太少时跳过 VACUUM；这里同步执行，完成后才退出。
+	if !*noVacuum {
+		if result.MergedRows < minVacuumDeletedRows {
+			log.Printf("本次合并仅删除了 %d 条记录，跳过 VACUUM。", result.MergedRows)
+		} else {
+			vacuumDB(dbs.db)
+		}
+	}
+	return exitOK
+}
+
+// runExportCommand 实现 `infoclash export`：把主数据库（或 `--archive` 时的归档数据库）中的连接记录按开始时间升序导出。
+// 默认写入标准输出，`--out` 指定文件时写入该文件；导出失败时删除写了一半的文件。
+func runExportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dbPath := fs.String("db", "", "主数据库文件的路径")
+	archivePath := fs.String("adb", "", "归档数据库文件的路径")
+	format := fs.String("format", ExportFormatCSV, "导出格式：csv 或 json")
+	out := fs.String("out", "", "输出文件的路径，为空或 - 时写入标准输出")
+	start := fs.String("start", "", "只导出开始时间不早于该时间的记录（Unix 时间戳、2006-01-02 或 RFC 3339）")
+	end := fs.String("end", "", "只导出开始时间不晚于该时间的记录（Unix 时间戳、2006-01-02 或 RFC 3339）")
+	fromArchive := fs.Bool("archive", false, "从归档数据库导出")
+	humanize := fs.Bool("humanize", false, "CSV 格式时在末尾附加易读格式的流量列（uploadHuman、downloadHuman）")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s export [--format csv|json] [--out file] [--start <time>] [--end <time>] [options]\n\n参数说明:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	*format = strings.ToLower(*format)
+	if *format != ExportFormatCSV && *format != ExportFormatJSON {
+		fmt.Fprintf(os.Stderr, "-format: 不支持的导出格式 %s，可选值为 csv、json\n", *format)
+		return exitUsage
+	}
+	startDate, err := parseTimeArg(*start)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-start: %v\n", err)
+		return exitUsage
+	}
+	endDate, err := parseTimeArg(*end)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-end: %v\n", err)
+		return exitUsage
+	}
+
+	dbs, err := openCommandDatabases(*dbPath, *archivePath)
+	if err != nil {
+		log.Println(err)
+		return exitError
+	}
+	defer dbs.Close()
+
+	source, table := dbs.db, "connections"
+	if *fromArchive {
+		if dbs.archiveDB == nil {
+			log.Println(errArchiveDisabled)
+			return exitError
+		}
+		source, table = dbs.archiveDB, "connections_archive"
+	}
+	query := "SELECT " + connectionColumns + " FROM " + table + " WHERE 1=1"
+	var queryArgs []interface{}
+	if startDate > 0 {
+		query += " AND start >= ?"
+		queryArgs = append(queryArgs, startDate)
+	}
+	if endDate > 0 {
+		query += " AND start <= ?"
+		queryArgs = append(queryArgs, endDate)
+	}
+	query += " ORDER BY start, rowid"
+
+	rows, err := source.Query(query, queryArgs...)
+	if err != nil {
+		log.Printf("查询数据失败: %v", err)
+		return exitError
+	}
+
+	if *out == "" || *out == "-" {
+		count, err := exportConnections(os.Stdout, rows, *format, *humanize)
+		if err != nil {
+			log.Printf("导出失败: %v", err)
+			return exitError
+		}
+		log.Printf("已导出 %d 条记录。", count)
+		return exitOK
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		rows.Close()
+		log.Printf("创建输出文件失败: %v", err)
+		return exitError
+	}
+	count, err := exportConnections(file, rows, *format, *humanize)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*out)
+		log.Printf("导出失败: %v", err)
+		return exitError
+	}
+	log.Printf("已导出 %d 条记录到 %s。", count, *out)
+	return exitOK
+}
+
+// runVacuumCommand 实现 `infoclash vacuum`：回收主数据库和归档数据库中的空闲空间，并报告文件大小的变化。
+// VACUUM_MODE=incremental 时分批释放空闲页，其他情况（包括 never）执行完整的 VACUUM：
+// 显式执行这个子命令就是要回收空间，never 只影响合并、删除之后的自动回收。
+func runVacuumCommand(args []string) int {
+	fs := flag.NewFlagSet("vacuum", flag.ExitOnError)
+	dbPath := fs.String("db", "", "主数据库文件的路径")
+	archivePath := fs.String("adb", "", "归档数据库文件的路径")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s vacuum [options]\n\n参数说明:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	dbs, err := openCommandDatabases(*dbPath, *archivePath)
+	if err != nil {
+		log.Println(err)
+		return exitError
+	}
+	defer dbs.Close()
+
+	type vacuumTarget struct {
+		db   *sql.DB
+		path string
+	}
+	targets := []vacuumTarget{{dbs.db, dbs.cfg.DatabasePath}}
+	if dbs.archiveDB != nil {
+		targets = append(targets, vacuumTarget{dbs.archiveDB, dbs.cfg.ArchiveDatabasePath})
+	}
+	for _, target := range targets {
+		before := fileSize(target.path)
+		if vacuumMode == VacuumModeIncremental {
+			incrementalVacuum(target.db)
+		} else if err := fullVacuum(target.db); err != nil {
+			log.Printf("执行 VACUUM 失败 (%s): %v", target.path, err)
+			return exitError
+		}
+		fmt.Printf("%s: %d → %d 字节\n", target.path, before, fileSize(target.path))
+	}
+	return exitOK
+}
+
+// runRebuildRollupCommand 实现 `infoclash rebuild-rollup`：从连接记录重新生成按天汇总表 daily_rollup。
+func runRebuildRollupCommand(args []string) int {
+	fs := flag.NewFlagSet("rebuild-rollup", flag.ExitOnError)
+	dbPath := fs.String("db", "", "主数据库文件的路径")
+	archivePath := fs.String("adb", "", "归档数据库文件的路径")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s rebuild-rollup [options]\n\n参数说明:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	dbs, err := openCommandDatabases(*dbPath, *archivePath)
+	if err != nil {
+		log.Println(err)
+		return exitError
+	}
+	defer dbs.Close()
+
+	if !dailyRollupEnabled {
+		log.Println("未启用按天汇总表 (DAILY_ROLLUP=false)，无需生成。")
+		return exitError
+	}
+	started := time.Now()
+	rows, err := rebuildDailyRollup(dbs.db)
+	if err != nil {
+		log.Println(err)
+		return exitError
+	}
+	fmt.Printf("已生成 %d 行按天汇总，耗时 %v\n", rows, time.Since(started).Round(time.Millisecond))
+	return exitOK
+}
+
+// runIngestCommand 实现 `infoclash ingest`：回放一个或多个录制文件中的快照，写入数据库后退出。
+// 文件按参数顺序回放，`-` 表示标准输入。没有指定 `--start` 时，让最后一个快照的时间恰好为当前时间。
+func runIngestCommand(args []string) int {
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	dbPath := fs.String("db", "", "主数据库文件的路径")
+	archivePath := fs.String("adb", "", "归档数据库文件的路径")
+	start := fs.String("start", "", "第一个快照的时间（Unix 时间戳、2006-01-02 或 RFC 3339），默认让最后一个快照的时间为当前时间")
+	step := fs.Duration("step", time.Second, "相邻两个快照之间的时间间隔")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s ingest [options] <file.json>...\n\n录制文件每行一个 Clash /connections 快照，或者是由快照组成的 JSON 数组。\n\n参数说明:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "请指定至少一个录制文件。")
+		fs.Usage()
+		return exitUsage
+	}
+	if *step <= 0 {
+		fmt.Fprintln(os.Stderr, "-step 必须大于 0。")
+		return exitUsage
+	}
+	startTime, err := parseTimeArg(*start)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-start: %v\n", err)
+		return exitUsage
+	}
+
+	var snapshots []json.RawMessage
+	for _, path := range fs.Args() {
+		var r io.Reader = os.Stdin
+		if path != "-" {
+			file, err := os.Open(path)
+			if err != nil {
+				log.Printf("打开录制文件失败: %v", err)
+				return exitError
+			}
+			defer file.Close()
+			r = file
+		}
+		read, err := readReplaySnapshots(r)
+		if err != nil {
+			log.Printf("读取录制文件 %s 失败: %v", path, err)
+			return exitError
+		}
+		snapshots = append(snapshots, read...)
+	}
+	if len(snapshots) == 0 {
+		log.Println("录制文件中没有快照。")
+		return exitError
+	}
+
+	dbs, err := openCommandDatabases(*dbPath, *archivePath)
+	if err != nil {
+		log.Println(err)
+		return exitError
+	}
+	defer dbs.Close()
+	// 与 serve 一样先恢复累计流量计数器和 Clash 状态采样，回放时不会把录制的计数器重复累加。
+	if err := lifetimeTotals.Load(dbs.db); err != nil {
+		log.Printf("加载累计流量计数器失败: %v", err)
+	}
+	if err := clashStats.Load(dbs.db); err != nil {
+		log.Printf("加载 Clash 状态采样失败: %v", err)
+	}
+	if err := initConnectionCleaning(dbs.cfg, dbs.db); err != nil {
+		log.Println(err)
+		return exitError
+	}
+
+	first := time.Unix(startTime, 0)
+	if startTime == 0 {
+		first = time.Now().Add(-time.Duration(len(snapshots)-1) * *step)
+	}
+	result, err := replaySnapshots(context.Background(), dbs.db, dbs.cfg, snapshots, first, *step)
+	if err != nil {
+		log.Printf("写入数据库失败: %v", err)
+		return exitError
+	}
+	fmt.Printf("回放完成：%d 个快照（跳过 %d 个），%d 个连接，写入 %d 条记录。\n", result.Snapshots, result.Skipped, result.Connections, result.Written)
+	return exitOK
+}
+
+// fileSize 返回文件的大小（字节），无法获取时返回 0。
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
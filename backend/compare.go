@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// 这个文件实现了与上一个周期的流量对比 (`/api/summary/compare`)，用于仪表盘上「比上周多用了 23%」之类的提示。
+// 上一个周期是紧挨在查询范围之前、长度相同的时间范围，例如查询本周时与上周对比。
+
+// defaultCompareLimit 是 byHost=true 时增长最多和减少最多的主机各返回的数量。
+const defaultCompareLimit = 5
+
+// ComparePeriod 是一个时间范围内的流量合计。
+type ComparePeriod struct {
+	StartDate   int64  `json:"startDate"` // 开始时间 (Unix 时间戳, 秒)，包含。
+	EndDate     int64  `json:"endDate"`   // 结束时间 (Unix 时间戳, 秒)，包含。
+	Upload      uint64 `json:"upload"`
+	Download    uint64 `json:"download"`
+	Total       uint64 `json:"total"`
+	Connections uint64 `json:"connections"`
+}
+
+// HostChange 是一个主机在两个周期之间的流量变化。
+type HostChange struct {
+	Host          string   `json:"host"`
+	Total         uint64   `json:"total"`         // 本周期的总流量。
+	PreviousTotal uint64   `json:"previousTotal"` // 上一个周期的总流量。
+	Delta         int64    `json:"delta"`         // 变化量 (total - previousTotal)，减少时为负数。
+	Change        *float64 `json:"change"`        // 变化的百分比，保留一位小数；上一个周期没有流量时为 null。
+}
+
+// trafficTotals 是按 key 分组的流量合计。
+type trafficTotals struct {
+	upload, download, connections uint64
+}
+
+// percentChange 返回从 previous 到 current 变化的百分比，保留一位小数。previous 为 0 时无法计算，返回 nil。
+func percentChange(current, previous uint64) *float64 {
+	if previous == 0 {
+		return nil
+	}
+	change := math.Round((float64(current)-float64(previous))/float64(previous)*1000) / 10
+	return &change
+}
+
+// previousRange 返回紧挨在 [startDate, endDate] 之前、长度相同的上一个周期（两端都包含）。
+// 开始时间最早为 1，避免出现非正的时间戳。
+func previousRange(startDate, endDate int64) (int64, int64) {
+	length := endDate - startDate + 1
+	return max(startDate-length, 1), startDate - 1
+}
+
+// rangeTrafficTotals 统计开始时间在 [startDate, endDate] 内的流量，按 key（SQL 表达式，例如 host；不分组时为常量空字符串）分组。
+// archiveDB 不为 nil 时同时统计归档数据库中的原始记录，并排除主数据库中的合并记录，与 combinedTrafficSeries 一致；
+// 否则通过 summarySource 查询，daily_rollup 可用时完整的日期从按天汇总表读取。
+func rangeTrafficTotals(ctx context.Context, db, archiveDB *sql.DB, key string, startDate, endDate int64) (map[string]trafficTotals, error) {
+	totals := map[string]trafficTotals{}
+	collect := func(source *sql.DB, query string, args []interface{}) error {
+		rows, err := timedQuery(ctx, source, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var k string
+			var t trafficTotals
+			if err := rows.Scan(&k, &t.upload, &t.download, &t.connections); err != nil {
+				log.Printf("扫描数据库行失败: %v", err)
+				continue
+			}
+			sum := totals[k]
+			sum.upload += t.upload
+			sum.download += t.download
+			sum.connections += t.connections
+			totals[k] = sum
+		}
+		return rows.Err()
+	}
+
+	const columns = ", SUM(upload), SUM(download), SUM(connections) FROM "
+	if archiveDB == nil {
+		source, args := summarySource("%Y-%m-%d", true, "", nil, startDate, endDate)
+		return totals, collect(db, "SELECT "+key+columns+source+" GROUP BY 1", args)
+	}
+	args := []interface{}{startDate, endDate}
+	if err := collect(db, "SELECT "+key+columns+"connections WHERE merged_at IS NULL AND start >= ? AND start <= ? GROUP BY 1", args); err != nil {
+		return nil, err
+	}
+	if err := collect(archiveDB, "SELECT "+key+columns+"connections_archive WHERE start >= ? AND start <= ? GROUP BY 1", args); err != nil {
+		return nil, fmt.Errorf("查询归档数据失败: %w", err)
+	}
+	return totals, nil
+}
+
+// hostChanges 对比两个周期中每个主机的总流量，返回增长最多和减少最多的各 limit 个主机。
+// 只在一个周期中出现的主机，另一个周期的流量按 0 计算。
+func hostChanges(current, previous map[string]trafficTotals, scale sampleScaler, limit int) (risers, fallers []HostChange) {
+	changes := []HostChange{}
+	seen := map[string]struct{}{}
+	add := func(host string) {
+		if _, ok := seen[host]; ok {
+			return
+		}
+		seen[host] = struct{}{}
+		cur, prev := current[host], previous[host]
+		change := HostChange{Host: host, Total: cur.upload + cur.download, PreviousTotal: prev.upload + prev.download}
+		scale.Scale(&change.Total, &change.PreviousTotal)
+		change.Delta = int64(change.Total) - int64(change.PreviousTotal)
+		change.Change = percentChange(change.Total, change.PreviousTotal)
+		if change.Delta != 0 {
+			changes = append(changes, change)
+		}
+	}
+	for host := range current {
+		add(host)
+	}
+	for host := range previous {
+		add(host)
+	}
+	// 变化量相同时按主机名排序，保证结果稳定。
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Delta != changes[j].Delta {
+			return changes[i].Delta > changes[j].Delta
+		}
+		return changes[i].Host < changes[j].Host
+	})
+
+	risers, fallers = []HostChange{}, []HostChange{}
+	for i := 0; i < len(changes) && len(risers) < limit && changes[i].Delta > 0; i++ {
+		risers = append(risers, changes[i])
+	}
+	for i := len(changes) - 1; i >= 0 && len(fallers) < limit && changes[i].Delta < 0; i-- {
+		fallers = append(fallers, changes[i])
+	}
+	return risers, fallers
+}
+
+// getCompareSummaryHandler 是处理 `/api/summary/compare` GET 请求的 HTTP Handler。
+// 它返回 [startDate, endDate] 与紧挨在它之前、长度相同的上一个周期的流量合计，以及总流量变化的百分比。
+// `byHost=true` 时额外返回增长最多 (risers) 和减少最多 (fallers) 的主机，数量由 limit 指定；
+// `includeArchive=true` 时同时统计归档数据库中的原始记录。
+func getCompareSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	startDate, err := strconv.ParseInt(r.URL.Query().Get("startDate"), 10, 64)
+	if err != nil || startDate <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "startDate", "startDate 必须是正的 Unix 时间戳（秒）")
+		return
+	}
+	endDate, err := strconv.ParseInt(r.URL.Query().Get("endDate"), 10, 64)
+	if err != nil || endDate < startDate {
+		writeJSONError(w, http.StatusBadRequest, "endDate", "endDate 必须是不早于 startDate 的 Unix 时间戳（秒）")
+		return
+	}
+	previousStart, previousEnd := previousRange(startDate, endDate)
+
+	byHost := r.URL.Query().Get("byHost") == "true"
+	limit := defaultCompareLimit
+	if byHost {
+		limit = parseLimit(w, r, defaultCompareLimit)
+	}
+	// 关闭归档数据库时没有归档数据，忽略 includeArchive。
+	var archiveDB *sql.DB
+	if r.URL.Query().Get("includeArchive") == "true" {
+		archiveDB = archiveDBFromContext(r)
+	}
+	key := "''"
+	if byHost {
+		key = "host"
+	}
+
+	current, err := rangeTrafficTotals(r.Context(), db, archiveDB, key, startDate, endDate)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	previous, err := rangeTrafficTotals(r.Context(), db, archiveDB, key, previousStart, previousEnd)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	scale := sampleScalerFor(w, r)
+	period := func(start, end int64, totals map[string]trafficTotals) ComparePeriod {
+		p := ComparePeriod{StartDate: start, EndDate: end}
+		for _, t := range totals {
+			p.Upload += t.upload
+			p.Download += t.download
+			p.Connections += t.connections
+		}
+		p.Total = p.Upload + p.Download
+		scale.Scale(&p.Upload, &p.Download, &p.Total, &p.Connections)
+		return p
+	}
+	currentPeriod := period(startDate, endDate, current)
+	previousPeriod := period(previousStart, previousEnd, previous)
+	response := map[string]interface{}{
+		"current":  currentPeriod,
+		"previous": previousPeriod,
+		"change":   percentChange(currentPeriod.Total, previousPeriod.Total),
+	}
+	if byHost {
+		response["risers"], response["fallers"] = hostChanges(current, previous, scale, limit)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPreviousRange(t *testing.T) {
+	tests := []struct {
+		start, end         int64
+		wantStart, wantEnd int64
+	}{
+		{10000, 10999, 9000, 9999},
+		{10000, 10000, 9999, 9999},
+		{1700000000, 1700604799, 1699395200, 1699999999},
+		// 开始时间不早于 1。
+		{1000, 1999, 1, 999},
+	}
+	for _, tt := range tests {
+		start, end := previousRange(tt.start, tt.end)
+		if start != tt.wantStart || end != tt.wantEnd {
+			t.Errorf("previousRange(%d, %d) = %d, %d, want %d, %d", tt.start, tt.end, start, end, tt.wantStart, tt.wantEnd)
+		}
+	}
+}
+
+func TestPercentChange(t *testing.T) {
+	tests := []struct {
+		current, previous uint64
+		want              *float64
+	}{
+		{100, 0, nil},
+		{0, 0, nil},
+		{150, 100, floatPtr(50)},
+		{0, 100, floatPtr(-100)},
+		{4, 3, floatPtr(33.3)},
+		{100, 100, floatPtr(0)},
+	}
+	for _, tt := range tests {
+		got := percentChange(tt.current, tt.previous)
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("percentChange(%d, %d) = %v, want %v", tt.current, tt.previous, derefFloat(got), derefFloat(tt.want))
+		}
+	}
+}
+
+func floatPtr(f float64) *float64 { return &f }
+
+// derefFloat 便于在错误信息中打印 *float64，nil 打印为 <nil>。
+func derefFloat(f *float64) interface{} {
+	if f == nil {
+		return nil
+	}
+	return *f
+}
+
+// TestCompareSummary 检查接口使用紧挨在查询范围之前的周期，上一个周期没有流量时 change 为 null。
+func TestCompareSummary(t *testing.T) {
+	const start, end = 1700000000, 1700000999
+	db := newTestDB(t)
+	seedConnections(t, db,
+		Connection{ID: "current", Metadata: Metadata{Host: "example.com", SourceIP: "10.0.0.1"}, Upload: 100, Download: 200, Start: time.Unix(start, 0)},
+		Connection{ID: "new", Metadata: Metadata{Host: "new.example.com", SourceIP: "10.0.0.1"}, Upload: 50, Start: time.Unix(end, 0)},
+		Connection{ID: "previous", Metadata: Metadata{Host: "example.com", SourceIP: "10.0.0.1"}, Upload: 100, Download: 100, Start: time.Unix(start-1, 0)},
+		Connection{ID: "too early", Metadata: Metadata{Host: "example.com", SourceIP: "10.0.0.1"}, Upload: 1000, Start: time.Unix(start-1001, 0)},
+	)
+
+	tests := []struct {
+		name         string
+		query        string
+		wantCurrent  uint64
+		wantPrevious uint64
+		wantChange   *float64
+	}{
+		{"with previous traffic", "startDate=1700000000&endDate=1700000999", 350, 200, floatPtr(75)},
+		{"empty current period", "startDate=1700001000&endDate=1700001999", 0, 350, floatPtr(-100)},
+		{"previous total is zero", "startDate=1699998999&endDate=1699999998", 1000, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveWithDB(db, getCompareSummaryHandler, httptest.NewRequest(http.MethodGet, "/api/summary/compare?"+tt.query, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			var resp struct {
+				Current, Previous ComparePeriod
+				Change            *float64
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Current.Total != tt.wantCurrent || resp.Previous.Total != tt.wantPrevious {
+				t.Errorf("current.total = %d, previous.total = %d, want %d, %d", resp.Current.Total, resp.Previous.Total, tt.wantCurrent, tt.wantPrevious)
+			}
+			if (resp.Change == nil) != (tt.wantChange == nil) || (resp.Change != nil && *resp.Change != *tt.wantChange) {
+				t.Errorf("change = %v, want %v", derefFloat(resp.Change), derefFloat(tt.wantChange))
+			}
+		})
+	}
+}
+
+// TestCompareSummaryByHost 检查上一个周期没有流量的主机也会出现在 risers 中，change 为 null。
+func TestCompareSummaryByHost(t *testing.T) {
+	const start = 1700000000
+	db := newTestDB(t)
+	seedConnections(t, db,
+		Connection{ID: "current", Metadata: Metadata{Host: "example.com", SourceIP: "10.0.0.1"}, Upload: 300, Start: time.Unix(start, 0)},
+		Connection{ID: "new", Metadata: Metadata{Host: "new.example.com", SourceIP: "10.0.0.1"}, Upload: 50, Start: time.Unix(start, 0)},
+		Connection{ID: "previous", Metadata: Metadata{Host: "example.com", SourceIP: "10.0.0.1"}, Upload: 200, Start: time.Unix(start-1, 0)},
+	)
+
+	w := serveWithDB(db, getCompareSummaryHandler, httptest.NewRequest(http.MethodGet, "/api/summary/compare?startDate=1700000000&endDate=1700000999&byHost=true", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Risers, Fallers []HostChange
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Risers) != 2 || len(resp.Fallers) != 0 {
+		t.Fatalf("risers = %+v, fallers = %+v, want 2 risers", resp.Risers, resp.Fallers)
+	}
+	if r := resp.Risers[0]; r.Host != "example.com" || r.Delta != 100 || r.Change == nil || *r.Change != 50 {
+		t.Errorf("risers[0] = %+v, want example.com +100 (50%%)", r)
+	}
+	if r := resp.Risers[1]; r.Host != "new.example.com" || r.Delta != 50 || r.Change != nil {
+		t.Errorf("risers[1] = %+v, want new.example.com +50 with null change", r)
+	}
+}
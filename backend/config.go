@@ -8,21 +8,102 @@ import (
 	"time"
 
 	"github.com/joho/godotenv"
+	"golang.org/x/net/http/httpguts"
 )
 
 // Config 结构体用于存储从环境变量或 .env 文件加载的所有应用程序配置。
 // 这样做的好处是集中管理配置，方便在程序各处使用。
 type Config struct {
-	ClashAPIURL         string        // Clash API 的 URL，用于获取连接信息。
-	ClashAPIToken       string        // Clash API 的 Token（secret），用于认证。
-	DatabasePath        string        // 主数据库文件的路径。
-	ArchiveDatabasePath string        // 归档数据库文件的路径。
-	DBWriteInterval     time.Duration // 将内存中的数据写入数据库的时间间隔。
-	APISyncInterval     time.Duration // 从 Clash API 同步数据的频率。
-	WebPort             string        // Web 服务器监听的端口。
-	HostSuffixWhitelist []string      // 域名后缀名单，用于合并相同后缀的host
+	ClashAPIURL              string        // Clash API 的 URL，用于获取连接信息。
+	ClashAPIToken            string        // Clash API 的 Token（secret），用于认证。认证方式为 basic 时格式为 `user:pass`。
+	ClashAPITokenFile        string        // 保存 Token 的文件路径，仅在没有直接提供 Token 时读取。
+	ClashAPIAuthStyle        string        // Clash API 的认证方式：bearer（默认）、basic、query、header:<name> 或 none。
+	ClashAPITimeout          time.Duration // 请求 Clash `/connections` 的超时时间。
+	DatabasePath             string        // 主数据库文件的路径。
+	ArchiveDatabasePath      string        // 归档数据库文件的路径。
+	ArchiveEnabled           bool          // 是否启用归档数据库。关闭时不会创建归档数据库文件，合并时直接删除原始记录。
+	DBWriteInterval          time.Duration // 将内存中的数据写入数据库的时间间隔。
+	APISyncInterval          time.Duration // 从 Clash API 同步数据的频率。
+	WebHost                  string        // Web 服务器监听的地址，默认 0.0.0.0（所有网卡）。
+	WebPort                  string        // Web 服务器监听的端口。
+	TLSCertFile              string        // TLS 证书文件路径。与 TLSKeyFile 同时设置时启用 HTTPS。
+	TLSKeyFile               string        // TLS 私钥文件路径。
+	TLSRedirectPort          string        // 启用 HTTPS 时，在此端口监听 HTTP 并重定向到 HTTPS。为空时不监听。
+	HostSuffixWhitelist      []string      // 域名后缀名单，用于合并相同后缀的host
+	HostSuffixWhitelistFile  string        // 域名后缀名单文件的路径，文件变化时自动重新加载。
+	HostRewriteRulesFile     string        // host 正则改写规则文件的路径。
+	HostNormalize            string        // host 归一化模式：为空时不处理，etld1 表示折叠为可注册域名。
+	EmptyHostPolicy          string        // host 为空时的处理策略：skip、useDestIP 或 useLiteral。
+	EmptyHostLiteral         string        // EmptyHostPolicy 为 useLiteral 时写入的 host 字面值。
+	StoreUnknownHosts        bool          // 按 EmptyHostPolicy 处理后 host 仍为空时，是否以目标 IP（或 `unknown`）作为 host 保存，而不是丢弃。显式设置了 EMPTY_HOST_POLICY 时为 false。
+	EnableTrafficStream      bool          // 是否订阅 Clash 的 `/traffic` 推送，记录实时带宽。
+	ReverseDNS               bool          // 是否对 host 为空的连接反向解析目标 IP 以补充主机名。
+	AnonymizeSourceIP        bool          // 是否将源 IP 替换为稳定的匿名标记后再存储。
+	DBRotateDaily            bool          // 是否在每天零点轮转主数据库文件。
+	AlertWebhookURL          string        // 告警 Webhook 地址。为空时不开启告警。
+	AlertMaxConnections      uint64        // 活跃连接数告警阈值，0 表示不检查。
+	AlertMaxBytesPerInterval uint64        // 单个数据库写入周期内的流量告警阈值（字节），0 表示不检查。
+	AlertCooldown            time.Duration // 两次告警之间的最短间隔。
+	SQLiteSynchronous        string        // PRAGMA synchronous 的取值（OFF/NORMAL/FULL/EXTRA），为空时使用驱动默认值。
+	SQLiteCacheSize          int64         // PRAGMA cache_size 的取值，0 表示使用默认值。
+	SQLiteMmapSize           int64         // PRAGMA mmap_size 的取值（字节），0 表示使用默认值。
+	GeoIPDBPath              string        // GeoIP 数据库（.mmdb）文件的路径，为空时不查询国家信息。
+	SampleRate               float64       // 连接的采样率，取值 (0, 1]。1 表示记录所有连接（不抽样）。
+	CacheFlushThreshold      int64         // 内存缓存中的连接数达到该值时立即写入数据库，而不等到下一个写入周期，0 表示不检查。
+	CacheSpillFile           string        // 数据库写入失败时保存缓存内容的 JSON 文件路径，为空时不保存。
+	LogLevel                 string        // 日志级别：info（默认）或 debug。
+	MaxRequestBodyBytes      int64         // POST 等请求的请求体大小上限（字节），超过时返回 413。
+	VacuumMode               string        // 合并、删除和轮转后回收空间的策略：always（默认）、never 或 incremental。
+	SummaryOtherLabel        string        // 主机排行中汇总排行之外所有主机的一项使用的名称。
+	ReadOnly                 bool          // 是否为只读模式。只读模式下修改数据的接口返回 403，用于公开仪表盘。
+	MaxPageSize              int           // 分页接口的 pageSize 和排行接口的 limit 的上限，超过时截断为该值。
+	DailyRollup              bool          // 是否维护按天汇总表 daily_rollup，用于加速按天的流量汇总和主机排行。
+	SummaryCache             bool          // 是否缓存汇总接口的响应，有效期为 DBWriteInterval，修改连接记录后清空。
+	CacheIdleSyncs           int           // host 为空的连接超过这么多次同步没有出现在 Clash 响应中时从内存缓存中清理，0 表示不清理。
+	SlowQueryMs              int           // 查询接口中耗时超过这么多毫秒的 SQL 查询记录到日志，0 表示不记录。
+	StartTimeSource          string        // 连接开始时间的来源：clash（默认，无效时退回同步时间）或 ingest（始终使用同步时间）。
+	BillingResetDay          int           // 计费周期每月的重置日 (1-31)，`/api/summary/billing` 未指定 resetDay 时使用。
 }
 
+// defaultCacheIdleSyncs 是 CACHE_IDLE_SYNCS 的默认值。同步间隔为 1 秒，即大约 1 分钟。
+const defaultCacheIdleSyncs = 60
+
+// defaultSlowQueryMs 是 SLOW_QUERY_MS 的默认值。
+const defaultSlowQueryMs = 500
+
+// defaultSummaryOtherLabel 是 SUMMARY_OTHER_LABEL 的默认值。
+const defaultSummaryOtherLabel = "其他"
+
+// 日志级别。
+const (
+	LogLevelInfo  = "info"  // 默认级别。
+	LogLevelDebug = "debug" // 额外输出调试日志，如每个写入批次的大小。
+)
+
+// host 归一化模式。
+const (
+	HostNormalizeNone  = ""      // 不做归一化（默认）。
+	HostNormalizeETLD1 = "etld1" // 按公共后缀列表折叠为可注册域名 (eTLD+1)。
+)
+
+// Clash API 的认证方式。
+const (
+	ClashAuthBearer = "bearer" // `Authorization: Bearer <token>`（默认）。
+	ClashAuthBasic  = "basic"  // HTTP Basic Auth，Token 的格式为 `user:pass`。
+	ClashAuthQuery  = "query"  // 在 URL 中附加 `?secret=<token>`，用于部分 Clash 分支和旧版本。
+	ClashAuthNone   = "none"   // 不发送认证信息。
+
+	// ClashAuthHeaderPrefix 是自定义请求头认证方式的前缀，`header:X-Secret` 表示发送 `X-Secret: <token>`。
+	ClashAuthHeaderPrefix = "header:"
+)
+
+// host 为空时的处理策略。
+const (
+	EmptyHostSkip       = "skip"       // 丢弃该连接。未设置 EMPTY_HOST_POLICY 时，只有 STORE_UNKNOWN_HOSTS=false 才会丢弃。
+	EmptyHostUseDestIP  = "useDestIP"  // 使用目标 IP 作为 host。
+	EmptyHostUseLiteral = "useLiteral" // 使用固定的字面值（如 `<direct>`）作为 host。
+)
+
 // Load 函数负责加载应用程序的配置。
 // 它会首先尝试从项目根目录下的 .env 文件加载配置，
 // 然后用任何已设置的环境变量覆盖这些值。
@@ -39,6 +120,7 @@ func LoadConfig(
 	archiveDatabasePath,
 	webPort string,
 	dbWriteInterval int,
+	dbWriteIntervalSeconds int,
 ) *Config {
 	// 尝试加载 .env 文件。这会把 .env 中的值加载到环境变量中，但不会覆盖已存在的环境变量。
 	if err := godotenv.Load(); err != nil {
@@ -54,26 +136,115 @@ func LoadConfig(
 	// Clash API Token
 	finalAPIToken := getValue("CLASH_API_TOKEN", clashAPIToken, "") // Token 没有合理的默认值
 
+	// Clash API Token File (仅从环境变量加载)
+	// 通过环境变量或命令行参数传递的 Token 会出现在进程列表和 shell 历史中，容器中通常改为挂载一个只包含 secret 的文件。
+	// 只有没有通过 -t、.env 或 CLASH_API_TOKEN 直接提供 Token 时才读取该文件，文件内容去掉首尾的空白字符（包括末尾的换行）。
+	clashAPITokenFile := strings.TrimSpace(os.Getenv("CLASH_API_TOKEN_FILE"))
+	if clashAPITokenFile != "" && finalAPIToken == "" {
+		data, err := os.ReadFile(clashAPITokenFile)
+		if err != nil {
+			log.Printf("警告: 无法读取 CLASH_API_TOKEN_FILE %q: %v，将不使用 Token。", clashAPITokenFile, err)
+		} else {
+			finalAPIToken = strings.TrimSpace(string(data))
+		}
+	}
+
+	// Clash API Auth Style (仅从环境变量加载)
+	// header:<name> 中的请求头名称保留原样，其余取值不区分大小写。
+	clashAPIAuthStyle := strings.TrimSpace(getValue("CLASH_API_AUTH_STYLE", "", ClashAuthBearer))
+	if !strings.HasPrefix(strings.ToLower(clashAPIAuthStyle), ClashAuthHeaderPrefix) {
+		clashAPIAuthStyle = strings.ToLower(clashAPIAuthStyle)
+	}
+	switch {
+	case clashAPIAuthStyle == ClashAuthBearer, clashAPIAuthStyle == ClashAuthQuery, clashAPIAuthStyle == ClashAuthNone:
+	case clashAPIAuthStyle == ClashAuthBasic:
+		if !strings.Contains(finalAPIToken, ":") {
+			log.Println("警告: CLASH_API_AUTH_STYLE 为 basic，但 CLASH_API_TOKEN 不是 user:pass 格式，将把整个值作为用户名。")
+		}
+	case strings.HasPrefix(strings.ToLower(clashAPIAuthStyle), ClashAuthHeaderPrefix) && httpguts.ValidHeaderFieldName(clashAPIAuthStyle[len(ClashAuthHeaderPrefix):]):
+		clashAPIAuthStyle = ClashAuthHeaderPrefix + clashAPIAuthStyle[len(ClashAuthHeaderPrefix):]
+	default:
+		log.Printf("警告: 无效的 CLASH_API_AUTH_STYLE 值 %q，将使用默认值 %q。", clashAPIAuthStyle, ClashAuthBearer)
+		clashAPIAuthStyle = ClashAuthBearer
+	}
+
+	// Clash API Timeout (仅从环境变量加载)
+	clashAPITimeout := defaultClashAPITimeout
+	if raw := os.Getenv("CLASH_API_TIMEOUT_SECONDS"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds < 1 {
+			log.Printf("警告: 无效的 CLASH_API_TIMEOUT_SECONDS 值 %q，将使用默认值 %v。", raw, defaultClashAPITimeout)
+		} else {
+			clashAPITimeout = time.Duration(seconds) * time.Second
+		}
+	}
+
 	// Database Path
 	finalDBPath := getValue("DATABASE_PATH", databasePath, "./clash_traffic.db")
 
 	// Archive Database Path
 	finalArchiveDBPath := getValue("ARCHIVE_DATABASE_PATH", archiveDatabasePath, "./clash_traffic_archive.db")
 
+	// Archive Enabled (仅从环境变量加载)
+	archiveEnabled, err := strconv.ParseBool(getValue("ARCHIVE_ENABLED", "", "true"))
+	if err != nil {
+		log.Printf("警告: 无效的 ARCHIVE_ENABLED 值 %q，将使用默认值 true。", os.Getenv("ARCHIVE_ENABLED"))
+		archiveEnabled = true
+	}
+
 	// Web Port
 	finalWebPort := getValue("WEB_PORT", webPort, "8081")
 
+	// Web Host (仅从环境变量加载)
+	// 多网卡的主机上可以设置为 127.0.0.1，只允许本机访问。
+	webHost := getValue("WEB_HOST", "", "0.0.0.0")
+
+	// TLS (仅从环境变量加载)
+	// 证书和私钥必须同时设置，只设置其中一个时视为配置错误，继续使用 HTTP。
+	tlsCertFile := os.Getenv("TLS_CERT_FILE")
+	tlsKeyFile := os.Getenv("TLS_KEY_FILE")
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		log.Println("警告: TLS_CERT_FILE 和 TLS_KEY_FILE 必须同时设置，将不启用 HTTPS。")
+		tlsCertFile, tlsKeyFile = "", ""
+	}
+	tlsRedirectPort := os.Getenv("TLS_REDIRECT_PORT")
+	if tlsRedirectPort != "" && tlsCertFile == "" {
+		log.Println("警告: 未启用 HTTPS，TLS_REDIRECT_PORT 将被忽略。")
+		tlsRedirectPort = ""
+	}
+
 	// DB Write Interval
-	var finalDBWriteIntervalMinutes int
-	if dbWriteInterval > 0 {
-		finalDBWriteIntervalMinutes = dbWriteInterval
-	} else {
+	// 以秒为单位的选项可以设置小于 1 分钟的间隔，同时设置时优先于以分钟为单位的选项。
+	// 优先级：-is > -i > DB_WRITE_INTERVAL_SECONDS > DB_WRITE_INTERVAL_MINUTES > 默认值 3 分钟。
+	// 无效的秒数（小于 1）会被忽略，继续使用以分钟为单位的选项。
+	if dbWriteIntervalSeconds < 0 {
+		log.Printf("警告: 无效的 -is 值 %d，数据库写入间隔至少为 1 秒，将忽略该参数。", dbWriteIntervalSeconds)
+		dbWriteIntervalSeconds = 0
+	}
+	var envDBWriteIntervalSeconds int
+	if raw := os.Getenv("DB_WRITE_INTERVAL_SECONDS"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds < 1 {
+			log.Printf("警告: 无效的 DB_WRITE_INTERVAL_SECONDS 值 %q，数据库写入间隔至少为 1 秒，将忽略该配置。", raw)
+		} else {
+			envDBWriteIntervalSeconds = seconds
+		}
+	}
+	var finalDBWriteInterval time.Duration
+	switch {
+	case dbWriteIntervalSeconds > 0:
+		finalDBWriteInterval = time.Duration(dbWriteIntervalSeconds) * time.Second
+	case dbWriteInterval > 0:
+		finalDBWriteInterval = time.Duration(dbWriteInterval) * time.Minute
+	case envDBWriteIntervalSeconds > 0:
+		finalDBWriteInterval = time.Duration(envDBWriteIntervalSeconds) * time.Second
+	default:
 		dbWriteIntervalStr := os.Getenv("DB_WRITE_INTERVAL_MINUTES")
 		interval, err := strconv.Atoi(dbWriteIntervalStr)
 		if err != nil || interval <= 0 {
-			finalDBWriteIntervalMinutes = 3 // 默认值
+			finalDBWriteInterval = 3 * time.Minute // 默认值
 		} else {
-			finalDBWriteIntervalMinutes = interval
+			finalDBWriteInterval = time.Duration(interval) * time.Minute
 		}
 	}
 
@@ -84,16 +255,229 @@ func LoadConfig(
 		hostSuffixWhitelist = strings.Split(hostSuffixWhitelistStr, ",")
 	}
 
+	// Host Suffix Whitelist File (仅从环境变量加载)
+	hostSuffixWhitelistFile := os.Getenv("HOST_SUFFIX_WHITELIST_FILE")
+
+	// Host Rewrite Rules File (仅从环境变量加载)
+	hostRewriteRulesFile := os.Getenv("HOST_REWRITE_RULES_FILE")
+
+	// Host Normalize (仅从环境变量加载)
+	hostNormalize := strings.ToLower(os.Getenv("HOST_NORMALIZE"))
+	switch hostNormalize {
+	case HostNormalizeNone, HostNormalizeETLD1:
+	default:
+		log.Printf("警告: 无效的 HOST_NORMALIZE 值 %q，将不进行 host 归一化。", hostNormalize)
+		hostNormalize = HostNormalizeNone
+	}
+
+	// Empty Host Policy (仅从环境变量加载)
+	emptyHostPolicy := getValue("EMPTY_HOST_POLICY", "", EmptyHostSkip)
+	emptyHostPolicyExplicit := os.Getenv("EMPTY_HOST_POLICY") != ""
+	switch emptyHostPolicy {
+	case EmptyHostSkip, EmptyHostUseDestIP, EmptyHostUseLiteral:
+	default:
+		log.Printf("警告: 无效的 EMPTY_HOST_POLICY 值 %q，将使用默认值 %q。", emptyHostPolicy, EmptyHostSkip)
+		emptyHostPolicy = EmptyHostSkip
+		emptyHostPolicyExplicit = false
+	}
+	emptyHostLiteral := getValue("EMPTY_HOST_LITERAL", "", "<direct>")
+	storeUnknownHosts, err := strconv.ParseBool(getValue("STORE_UNKNOWN_HOSTS", "", "true"))
+	if err != nil {
+		log.Printf("警告: 无效的 STORE_UNKNOWN_HOSTS 值 %q，将使用默认值 true。", os.Getenv("STORE_UNKNOWN_HOSTS"))
+		storeUnknownHosts = true
+	}
+	// STORE_UNKNOWN_HOSTS 只在没有显式设置 EMPTY_HOST_POLICY 时生效：显式设置的策略（包括 skip）总是优先，
+	// 否则 EMPTY_HOST_POLICY=skip 会因为 STORE_UNKNOWN_HOSTS 默认开启而不再丢弃任何连接。
+	if emptyHostPolicyExplicit && storeUnknownHosts {
+		if os.Getenv("STORE_UNKNOWN_HOSTS") != "" {
+			log.Printf("警告: 已显式设置 EMPTY_HOST_POLICY=%s，STORE_UNKNOWN_HOSTS 将被忽略。", emptyHostPolicy)
+		}
+		storeUnknownHosts = false
+	}
+
+	// Enable Traffic Stream (仅从环境变量加载)
+	enableTrafficStream, _ := strconv.ParseBool(os.Getenv("ENABLE_TRAFFIC_STREAM"))
+
+	// Reverse DNS (仅从环境变量加载)
+	reverseDNS, _ := strconv.ParseBool(os.Getenv("REVERSE_DNS"))
+
+	// Anonymize Source IP (仅从环境变量加载)
+	anonymizeSourceIP, _ := strconv.ParseBool(os.Getenv("ANONYMIZE_SOURCE_IP"))
+
+	// DB Rotate Daily (仅从环境变量加载)
+	dbRotateDaily, _ := strconv.ParseBool(os.Getenv("DB_ROTATE_DAILY"))
+
+	// SQLite PRAGMA (仅从环境变量加载)，取值在打开数据库前由 configureSQLitePragmas 校验。
+	sqliteSynchronous := os.Getenv("SQLITE_SYNCHRONOUS")
+	sqliteCacheSize, _ := strconv.ParseInt(os.Getenv("SQLITE_CACHE_SIZE"), 10, 64)
+	sqliteMmapSize, _ := strconv.ParseInt(os.Getenv("SQLITE_MMAP_SIZE"), 10, 64)
+
+	// GeoIP Database Path (仅从环境变量加载)
+	geoIPDBPath := os.Getenv("GEOIP_DB_PATH")
+
+	// Alert Webhook (仅从环境变量加载)
+	alertWebhookURL := os.Getenv("ALERT_WEBHOOK_URL")
+	alertMaxConnections, _ := strconv.ParseUint(os.Getenv("ALERT_MAX_CONNECTIONS"), 10, 64)
+	alertMaxBytes, _ := strconv.ParseUint(os.Getenv("ALERT_MAX_BYTES_PER_INTERVAL"), 10, 64)
+	alertCooldownMinutes, err := strconv.Atoi(os.Getenv("ALERT_COOLDOWN_MINUTES"))
+	if err != nil || alertCooldownMinutes <= 0 {
+		alertCooldownMinutes = 30 // 默认值
+	}
+	if alertWebhookURL != "" && alertMaxConnections == 0 && alertMaxBytes == 0 {
+		log.Println("警告: 已设置 ALERT_WEBHOOK_URL，但未设置任何告警阈值，将不会发送告警。")
+	}
+
+	// Sample Rate (仅从环境变量加载)
+	sampleRate, err := strconv.ParseFloat(getValue("SAMPLE_RATE", "", "1"), 64)
+	if err != nil || !(sampleRate > 0 && sampleRate <= 1) {
+		log.Printf("警告: 无效的 SAMPLE_RATE 值 %q，取值范围为 (0, 1]，将使用默认值 1（不抽样）。", os.Getenv("SAMPLE_RATE"))
+		sampleRate = 1
+	}
+
+	// Cache Flush Threshold / Spill File (仅从环境变量加载)
+	cacheFlushThreshold, err := strconv.ParseInt(getValue("CACHE_FLUSH_THRESHOLD", "", "20000"), 10, 64)
+	if err != nil || cacheFlushThreshold < 0 {
+		log.Printf("警告: 无效的 CACHE_FLUSH_THRESHOLD 值 %q，将使用默认值 20000。", os.Getenv("CACHE_FLUSH_THRESHOLD"))
+		cacheFlushThreshold = 20000
+	}
+	cacheSpillFile := os.Getenv("CACHE_SPILL_FILE")
+	cacheIdleSyncs, err := strconv.Atoi(getValue("CACHE_IDLE_SYNCS", "", strconv.Itoa(defaultCacheIdleSyncs)))
+	if err != nil || cacheIdleSyncs < 0 {
+		log.Printf("警告: 无效的 CACHE_IDLE_SYNCS 值 %q，将使用默认值 %d。", os.Getenv("CACHE_IDLE_SYNCS"), defaultCacheIdleSyncs)
+		cacheIdleSyncs = defaultCacheIdleSyncs
+	}
+
+	// Slow Query Log (仅从环境变量加载)
+	slowQueryMs, err := strconv.Atoi(getValue("SLOW_QUERY_MS", "", strconv.Itoa(defaultSlowQueryMs)))
+	if err != nil || slowQueryMs < 0 {
+		log.Printf("警告: 无效的 SLOW_QUERY_MS 值 %q，将使用默认值 %d。", os.Getenv("SLOW_QUERY_MS"), defaultSlowQueryMs)
+		slowQueryMs = defaultSlowQueryMs
+	}
+
+	// Log Level (仅从环境变量加载)
+	logLevel := strings.ToLower(getValue("LOG_LEVEL", "", LogLevelInfo))
+	switch logLevel {
+	case LogLevelInfo, LogLevelDebug:
+	default:
+		log.Printf("警告: 无效的 LOG_LEVEL 值 %q，将使用默认值 %q。", logLevel, LogLevelInfo)
+		logLevel = LogLevelInfo
+	}
+
+	// Max Request Body Bytes (仅从环境变量加载)
+	maxRequestBodyBytes, err := strconv.ParseInt(getValue("MAX_REQUEST_BODY_BYTES", "", strconv.Itoa(defaultMaxRequestBodyBytes)), 10, 64)
+	if err != nil || maxRequestBodyBytes <= 0 {
+		log.Printf("警告: 无效的 MAX_REQUEST_BODY_BYTES 值 %q，将使用默认值 %d。", os.Getenv("MAX_REQUEST_BODY_BYTES"), defaultMaxRequestBodyBytes)
+		maxRequestBodyBytes = defaultMaxRequestBodyBytes
+	}
+
+	// Vacuum Mode (仅从环境变量加载)
+	vacuumMode, ok := parseVacuumMode(getValue("VACUUM_MODE", "", VacuumModeAlways))
+	if !ok {
+		log.Printf("警告: 无效的 VACUUM_MODE 值 %q，可选值为 always、never、incremental，将使用默认值 %q。", os.Getenv("VACUUM_MODE"), VacuumModeAlways)
+		vacuumMode = VacuumModeAlways
+	}
+
+	// Summary Other Label (仅从环境变量加载)
+	summaryOtherLabel := strings.TrimSpace(getValue("SUMMARY_OTHER_LABEL", "", defaultSummaryOtherLabel))
+	if summaryOtherLabel == "" {
+		summaryOtherLabel = defaultSummaryOtherLabel
+	}
+
+	// Read Only (仅从环境变量加载)
+	readOnly, err := strconv.ParseBool(getValue("READ_ONLY", "", "false"))
+	if err != nil {
+		log.Printf("警告: 无效的 READ_ONLY 值 %q，将使用默认值 false。", os.Getenv("READ_ONLY"))
+		readOnly = false
+	}
+
+	// Max Page Size (仅从环境变量加载)
+	maxPageSize, err := strconv.Atoi(getValue("MAX_PAGE_SIZE", "", strconv.Itoa(defaultMaxPageSize)))
+	if err != nil || maxPageSize <= 0 {
+		log.Printf("警告: 无效的 MAX_PAGE_SIZE 值 %q，将使用默认值 %d。", os.Getenv("MAX_PAGE_SIZE"), defaultMaxPageSize)
+		maxPageSize = defaultMaxPageSize
+	}
+
+	// Daily Rollup (仅从环境变量加载)
+	dailyRollup, err := strconv.ParseBool(getValue("DAILY_ROLLUP", "", "true"))
+	if err != nil {
+		log.Printf("警告: 无效的 DAILY_ROLLUP 值 %q，将使用默认值 true。", os.Getenv("DAILY_ROLLUP"))
+		dailyRollup = true
+	}
+
+	// Summary Cache (仅从环境变量加载)
+	summaryCacheEnabled, err := strconv.ParseBool(getValue("SUMMARY_CACHE", "", "true"))
+	if err != nil {
+		log.Printf("警告: 无效的 SUMMARY_CACHE 值 %q，将使用默认值 true。", os.Getenv("SUMMARY_CACHE"))
+		summaryCacheEnabled = true
+	}
+
+	// Start Time Source (仅从环境变量加载)
+	startTimeSource := strings.ToLower(strings.TrimSpace(getValue("START_TIME_SOURCE", "", StartTimeSourceClash)))
+	switch startTimeSource {
+	case StartTimeSourceClash, StartTimeSourceIngest:
+	default:
+		log.Printf("警告: 无效的 START_TIME_SOURCE 值 %q，可选值为 clash、ingest，将使用默认值 %q。", os.Getenv("START_TIME_SOURCE"), StartTimeSourceClash)
+		startTimeSource = StartTimeSourceClash
+	}
+
+	// Billing Reset Day (仅从环境变量加载)
+	billingResetDay, err := strconv.Atoi(getValue("BILLING_RESET_DAY", "", strconv.Itoa(defaultBillingResetDay)))
+	if err != nil || billingResetDay < 1 || billingResetDay > maxBillingResetDay {
+		log.Printf("警告: 无效的 BILLING_RESET_DAY 值 %q，将使用默认值 %d。", os.Getenv("BILLING_RESET_DAY"), defaultBillingResetDay)
+		billingResetDay = defaultBillingResetDay
+	}
+
 	// 返回最终的配置
 	return &Config{
-		ClashAPIURL:         finalAPIURL,
-		ClashAPIToken:       finalAPIToken,
-		DatabasePath:        finalDBPath,
-		ArchiveDatabasePath: finalArchiveDBPath,
-		DBWriteInterval:     time.Duration(finalDBWriteIntervalMinutes) * time.Minute,
-		APISyncInterval:     1 * time.Second, // API 同步间隔硬编码为1秒
-		WebPort:             finalWebPort,
-		HostSuffixWhitelist: hostSuffixWhitelist,
+		ClashAPIURL:              finalAPIURL,
+		ClashAPIToken:            finalAPIToken,
+		ClashAPITokenFile:        clashAPITokenFile,
+		ClashAPIAuthStyle:        clashAPIAuthStyle,
+		ClashAPITimeout:          clashAPITimeout,
+		DatabasePath:             finalDBPath,
+		ArchiveDatabasePath:      finalArchiveDBPath,
+		ArchiveEnabled:           archiveEnabled,
+		DBWriteInterval:          finalDBWriteInterval,
+		APISyncInterval:          1 * time.Second, // API 同步间隔硬编码为1秒
+		WebHost:                  webHost,
+		WebPort:                  finalWebPort,
+		TLSCertFile:              tlsCertFile,
+		TLSKeyFile:               tlsKeyFile,
+		TLSRedirectPort:          tlsRedirectPort,
+		HostSuffixWhitelist:      hostSuffixWhitelist,
+		HostSuffixWhitelistFile:  hostSuffixWhitelistFile,
+		HostRewriteRulesFile:     hostRewriteRulesFile,
+		HostNormalize:            hostNormalize,
+		EmptyHostPolicy:          emptyHostPolicy,
+		EmptyHostLiteral:         emptyHostLiteral,
+		StoreUnknownHosts:        storeUnknownHosts,
+		EnableTrafficStream:      enableTrafficStream,
+		ReverseDNS:               reverseDNS,
+		AnonymizeSourceIP:        anonymizeSourceIP,
+		DBRotateDaily:            dbRotateDaily,
+		SQLiteSynchronous:        sqliteSynchronous,
+		SQLiteCacheSize:          sqliteCacheSize,
+		SQLiteMmapSize:           sqliteMmapSize,
+		GeoIPDBPath:              geoIPDBPath,
+		AlertWebhookURL:          alertWebhookURL,
+		AlertMaxConnections:      alertMaxConnections,
+		AlertMaxBytesPerInterval: alertMaxBytes,
+		AlertCooldown:            time.Duration(alertCooldownMinutes) * time.Minute,
+		SampleRate:               sampleRate,
+		CacheFlushThreshold:      cacheFlushThreshold,
+		CacheSpillFile:           cacheSpillFile,
+		LogLevel:                 logLevel,
+		MaxRequestBodyBytes:      maxRequestBodyBytes,
+		VacuumMode:               vacuumMode,
+		SummaryOtherLabel:        summaryOtherLabel,
+		ReadOnly:                 readOnly,
+		MaxPageSize:              maxPageSize,
+		DailyRollup:              dailyRollup,
+		SummaryCache:             summaryCacheEnabled,
+		CacheIdleSyncs:           cacheIdleSyncs,
+		SlowQueryMs:              slowQueryMs,
+		StartTimeSource:          startTimeSource,
+		BillingResetDay:          billingResetDay,
 	}
 }
 
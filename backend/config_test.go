@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestLoadConfigEmptyHostPolicyOverridesStoreUnknownHosts(t *testing.T) {
+	tests := []struct {
+		name              string
+		emptyHostPolicy   string
+		storeUnknownHosts string
+		wantPolicy        string
+		wantStore         bool
+		wantHost          string
+	}{
+		{"defaults store unknown hosts", "", "", EmptyHostSkip, true, "10.0.0.1"},
+		{"store disabled", "", "false", EmptyHostSkip, false, ""},
+		{"explicit skip", EmptyHostSkip, "", EmptyHostSkip, false, ""},
+		{"explicit skip wins over explicit store", EmptyHostSkip, "true", EmptyHostSkip, false, ""},
+		{"explicit useDestIP", EmptyHostUseDestIP, "", EmptyHostUseDestIP, false, "10.0.0.1"},
+		{"explicit useLiteral", EmptyHostUseLiteral, "", EmptyHostUseLiteral, false, "<direct>"},
+		{"invalid policy falls back to default", "bogus", "", EmptyHostSkip, true, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("EMPTY_HOST_POLICY", tt.emptyHostPolicy)
+			t.Setenv("EMPTY_HOST_LITERAL", "")
+			t.Setenv("STORE_UNKNOWN_HOSTS", tt.storeUnknownHosts)
+			cfg := LoadConfig("", "", "", "", "", 0, 0)
+			if cfg.EmptyHostPolicy != tt.wantPolicy || cfg.StoreUnknownHosts != tt.wantStore {
+				t.Fatalf("EmptyHostPolicy = %q, StoreUnknownHosts = %v, want %q, %v",
+					cfg.EmptyHostPolicy, cfg.StoreUnknownHosts, tt.wantPolicy, tt.wantStore)
+			}
+
+			connections := &Connections{Connections: []Connection{{ID: "1", Metadata: Metadata{DestinationIP: "10.0.0.1"}}}}
+			cleanConnections(connections, cfg)
+			conn := connections.Connections[0]
+			if conn.Metadata.Host != tt.wantHost || conn.HostUnknown != (tt.wantHost != "") {
+				t.Errorf("host = %q, hostUnknown = %v, want %q", conn.Metadata.Host, conn.HostUnknown, tt.wantHost)
+			}
+		})
+	}
+}
@@ -1,13 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
-
-	// 导入 "github.com/mattn/go-sqlite3" 驱动。
-	// 下划线 `_` 表示我们只需要这个包的副作用（即注册 sqlite3 驱动），
-	// 而不需要在代码中直接调用它的任何函数。
-	_ "github.com/mattn/go-sqlite3"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // InitDB 函数负责初始化主数据库。
@@ -26,7 +26,8 @@ func InitDB(filepath string) (*sql.DB, error) {
 	// `_journal_mode=DELETE` 是一个优化选项，用于强制禁用 WAL (Write-Ahead Logging) 模式。
 	// 在某些高并发写入场景下，WAL 可能会导致数据库锁定问题，这里显式禁用以确保稳定性。
 	dsn := fmt.Sprintf("file:%s?_journal_mode=DELETE", filepath)
-	db, err := sql.Open("sqlite3", dsn)
+	// 使用带 PRAGMA 调优的驱动（见 pragma.go），未配置调优时与 sqlite3 驱动相同。
+	db, err := sql.Open(sqliteDriverName, dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -49,10 +50,149 @@ func InitDB(filepath string) (*sql.DB, error) {
 		return nil, err
 	}
 
+	// 为旧版本创建的数据库补齐后来新增的列。
+	// `merged_at` 标记由合并操作生成的聚合记录，值为该次合并的归档时间戳，原始记录为 NULL。
+	if err = ensureColumn(db, "connections", "merged_at", "INTEGER"); err != nil {
+		return nil, err
+	}
+	// `country` 是目标 IP 所属国家的 ISO 代码，仅在配置了 GeoIP 数据库时填充。
+	if err = ensureColumn(db, "connections", "country", "TEXT"); err != nil {
+		return nil, err
+	}
+	// `network` 是连接的网络类型（`tcp` / `udp`），来自 Clash 的 metadata.network。旧记录为 NULL。
+	if err = ensureColumn(db, "connections", "network", "TEXT"); err != nil {
+		return nil, err
+	}
+	// `type` 是连接的入站类型（`HTTP` / `HTTPS` / `Socks5` 等），来自 Clash 的 metadata.type。旧记录为 NULL。
+	if err = ensureColumn(db, "connections", "type", "TEXT"); err != nil {
+		return nil, err
+	}
+	// `connections` 是这条记录代表的原始连接数：采集到的记录为 1，合并生成的记录为被合并记录数之和。
+	if err = ensureColumn(db, "connections", "connections", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return nil, err
+	}
+	// `chains` 是完整的代理链（JSON 数组，顺序与 Clash 返回的一致）。`chain` 列仍只保存最后一个元素，
+	// 以兼容旧的查询和过滤。旧记录为 NULL。
+	if err = ensureColumn(db, "connections", "chains", "TEXT"); err != nil {
+		return nil, err
+	}
+	// `chainFull` 是用 ` → ` 连接起来的完整代理链，便于按完整路径精确过滤（例如区分 `Auto → HK-01` 和 `HK-01`）。
+	if err = ensureChainFullColumn(db, "connections"); err != nil {
+		return nil, err
+	}
+	// `rule` 和 `rulePayload` 是连接匹配到的 Clash 规则（如 `DomainSuffix`）及其内容（如 `google.com`），
+	// 用于统计每条规则的流量。旧记录为 NULL。
+	if err = ensureColumn(db, "connections", "rule", "TEXT"); err != nil {
+		return nil, err
+	}
+	if err = ensureColumn(db, "connections", "rulePayload", "TEXT"); err != nil {
+		return nil, err
+	}
+	// `endTime` 是采集程序观察到连接关闭（从 Clash 的连接列表中消失）的时间，`duration` 是连接持续的秒数。
+	// 仍在进行中的连接以及旧记录为 NULL。合并生成的记录中 `duration` 为各连接之和，`endTime` 取最晚的关闭时间。
+	// 列名避开 SQL 关键字 `end`。
+	if err = ensureColumn(db, "connections", "endTime", "INTEGER"); err != nil {
+		return nil, err
+	}
+	if err = ensureColumn(db, "connections", "duration", "INTEGER"); err != nil {
+		return nil, err
+	}
+	// `hostUnknown` 为 1 表示 Clash 没有提供主机名，host 是按 EMPTY_HOST_POLICY / STORE_UNKNOWN_HOSTS 填充的目标 IP 或占位值。
+	if err = ensureColumn(db, "connections", "hostUnknown", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	// `destinationPort` 是连接的目标端口，来自 Clash 的 metadata.destinationPort，用于按端口识别服务（见 ports.go）。
+	// 旧记录以及 Clash 没有提供端口的连接为 NULL。
+	if err = ensureColumn(db, "connections", "destinationPort", "INTEGER"); err != nil {
+		return nil, err
+	}
+
+	// 按时间范围查询（汇总、导出、按天更新 daily_rollup 等）都以 start 为条件，为它建立索引避免全表扫描。
+	if _, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_connections_start ON connections (start)"); err != nil {
+		return nil, err
+	}
+
+	// `metadata` 是一个简单的键值表，用于持久化程序自身的状态（例如累计流量计数器）。
+	createMetadataSQL := `CREATE TABLE IF NOT EXISTS metadata (
+		"key" TEXT NOT NULL PRIMARY KEY,
+		"value" TEXT
+	);`
+	if _, err = db.Exec(createMetadataSQL); err != nil {
+		return nil, err
+	}
+
+	// `devices` 表保存源 IP 与设备名称的映射，用于在界面上显示友好的设备名。
+	createDevicesSQL := `CREATE TABLE IF NOT EXISTS devices (
+		"ip" TEXT NOT NULL PRIMARY KEY,
+		"name" TEXT
+	);`
+	if _, err = db.Exec(createDevicesSQL); err != nil {
+		return nil, err
+	}
+
+	// `traffic_samples` 表保存 Clash `/traffic` 推送的实时带宽采样（见 trafficstream.go），仅在开启 ENABLE_TRAFFIC_STREAM 时写入。
+	// up、down 为该时间段内的平均速率（字节/秒），resolution 为一行代表的秒数，samples 为聚合的原始采样数。
+	createTrafficSamplesSQL := `CREATE TABLE IF NOT EXISTS traffic_samples (
+		"timestamp" INTEGER NOT NULL,
+		"up" INTEGER NOT NULL,
+		"down" INTEGER NOT NULL,
+		"resolution" INTEGER NOT NULL DEFAULT 1,
+		"samples" INTEGER NOT NULL DEFAULT 1
+	);
+	CREATE INDEX IF NOT EXISTS idx_traffic_samples_timestamp ON traffic_samples (timestamp);`
+	if _, err = db.Exec(createTrafficSamplesSQL); err != nil {
+		return nil, err
+	}
+
+	// `clash_stats` 表每分钟保存一个 Clash 内存占用和全局计数器的采样（见 clashstats.go），只保留最近 30 天。
+	// restarted 为 1 表示这一分钟内检测到计数器重置，即 Clash 发生了重启。
+	createClashStatsSQL := `CREATE TABLE IF NOT EXISTS clash_stats (
+		"timestamp" INTEGER NOT NULL PRIMARY KEY,
+		"memory" INTEGER NOT NULL DEFAULT 0,
+		"uploadTotal" INTEGER NOT NULL DEFAULT 0,
+		"downloadTotal" INTEGER NOT NULL DEFAULT 0,
+		"restarted" INTEGER NOT NULL DEFAULT 0
+	);`
+	if _, err = db.Exec(createClashStatsSQL); err != nil {
+		return nil, err
+	}
+
+	// 创建 alert_rules 表，保存流量告警规则（见 alertrules.go）。
+	// last_fired_period 记录最近一次告警的周期，同一条规则在同一个周期内只告警一次。
+	createAlertRulesSQL := `CREATE TABLE IF NOT EXISTS alert_rules (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"name" TEXT NOT NULL DEFAULT '',
+		"scope" TEXT NOT NULL,
+		"target" TEXT NOT NULL DEFAULT '',
+		"threshold" INTEGER NOT NULL,
+		"period" TEXT NOT NULL,
+		"webhook_url" TEXT NOT NULL,
+		"payload_template" TEXT NOT NULL DEFAULT '',
+		"enabled" INTEGER NOT NULL DEFAULT 1,
+		"last_fired_period" TEXT NOT NULL DEFAULT '',
+		"last_fired_at" INTEGER NOT NULL DEFAULT 0
+	);`
+	if _, err = db.Exec(createAlertRulesSQL); err != nil {
+		return nil, err
+	}
+
 	// 返回初始化成功的数据库连接。
 	return db, nil
 }
 
+// UpsertStats 是一次 BulkUpsertConnections 的结果。
+type UpsertStats struct {
+	Inserted         int           // 新插入的记录数。
+	Updated          int           // 已存在而被更新的记录数。
+	SkippedEmptyHost int           // host 为空而被跳过的连接数。
+	Duration         time.Duration // 整个事务（含提交）的耗时。
+}
+
+// Written 返回实际写入（插入或更新）的记录数。
+func (s UpsertStats) Written() int {
+	return s.Inserted + s.Updated
+}
+
 // BulkUpsertConnections 函数使用单个事务来批量更新或插入（Upsert）连接信息。
 // "Upsert" 是一种数据库操作，如果记录已存在，则更新它；如果不存在，则插入新记录。
 // 这种方法比逐条检查和插入/更新要高效得多，尤其是在处理大量数据时。
@@ -63,12 +203,15 @@ func InitDB(filepath string) (*sql.DB, error) {
 //
 // 返回值:
 //
+//	stats: 插入、更新和因 host 为空而跳过的记录数，以及事务的耗时。事务失败时插入和更新的记录数为 0。
 //	error: 如果在事务处理过程中发生任何错误，则返回一个错误。
-func BulkUpsertConnections(db *sql.DB, connections []Connection) (err error) {
+func BulkUpsertConnections(ctx context.Context, db *sql.DB, connections []Connection) (stats UpsertStats, err error) {
+	started := time.Now()
 	// 开始一个新的数据库事务。事务可以确保一系列操作要么全部成功，要么全部失败，从而保证数据的一致性。
-	tx, err := db.Begin()
+	// ctx 被取消时，事务会被自动回滚，已写入的部分不会生效。
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("开启事务失败: %w", err)
+		return stats, fmt.Errorf("开启事务失败: %w", err)
 	}
 	// 使用 defer-recover 机制来确保事务在函数退出时能被正确处理（提交或回滚）。
 	// 这是一个健壮的错误处理模式。
@@ -81,48 +224,277 @@ func BulkUpsertConnections(db *sql.DB, connections []Connection) (err error) {
 		} else {
 			err = tx.Commit() // 否则，提交事务
 		}
+		if err != nil {
+			// 事务失败时所有写入都未生效。
+			stats.Inserted, stats.Updated = 0, 0
+		}
+		stats.Duration = time.Since(started)
 	}()
 
 	// 定义 SQL Upsert 语句。
 	// `ON CONFLICT(id) DO UPDATE SET ...` 是 SQLite 中实现 Upsert 的语法。
 	// 当插入的记录 `id` 与表中现有记录冲突时，它会执行 `UPDATE` 部分。
+	// Clash 有时在连接建立几秒后才嗅探到域名或确定最终的代理链、匹配的规则，
+	// 因此除流量外，host、代理链和规则在新值非空时也会被更新。host 的更新规则见 upsertHostExpr，
+	// hostUnknown 与 host 一起更新（SET 中引用的列都是更新前的值）。
 	query := `
-	INSERT INTO connections (id, sourceIP, host, upload, download, start, chain)
-	VALUES (?, ?, ?, ?, ?, ?, ?)
+	INSERT INTO connections (` + connectionColumns + `)
+	VALUES (` + connectionPlaceholders + `)
 	ON CONFLICT(id) DO UPDATE SET
 		upload = excluded.upload,
-		download = excluded.download;
+		download = excluded.download,
+		host = ` + upsertHostExpr + `,
+		hostUnknown = CASE WHEN (` + upsertHostExpr + `) = excluded.host THEN excluded.hostUnknown ELSE hostUnknown END,
+		chain = CASE WHEN excluded.chain <> '' THEN excluded.chain ELSE chain END,
+		chains = COALESCE(excluded.chains, chains),
+		chainFull = CASE WHEN excluded.chainFull <> '' THEN excluded.chainFull ELSE chainFull END,
+		rule = CASE WHEN excluded.rule <> '' THEN excluded.rule ELSE rule END,
+		rulePayload = CASE WHEN excluded.rule <> '' THEN excluded.rulePayload ELSE rulePayload END,
+		endTime = COALESCE(excluded.endTime, endTime),
+		duration = COALESCE(excluded.duration, duration),
+		destinationPort = COALESCE(excluded.destinationPort, destinationPort);
 	`
 	// 预编译 SQL 语句以提高性能。
-	stmt, err := tx.Prepare(query)
+	stmt, err := tx.PrepareContext(ctx, query)
 	if err != nil {
-		return fmt.Errorf("准备 SQL 语句失败: %w", err)
+		return stats, fmt.Errorf("准备 SQL 语句失败: %w", err)
 	}
 	defer stmt.Close()
+	// Upsert 无论插入还是更新，RowsAffected 都是 1，无法区分两者。因此写入前先按主键查询一次记录是否已存在，
+	// 主键查询的开销很小，在同一个事务中执行，结果与随后的 Upsert 一致。
+	existsStmt, err := tx.PrepareContext(ctx, "SELECT EXISTS (SELECT 1 FROM connections WHERE id = ?)")
+	if err != nil {
+		return stats, fmt.Errorf("准备 SQL 语句失败: %w", err)
+	}
+	defer existsStmt.Close()
 
 	// 遍历所有待处理的连接。
 	for _, conn := range connections {
 		// 如果连接的 host 字段为空，则跳过该记录，不写入数据库。
 		// 这是一个数据清洗步骤，确保数据库中存储的是有效数据。
 		if conn.Metadata.Host == "" {
+			stats.SkippedEmptyHost++
 			continue
 		}
-		var chain string
-		if len(conn.Chains) > 0 {
-			// 我们只关心最终的出口节点，所以取链中的最后一个元素。
-			chain = conn.Chains[len(conn.Chains)-1]
+		var exists bool
+		if err = existsStmt.QueryRowContext(ctx, conn.ID).Scan(&exists); err != nil {
+			return stats, fmt.Errorf("在事务中查询记录失败 (ID: %s): %w", conn.ID, err)
 		}
 		// 执行预编译的语句，传入连接的具体数据。
-		_, err = stmt.Exec(conn.ID, conn.Metadata.SourceIP, conn.Metadata.Host, conn.Upload, conn.Download, conn.Start.Unix(), chain)
+		_, err = stmt.ExecContext(ctx, connectionArgs(conn)...)
 		if err != nil {
 			// 如果执行失败，返回一个包含具体连接 ID 的错误信息，便于调试。
-			return fmt.Errorf("在事务中执行语句失败 (ID: %s): %w", conn.ID, err)
+			return stats, fmt.Errorf("在事务中执行语句失败 (ID: %s): %w", conn.ID, err)
+		}
+		if exists {
+			stats.Updated++
+		} else {
+			stats.Inserted++
+		}
+	}
+
+	return stats, nil
+}
+
+// upsertHostExpr 是 Upsert 时 host 列的新值：新的 host 为空时保留原值；
+// 新的 host 是占位值（hostUnknown 为 1，即采集时填充的目标 IP、`unknown` 或 EMPTY_HOST_LITERAL）而原值不为空时也保留原值；
+// 新的 host 是 IP 字面量（例如 EMPTY_HOST_POLICY=useDestIP 写入的目标 IP）而原值是真正的主机名时也保留原值，
+// 其他情况使用新值，这样后来嗅探到的域名会替换最初记录的 IP、占位值或空值，而不会被反过来替换回去。
+// SQLite 没有判断 IP 的函数，这里把只由数字和 `.` 组成的值视为 IPv4，把包含 `:` 的值视为 IPv6
+// （采集时 host 已去掉端口，见 normalizeHost）。
+const upsertHostExpr = `CASE
+			WHEN excluded.host = '' THEN host
+			WHEN excluded.hostUnknown = 1 AND host <> '' THEN host
+			WHEN (excluded.host NOT GLOB '*[^0-9.]*' OR instr(excluded.host, ':') > 0)
+				AND host <> '' AND host GLOB '*[^0-9.]*' AND instr(host, ':') = 0 THEN host
+			ELSE excluded.host
+		END`
+
+// connectionColumns 是 `connections` 和 `connections_archive` 两张表共有的业务列，按固定顺序排列。
+// 所有整行读写连接记录的地方（批量写入、合并、归档、恢复）都通过它以及
+// connectionPlaceholders、scanConnection 和 connectionArgs 保持列顺序一致，新增列时只需修改这几处。
+const connectionColumns = "id, sourceIP, host, upload, download, start, chain, country, network, type, connections, chains, chainFull, rule, rulePayload, endTime, duration, hostUnknown, destinationPort"
+
+// connectionPlaceholders 是与 connectionColumns 一一对应的 SQL 占位符列表。
+var connectionPlaceholders = strings.TrimSuffix(strings.Repeat("?, ", strings.Count(connectionColumns, ",")+1), ", ")
+
+// rowScanner 抽象了 *sql.Row 和 *sql.Rows 共有的 Scan 方法。
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanConnection 按 connectionColumns 的顺序扫描一行数据并还原为 Connection。
+// extra 用于接收查询中排在 connectionColumns 之后的额外列（例如 rowid 或设备名称）。
+func scanConnection(row rowScanner, extra ...interface{}) (Connection, error) {
+	var conn Connection
+	var start int64
+	// chainFull 由 chains 推导而来，读取时只用 chains 还原代理链。
+	var chain, country, network, connType, fullChain, chainFull, rule, rulePayload sql.NullString
+	var end, duration, port sql.NullInt64
+	dest := []interface{}{&conn.ID, &conn.Metadata.SourceIP, &conn.Metadata.Host, &conn.Upload, &conn.Download, &start, &chain, &country, &network, &connType, &conn.Connections, &fullChain, &chainFull, &rule, &rulePayload, &end, &duration, &conn.HostUnknown, &port}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return conn, err
+	}
+	conn.Start = time.Unix(start, 0)
+	conn.Chains = decodeChains(fullChain, chain)
+	conn.Country = country.String
+	conn.Metadata.Network = network.String
+	conn.Metadata.Type = connType.String
+	conn.Rule = rule.String
+	conn.RulePayload = rulePayload.String
+	conn.End = end.Int64
+	conn.Duration = duration.Int64
+	if port.Valid {
+		conn.Metadata.DestinationPort = strconv.FormatInt(port.Int64, 10)
+	}
+	return conn, nil
+}
+
+// decodeChains 还原一条记录的代理链。
+// 优先使用 chains 列中的完整代理链；旧记录没有该列的值（或无法解析）时，退回只包含 chain 列（策略组）的链。
+func decodeChains(fullChain, chain sql.NullString) []string {
+	if fullChain.Valid {
+		var chains []string
+		if err := json.Unmarshal([]byte(fullChain.String), &chains); err == nil && len(chains) > 0 {
+			return chains
+		}
+	}
+	if chain.Valid {
+		return []string{chain.String}
+	}
+	return []string{}
+}
+
+// connectionArgs 按 connectionColumns 的顺序返回写入一条连接记录所需的参数。
+func connectionArgs(conn Connection) []interface{} {
+	var chain, chainFull string
+	// 完整的代理链以 JSON 数组保存，链为空时写入 NULL。
+	var fullChain interface{}
+	if len(conn.Chains) > 0 {
+		// Clash 返回的代理链从实际使用的节点开始，最后一个元素是规则选中的策略组。
+		// chain 列只保存这个策略组，与最初的版本保持一致。
+		chain = conn.Chains[len(conn.Chains)-1]
+		chainFull = joinChains(conn.Chains)
+		if data, err := json.Marshal(conn.Chains); err == nil {
+			fullChain = string(data)
 		}
 	}
+	// 刚从 Clash API 采集到的连接没有这个值，代表的就是它自己这一条连接。
+	count := conn.Connections
+	if count <= 0 {
+		count = 1
+	}
+	// 尚未观察到关闭的连接写入 NULL，Upsert 时不会覆盖已记录的关闭时间。
+	var end, duration interface{}
+	if conn.End > 0 {
+		end, duration = conn.End, conn.Duration
+	}
+	// Clash 以字符串返回端口，无法解析或为 0 时写入 NULL。
+	var port interface{}
+	if p := parsePort(conn.Metadata.DestinationPort); p > 0 {
+		port = p
+	}
+	return []interface{}{conn.ID, conn.Metadata.SourceIP, conn.Metadata.Host, conn.Upload, conn.Download, conn.Start.Unix(), chain, conn.Country, conn.Metadata.Network, conn.Metadata.Type, count, fullChain, chainFull, conn.Rule, conn.RulePayload, end, duration, conn.HostUnknown, port}
+}
+
+// chainSeparator 是 chainFull 列中连接代理链各节点的分隔符。
+const chainSeparator = " → "
+
+// joinChains 把代理链连接为 chainFull 列的格式。Clash 的代理链从节点排到策略组，
+// 这里按流量经过的顺序反过来连接，例如 `["HK-01", "Auto"]` → `Auto → HK-01`。
+func joinChains(chains []string) string {
+	reversed := make([]string, len(chains))
+	for i, c := range chains {
+		reversed[len(chains)-1-i] = c
+	}
+	return strings.Join(reversed, chainSeparator)
+}
 
+// ensureChainFullColumn 为表添加 chainFull 列及其索引。列是新添加的时候，
+// 用已有记录的 chains 列（JSON 数组）按 joinChains 的顺序回填；没有 chains 的旧记录只知道策略组，回填为 chain 列的值。
+func ensureChainFullColumn(db *sql.DB, table string) error {
+	exists, err := hasColumn(db, table, "chainFull")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := ensureColumn(db, table, "chainFull", "TEXT"); err != nil {
+			return err
+		}
+		backfill := fmt.Sprintf(`UPDATE %s SET chainFull = COALESCE(
+			(SELECT group_concat(value, ?) FROM (SELECT value FROM json_each(%s.chains) ORDER BY key DESC)),
+			chain
+		) WHERE chains IS NOT NULL OR chain IS NOT NULL`, table, table)
+		if _, err := db.Exec(backfill, chainSeparator); err != nil {
+			return fmt.Errorf("回填表 %s 的 chainFull 列失败: %w", table, err)
+		}
+	}
+	_, err = db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_chainFull ON %s (chainFull)", table, table))
+	return err
+}
+
+// ensureColumn 检查表中是否存在指定的列，不存在则通过 `ALTER TABLE ... ADD COLUMN` 添加。
+// SQLite 不支持 `ADD COLUMN IF NOT EXISTS`，因此先用 `PRAGMA table_info` 查询现有的列。
+// 这是一个轻量级的数据库迁移手段，用于让旧版本创建的数据库文件自动升级。
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	exists, err := hasColumn(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN \"%s\" %s", table, column, definition)); err != nil {
+		return fmt.Errorf("为表 %s 添加列 %s 失败: %w", table, column, err)
+	}
 	return nil
 }
 
+// hasColumn 通过 `PRAGMA table_info` 检查表中是否存在指定的列。
+func hasColumn(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, fmt.Errorf("查询表 %s 结构失败: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, fmt.Errorf("扫描表 %s 结构失败: %w", table, err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// sqlExecer 抽象了 *sql.DB 和 *sql.Tx 共有的 Exec 方法，
+// 使辅助函数既可以直接执行，也可以在事务中执行。
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// getMetadata 从 `metadata` 表中读取指定 key 的值。
+// 第二个返回值表示该 key 是否存在。
+func getMetadata(db *sql.DB, key string) (string, bool, error) {
+	var value sql.NullString
+	err := db.QueryRow("SELECT value FROM metadata WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value.String, true, nil
+}
+
+// setMetadata 向 `metadata` 表写入（或覆盖）指定 key 的值。
+func setMetadata(db sqlExecer, key, value string) error {
+	_, err := db.Exec("INSERT INTO metadata (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value", key, value)
+	return err
+}
+
 // InitArchiveDB 函数负责初始化归档数据库。
 // 其功能与 InitDB 类似，但创建的是 `connections_archive` 表，用于存储已合并的旧数据。
 // 参数:
@@ -135,7 +507,7 @@ func BulkUpsertConnections(db *sql.DB, connections []Connection) (err error) {
 //	error: 如果在打开数据库或创建表时发生错误，则返回一个错误。
 func InitArchiveDB(filepath string) (*sql.DB, error) {
 	dsn := fmt.Sprintf("file:%s?_journal_mode=DELETE", filepath)
-	db, err := sql.Open("sqlite3", dsn)
+	db, err := sql.Open(sqliteDriverName, dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -158,5 +530,43 @@ func InitArchiveDB(filepath string) (*sql.DB, error) {
 		return nil, err
 	}
 
+	// 与主数据库保持一致，为旧版本创建的归档数据库补齐新增的列。
+	if err = ensureColumn(db, "connections_archive", "country", "TEXT"); err != nil {
+		return nil, err
+	}
+	if err = ensureColumn(db, "connections_archive", "network", "TEXT"); err != nil {
+		return nil, err
+	}
+	if err = ensureColumn(db, "connections_archive", "type", "TEXT"); err != nil {
+		return nil, err
+	}
+	if err = ensureColumn(db, "connections_archive", "connections", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return nil, err
+	}
+	if err = ensureColumn(db, "connections_archive", "chains", "TEXT"); err != nil {
+		return nil, err
+	}
+	if err = ensureChainFullColumn(db, "connections_archive"); err != nil {
+		return nil, err
+	}
+	if err = ensureColumn(db, "connections_archive", "rule", "TEXT"); err != nil {
+		return nil, err
+	}
+	if err = ensureColumn(db, "connections_archive", "rulePayload", "TEXT"); err != nil {
+		return nil, err
+	}
+	if err = ensureColumn(db, "connections_archive", "endTime", "INTEGER"); err != nil {
+		return nil, err
+	}
+	if err = ensureColumn(db, "connections_archive", "duration", "INTEGER"); err != nil {
+		return nil, err
+	}
+	if err = ensureColumn(db, "connections_archive", "hostUnknown", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err = ensureColumn(db, "connections_archive", "destinationPort", "INTEGER"); err != nil {
+		return nil, err
+	}
+
 	return db, nil
 }
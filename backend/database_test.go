@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDB 创建一个只存在于内存中的主数据库，每个测试独立，测试结束时关闭。
+// InitDB 会在路径之后追加 `?_journal_mode=DELETE`，这里把它放进最后一个（SQLite 会忽略的）参数的值中，
+// 以便使用共享缓存的内存数据库，让连接池中的所有连接看到同一个数据库。
+func newTestDB(t testing.TB) *sql.DB {
+	t.Helper()
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	db, err := InitDB(name + "?mode=memory&cache=shared&_test=")
+	if err != nil {
+		t.Fatalf("InitDB() error = %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// seedConnections 通过 BulkUpsertConnections 写入测试用的连接记录，与写库 Goroutine 的写入路径相同。
+func seedConnections(t testing.TB, db *sql.DB, conns ...Connection) {
+	t.Helper()
+	if _, err := BulkUpsertConnections(context.Background(), db, conns); err != nil {
+		t.Fatalf("BulkUpsertConnections() error = %v", err)
+	}
+}
+
+// connectionIDs 返回表中所有连接的 ID，按 ID 排序，用逗号连接便于比较。
+func connectionIDs(t testing.TB, db *sql.DB) string {
+	t.Helper()
+	rows, err := db.Query("SELECT id FROM connections ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(ids, ",")
+}
+
+// TestUpsertHostExpr 直接检查 upsertHostExpr 在各种新旧 host 组合下的结果，包括批量写入时会被跳过的空 host。
+// unknown 表示新写入的 host 是采集时填充的占位值（hostUnknown 为 1）。
+func TestUpsertHostExpr(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := db.Exec("CREATE TABLE upsert_host (id TEXT PRIMARY KEY, host TEXT, hostUnknown INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	upsert := "INSERT INTO upsert_host (id, host, hostUnknown) VALUES (?, ?, ?) ON CONFLICT(id) DO UPDATE SET host = " + upsertHostExpr
+
+	tests := []struct {
+		old, new, want string
+		unknown        bool
+	}{
+		{"", "example.com", "example.com", false},
+		{"", "1.2.3.4", "1.2.3.4", false},
+		{"1.2.3.4", "example.com", "example.com", false},
+		{"2001:db8::1", "example.com", "example.com", false},
+		{"example.com", "1.2.3.4", "example.com", false},
+		{"example.com", "2001:db8::1", "example.com", false},
+		{"example.com", "", "example.com", false},
+		{"1.2.3.4", "", "1.2.3.4", false},
+		{"example.com", "www.example.com", "www.example.com", false},
+		{"1.2.3.4", "5.6.7.8", "5.6.7.8", false},
+		{"1.2.3.4", "2001:db8::1", "2001:db8::1", false},
+		{"unknown", "example.com", "example.com", false},
+		{"10.example.com", "1.2.3.4", "10.example.com", false},
+		{"example.com", "unknown", "example.com", true},
+		{"example.com", "<direct>", "example.com", true},
+		{"example.com", "1.2.3.4", "example.com", true},
+		{"1.2.3.4", "unknown", "1.2.3.4", true},
+		{"", "<direct>", "<direct>", true},
+		{"unknown", "<direct>", "unknown", true},
+	}
+	for i, tt := range tests {
+		id := strconv.Itoa(i)
+		if _, err := db.Exec(upsert, id, tt.old, false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(upsert, id, tt.new, tt.unknown); err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if err := db.QueryRow("SELECT host FROM upsert_host WHERE id = ?", id).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("host %q then %q = %q, want %q", tt.old, tt.new, got, tt.want)
+		}
+	}
+}
+
+// TestBulkUpsertConnectionsHost 经由批量写入检查 host 与 hostUnknown 的更新：
+// 后来嗅探到的域名替换最初记录的 IP，而 IP 不会反过来替换已记录的域名。
+func TestBulkUpsertConnectionsHost(t *testing.T) {
+	type write struct {
+		host    string
+		unknown bool
+	}
+	tests := []struct {
+		name        string
+		writes      []write
+		wantHost    string
+		wantUnknown bool
+	}{
+		{"empty then sniffed domain", []write{{"", false}, {"example.com", false}}, "example.com", false},
+		{"ip then domain", []write{{"1.2.3.4", true}, {"example.com", false}}, "example.com", false},
+		{"domain then ip", []write{{"example.com", false}, {"1.2.3.4", true}}, "example.com", false},
+		{"domain then ipv6", []write{{"example.com", false}, {"2001:db8::1", true}}, "example.com", false},
+		{"domain then empty", []write{{"example.com", false}, {"", false}}, "example.com", false},
+		{"ip then ip", []write{{"1.2.3.4", true}, {"1.2.3.4", true}}, "1.2.3.4", true},
+		{"domain then unknown", []write{{"example.com", false}, {"unknown", true}}, "example.com", false},
+		{"domain then literal", []write{{"example.com", false}, {"<direct>", true}}, "example.com", false},
+		{"literal then domain", []write{{"<direct>", true}, {"example.com", false}}, "example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			for _, w := range tt.writes {
+				seedConnections(t, db, Connection{
+					ID:          "1",
+					Metadata:    Metadata{Host: w.host, SourceIP: "10.0.0.1"},
+					Start:       time.Unix(1700000000, 0),
+					HostUnknown: w.unknown,
+				})
+			}
+			var host string
+			var unknown bool
+			if err := db.QueryRow("SELECT host, hostUnknown FROM connections WHERE id = '1'").Scan(&host, &unknown); err != nil {
+				t.Fatal(err)
+			}
+			if host != tt.wantHost || unknown != tt.wantUnknown {
+				t.Errorf("host = %q, hostUnknown = %v, want %q, %v", host, unknown, tt.wantHost, tt.wantUnknown)
+			}
+		})
+	}
+}
+
+// TestChainFullOrder 检查 joinChains 和 chainFull 列的回填都按从策略组到节点的顺序连接代理链。
+func TestChainFullOrder(t *testing.T) {
+	if got, want := joinChains([]string{"HK-01", "Auto", "Proxy"}), "Proxy → Auto → HK-01"; got != want {
+		t.Errorf("joinChains() = %q, want %q", got, want)
+	}
+
+	db := newTestDB(t)
+	if _, err := db.Exec(`CREATE TABLE chain_backfill (chain TEXT, chains TEXT);
+		INSERT INTO chain_backfill VALUES ('Proxy', '["HK-01","Auto","Proxy"]'), ('DIRECT', NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureChainFullColumn(db, "chain_backfill"); err != nil {
+		t.Fatalf("ensureChainFullColumn() error = %v", err)
+	}
+	rows, err := db.Query("SELECT chainFull FROM chain_backfill ORDER BY rowid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var chainFull string
+		if err := rows.Scan(&chainFull); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, chainFull)
+	}
+	if want := "Proxy → Auto → HK-01,DIRECT"; strings.Join(got, ",") != want {
+		t.Errorf("backfilled chainFull = %q, want %q", strings.Join(got, ","), want)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 这个文件负责在数据库写入失败时尽量不丢数据。
+// 写库失败（磁盘已满、数据库被锁定等）时，连接会一直留在内存缓存中，等到下一次写入周期再试；
+// 但如果在此之前程序崩溃，这些数据就丢失了，而且连续失败时缓存会不断增长。因此：
+//   - 写入失败后按指数退避重试有限的次数，而不是干等一个完整的写入周期；
+//   - 缓存中的连接数达到阈值 (CACHE_FLUSH_THRESHOLD) 时立即尝试写入一次，短连接很多时也能避免单次写入过大；
+//   - 连接按 dbWriteChunkSize 分批写入，每批一个事务，一批失败不会回滚其他批次；
+//   - 配置了溢出文件 (CACHE_SPILL_FILE) 时，每次写入失败都把缓存内容保存到该文件，
+//     程序启动时重新加载，这样数据库不可用期间程序崩溃也不会丢失数据。
+// 连续失败的次数通过 `/api/health` 提供。
+
+const (
+	dbWriteMaxRetries     = 5               // 一次写入失败后最多重试的次数，之后等待下一次定时写入。
+	dbWriteRetryBaseDelay = 5 * time.Second // 第一次重试前的等待时间，之后每次翻倍。
+	dbWriteChunkSize      = 1000            // 每个写入事务包含的连接数。
+)
+
+// cacheEntries 是 connectionsCache 中的连接数。sync.Map 无法直接获取长度，因此由 cacheConnection 和 writeCacheToDB 维护。
+var cacheEntries atomic.Int64
+
+// cacheFull 在缓存中的连接数达到阈值时收到信号，通知写库 Goroutine 立即写入。缓冲为 1，多余的信号会被丢弃。
+var cacheFull = make(chan struct{}, 1)
+
+// cacheConnection 把连接存入内存缓存，返回存入后缓存中的连接数。
+// 同一个 ID 已在缓存中时，上传和下载流量分别取已缓存的值与新值中的较大者，而不是直接用新值覆盖：
+// Clash 的计数器在一个写入周期内偶尔变小（例如计数器被重置）时，已经观察到的流量不会因此丢失。
+// conn 必须是尚未存入缓存的新对象，缓存中的对象存入后不会再被修改。
+func cacheConnection(conn *Connection) int64 {
+	if value, ok := connectionsCache.Load(conn.ID); ok {
+		prev := value.(*Connection)
+		conn.Upload = max(conn.Upload, prev.Upload)
+		conn.Download = max(conn.Download, prev.Download)
+	}
+	if _, loaded := connectionsCache.Swap(conn.ID, conn); !loaded {
+		return cacheEntries.Add(1)
+	}
+	return cacheEntries.Load()
+}
+
+// notifyCacheFull 在缓存中的连接数达到阈值 threshold 时通知写库 Goroutine。threshold 为 0 时不检查。
+func notifyCacheFull(entries, threshold int64) {
+	if threshold <= 0 || entries < threshold {
+		return
+	}
+	select {
+	case cacheFull <- struct{}{}:
+	default:
+	}
+}
+
+// cacheLastSeen 记录缓存中的连接最后一次出现在 Clash 响应中的同步序号 (cacheSyncSeq)，由 clashSyncMu 保护。
+// 只在开启了闲置清理 (CACHE_IDLE_SYNCS) 时记录。
+var cacheLastSeen = map[string]uint64{}
+
+// cacheSyncSeq 是完整同步（响应没有被截断）的序号，由 clashSyncMu 保护。
+var cacheSyncSeq uint64
+
+// pruneIdleCacheEntries 在一次完整的同步之后调用，返回被清理的连接数。
+// 它记录 current 中被抽样保留的连接，然后从缓存中删除超过 idleSyncs 次同步没有出现在 Clash 响应中、而且 host 仍为空的连接。
+// host 为空的连接不会被写入数据库，Clash 已经忘记了它们，也不会再补充主机名，留在缓存中只会占用内存。
+// 有 host 的连接即使已经消失也要保留，它们的流量会在下一次写入时落库。idleSyncs 为 0 时不清理。调用方必须持有 clashSyncMu。
+func pruneIdleCacheEntries(current []Connection, sampleRate float64, idleSyncs int) int {
+	if idleSyncs <= 0 {
+		return 0
+	}
+	cacheSyncSeq++
+	for i := range current {
+		if sampleKeep(current[i].ID, sampleRate) {
+			cacheLastSeen[current[i].ID] = cacheSyncSeq
+		}
+	}
+
+	pruned := 0
+	for id, seen := range cacheLastSeen {
+		if cacheSyncSeq-seen < uint64(idleSyncs) {
+			continue
+		}
+		// 已经写入数据库并移出缓存的连接只需要删除记录。
+		delete(cacheLastSeen, id)
+		value, ok := connectionsCache.Load(id)
+		if !ok || value.(*Connection).Metadata.Host != "" {
+			continue
+		}
+		if connectionsCache.CompareAndDelete(id, value) {
+			cacheEntries.Add(-1)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// runDBWriter 定时把内存缓存写入数据库，直到 ctx 被取消。它会一直阻塞，应在 Goroutine 中调用。
+// 写入失败时按 dbWriteRetryBaseDelay 开始指数退避，最多重试 dbWriteMaxRetries 次；
+// 仍然失败时不再额外重试，只在定时写入时再试，直到成功后重新开始计数。
+func runDBWriter(ctx context.Context, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var retry <-chan time.Time // 等待中的重试，没有时为 nil。
+	failures := 0              // 自最近一次成功以来的失败次数。
+	for {
+		periodic := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			periodic = true
+		case <-retry:
+		case <-cacheFull:
+			// 正在退避或已放弃重试时，数据库多半仍不可用，不因缓存超过阈值而额外写入。
+			if retry != nil || failures > dbWriteMaxRetries {
+				continue
+			}
+			log.Printf("内存缓存中的连接数已达到阈值 (%d)，立即写入数据库。", cacheEntries.Load())
+		}
+		retry = nil
+
+		_, err := writeCacheToDB(ctx, db)
+		if ctx.Err() != nil {
+			return // 程序正在退出，缓存会在退出前最后写入一次。
+		}
+		switch {
+		case err == nil:
+			failures = 0
+		case failures < dbWriteMaxRetries:
+			failures++
+			delay := dbWriteRetryBaseDelay << (failures - 1)
+			log.Printf("将在 %v 后重试写入数据库（第 %d/%d 次重试）。", delay, failures, dbWriteMaxRetries)
+			retry = time.After(delay)
+		case failures == dbWriteMaxRetries:
+			failures++
+			log.Printf("重试 %d 次后仍无法写入数据库，将在下一次定时写入时再试。", dbWriteMaxRetries)
+		}
+
+		// 每个写入周期结束时检查本周期的流量。
+		if periodic && alerter != nil {
+			alerter.CheckInterval()
+		}
+		// 写入成功后，在后台检查告警规则（见 alertrules.go）。
+		if err == nil && ruleAlerter != nil {
+			ruleAlerter.Notify()
+		}
+	}
+}
+
+// DBWriteHealth 是数据库写入状态的快照。
+type DBWriteHealth struct {
+	LastSuccess         int64  `json:"lastSuccess,omitempty"` // 最近一次成功写入的时间（Unix 时间戳，秒）。
+	LastError           string `json:"lastError,omitempty"`   // 最近一次写入失败的错误信息。
+	LastErrorAt         int64  `json:"lastErrorAt,omitempty"` // 最近一次写入失败的时间（Unix 时间戳，秒）。
+	ConsecutiveFailures int    `json:"consecutiveFailures"`   // 自最近一次成功以来的连续失败次数。
+	CachedConnections   int64  `json:"cachedConnections"`     // 内存缓存中尚未写入数据库的连接数。
+}
+
+// dbWriteHealthTracker 记录每次把缓存写入数据库的结果。
+type dbWriteHealthTracker struct {
+	mu     sync.Mutex
+	health DBWriteHealth
+}
+
+// dbWriteHealth 是全局唯一的数据库写入状态记录。
+var dbWriteHealth = &dbWriteHealthTracker{}
+
+// Record 记录一次写入的结果。err 为 nil 表示成功。
+func (t *dbWriteHealthTracker) Record(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now().Unix()
+	if err == nil {
+		t.health.LastSuccess = now
+		t.health.ConsecutiveFailures = 0
+		return
+	}
+	t.health.LastError = err.Error()
+	t.health.LastErrorAt = now
+	t.health.ConsecutiveFailures++
+}
+
+// Snapshot 返回当前的写入状态。
+func (t *dbWriteHealthTracker) Snapshot() DBWriteHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	health := t.health
+	health.CachedConnections = cacheEntries.Load()
+	return health
+}
+
+// cacheSpillFile 是写库失败时保存缓存内容的 JSON 文件。
+type cacheSpillFile struct {
+	path string
+}
+
+// cacheSpill 是全局的缓存溢出文件。为 nil 时表示未开启。
+var cacheSpill *cacheSpillFile
+
+// Save 用 conns 覆盖溢出文件。先写入临时文件再重命名，避免崩溃时留下写了一半的文件。
+func (f *cacheSpillFile) Save(conns []Connection) error {
+	data, err := json.Marshal(conns)
+	if err != nil {
+		return fmt.Errorf("序列化连接失败: %w", err)
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("写入临时文件失败: %w", err)
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("重命名临时文件失败: %w", err)
+	}
+	return nil
+}
+
+// Load 把溢出文件中的连接重新存入内存缓存，返回加载的连接数。文件不存在时返回 0。
+// 文件会保留到下一次成功写入数据库之后再删除，加载后立即崩溃也不会丢失数据。
+func (f *cacheSpillFile) Load() (int, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var conns []Connection
+	if err := json.Unmarshal(data, &conns); err != nil {
+		return 0, fmt.Errorf("解析 JSON 失败: %w", err)
+	}
+	for i := range conns {
+		cacheConnection(&conns[i])
+	}
+	return len(conns), nil
+}
+
+// Remove 删除溢出文件。文件不存在时什么也不做。
+func (f *cacheSpillFile) Remove() error {
+	if err := os.Remove(f.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// resetConnectionsCache 清空全局的内存缓存，测试结束时再清空一次，避免影响其他测试。
+func resetConnectionsCache(t *testing.T) {
+	t.Helper()
+	clear := func() {
+		connectionsCache.Clear()
+		cacheEntries.Store(0)
+	}
+	clear()
+	t.Cleanup(clear)
+}
+
+// TestCacheAndWriteConcurrently 让采集和写库同时进行：写库期间存入缓存的更新流量必须保留到下一次写入，
+// 而不是随着这一批连接被一起删除。用 `go test -race` 运行时同时检查数据竞争。
+func TestCacheAndWriteConcurrently(t *testing.T) {
+	resetConnectionsCache(t)
+	// 使用数据库文件而不是内存数据库，另一个连接持有共享锁时写库的提交会等待，而不是立即失败。
+	db, err := InitDB(filepath.Join(t.TempDir(), "race.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const (
+		conns  = 20
+		writes = 20 // 第一阶段持续到写库完成这么多次。
+	)
+	start := time.Unix(1700000000, 0)
+	ctx := context.Background()
+
+	// 采集：每一轮每个连接的流量都比上一轮大，最后一轮的值就是最终的流量。
+	rounds := 0
+	collect := func() {
+		rounds++
+		for i := 0; i < conns; i++ {
+			cacheConnection(&Connection{
+				ID:       fmt.Sprintf("conn-%d", i),
+				Metadata: Metadata{Host: "example.com", SourceIP: "10.0.0.1"},
+				Upload:   uint64(rounds),
+				Download: uint64(2 * rounds),
+				Start:    start,
+				Chains:   []string{"DIRECT"},
+			})
+		}
+	}
+
+	// 第一阶段：写库 Goroutine 不停地写入，同时不停地采集。
+	done := make(chan struct{})
+	var completed atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := writeCacheToDB(ctx, db); err != nil {
+				t.Errorf("writeCacheToDB() error = %v", err)
+				return
+			}
+			completed.Add(1)
+		}
+	}()
+	for completed.Load() < writes {
+		collect()
+	}
+	close(done)
+	wg.Wait()
+
+	// 第二阶段：确定地让一轮采集落在写库的快照与删除之间。另一个连接在读事务中持有共享锁，
+	// 写库在取得快照之后阻塞在提交上（等待共享锁释放），这时存入更新的流量，再结束读事务让写库完成。
+	collect()
+	lock, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	if _, err := lock.ExecContext(ctx, "BEGIN"); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := lock.QueryRowContext(ctx, "SELECT COUNT(*) FROM connections").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := writeCacheToDB(ctx, db)
+		blocked <- err
+	}()
+	for dbWriteMu.TryLock() {
+		dbWriteMu.Unlock()
+		select {
+		case err := <-blocked:
+			t.Fatalf("writeCacheToDB() returned early: %v", err)
+		default:
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond) // 取得快照只需要几微秒，之后写库一直等待共享锁释放。
+	collect()
+	if _, err := lock.ExecContext(ctx, "ROLLBACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-blocked; err != nil {
+		t.Fatalf("writeCacheToDB() error = %v", err)
+	}
+
+	// 最后一次写入，与程序退出前相同。
+	if _, err := writeCacheToDB(ctx, db); err != nil {
+		t.Fatalf("writeCacheToDB() error = %v", err)
+	}
+	if n := cacheEntries.Load(); n != 0 {
+		t.Errorf("cacheEntries = %d after final write, want 0", n)
+	}
+
+	rows, err := db.Query("SELECT id, upload, download FROM connections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	seen := 0
+	for rows.Next() {
+		var id string
+		var upload, download uint64
+		if err := rows.Scan(&id, &upload, &download); err != nil {
+			t.Fatal(err)
+		}
+		seen++
+		if upload != uint64(rounds) || download != uint64(2*rounds) {
+			t.Errorf("%s: upload = %d, download = %d, want %d, %d (update lost)", id, upload, download, rounds, 2*rounds)
+		}
+	}
+	if seen != conns {
+		t.Errorf("wrote %d connections, want %d", seen, conns)
+	}
+}
+
+// TestCacheConnectionKeepsMaxAcrossCounterReset 模拟写入周期中途 Clash 计数器被重置：
+// 同一个 ID 之后上报了更小的流量，写入数据库的仍应是这个周期内观察到的最大值。
+func TestCacheConnectionKeepsMaxAcrossCounterReset(t *testing.T) {
+	resetConnectionsCache(t)
+	db := newTestDB(t)
+
+	conn := func(upload, download uint64) *Connection {
+		return &Connection{
+			ID:       "reset",
+			Metadata: Metadata{Host: "example.com", SourceIP: "10.0.0.1"},
+			Upload:   upload,
+			Download: download,
+			Start:    time.Unix(1700000000, 0),
+			Chains:   []string{"DIRECT"},
+		}
+	}
+	cacheConnection(conn(1000, 5000))
+	if n := cacheConnection(conn(10, 20)); n != 1 {
+		t.Errorf("cacheEntries = %d after caching the same id twice, want 1", n)
+	}
+
+	if _, err := writeCacheToDB(context.Background(), db); err != nil {
+		t.Fatalf("writeCacheToDB() error = %v", err)
+	}
+	var upload, download uint64
+	if err := db.QueryRow("SELECT upload, download FROM connections WHERE id = ?", "reset").Scan(&upload, &download); err != nil {
+		t.Fatal(err)
+	}
+	if upload != 1000 || download != 5000 {
+		t.Errorf("upload = %d, download = %d, want 1000, 5000", upload, download)
+	}
+}
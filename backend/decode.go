@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// 这个文件实现了对 Clash `/connections` 响应的宽松解析。
+// 路由器负载较高时，Clash 偶尔会返回被截断或格式错误的响应体。直接 Decode 整个结构体时，
+// 任何一处错误都会让整次同步被跳过。这里改为逐个解析 `connections` 数组中的元素：
+// 单个连接的字段类型不对时只跳过这一个连接；响应体被截断时保留已经解析出的连接。
+// 开始时间的格式不对时不跳过连接，而是改用同步时间（见 starttime.go）。
+// 一个连接都没有解析出来时返回 ClashDecodeError，其中带有响应体的开头部分，便于排查。
+
+// decodeSnippetSize 是解析失败时在日志中展示的响应体长度（字节）。
+const decodeSnippetSize = 256
+
+// ClashDecodeError 表示 Clash API 的响应无法解析。
+type ClashDecodeError struct {
+	Err     error
+	Snippet string // 响应体的开头部分。
+}
+
+func (e *ClashDecodeError) Error() string {
+	return fmt.Sprintf("解析 JSON 失败: %v（响应开头: %q）", e.Err, e.Snippet)
+}
+
+func (e *ClashDecodeError) Unwrap() error {
+	return e.Err
+}
+
+// prefixWriter 只保留写入内容的前 max 个字节，用于截取响应体的开头。
+type prefixWriter struct {
+	buf []byte
+	max int
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	if room := p.max - len(p.buf); room > 0 {
+		p.buf = append(p.buf, b[:min(room, len(b))]...)
+	}
+	return len(b), nil
+}
+
+// decodeConnections 宽松地解析 Clash `/connections` 的响应体。
+// 响应体被截断但已解析出部分连接时，返回这些连接并将 Partial 置为 true，同时记录一条警告。
+func decodeConnections(r io.Reader) (*Connections, error) {
+	snippet := &prefixWriter{max: decodeSnippetSize}
+	dec := json.NewDecoder(io.TeeReader(r, snippet))
+
+	var connections Connections
+	skipped, err := decodeConnectionsObject(dec, &connections)
+	if skipped > 0 {
+		log.Printf("警告: 跳过了 %d 个无法解析的连接。", skipped)
+	}
+	if err == nil {
+		return &connections, nil
+	}
+	if len(connections.Connections) > 0 {
+		connections.Partial = true
+		log.Printf("警告: Clash API 的响应不完整 (%v)，保留已解析的 %d 个连接。响应开头: %q", err, len(connections.Connections), snippet.buf)
+		return &connections, nil
+	}
+	return nil, &ClashDecodeError{Err: err, Snippet: string(snippet.buf)}
+}
+
+// decodeConnectionsObject 逐个字段解析顶层对象，返回被跳过的连接数。
+func decodeConnectionsObject(dec *json.Decoder, out *Connections) (skipped int, err error) {
+	if err := expectDelim(dec, '{'); err != nil {
+		return 0, err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return skipped, err
+		}
+		switch key, _ := tok.(string); key {
+		case "downloadTotal":
+			err = dec.Decode(&out.DownloadTotal)
+		case "uploadTotal":
+			err = dec.Decode(&out.UploadTotal)
+		case "memory":
+			err = dec.Decode(&out.Memory)
+		case "connections":
+			var n int
+			n, err = decodeConnectionArray(dec, &out.Connections)
+			skipped += n
+		default:
+			var ignored json.RawMessage
+			err = dec.Decode(&ignored)
+		}
+		if err != nil {
+			return skipped, err
+		}
+	}
+	_, err = dec.Token() // 读取结尾的 `}`。
+	return skipped, err
+}
+
+// decodeConnectionArray 逐个解析 `connections` 数组中的元素，跳过字段类型不匹配的元素，返回被跳过的数量。
+// 没有活跃连接时 Clash 可能返回 `null`。
+func decodeConnectionArray(dec *json.Decoder, out *[]Connection) (skipped int, err error) {
+	tok, err := dec.Token()
+	if err != nil || tok == nil {
+		return 0, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return 0, fmt.Errorf("connections 不是数组: %v", tok)
+	}
+	for dec.More() {
+		var conn Connection
+		if err := dec.Decode(&conn); err != nil {
+			// Decoder 先读出完整的元素再赋值，因此字段类型不匹配时这个元素已被读完，可以继续解析下一个；
+			// 语法错误、响应体被截断或读取失败（例如超时）时则无法继续，此时 More 仍返回 true，继续循环不会结束。
+			var typeErr *json.UnmarshalTypeError
+			if !errors.As(err, &typeErr) {
+				return skipped, err
+			}
+			skipped++
+			continue
+		}
+		*out = append(*out, conn)
+	}
+	_, err = dec.Token() // 读取结尾的 `]`。
+	return skipped, err
+}
+
+// expectDelim 读取下一个 token 并检查它是否为指定的分隔符。
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("期望 %q，实际为 %v", want, tok)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// syntheticConnectionsResponse 生成一个包含 n 个连接的 Clash `/connections` 响应体，字段与 Clash Meta 返回的一致。
+func syntheticConnectionsResponse(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"downloadTotal":123456789012,"uploadTotal":9876543210,"memory":52428800,"connections":[`)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `{"id":"%08x-1c2d-4e5f-8a9b-%012x","metadata":{"network":"tcp","type":"Tun","sourceIP":"192.168.1.%d",`+
+			`"destinationIP":"142.250.%d.%d","sourcePort":"%d","destinationPort":"443","inboundIP":"","inboundPort":"0",`+
+			`"inboundName":"DEFAULT-TUN","inboundUser":"","host":"r%d---sn-abc.googlevideo.com","dnsMode":"fake-ip","uid":0,`+
+			`"process":"","processPath":"","specialProxy":"","specialRules":"","remoteDestination":"142.250.%d.%d","dscp":0,"sniffHost":""},`+
+			`"upload":%d,"download":%d,"start":"2024-05-01T12:%02d:%02d.123456789+08:00","chains":["HK-01","Proxy"],`+
+			`"rule":"DomainSuffix","rulePayload":"googlevideo.com"}`,
+			i, i, i%254+1, i%256, i/256%256, 40000+i%20000, i%100, i%256, i/256%256, i*1024, i*8192, i/60%60, i%60)
+	}
+	buf.WriteString(`]}`)
+	return buf.Bytes()
+}
+
+// BenchmarkDecodeConnections 衡量解析一次大型 Clash 响应（数千个活跃连接）的耗时和内存分配。
+func BenchmarkDecodeConnections(b *testing.B) {
+	const n = 5000
+	body := syntheticConnectionsResponse(n)
+	conns, err := decodeConnections(bytes.NewReader(body))
+	if err != nil {
+		b.Fatalf("decodeConnections() error = %v", err)
+	}
+	if len(conns.Connections) != n || conns.Partial {
+		b.Fatalf("decodeConnections() = %d connections (partial = %v), want %d", len(conns.Connections), conns.Partial, n)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeConnections(bytes.NewReader(body)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// errAfterReader 先返回 data，之后每次读取都返回 err，模拟读取响应体时超时或连接被重置。
+type errAfterReader struct {
+	data []byte
+	err  error
+}
+
+func (r *errAfterReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestDecodeConnectionsSkipsMismatchedElements(t *testing.T) {
+	body := `{"connections":[{"id":"a","upload":1},{"id":"b","upload":"oops"},{"id":"c","upload":3}]}`
+	conns, err := decodeConnections(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("decodeConnections() error = %v", err)
+	}
+	if len(conns.Connections) != 2 || conns.Connections[0].ID != "a" || conns.Connections[1].ID != "c" || conns.Partial {
+		t.Errorf("decodeConnections() = %+v, want a and c", conns.Connections)
+	}
+}
+
+// TestDecodeConnectionsStopsOnReadError 检查读取响应体失败时解析立即结束，而不是把错误当作无法解析的元素跳过、一直重试。
+func TestDecodeConnectionsStopsOnReadError(t *testing.T) {
+	readErr := errors.New("read timeout")
+	tests := []struct {
+		name        string
+		data        string
+		wantPartial bool
+	}{
+		{"before any connection", `{"connections":[`, false},
+		{"after a connection", `{"connections":[{"id":"a","upload":1},`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan struct{})
+			var conns *Connections
+			var err error
+			go func() {
+				defer close(done)
+				conns, err = decodeConnections(&errAfterReader{data: []byte(tt.data), err: readErr})
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("decodeConnections() did not return after a read error")
+			}
+			if tt.wantPartial {
+				if err != nil || !conns.Partial || len(conns.Connections) != 1 {
+					t.Errorf("decodeConnections() = %+v, %v, want one connection with Partial set", conns, err)
+				}
+				return
+			}
+			if !errors.Is(err, readErr) {
+				t.Errorf("decodeConnections() error = %v, want %v", err, readErr)
+			}
+		})
+	}
+}
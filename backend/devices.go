@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// 这个文件包含了设备名称（`devices` 表）的增删改查 Handler。
+// 设备名称让用户可以把 `192.168.1.23` 这样的源 IP 标记为“客厅电视”等易读的名字。
+
+// getDevicesHandler 是处理 `/api/devices` GET 请求的 HTTP Handler。
+// 它返回所有已设置名称的设备，按 IP 排序。
+func getDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := timedQuery(r.Context(), db, "SELECT ip, name FROM devices ORDER BY ip")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var device Device
+		var name sql.NullString
+		if err := rows.Scan(&device.IP, &name); err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		device.Name = name.String
+		devices = append(devices, device)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices)
+}
+
+// saveDeviceHandler 处理 `/api/devices` POST 请求和 `/api/devices/{ip}` PUT 请求。
+// 它为源 IP 设置（或更新）设备名称。PUT 请求的 IP 取自 URL 路径，POST 请求的 IP 取自请求体。
+func saveDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	var device Device
+	if err := decodeJSONBody(w, r, &device); err != nil {
+		status, msg := requestBodyError(err)
+		writeJSONError(w, status, "", msg)
+		return
+	}
+	if ip, ok := mux.Vars(r)["ip"]; ok {
+		device.IP = ip
+	}
+	// 与采集到的 sourceIP 使用相同的规范形式，保证能与连接记录关联上。
+	device.IP = normalizeIP(device.IP)
+	device.Name = strings.TrimSpace(device.Name)
+	if device.IP == "" {
+		writeJSONError(w, http.StatusBadRequest, "ip", "ip 不能为空")
+		return
+	}
+	if device.Name == "" {
+		writeJSONError(w, http.StatusBadRequest, "name", "name 不能为空")
+		return
+	}
+
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	_, err := db.Exec("INSERT INTO devices (ip, name) VALUES (?, ?) ON CONFLICT(ip) DO UPDATE SET name = excluded.name", device.IP, device.Name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("保存设备失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(device)
+}
+
+// deleteDeviceHandler 是处理 `/api/devices/{ip}` DELETE 请求的 HTTP Handler。
+// 它删除源 IP 的设备名称映射，不影响任何连接记录。
+func deleteDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	ip := normalizeIP(mux.Vars(r)["ip"])
+
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM devices WHERE ip = ?", ip)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("删除设备失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeJSONError(w, http.StatusNotFound, "ip", "设备不存在")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "删除成功"})
+}
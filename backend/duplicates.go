@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 这个文件实现了重复连接记录的检测和清理 (`/api/maintenance/duplicates`)。
+// Clash 的连接 ID 并不稳定：同一个逻辑上的连接（例如长连接在 Clash 内部重建、或 Clash 重启后重新上报）
+// 可能以不同的 ID 出现多次，每个 ID 都会被保存为一条记录，按连接数统计时就被重复计算了。
+// 这里把主机、源 IP、代理链都相同，且开始时间落在同一个短时间窗口内的多条记录视为可能的重复。
+// 与按时间窗口合并 (`/api/connections/merge`) 不同，清理只针对这些重复的记录，合并后的记录只算作一个连接。
+
+// defaultDuplicateWindowSeconds 是判断重复时使用的时间窗口（秒）的默认值。
+const defaultDuplicateWindowSeconds = 60
+
+// maxDuplicateWindowSeconds 是时间窗口的上限（秒）。更大的窗口会把正常的重复访问也当作重复记录，应该改用按时间窗口合并。
+const maxDuplicateWindowSeconds = 3600
+
+// DuplicateGroup 是一组可能重复的连接记录。
+type DuplicateGroup struct {
+	Host     string `json:"host"`
+	SourceIP string `json:"sourceIP"`
+	Chain    string `json:"chain"`
+	Start    int64  `json:"start"`    // 时间窗口的开始时间 (Unix 时间戳, 秒)。
+	Rows     int64  `json:"rows"`     // 这一组的记录数，清理后合并为一条。
+	Upload   uint64 `json:"upload"`   // 这一组的上传流量之和，清理后保持不变。
+	Download uint64 `json:"download"` // 这一组的下载流量之和，清理后保持不变。
+}
+
+// duplicateFilter 是检测重复记录的参数。
+type duplicateFilter struct {
+	window             int64 // 时间窗口（秒）。
+	startDate, endDate int64 // 只检查开始时间在这个范围内的记录，0 表示不限制。
+}
+
+// parseDuplicateFilter 从查询参数中解析 window、startDate 和 endDate。参数无效时返回出错的字段名和错误描述。
+func parseDuplicateFilter(r *http.Request) (duplicateFilter, string, string) {
+	filter := duplicateFilter{window: defaultDuplicateWindowSeconds}
+	if value := r.URL.Query().Get("window"); value != "" {
+		window, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || window < 1 || window > maxDuplicateWindowSeconds {
+			return filter, "window", fmt.Sprintf("window 必须是 1 到 %d 之间的整数（秒）", maxDuplicateWindowSeconds)
+		}
+		filter.window = window
+	}
+	filter.startDate, _ = strconv.ParseInt(r.URL.Query().Get("startDate"), 10, 64)
+	filter.endDate, _ = strconv.ParseInt(r.URL.Query().Get("endDate"), 10, 64)
+	return filter, "", ""
+}
+
+// duplicateGroupsQuery 返回按 (host, sourceIP, chain, 时间窗口) 分组、只保留多于一条记录的分组的子查询及其参数，
+// 列为 h (host)、s (sourceIP)、ch (chain)、bucket（时间窗口的开始时间）、n（记录数）、up、down（流量之和）。
+// 列名与 connections 表不同，子查询与 connections 表 JOIN 时不会产生歧义。
+// 合并生成的记录 (merged_at 不为空) 本身就是多个连接的汇总，不参与检测。
+func duplicateGroupsQuery(filter duplicateFilter) (string, []interface{}) {
+	where := " WHERE merged_at IS NULL"
+	// 参数按占位符在语句中出现的顺序排列：SELECT 中的窗口、WHERE 中的时间范围、GROUP BY 中的窗口。
+	args := []interface{}{filter.window}
+	if filter.startDate > 0 {
+		where += " AND start >= ?"
+		args = append(args, filter.startDate)
+	}
+	if filter.endDate > 0 {
+		where += " AND start <= ?"
+		args = append(args, filter.endDate)
+	}
+	args = append(args, filter.window)
+	return `SELECT host AS h, sourceIP AS s, chain AS ch, start - start % ? AS bucket, COUNT(*) AS n, SUM(upload) AS up, SUM(download) AS down
+		FROM connections` + where + `
+		GROUP BY host, sourceIP, chain, start - start % ?
+		HAVING COUNT(*) > 1`, args
+}
+
+// findDuplicateGroups 返回记录数最多的 limit 组重复记录，以及重复的组数和清理后会减少的记录数。
+func findDuplicateGroups(ctx context.Context, db *sql.DB, filter duplicateFilter, limit int) (groups []DuplicateGroup, total, extraRows int64, err error) {
+	query, args := duplicateGroupsQuery(filter)
+	if err := timedQueryRow(ctx, db, "SELECT COUNT(*), COALESCE(SUM(n - 1), 0) FROM ("+query+")", args...).Scan(&total, &extraRows); err != nil {
+		return nil, 0, 0, err
+	}
+
+	rows, err := timedQuery(ctx, db, "SELECT h, COALESCE(s, ''), COALESCE(ch, ''), bucket, n, up, down FROM ("+query+") ORDER BY n DESC, bucket DESC LIMIT ?",
+		append(args, limit)...)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer rows.Close()
+
+	groups = []DuplicateGroup{}
+	for rows.Next() {
+		var g DuplicateGroup
+		if err := rows.Scan(&g.Host, &g.SourceIP, &g.Chain, &g.Start, &g.Rows, &g.Upload, &g.Download); err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		groups = append(groups, g)
+	}
+	return groups, total, extraRows, rows.Err()
+}
+
+// mergeDuplicateConnections 把每组重复记录合并为一条：流量和持续时间相加，开始时间取最早的一条，关闭时间取最晚的一条，
+// 连接数记为 1。原始记录与按时间窗口合并时一样写入归档数据库，可以通过 `/api/archive/restore` 恢复。
+func mergeDuplicateConnections(db, archiveDB *sql.DB, filter duplicateFilter) (result MergeResult, err error) {
+	query, args := duplicateGroupsQuery(filter)
+	args = append(args, filter.window)
+	// 时间窗口可能跨过 startDate 或 endDate，范围之外的记录不参与分组，也不应被合并。
+	where := " WHERE c.merged_at IS NULL"
+	if filter.startDate > 0 {
+		where += " AND c.start >= ?"
+		args = append(args, filter.startDate)
+	}
+	if filter.endDate > 0 {
+		where += " AND c.start <= ?"
+		args = append(args, filter.endDate)
+	}
+	// 用 IS 比较 sourceIP 和 chain，它们为 NULL 的记录同样可以匹配到所在的分组。
+	rows, err := db.Query(`SELECT `+connectionColumns+`, COALESCE(d.ch, ''), d.bucket FROM connections c
+		JOIN (`+query+`) d ON c.host = d.h AND c.sourceIP IS d.s AND c.chain IS d.ch AND c.start - c.start % ? = d.bucket`+where+`
+		ORDER BY c.start, c.id`,
+		args...)
+	if err != nil {
+		return result, fmt.Errorf("查询重复记录失败: %w", err)
+	}
+	defer rows.Close()
+
+	var originals []Connection
+	merged := map[string]Connection{}
+	for rows.Next() {
+		var chain string
+		var bucket int64
+		conn, err := scanConnection(rows, &chain, &bucket)
+		if err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		originals = append(originals, conn)
+
+		// 与 SQL 中的分组一致，按 chain 列（而不是完整的代理链）区分。记录按开始时间排序，每组的第一条就是最早的一条。
+		key := fmt.Sprintf("%s\x00%s\x00%s\x00%d", conn.Metadata.Host, conn.Metadata.SourceIP, chain, bucket)
+		if existing, ok := merged[key]; ok {
+			existing.Upload += conn.Upload
+			existing.Download += conn.Download
+			existing.Duration += conn.Duration
+			existing.End = max(existing.End, conn.End)
+			merged[key] = existing
+		} else {
+			conn.Connections = 1
+			merged[key] = conn
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("查询重复记录失败: %w", err)
+	}
+	rows.Close()
+
+	if len(originals) == 0 {
+		return result, nil
+	}
+	if err := replaceWithMergedConnections(db, archiveDB, originals, merged); err != nil {
+		return result, err
+	}
+	result.MergedRows = len(originals)
+	result.CreatedRows = len(merged)
+	return result, nil
+}
+
+// getDuplicatesHandler 是处理 `/api/maintenance/duplicates` GET 请求的 HTTP Handler。
+// 它报告可能重复的连接记录，不修改数据库；确认之后通过 POST 请求清理。
+func getDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+	filter, field, msg := parseDuplicateFilter(r)
+	if field != "" {
+		writeJSONError(w, http.StatusBadRequest, field, msg)
+		return
+	}
+	limit := parseLimit(w, r, 50)
+
+	groups, total, extraRows, err := findDuplicateGroups(r.Context(), db, filter, limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("查询重复记录失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"window":    filter.window,
+		"groups":    total,
+		"extraRows": extraRows,
+		"data":      groups,
+	})
+}
+
+// mergeDuplicatesHandler 是处理 `/api/maintenance/duplicates` POST 请求的 HTTP Handler。
+// 必须带有 `merge=true`，避免误发的请求直接修改数据；参数与 GET 请求相同（limit 除外，清理所有重复的组）。
+func mergeDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("merge") != "true" {
+		writeJSONError(w, http.StatusBadRequest, "merge", "清理重复记录需要 merge=true，只查看重复记录请使用 GET 请求")
+		return
+	}
+	filter, field, msg := parseDuplicateFilter(r)
+	if field != "" {
+		writeJSONError(w, http.StatusBadRequest, field, msg)
+		return
+	}
+
+	started := time.Now()
+	archiveDB := archiveDBFromContext(r)
+	result, err := mergeDuplicateConnections(db, archiveDB, filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("清理重复记录失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("重复记录清理完成：%d 条记录被合并为 %d 条，耗时 %v。", result.MergedRows, result.CreatedRows, time.Since(started).Round(time.Millisecond))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":     "重复记录清理成功",
+		"mergedRows":  result.MergedRows,
+		"createdRows": result.CreatedRows,
+		"archived":    archiveDB != nil,
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// seedDuplicateFixture 写入重复检测测试用的记录。开始时间相对于 1700000000，
+// window 为 60 时除 c 以外都落在同一个时间窗口 [1699999980, 1700000040) 内：
+//
+//	a, b     x.example.com  10.0.0.1  P  +0, +10     一组重复
+//	c        x.example.com  10.0.0.1  P  +100        不同的时间窗口
+//	d        x.example.com  10.0.0.2  P  +0          不同的源 IP
+//	e        x.example.com  10.0.0.1  Q  +5          不同的代理链
+//	f, g, h  y.example.com  10.0.0.1  -  +0, +1, +2  一组重复（没有代理链）
+//	i        y.example.com  10.0.0.1  -  +3          合并生成的记录，不参与检测
+func seedDuplicateFixture(t *testing.T) *sql.DB {
+	t.Helper()
+	db := newTestDB(t)
+	conn := func(id, host, sourceIP, chain string, offset int64, upload uint64) Connection {
+		c := Connection{ID: id, Metadata: Metadata{Host: host, SourceIP: sourceIP}, Upload: upload, Start: time.Unix(1700000000+offset, 0)}
+		if chain != "" {
+			c.Chains = []string{chain}
+		}
+		return c
+	}
+	seedConnections(t, db,
+		conn("a", "x.example.com", "10.0.0.1", "P", 0, 1),
+		conn("b", "x.example.com", "10.0.0.1", "P", 10, 2),
+		conn("c", "x.example.com", "10.0.0.1", "P", 100, 4),
+		conn("d", "x.example.com", "10.0.0.2", "P", 0, 8),
+		conn("e", "x.example.com", "10.0.0.1", "Q", 5, 16),
+		conn("f", "y.example.com", "10.0.0.1", "", 0, 32),
+		conn("g", "y.example.com", "10.0.0.1", "", 1, 64),
+		conn("h", "y.example.com", "10.0.0.1", "", 2, 128),
+		conn("i", "y.example.com", "10.0.0.1", "", 3, 256),
+	)
+	if _, err := db.Exec("UPDATE connections SET merged_at = 1 WHERE id = 'i'"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestFindDuplicateGroups(t *testing.T) {
+	db := seedDuplicateFixture(t)
+
+	tests := []struct {
+		name          string
+		filter        duplicateFilter
+		wantGroups    []DuplicateGroup
+		wantExtraRows int64
+	}{
+		{"default window", duplicateFilter{window: 60}, []DuplicateGroup{
+			{Host: "y.example.com", SourceIP: "10.0.0.1", Start: 1699999980, Rows: 3, Upload: 224},
+			{Host: "x.example.com", SourceIP: "10.0.0.1", Chain: "P", Start: 1699999980, Rows: 2, Upload: 3},
+		}, 3},
+		// a 和 b 相隔 10 秒，5 秒的窗口中不再是重复。
+		{"small window", duplicateFilter{window: 5}, []DuplicateGroup{
+			{Host: "y.example.com", SourceIP: "10.0.0.1", Start: 1700000000, Rows: 3, Upload: 224},
+		}, 2},
+		// 范围之外的 f 不参与分组。
+		{"date range", duplicateFilter{window: 60, startDate: 1700000001}, []DuplicateGroup{
+			{Host: "y.example.com", SourceIP: "10.0.0.1", Start: 1699999980, Rows: 2, Upload: 192},
+		}, 1},
+		{"end date", duplicateFilter{window: 60, endDate: 1700000001}, []DuplicateGroup{
+			{Host: "y.example.com", SourceIP: "10.0.0.1", Start: 1699999980, Rows: 2, Upload: 96},
+		}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups, total, extraRows, err := findDuplicateGroups(context.Background(), db, tt.filter, 10)
+			if err != nil {
+				t.Fatalf("findDuplicateGroups() error = %v", err)
+			}
+			if total != int64(len(tt.wantGroups)) || extraRows != tt.wantExtraRows {
+				t.Errorf("total = %d, extraRows = %d, want %d, %d", total, extraRows, len(tt.wantGroups), tt.wantExtraRows)
+			}
+			if len(groups) != len(tt.wantGroups) {
+				t.Fatalf("groups = %+v, want %+v", groups, tt.wantGroups)
+			}
+			for i := range groups {
+				if groups[i] != tt.wantGroups[i] {
+					t.Errorf("groups[%d] = %+v, want %+v", i, groups[i], tt.wantGroups[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMergeDuplicateConnections(t *testing.T) {
+	db := seedDuplicateFixture(t)
+
+	result, err := mergeDuplicateConnections(db, nil, duplicateFilter{window: 60})
+	if err != nil {
+		t.Fatalf("mergeDuplicateConnections() error = %v", err)
+	}
+	if result.MergedRows != 5 || result.CreatedRows != 2 {
+		t.Errorf("result = %+v, want 5 rows merged into 2", result)
+	}
+
+	// 合并后的记录开始时间取每组最早的一条，流量相加，只算作一个连接。
+	rows, err := db.Query("SELECT host, start, upload, connections FROM connections WHERE merged_at IS NOT NULL AND id <> 'i' ORDER BY host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	type mergedRow struct {
+		host                       string
+		start, upload, connections int64
+	}
+	var got []mergedRow
+	for rows.Next() {
+		var r mergedRow
+		if err := rows.Scan(&r.host, &r.start, &r.upload, &r.connections); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r)
+	}
+	want := []mergedRow{{"x.example.com", 1700000000, 3, 1}, {"y.example.com", 1700000000, 224, 1}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("merged rows = %+v, want %+v", got, want)
+	}
+
+	// 不重复的记录保持不变，再次检测时不再有重复。
+	var untouched int
+	if err := db.QueryRow("SELECT COUNT(*) FROM connections WHERE id IN ('c', 'd', 'e', 'i')").Scan(&untouched); err != nil {
+		t.Fatal(err)
+	}
+	if untouched != 4 {
+		t.Errorf("untouched rows = %d, want 4", untouched)
+	}
+	if _, total, _, err := findDuplicateGroups(context.Background(), db, duplicateFilter{window: 60}, 10); err != nil || total != 0 {
+		t.Errorf("findDuplicateGroups() after merge = %d groups, %v, want 0", total, err)
+	}
+}
+
+// TestMergeDuplicateConnectionsDateRange 检查时间窗口跨过 startDate 时，范围之外的记录不会被合并。
+func TestMergeDuplicateConnectionsDateRange(t *testing.T) {
+	db := seedDuplicateFixture(t)
+
+	result, err := mergeDuplicateConnections(db, nil, duplicateFilter{window: 60, startDate: 1700000001})
+	if err != nil {
+		t.Fatalf("mergeDuplicateConnections() error = %v", err)
+	}
+	if result.MergedRows != 2 || result.CreatedRows != 1 {
+		t.Errorf("result = %+v, want 2 rows merged into 1", result)
+	}
+	// g 和 h 被合并为一条新记录，f 保持不变。
+	var originals string
+	var merged int
+	if err := db.QueryRow("SELECT group_concat(id, ',') FROM (SELECT id FROM connections WHERE merged_at IS NULL ORDER BY id)").Scan(&originals); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM connections WHERE merged_at IS NOT NULL").Scan(&merged); err != nil {
+		t.Fatal(err)
+	}
+	if originals != "a,b,c,d,e,f" || merged != 2 {
+		t.Errorf("original ids = %q, merged rows = %d, want %q, 2", originals, merged, "a,b,c,d,e,f")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+)
+
+// 这个文件实现了把连接记录导出为 CSV 或 JSON，供 `infoclash export` 子命令和 `/api/archive?format=csv` 共用。
+// 导出逐行读取、逐行写出，不会把整张表读入内存。
+
+// 导出格式。
+const (
+	ExportFormatCSV  = "csv"
+	ExportFormatJSON = "json"
+)
+
+// connectionCSVHeader 是导出连接记录时 CSV 文件的表头，与 connectionCSVRecord 返回的列一一对应。
+var connectionCSVHeader = []string{"id", "host", "sourceIP", "upload", "download", "start", "chainFull", "country", "network", "destinationPort", "type", "connections", "rule", "rulePayload", "endTime", "duration"}
+
+// connectionCSVHumanizedHeader 是 humanize 时附加在末尾的列，为 upload 和 download 的易读格式（例如 `4.2 GiB`）。
+// 原始的字节数列保持不变，附加在末尾不会改变已有列的位置。
+var connectionCSVHumanizedHeader = []string{"uploadHuman", "downloadHuman"}
+
+// connectionCSVHeaderFor 返回 CSV 的表头，humanize 为 true 时包含易读格式的列。
+func connectionCSVHeaderFor(humanize bool) []string {
+	if !humanize {
+		return connectionCSVHeader
+	}
+	return append(append([]string(nil), connectionCSVHeader...), connectionCSVHumanizedHeader...)
+}
+
+// connectionCSVRecord 把一条连接记录转换为 CSV 的一行，列与 connectionCSVHeaderFor(humanize) 一致。start 和 endTime 为 Unix 时间戳（秒），
+// 结束时间未知时 endTime 和 duration 为空，目标端口未知时 destinationPort 为空。
+func connectionCSVRecord(conn Connection, humanize bool) []string {
+	var endTime, duration string
+	if conn.End > 0 {
+		endTime = strconv.FormatInt(conn.End, 10)
+		duration = strconv.FormatInt(conn.Duration, 10)
+	}
+	record := []string{
+		conn.ID,
+		conn.Metadata.Host,
+		conn.Metadata.SourceIP,
+		strconv.FormatUint(conn.Upload, 10),
+		strconv.FormatUint(conn.Download, 10),
+		strconv.FormatInt(conn.Start.Unix(), 10),
+		joinChains(conn.Chains),
+		conn.Country,
+		conn.Metadata.Network,
+		conn.Metadata.DestinationPort,
+		conn.Metadata.Type,
+		strconv.FormatInt(conn.Connections, 10),
+		conn.Rule,
+		conn.RulePayload,
+		endTime,
+		duration,
+	}
+	if humanize {
+		record = append(record, humanizeBytes(conn.Upload), humanizeBytes(conn.Download))
+	}
+	return record
+}
+
+// exportConnections 按 format 把 rows 中的连接记录写入 w，返回写入的记录数，并关闭 rows。
+// 查询的列必须为 connectionColumns。JSON 格式为 ConnectionRecord 数组，chains 为完整的代理链。
+// humanize 为 true 时 CSV 在末尾附加易读格式的流量列，对 JSON 格式没有影响。
+func exportConnections(w io.Writer, rows *sql.Rows, format string, humanize bool) (int, error) {
+	defer rows.Close()
+
+	var write func(Connection) error
+	var finish func() error
+	switch format {
+	case ExportFormatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(connectionCSVHeaderFor(humanize)); err != nil {
+			return 0, err
+		}
+		write = func(conn Connection) error { return writer.Write(connectionCSVRecord(conn, humanize)) }
+		finish = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	case ExportFormatJSON:
+		if _, err := io.WriteString(w, "["); err != nil {
+			return 0, err
+		}
+		first := true
+		write = func(conn Connection) error {
+			if !first {
+				if _, err := io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			first = false
+			data, err := json.Marshal(ConnectionRecord{ID: conn.ID, ConnectionInfo: newConnectionInfo(conn, "", true)})
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(data)
+			return err
+		}
+		finish = func() error {
+			_, err := io.WriteString(w, "]\n")
+			return err
+		}
+	default:
+		return 0, fmt.Errorf("不支持的导出格式: %s，可选值为 csv、json", format)
+	}
+
+	count := 0
+	for rows.Next() {
+		conn, err := scanConnection(rows)
+		if err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		if err := write(conn); err != nil {
+			return count, fmt.Errorf("写入导出数据失败: %w", err)
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, fmt.Errorf("查询数据失败: %w", err)
+	}
+	if err := finish(); err != nil {
+		return count, fmt.Errorf("写入导出数据失败: %w", err)
+	}
+	return count, nil
+}
@@ -9,6 +9,9 @@ package main
 
 import "github.com/gorilla/mux"
 
+// frontendBuild 标识前端的构建方式，由 `/api/version` 返回。
+const frontendBuild = "dev"
+
 // addFrontendRoutes 在开发模式下是一个空函数。
 // 这是因为在开发环境中，前端静态资源是由 Vite 开发服务器（例如 http://localhost:5173）提供的，
 // Go 后端只负责 API 接口。因此，我们不需要在 Go 的路由中添加任何处理前端文件的逻辑。
@@ -25,6 +25,9 @@ import (
 //go:embed dist
 var embeddedFrontend embed.FS
 
+// frontendBuild 标识前端的构建方式，由 `/api/version` 返回。
+const frontendBuild = "prod"
+
 // spaFileSystem 是一个自定义的文件系统处理器，专门为单页应用（SPA）设计。
 // 它包装了标准的 http.FileSystem。
 type spaFileSystem struct {
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// 这个文件实现了可选的 GeoIP 国家信息补充功能。
+// 配置了 GEOIP_DB_PATH（MaxMind GeoLite2-Country / GeoLite2-City 格式的 `.mmdb` 文件）后，
+// 采集器会为每个连接的目标 IP 查询所属国家，并写入 `country` 列，
+// 供 `/api/summary/countries` 按国家汇总流量。未配置时不做任何查询。
+// 数据库文件由用户提供，使用 MaxMind 官方维护的 maxminddb-golang 读取，格式错误的文件会返回错误而不是导致程序崩溃。
+
+// geoIPCacheSize 是国家查询缓存的最大条目数。
+// 采集器每秒都会轮询一次，同一个目标 IP 会被反复查询，因此按 IP 缓存查询结果；
+// 缓存写满后直接清空重建，保证内存占用有上限。
+const geoIPCacheSize = 10000
+
+// unknownCountry 是汇总时用于表示未知国家（未配置 GeoIP、查询不到或历史数据）的取值。
+const unknownCountry = "unknown"
+
+// geoIPResolver 查询 IP 地址所属的国家，并按 IP 缓存查询结果。
+type geoIPResolver struct {
+	reader *maxminddb.Reader
+	mu     sync.Mutex
+	cache  map[string]string
+}
+
+// countryResolver 是全局的国家查询器。为 nil 时表示未配置 GeoIP 数据库。
+var countryResolver *geoIPResolver
+
+// newGeoIPResolver 打开 GeoIP 数据库文件并创建查询器。
+func newGeoIPResolver(path string) (*geoIPResolver, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &geoIPResolver{reader: reader, cache: make(map[string]string)}, nil
+}
+
+// Country 返回 IP 地址所属国家的 ISO 3166-1 代码（如 `US`），查询不到时返回空字符串。
+// 查询不到的结果同样会被缓存，避免对私有地址等反复查询。
+func (g *geoIPResolver) Country(ip string) string {
+	if ip == "" {
+		return ""
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if country, ok := g.cache[ip]; ok {
+		return country
+	}
+
+	var country string
+	if parsed := net.ParseIP(ip); parsed != nil {
+		var record geoIPRecord
+		if err := g.reader.Lookup(parsed, &record); err != nil {
+			log.Printf("查询 IP %s 的 GeoIP 信息失败: %v", ip, err)
+		}
+		country = record.isoCountryCode()
+	}
+
+	if len(g.cache) >= geoIPCacheSize {
+		g.cache = make(map[string]string)
+	}
+	g.cache[ip] = country
+	return country
+}
+
+// geoIPRecord 是 GeoLite2-Country / GeoLite2-City 记录中用到的字段，其余字段在解码时跳过。
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// isoCountryCode 从 GeoIP 记录中取出国家代码。
+// 优先使用 `country.iso_code`，没有时退回到 IP 段注册地 `registered_country.iso_code`。
+func (r geoIPRecord) isoCountryCode() string {
+	if r.Country.ISOCode != "" {
+		return r.Country.ISOCode
+	}
+	return r.RegisteredCountry.ISOCode
+}
+
+// getCountrySummaryHandler 是处理 `/api/summary/countries` GET 请求的 HTTP Handler。
+// 它返回按目标国家分组的流量汇总，按总流量降序排列。没有国家信息的记录归入 `unknown`。
+func getCountrySummaryHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	// 解析查询参数：limit, startDate, endDate。limit 未提供时返回所有国家。
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	startDate, _ := strconv.ParseInt(r.URL.Query().Get("startDate"), 10, 64)
+	endDate, _ := strconv.ParseInt(r.URL.Query().Get("endDate"), 10, 64)
+
+	query := `
+		SELECT
+			COALESCE(NULLIF(country, ''), ?) as country,
+			SUM(upload) as upload,
+			SUM(download) as download,
+			SUM(upload) + SUM(download) as total,
+			SUM(connections) as connections
+		FROM connections
+		WHERE 1=1
+	`
+	args := []interface{}{unknownCountry}
+
+	if startDate > 0 {
+		query += " AND start >= ?"
+		args = append(args, startDate)
+	}
+	if endDate > 0 {
+		query += " AND start <= ?"
+		args = append(args, endDate)
+	}
+
+	query += " GROUP BY 1 ORDER BY total DESC"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := timedQuery(r.Context(), db, query, args...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type CountrySummary struct {
+		Country     string `json:"country"`
+		Upload      uint64 `json:"upload"`
+		Download    uint64 `json:"download"`
+		Total       uint64 `json:"total"`
+		Connections uint64 `json:"connections"`
+	}
+
+	scale := sampleScalerFor(w, r)
+	summaries := []CountrySummary{}
+	for rows.Next() {
+		var summary CountrySummary
+		err := rows.Scan(&summary.Country, &summary.Upload, &summary.Download, &summary.Total, &summary.Connections)
+		if err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		scale.Scale(&summary.Upload, &summary.Download, &summary.Total, &summary.Connections)
+		summaries = append(summaries, summary)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
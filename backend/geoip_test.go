@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mmdbString、mmdbUint16 等按 MaxMind DB 的数据段格式编码测试用的值，只支持长度小于 29 的字符串和 map。
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+func mmdbUint16(n uint16) []byte {
+	return []byte{5<<5 | 2, byte(n >> 8), byte(n)}
+}
+
+func mmdbUint32(n uint32) []byte {
+	return []byte{6<<5 | 4, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+}
+
+func mmdbMap(pairs ...[]byte) []byte {
+	out := []byte{7<<5 | byte(len(pairs)/2)}
+	for _, p := range pairs {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// writeTestMMDB 生成一个只有一个节点的 IPv4 数据库：0.0.0.0/1 的记录为 record，128.0.0.0/1 没有数据。
+func writeTestMMDB(t *testing.T, record []byte) string {
+	t.Helper()
+	const nodeCount = 1
+	var buf bytes.Buffer
+	// 24 位记录：左子树指向数据段偏移 0 (node_count + 16 + 0)，右子树等于 node_count 表示没有数据。
+	left := make([]byte, 4)
+	binary.BigEndian.PutUint32(left, nodeCount+16)
+	right := make([]byte, 4)
+	binary.BigEndian.PutUint32(right, nodeCount)
+	buf.Write(left[1:])
+	buf.Write(right[1:])
+	buf.Write(make([]byte, 16)) // 搜索树与数据段之间的分隔。
+	buf.Write(record)
+	buf.WriteString("\xab\xcd\xefMaxMind.com")
+	buf.Write(mmdbMap(
+		mmdbString("node_count"), mmdbUint32(nodeCount),
+		mmdbString("record_size"), mmdbUint16(24),
+		mmdbString("ip_version"), mmdbUint16(4),
+		mmdbString("binary_format_major_version"), mmdbUint16(2),
+		mmdbString("binary_format_minor_version"), mmdbUint16(0),
+		mmdbString("database_type"), mmdbString("Test-Country"),
+	))
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoIPResolverCountry(t *testing.T) {
+	tests := []struct {
+		name   string
+		record []byte
+		ip     string
+		want   string
+	}{
+		{"country", mmdbMap(mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString("US"))), "1.2.3.4", "US"},
+		{"registered country fallback", mmdbMap(mmdbString("registered_country"), mmdbMap(mmdbString("iso_code"), mmdbString("DE"))), "1.2.3.4", "DE"},
+		{"no data", mmdbMap(mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString("US"))), "200.1.1.1", ""},
+		{"invalid ip", mmdbMap(), "not-an-ip", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver, err := newGeoIPResolver(writeTestMMDB(t, tt.record))
+			if err != nil {
+				t.Fatalf("newGeoIPResolver() error = %v", err)
+			}
+			if got := resolver.Country(tt.ip); got != tt.want {
+				t.Errorf("Country(%q) = %q, want %q", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewGeoIPResolverRejectsMalformedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.mmdb")
+	// 元数据标记之后声明了一个巨大的 map，格式错误的文件应返回错误，而不是崩溃或耗尽内存。
+	if err := os.WriteFile(path, []byte("\xab\xcd\xefMaxMind.com\xff\xff\xff\xff"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newGeoIPResolver(path); err == nil {
+		t.Fatal("newGeoIPResolver() error = nil, want error for malformed file")
+	}
+}
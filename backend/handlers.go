@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -18,6 +24,10 @@ type MergeRequest struct {
 	StartDate int64 `json:"startDate"` // 合并范围的开始时间戳（秒）。
 	EndDate   int64 `json:"endDate"`   // 合并范围的结束时间戳（秒）。
 	Interval  int   `json:"interval"`  // 合并的时间窗口大小（分钟）。
+	DryRun    bool  `json:"dryRun"`    // 为 true 时只统计将被合并的记录数，不修改数据库。
+	Vacuum    *bool `json:"vacuum"`    // 合并后是否执行 VACUUM，未提供时默认为 true。
+	// Hosts 不为空时只合并这些主机（精确匹配）的记录，其他主机的记录保持原样；为空时合并范围内的所有记录。
+	Hosts []string `json:"hosts"`
 }
 
 // ReplaceHostRequest 定义了替换主机后缀请求的 JSON 结构。
@@ -25,13 +35,97 @@ type ReplaceHostRequest struct {
 	DomainSuffix string `json:"domainSuffix"` // 要替换成的域名后缀。
 }
 
+// maxMergeIntervalMinutes 是合并时间窗口允许的最大值（分钟），即 31 天。
+// 更大的窗口没有实际意义，还容易因误填单位而把大量数据合并成一条。
+const maxMergeIntervalMinutes = 31 * 24 * 60
+
+// maxMergeHosts 是合并请求中 hosts 的最大数量。每个主机占用一个 SQL 参数，需要远低于 SQLite 的参数数量上限。
+const maxMergeHosts = 1000
+
+// MergeResult 描述了一次合并操作的结果，用于让调用方知道合并是否真的处理了数据。
+type MergeResult struct {
+	MergedRows  int `json:"mergedRows"`  // 被合并（并归档）的原始记录数。
+	CreatedRows int `json:"createdRows"` // 合并后新生成的记录数。
+}
+
+// writeJSONError 以 JSON 格式返回错误信息。
+// field 用于指明是哪个请求参数出了问题，为空时不输出该字段。
+func writeJSONError(w http.ResponseWriter, status int, field, message string) {
+	body := map[string]string{"error": message}
+	if field != "" {
+		body["field"] = field
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// defaultMaxRequestBodyBytes 是请求体大小的默认上限（1 MiB），可以通过 MAX_REQUEST_BODY_BYTES 修改。
+// 现有接口的请求体都只有几百字节，这个上限足够宽松，同时能防止异常的客户端发送超大的请求体耗尽内存。
+const defaultMaxRequestBodyBytes = 1 << 20
+
+// decodeJSONBody 把请求体解析为 JSON 并存入 v，请求体的大小受配置的上限约束。
+// 出错时返回的错误可以交给 requestBodyError 转换为状态码和错误信息；请求体为空时返回 io.EOF。
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	limit := int64(defaultMaxRequestBodyBytes)
+	if cfg, ok := r.Context().Value("config").(*Config); ok && cfg.MaxRequestBodyBytes > 0 {
+		limit = cfg.MaxRequestBodyBytes
+	}
+	// MaxBytesReader 在读取超过上限时返回 *http.MaxBytesError，并让服务器在响应后关闭连接，不再读取剩余的数据。
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// requestBodyError 返回 decodeJSONBody 的错误对应的状态码和错误信息：
+// 请求体超过上限时为 413，其他情况为 400。
+func requestBodyError(err error) (int, string) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("请求体超过 %d 字节的上限", maxBytesErr.Limit)
+	}
+	return http.StatusBadRequest, "无效的请求体"
+}
+
+// validateMergeRequest 校验合并请求的参数。
+// 校验失败时返回出错的字段名和错误描述；校验通过时两者均为空。
+func validateMergeRequest(req MergeRequest, now time.Time) (string, string) {
+	if req.Interval < 1 || req.Interval > maxMergeIntervalMinutes {
+		return "interval", fmt.Sprintf("interval 必须在 1 到 %d 分钟之间", maxMergeIntervalMinutes)
+	}
+	// 缺少 startDate 时它的值为 0，会把 1970 年以来的所有记录都纳入合并范围，多半是调用方的失误。
+	if req.StartDate <= 0 {
+		return "startDate", "startDate 必须是正的 Unix 时间戳（秒）"
+	}
+	if req.StartDate >= req.EndDate {
+		return "startDate", "startDate 必须早于 endDate"
+	}
+	if req.EndDate > now.Unix() {
+		return "endDate", "endDate 不能晚于当前时间"
+	}
+	if len(req.Hosts) > maxMergeHosts {
+		return "hosts", fmt.Sprintf("hosts 最多包含 %d 个主机", maxMergeHosts)
+	}
+	for _, host := range req.Hosts {
+		// 空字符串会被当作「host 为空的记录」，多半是调用方拼接列表时的失误。
+		if strings.TrimSpace(host) == "" {
+			return "hosts", "hosts 中不能包含空的主机名"
+		}
+	}
+	return "", ""
+}
+
 // mergeConnectionsHandler 是处理 `/api/connections/merge` POST 请求的 HTTP Handler。
 // 它负责解析请求，调用核心的合并与归档逻辑，并返回操作结果。
 func mergeConnectionsHandler(w http.ResponseWriter, r *http.Request) {
-	// 1. 解析请求体中的 JSON 数据到 MergeRequest 结构体。
+	// 1. 解析请求体中的 JSON 数据到 MergeRequest 结构体，并校验参数。
 	var req MergeRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "无效的请求体", http.StatusBadRequest)
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		status, msg := requestBodyError(err)
+		writeJSONError(w, status, "", msg)
+		return
+	}
+	if field, msg := validateMergeRequest(req, time.Now()); field != "" {
+		writeJSONError(w, http.StatusBadRequest, field, msg)
 		return
 	}
 
@@ -42,128 +136,156 @@ func mergeConnectionsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
 		return
 	}
-	archiveDB, ok := r.Context().Value("archiveDB").(*sql.DB)
-	if !ok {
-		http.Error(w, "无法获取归档数据库连接", http.StatusInternalServerError)
-		return
-	}
+	// 关闭归档数据库时 archiveDB 为 nil，合并时直接删除原始记录而不归档。
+	archiveDB := archiveDBFromContext(r)
 
 	// 3. 调用核心业务逻辑函数来执行合并和归档操作。
-	err := mergeAndArchiveConnections(db, archiveDB, req.StartDate, req.EndDate, req.Interval)
+	result, err := mergeAndArchiveConnections(db, archiveDB, req.StartDate, req.EndDate, req.Interval, req.Hosts, req.DryRun)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("合并失败: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// 4. 合并成功后，对主数据库执行 VACUUM 操作。
-	// VACUUM 可以重建数据库文件，清除已删除数据占用的空间，减小数据库文件大小。
-	log.Println("数据合并成功，开始执行 VACUUM...")
-	if _, vacErr := db.Exec("VACUUM"); vacErr != nil {
-		// VACUUM 失败不应影响主操作的成功状态，仅记录日志。
-		log.Printf("执行 VACUUM 失败: %v", vacErr)
-	} else {
-		log.Println("VACUUM 执行成功。")
+	// 试运行时数据库未被修改，直接返回统计结果。
+	if req.DryRun {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":     "试运行完成，未修改数据",
+			"dryRun":      true,
+			"mergedRows":  result.MergedRows,
+			"createdRows": result.CreatedRows,
+		})
+		return
 	}
 
-	// 5. 返回成功的 JSON 响应。
+	// 4. 返回成功的 JSON 响应，附带合并的记录数，便于判断是否真的处理了数据。
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"message": "合并成功"})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":     "合并成功",
+		"mergedRows":  result.MergedRows,
+		"createdRows": result.CreatedRows,
+		"archived":    archiveDB != nil, // 关闭归档数据库时原始记录被直接删除，无法恢复。
+	})
+
+	// 5. 合并成功后，在后台对主数据库执行 VACUUM 操作。
+	// VACUUM 可以重建数据库文件，清除已删除数据占用的空间，减小数据库文件大小。
+	// 它会长时间锁住数据库，所以放在响应发送之后异步执行，且删除的行数太少时直接跳过。
+	if req.Vacuum == nil || *req.Vacuum {
+		if result.MergedRows < minVacuumDeletedRows {
+			log.Printf("本次合并仅删除了 %d 条记录，跳过 VACUUM。", result.MergedRows)
+		} else {
+			go vacuumDB(db)
+		}
+	}
 }
 
 // mergeAndArchiveConnections 包含了数据合并与归档的核心业务逻辑。
 // 它在一个事务中完成以下操作：
-// 1. 从主数据库查询指定时间范围内的数据。
+// 1. 从主数据库查询指定时间范围内的数据，hosts 不为空时只查询这些主机的记录。
 // 2. 在内存中按主机和时间窗口对数据进行分组和聚合。
 // 3. 将原始数据归档到归档数据库。
 // 4. 从主数据库删除原始数据。
 // 5. 将聚合后的新数据插入主数据库。
-func mergeAndArchiveConnections(db, archiveDB *sql.DB, startDate, endDate int64, interval int) error {
-	// 1. 查询需要合并的数据。
-	query := "SELECT id, sourceIP, host, upload, download, start, chain FROM connections WHERE start >= ? AND start <= ?"
-	rows, err := db.Query(query, startDate, endDate)
+// 当 dryRun 为 true 时，只执行前两步并返回统计结果，不修改任何数据库。
+// 当 archiveDB 为 nil（关闭了归档数据库）时跳过第 3 步，原始数据被直接删除。
+// 第 3 ~ 5 步由 replaceWithMergedConnections 完成，清理重复记录 (`/api/maintenance/duplicates`) 也使用它。
+func mergeAndArchiveConnections(db, archiveDB *sql.DB, startDate, endDate int64, interval int, hosts []string, dryRun bool) (result MergeResult, err error) {
+	// 1. 查询需要合并的数据。后面的归档、删除都只针对这里查询到的记录，试运行的统计也因此只包含这些主机。
+	hostClause, hostArgs := listFilterClause("host", hosts, false)
+	query := "SELECT " + connectionColumns + " FROM connections WHERE start >= ? AND start <= ?" + hostClause
+	rows, err := db.Query(query, append([]interface{}{startDate, endDate}, hostArgs...)...)
 	if err != nil {
-		return fmt.Errorf("查询数据失败: %w", err)
+		return result, fmt.Errorf("查询数据失败: %w", err)
 	}
 	defer rows.Close()
 
 	// 将查询结果扫描到 Connection 结构体切片中。
 	var connectionsToMerge []Connection
 	for rows.Next() {
-		var conn Connection
-		var start int64
-		var metadata Metadata
-		var chain sql.NullString
-		err := rows.Scan(&conn.ID, &metadata.SourceIP, &metadata.Host, &conn.Upload, &conn.Download, &start, &chain)
+		conn, err := scanConnection(rows)
 		if err != nil {
 			log.Printf("扫描数据库行失败: %v", err)
 			continue
 		}
-		conn.Start = time.Unix(start, 0)
-		conn.Metadata = metadata
-		if chain.Valid {
-			conn.Chains = []string{chain.String}
-		} else {
-			conn.Chains = []string{}
-		}
 		connectionsToMerge = append(connectionsToMerge, conn)
 	}
 
 	if len(connectionsToMerge) == 0 {
-		return nil // 没有需要合并的数据，直接返回成功。
+		return result, nil // 没有需要合并的数据，直接返回成功。
 	}
 
 	// 2. 数据分组与合并。
-	// 使用 map 来存储合并后的结果，key 是由主机名和时间窗口组成的唯一标识。
-	mergedConnections := make(map[string]Connection)
-	groupKeyFormat := "2006-01-02 15:04:05" // Go 的标准时间格式化字符串。
+	mergedConnections := groupConnections(connectionsToMerge, interval)
+	if !dryRun {
+		if err := replaceWithMergedConnections(db, archiveDB, connectionsToMerge, mergedConnections); err != nil {
+			return result, err
+		}
+	}
 
-	for _, conn := range connectionsToMerge {
-		// `Truncate` 将时间向下取整到指定的时间窗口。
-		timeSlot := conn.Start.Truncate(time.Duration(interval) * time.Minute).Format(groupKeyFormat)
-		groupKey := fmt.Sprintf("%s-%s", conn.Metadata.Host, timeSlot)
+	result.MergedRows = len(connectionsToMerge)
+	result.CreatedRows = len(mergedConnections)
+	return result, nil
+}
 
-		if existing, ok := mergedConnections[groupKey]; ok {
-			// 如果 key 已存在，累加流量。
-			existing.Upload += conn.Upload
-			existing.Download += conn.Download
-			mergedConnections[groupKey] = existing
-		} else {
-			// 如果 key 不存在，创建新条目。
-			mergedConnections[groupKey] = conn
-		}
+// replaceWithMergedConnections 在事务中把原始记录 originals 替换为合并后的记录 merged：
+// 原始记录写入归档数据库（archiveDB 为 nil 时跳过）并从主数据库删除，合并后的记录以新的 ID 插入主数据库。
+// 原始记录的 archived_at 与合并记录的 merged_at 相同，之后可以通过 `/api/archive/restore` 恢复。
+// merged 中每条记录的开始时间都应取自 originals，按天汇总表只重算原始记录所在的日期。
+func replaceWithMergedConnections(db, archiveDB *sql.DB, originals []Connection, merged map[string]Connection) (err error) {
+	startDate, endDate := originals[0].Start.Unix(), originals[0].Start.Unix()
+	for _, conn := range originals {
+		startDate = min(startDate, conn.Start.Unix())
+		endDate = max(endDate, conn.Start.Unix())
 	}
 
-	// 3. 数据库事务处理。
 	// 同时对主数据库和归档数据库开启事务，确保操作的原子性。
 	tx, err := db.Begin()
 	if err != nil {
 		return fmt.Errorf("开启主数据库事务失败: %w", err)
 	}
-	archiveTx, err := archiveDB.Begin()
-	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("开启归档数据库事务失败: %w", err)
+	var archiveTx *sql.Tx
+	if archiveDB != nil {
+		archiveTx, err = archiveDB.Begin()
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("开启归档数据库事务失败: %w", err)
+		}
 	}
 
 	// 使用 defer 确保在函数退出时，无论成功还是失败，事务都会被正确处理。
+	// 两个数据库无法在同一个事务中提交，因此先提交归档：归档提交失败时回滚主数据库，原始记录保持不变；
+	// 归档提交成功而主数据库提交失败时，原始记录在两边各有一份，不会丢失，从归档恢复时会跳过主数据库中已有的 ID。
 	defer func() {
+		if err == nil && archiveTx != nil {
+			if err = archiveTx.Commit(); err != nil {
+				err = fmt.Errorf("提交归档数据库事务失败: %w", err)
+			}
+		}
 		if err != nil {
 			tx.Rollback()
-			archiveTx.Rollback()
-		} else {
-			err = tx.Commit()
-			if err == nil {
-				archiveTx.Commit()
+			if archiveTx != nil {
+				archiveTx.Rollback()
 			}
+			return
+		}
+		if err = tx.Commit(); err != nil {
+			err = fmt.Errorf("提交主数据库事务失败: %w", err)
+			return
 		}
+		// 合并后的记录沿用原始记录的开始时间，只需重算原始记录所在的日期。
+		updateDailyRollup(db, startDate, endDate)
+		summaryCache.Invalidate()
 	}()
 
 	// 准备用于归档、删除和插入的 SQL 语句。
-	archiveStmt, err := archiveTx.Prepare("INSERT INTO connections_archive (id, sourceIP, host, upload, download, start, chain, archived_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
-	if err != nil {
-		return fmt.Errorf("准备归档语句失败: %w", err)
+	var archiveStmt *sql.Stmt
+	if archiveTx != nil {
+		archiveStmt, err = archiveTx.Prepare("INSERT INTO connections_archive (" + connectionColumns + ", archived_at) VALUES (" + connectionPlaceholders + ", ?)")
+		if err != nil {
+			return fmt.Errorf("准备归档语句失败: %w", err)
+		}
+		defer archiveStmt.Close()
 	}
-	defer archiveStmt.Close()
 
 	deleteStmt, err := tx.Prepare("DELETE FROM connections WHERE id = ?")
 	if err != nil {
@@ -173,14 +295,12 @@ func mergeAndArchiveConnections(db, archiveDB *sql.DB, startDate, endDate int64,
 
 	// 遍历所有原始数据，执行归档和删除。
 	now := time.Now().Unix()
-	for _, conn := range connectionsToMerge {
-		var chain string
-		if len(conn.Chains) > 0 {
-			chain = conn.Chains[0]
-		}
-		_, err = archiveStmt.Exec(conn.ID, conn.Metadata.SourceIP, conn.Metadata.Host, conn.Upload, conn.Download, conn.Start.Unix(), chain, now)
-		if err != nil {
-			return fmt.Errorf("归档数据失败: %w", err)
+	for _, conn := range originals {
+		if archiveStmt != nil {
+			_, err = archiveStmt.Exec(append(connectionArgs(conn), now)...)
+			if err != nil {
+				return fmt.Errorf("归档数据失败: %w", err)
+			}
 		}
 		_, err = deleteStmt.Exec(conn.ID)
 		if err != nil {
@@ -189,27 +309,52 @@ func mergeAndArchiveConnections(db, archiveDB *sql.DB, startDate, endDate int64,
 	}
 
 	// 准备插入语句，将合并后的数据写回主数据库。
-	insertStmt, err := tx.Prepare("INSERT INTO connections (id, sourceIP, host, upload, download, start, chain) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	// merged_at 记录为本次合并的归档时间戳，便于之后从归档中恢复时找到这些聚合记录。
+	insertStmt, err := tx.Prepare("INSERT INTO connections (" + connectionColumns + ", merged_at) VALUES (" + connectionPlaceholders + ", ?)")
 	if err != nil {
 		return fmt.Errorf("准备插入语句失败: %w", err)
 	}
 	defer insertStmt.Close()
 
-	for _, conn := range mergedConnections {
-		newID := uuid.New().String() // 为合并后的新记录生成唯一的 ID。
-		var chain string
-		if len(conn.Chains) > 0 {
-			chain = conn.Chains[0]
-		}
-		_, err = insertStmt.Exec(newID, conn.Metadata.SourceIP, conn.Metadata.Host, conn.Upload, conn.Download, conn.Start.Unix(), chain)
+	for _, conn := range merged {
+		conn.ID = uuid.New().String() // 为合并后的新记录生成唯一的 ID。
+		_, err = insertStmt.Exec(append(connectionArgs(conn), now)...)
 		if err != nil {
 			return fmt.Errorf("插入合并后数据失败: %w", err)
 		}
 	}
-
 	return nil
 }
 
+// groupConnections 按主机名和时间窗口对连接进行分组，并累加同组的流量。
+// 返回的 map 的 key 是由主机名和时间窗口组成的唯一标识，value 是合并后的连接。
+// 合并后的连接沿用每组第一条记录的其他字段（如 sourceIP、chain、start），
+// 其 Connections 为同组各记录所代表的原始连接数之和。
+func groupConnections(connections []Connection, interval int) map[string]Connection {
+	mergedConnections := make(map[string]Connection)
+	groupKeyFormat := "2006-01-02 15:04:05" // Go 的标准时间格式化字符串。
+
+	for _, conn := range connections {
+		// `Truncate` 将时间向下取整到指定的时间窗口。
+		timeSlot := conn.Start.Truncate(time.Duration(interval) * time.Minute).Format(groupKeyFormat)
+		groupKey := fmt.Sprintf("%s-%s", conn.Metadata.Host, timeSlot)
+
+		if existing, ok := mergedConnections[groupKey]; ok {
+			// 如果 key 已存在，累加流量、原始连接数和已关闭连接的持续时间，关闭时间取最晚的一个。
+			existing.Upload += conn.Upload
+			existing.Download += conn.Download
+			existing.Connections += conn.Connections
+			existing.Duration += conn.Duration
+			existing.End = max(existing.End, conn.End)
+			mergedConnections[groupKey] = existing
+		} else {
+			// 如果 key 不存在，创建新条目。
+			mergedConnections[groupKey] = conn
+		}
+	}
+	return mergedConnections
+}
+
 // getConnectionsHandler 是处理 `/api/connections` GET 请求的 HTTP Handler。
 // 它支持分页、排序和多种条件的过滤，用于在前端展示连接列表。
 func getConnectionsHandler(w http.ResponseWriter, r *http.Request) {
@@ -220,43 +365,77 @@ func getConnectionsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 从 URL 查询参数中解析分页、过滤和排序的选项。
-	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
-	if page < 1 {
-		page = 1
-	}
-	pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
-	if pageSize <= 0 {
-		pageSize = 20
+	page, pageSize, field, msg := parsePagination(r, 20)
+	if field != "" {
+		writeJSONError(w, http.StatusBadRequest, field, msg)
+		return
 	}
 	host := r.URL.Query().Get("host")
-	sourceIP := r.URL.Query().Get("sourceIP")
+	hostMatch := r.URL.Query().Get("hostMatch")
+	// 与采集时一样规范化 IP，使 `[2001:DB8::1]` 等写法也能匹配到存储的值；设备名称等非 IP 值原样使用。
+	sourceIP := normalizeIP(r.URL.Query().Get("sourceIP"))
 	startDate, _ := strconv.ParseInt(r.URL.Query().Get("startDate"), 10, 64)
 	endDate, _ := strconv.ParseInt(r.URL.Query().Get("endDate"), 10, 64)
 	sortBy := r.URL.Query().Get("sortBy")
 	sortOrder := r.URL.Query().Get("sortOrder")
 	chain := r.URL.Query().Get("chain")
+	chainFull := r.URL.Query().Get("chainFull")
+	connType := r.URL.Query().Get("type")
+	network := strings.ToLower(r.URL.Query().Get("network"))
+	var port int
+	if value := r.URL.Query().Get("port"); value != "" {
+		if port = parsePort(value); port == 0 {
+			writeJSONError(w, http.StatusBadRequest, "port", fmt.Sprintf("无效的端口: %s，必须是 1-65535 之间的整数", value))
+			return
+		}
+	}
+	minTotal, _ := strconv.ParseUint(r.URL.Query().Get("minTotal"), 10, 64)
+	fullChain := r.URL.Query().Get("fullChain") == "true"
+	// 与排序字段一样，未知的匹配方式直接返回 400，而不是悄悄退回默认的 contains。
+	hostClause, hostArg, ok := hostMatchClause(hostMatch, host)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "hostMatch", fmt.Sprintf("不支持的匹配方式: %s，可选值为 contains、exact、prefix、suffix", hostMatch))
+		return
+	}
+
+	// 在查询数据库之前校验排序字段，未知的字段直接返回 400，而不是悄悄退回默认排序。
+	// 排序字段相同的记录（例如同一秒开始的连接）之间的顺序是不确定的，翻页时同一条记录可能出现在两页中，
+	// 也可能一页都不出现，因此总是以唯一的 id 作为第二排序键，使每一页的内容稳定。
+	orderByClause := " ORDER BY start DESC" + connectionSortTiebreaker // 默认按开始时间降序排序。
+	if sortBy != "" {
+		sortExpr, ok := connectionSortExpr(sortBy)
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "sortBy", fmt.Sprintf("不支持的排序字段: %s", sortBy))
+			return
+		}
+		order := "ASC"
+		if strings.ToLower(sortOrder) == "desc" {
+			order = "DESC"
+		}
+		orderByClause = fmt.Sprintf(" ORDER BY %s %s", sortExpr, order) + connectionSortTiebreaker
+	}
 
 	// 动态构建 SQL 查询语句和参数列表，以避免 SQL 注入。
-	query := "SELECT id, sourceIP, host, upload, download, start, chain FROM connections WHERE 1=1"
-	countQuery := "SELECT COUNT(*) FROM connections WHERE 1=1"
+	// 通过 LEFT JOIN devices 表为源 IP 附加设备名称（如果设置过）。
+	query := "SELECT " + connectionColumns + ", name FROM connections LEFT JOIN devices ON devices.ip = connections.sourceIP WHERE 1=1"
+	countQuery := "SELECT COUNT(*) FROM connections LEFT JOIN devices ON devices.ip = connections.sourceIP WHERE 1=1"
 	var queryArgs []interface{}
 	var countArgs []interface{}
 
 	if host != "" {
-		clause := " AND host LIKE ?"
-		query += clause
-		countQuery += clause
-		likeHost := "%" + host + "%"
-		queryArgs = append(queryArgs, likeHost)
-		countArgs = append(countArgs, likeHost)
+		query += hostClause
+		countQuery += hostClause
+		queryArgs = append(queryArgs, hostArg)
+		countArgs = append(countArgs, hostArg)
 	}
 	if sourceIP != "" {
-		clause := " AND sourceIP LIKE ?"
+		// 既匹配源 IP，也匹配设备名称。
+		clause := " AND (sourceIP LIKE ? OR name LIKE ?)"
 		query += clause
 		countQuery += clause
 		likeSourceIP := "%" + sourceIP + "%"
-		queryArgs = append(queryArgs, likeSourceIP)
-		countArgs = append(countArgs, likeSourceIP)
+		queryArgs = append(queryArgs, likeSourceIP, likeSourceIP)
+		countArgs = append(countArgs, likeSourceIP, likeSourceIP)
 	}
 	if startDate > 0 {
 		clause := " AND start >= ?"
@@ -272,148 +451,875 @@ func getConnectionsHandler(w http.ResponseWriter, r *http.Request) {
 		queryArgs = append(queryArgs, endDate)
 		countArgs = append(countArgs, endDate)
 	}
-	if chain != "" {
-		clause := " AND chain = ?"
-		query += clause
-		countQuery += clause
-		queryArgs = append(queryArgs, chain)
-		countArgs = append(countArgs, chain)
+	if chain != "" {
+		clause := " AND chain = ?"
+		query += clause
+		countQuery += clause
+		queryArgs = append(queryArgs, chain)
+		countArgs = append(countArgs, chain)
+	}
+	if chainFull != "" {
+		clause := " AND chainFull = ?"
+		query += clause
+		countQuery += clause
+		queryArgs = append(queryArgs, chainFull)
+		countArgs = append(countArgs, chainFull)
+	}
+	if connType != "" {
+		clause := " AND type = ?"
+		query += clause
+		countQuery += clause
+		queryArgs = append(queryArgs, connType)
+		countArgs = append(countArgs, connType)
+	}
+	if network != "" {
+		clause := " AND network = ?"
+		query += clause
+		countQuery += clause
+		queryArgs = append(queryArgs, network)
+		countArgs = append(countArgs, network)
+	}
+	if port > 0 {
+		clause := " AND destinationPort = ?"
+		query += clause
+		countQuery += clause
+		queryArgs = append(queryArgs, port)
+		countArgs = append(countArgs, port)
+	}
+	if minTotal > 0 {
+		// 隐藏 DNS、心跳等流量极小的记录。
+		clause := " AND upload + download >= ?"
+		query += clause
+		countQuery += clause
+		queryArgs = append(queryArgs, minTotal)
+		countArgs = append(countArgs, minTotal)
+	}
+
+	// 多值过滤：hosts、chains、sourceIPs 只保留列出的值，excludeHosts、excludeChains、excludeSourceIPs
+	// 排除列出的值，均为精确匹配。源 IP 与单值过滤一样先规范化。
+	normalizeIPs := func(values []string) []string {
+		for i, v := range values {
+			values[i] = normalizeIP(v)
+		}
+		return values
+	}
+	listFilters := []struct {
+		column  string
+		values  []string
+		exclude bool
+	}{
+		{"host", parseListParam(r.URL.Query().Get("hosts")), false},
+		{"host", parseListParam(r.URL.Query().Get("excludeHosts")), true},
+		{"chain", parseListParam(r.URL.Query().Get("chains")), false},
+		{"chain", parseListParam(r.URL.Query().Get("excludeChains")), true},
+		{"sourceIP", normalizeIPs(parseListParam(r.URL.Query().Get("sourceIPs"))), false},
+		{"sourceIP", normalizeIPs(parseListParam(r.URL.Query().Get("excludeSourceIPs"))), true},
+	}
+	for _, filter := range listFilters {
+		clause, args := listFilterClause(filter.column, filter.values, filter.exclude)
+		query += clause
+		countQuery += clause
+		queryArgs = append(queryArgs, args...)
+		countArgs = append(countArgs, args...)
+	}
+
+	// 添加排序逻辑。
+	query += orderByClause
+
+	// 添加分页逻辑。
+	query += " LIMIT ? OFFSET ?"
+	queryArgs = append(queryArgs, pageSize, (page-1)*pageSize)
+
+	// COUNT 查询（获取满足条件的总记录数，用于前端分页）和数据查询都需要按过滤条件扫描表，数据量大时各自都要花费不少时间。
+	// 两者互不依赖，因此在另一个 Goroutine 中执行 COUNT 查询，与数据查询同时进行。
+	// 数据库使用回滚日志 (journal_mode=DELETE)，多个读取可以同时持有共享锁，连接池也没有限制连接数。
+	// 任一查询失败时取消另一个；客户端断开时 r.Context() 被取消，两个查询也会随之中止。
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	var total int
+	var countErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if countErr = timedQueryRow(ctx, db, countQuery, countArgs...).Scan(&total); countErr != nil {
+			cancel()
+		}
+	}()
+
+	// 执行最终的查询，并扫描查询结果到 ConnectionInfo 结构体切片中。
+	connections, err := func() ([]ConnectionInfo, error) {
+		rows, err := timedQuery(ctx, db, query, queryArgs...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var connections []ConnectionInfo
+		for rows.Next() {
+			var deviceName sql.NullString
+			conn, err := scanConnection(rows, &deviceName)
+			if err != nil {
+				log.Printf("扫描数据库行失败: %v", err)
+				continue
+			}
+
+			connections = append(connections, newConnectionInfo(conn, deviceName.String, fullChain))
+		}
+		return connections, rows.Err()
+	}()
+	if err != nil {
+		cancel()
+	}
+	wg.Wait()
+	// COUNT 查询失败时，数据查询的错误通常只是被取消，报告 COUNT 查询的错误。
+	if countErr != nil {
+		err = countErr
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// 返回包含分页信息的 JSON 响应。
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"total":       total,
+		"page":        page,
+		"pageSize":    pageSize,
+		"maxPageSize": maxPageSizeFor(r),
+		"totalPages":  (total + pageSize - 1) / pageSize,
+		"data":        connections,
+	})
+}
+
+// responseChains 返回连接列表中展示的代理链。
+// 默认只返回规则选中的策略组（与 chain 列一致，前端点击即可按它过滤）；full 为 true 时返回完整的代理链。
+func responseChains(chains []string, full bool) []string {
+	if full || len(chains) <= 1 {
+		return chains
+	}
+	return []string{policyGroup(chains)}
+}
+
+// policyGroup 返回规则选中的策略组，即 Clash 代理链的最后一个元素，与 chain 列一致。
+// 实际使用的节点是代理链的第一个元素。
+func policyGroup(chains []string) string {
+	if len(chains) == 0 {
+		return ""
+	}
+	return chains[len(chains)-1]
+}
+
+// newConnectionInfo 把数据库中的一条连接记录转换为 API 响应的格式。
+// fullChain 为 true 时 chains 返回完整的代理链，否则只包含策略组。
+func newConnectionInfo(conn Connection, deviceName string, fullChain bool) ConnectionInfo {
+	port := parsePort(conn.Metadata.DestinationPort)
+	return ConnectionInfo{
+		Host:        conn.Metadata.Host,
+		SourceIP:    conn.Metadata.SourceIP,
+		DeviceName:  deviceName,
+		Upload:      conn.Upload,
+		Download:    conn.Download,
+		Start:       conn.Start,
+		Chains:      responseChains(conn.Chains, fullChain),
+		Chain:       policyGroup(conn.Chains),
+		ChainFull:   joinChains(conn.Chains),
+		Country:     conn.Country,
+		Type:        conn.Metadata.Type,
+		Network:     conn.Metadata.Network,
+		Port:        port,
+		PortLabel:   portLabel(port),
+		Connections: conn.Connections,
+		End:         conn.End,
+		Duration:    connectionDuration(conn),
+		HostUnknown: conn.HostUnknown,
+	}
+}
+
+// connectionDuration 返回连接持续的秒数。尚未观察到关闭的连接（包括旧记录）返回 nil，响应中为 null。
+func connectionDuration(conn Connection) *int64 {
+	if conn.End == 0 {
+		return nil
+	}
+	duration := conn.Duration
+	return &duration
+}
+
+// connectionSortColumn 是连接列表的一个排序字段。
+type connectionSortColumn struct {
+	expr     string // 实际用于排序的 SQL 表达式，通常就是列名。
+	metadata bool   // 该字段在 Clash 的连接信息中位于 metadata 下，前端表格也可以用 `metadata.<字段>` 指定。
+}
+
+// connectionSortColumns 是连接列表允许的排序字段（白名单，防止 SQL 注入），key 为 sortBy 参数的取值。
+// 新增可排序的列时只需在这里添加一行。total 按上传与下载之和排序；
+// duration、endTime、destinationPort 等可能为 NULL 的列，NULL 在升序时排在最前。
+var connectionSortColumns = map[string]connectionSortColumn{
+	"upload":          {expr: "upload"},
+	"download":        {expr: "download"},
+	"total":           {expr: "upload + download"},
+	"start":           {expr: "start"},
+	"end":             {expr: "endTime"},
+	"duration":        {expr: "duration"},
+	"host":            {expr: "host", metadata: true},
+	"sourceIP":        {expr: "sourceIP", metadata: true},
+	"network":         {expr: "network", metadata: true},
+	"type":            {expr: "type", metadata: true},
+	"destinationPort": {expr: "destinationPort", metadata: true},
+	"chain":           {expr: "chain"},
+	"chainFull":       {expr: "chainFull"},
+	"country":         {expr: "country"},
+	"rule":            {expr: "rule"},
+	"connections":     {expr: "connections"},
+}
+
+// connectionSortAliases 把前端表格使用的其他列名映射为 connectionSortColumns 中的字段。
+// `metadata.<字段>` 形式的列名由 connectionSortExpr 统一处理，不需要在这里列出。
+var connectionSortAliases = map[string]string{
+	"chains": "chain",
+}
+
+// connectionSortTiebreaker 是连接列表的第二排序键。id 是主键，保证排序结果唯一；
+// 查询中 LEFT JOIN 了 devices 表，因此写明表名。
+const connectionSortTiebreaker = ", connections.id ASC"
+
+// connectionSortExpr 返回 sortBy 对应的排序表达式。第二个返回值为 false 表示不支持该字段。
+func connectionSortExpr(sortBy string) (string, bool) {
+	if alias, ok := connectionSortAliases[sortBy]; ok {
+		sortBy = alias
+	}
+	field, isMetadata := strings.CutPrefix(sortBy, "metadata.")
+	column, ok := connectionSortColumns[field]
+	if !ok || (isMetadata && !column.metadata) {
+		return "", false
+	}
+	return column.expr, true
+}
+
+// hostMatchClause 根据 hostMatch 参数构建主机名的过滤条件及其对应的参数。
+// 支持的匹配方式：
+//   - contains (默认)：子串匹配，`host LIKE %x%`。
+//   - exact：精确匹配，`host = x`，可以区分 google.com 与 googlevideo.com，且能利用索引。
+//   - prefix：前缀匹配，`host LIKE x%`。
+//   - suffix：后缀匹配，`host LIKE %x`。
+//
+// host 中的 `%` 和 `_` 按字面匹配，不作为通配符。未知的取值返回 false。
+func hostMatchClause(hostMatch, host string) (string, interface{}, bool) {
+	const likeClause = " AND host LIKE ? ESCAPE '\\'"
+	switch strings.ToLower(hostMatch) {
+	case "exact":
+		return " AND host = ?", host, true
+	case "prefix":
+		return likeClause, escapeLike(host) + "%", true
+	case "suffix":
+		return likeClause, "%" + escapeLike(host), true
+	case "", "contains":
+		return likeClause, "%" + escapeLike(host) + "%", true
+	default:
+		return "", nil, false
+	}
+}
+
+// likeEscaper 转义 LIKE 模式中的通配符，与 `ESCAPE '\'` 配合使用。
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// escapeLike 转义 s 中的 `%`、`_` 和转义符 `\`，使其在 LIKE 模式中按字面匹配。
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// parseListParam 把逗号分隔的查询参数解析为去重后的值列表，例如 `a.com,b.com`。
+// 按 CSV 规则解析，因此包含逗号的值可以用双引号括起来，例如 `"HK, 01",US`。
+// 空白会被去掉，空值会被忽略；引号不成对等无法解析的输入退回到简单的按逗号拆分。
+func parseListParam(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+
+	fields, err := func() ([]string, error) {
+		reader := csv.NewReader(strings.NewReader(value))
+		reader.TrimLeadingSpace = true
+		reader.LazyQuotes = true
+		return reader.Read()
+	}()
+	if err != nil {
+		fields = strings.Split(value, ",")
+	}
+
+	seen := make(map[string]bool, len(fields))
+	var values []string
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || seen[field] {
+			continue
+		}
+		seen[field] = true
+		values = append(values, field)
+	}
+	return values
+}
+
+// listFilterClause 为多值过滤构建 `IN` / `NOT IN` 条件及其参数，占位符的数量与值的数量一致。
+// 排除条件会保留该列为 NULL 的记录，否则 `NOT IN` 会把它们一并过滤掉。
+// values 为空时返回空条件。
+func listFilterClause(column string, values []string, exclude bool) (string, []interface{}) {
+	if len(values) == 0 {
+		return "", nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	if exclude {
+		return fmt.Sprintf(" AND (%s IS NULL OR %s NOT IN (%s))", column, column, placeholders), args
+	}
+	return fmt.Sprintf(" AND %s IN (%s)", column, placeholders), args
+}
+
+// TrafficSummary 是 `/api/summary/traffic` 返回的一个时间段的流量汇总。
+type TrafficSummary struct {
+	Time        string `json:"time"`
+	Upload      uint64 `json:"upload"`
+	Download    uint64 `json:"download"`
+	Connections uint64 `json:"connections"` // 该时间段内的原始连接数。
+	SourceIPs   uint64 `json:"sourceIPs"`   // 该时间段内活跃的不同源 IP 数。
+}
+
+// maxTrafficSeriesHosts 是 `/api/summary/traffic` 的 hosts 参数最多允许的主机数，避免一次返回过多的曲线。
+const maxTrafficSeriesHosts = 10
+
+// getTrafficSummaryHandler 是处理 `/api/summary/traffic` GET 请求的 HTTP Handler。
+// 它用于获取按时间（小时或天）分组的流量汇总数据，用于绘制图表。
+// includeArchive 为 true 时同时统计归档数据库中的原始记录，见 combinedTrafficSeries。
+// 指定 hosts（逗号分隔）时为每个主机分别返回一条曲线，响应为主机名到时间段列表的对象，用于在同一张图中比较多个主机；
+// 只指定 host 时与之前一样返回一条曲线。
+// `groupBy=chain` 时按 chain 列（规则选中的策略组）分别返回一条曲线，响应格式与 hosts 相同，用于比较各策略组承载的流量。
+func getTrafficSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	// 解析查询参数：host, hosts, groupBy, chain, sourceIP, granularity, startDate, endDate, includeArchive。
+	// host、chain、sourceIP 均为精确匹配，可以任意组合。
+	host := r.URL.Query().Get("host")
+	hosts := parseListParam(r.URL.Query().Get("hosts"))
+	if len(hosts) > 0 && host != "" {
+		writeJSONError(w, http.StatusBadRequest, "hosts", "host 和 hosts 不能同时使用")
+		return
+	}
+	if len(hosts) > maxTrafficSeriesHosts {
+		writeJSONError(w, http.StatusBadRequest, "hosts", fmt.Sprintf("hosts 最多包含 %d 个主机", maxTrafficSeriesHosts))
+		return
+	}
+	groupBy := r.URL.Query().Get("groupBy")
+	if groupBy != "" && groupBy != "chain" {
+		writeJSONError(w, http.StatusBadRequest, "groupBy", "groupBy 只支持 chain")
+		return
+	}
+	if groupBy != "" && len(hosts) > 0 {
+		writeJSONError(w, http.StatusBadRequest, "groupBy", "groupBy 和 hosts 不能同时使用")
+		return
+	}
+	chain := r.URL.Query().Get("chain")
+	sourceIP := normalizeIP(r.URL.Query().Get("sourceIP"))
+	granularity := r.URL.Query().Get("granularity")
+	if granularity != "hour" && granularity != "day" {
+		granularity = "day" // 默认粒度为天。
+	}
+	startDate, _ := strconv.ParseInt(r.URL.Query().Get("startDate"), 10, 64)
+	endDate, _ := strconv.ParseInt(r.URL.Query().Get("endDate"), 10, 64)
+	// 关闭归档数据库时没有归档数据，忽略 includeArchive。
+	archiveDB := archiveDBFromContext(r)
+	includeArchive := r.URL.Query().Get("includeArchive") == "true" && archiveDB != nil
+
+	// 根据粒度选择不同的 `strftime` 格式。
+	var format string
+	if granularity == "hour" {
+		format = "%Y-%m-%d %H:00:00"
+	} else {
+		format = "%Y-%m-%d 00:00:00"
+	}
+
+	// 构建筛选条件，主数据库和归档数据库的表结构相同，共用同一组条件。
+	// 时间范围单独处理：按天汇总时完整的日期从按天汇总表 daily_rollup 读取，见 summarySource。
+	where := ""
+	var filterArgs []interface{}
+	if host != "" {
+		where += " AND host = ?"
+		filterArgs = append(filterArgs, host)
+	}
+	if chain != "" {
+		where += " AND chain = ?"
+		filterArgs = append(filterArgs, chain)
+	}
+	if sourceIP != "" {
+		where += " AND sourceIP = ?"
+		filterArgs = append(filterArgs, sourceIP)
+	}
+	dateWhere := ""
+	var dateArgs []interface{}
+	if startDate > 0 {
+		dateWhere += " AND start >= ?"
+		dateArgs = append(dateArgs, startDate)
+	}
+	if endDate > 0 {
+		dateWhere += " AND start <= ?"
+		dateArgs = append(dateArgs, endDate)
+	}
+
+	// 需要多条曲线时，key 为区分曲线的 SQL 表达式。
+	var key string
+	if len(hosts) > 0 {
+		clause, hostArgs := listFilterClause("host", hosts, false)
+		where += clause
+		filterArgs = append(filterArgs, hostArgs...)
+		key = "host"
+	} else if groupBy == "chain" {
+		// 没有记录代理链的连接归入键为空字符串的一条曲线。
+		key = "COALESCE(chain, '')"
+	}
+
+	scale := sampleScalerFor(w, r)
+	if key != "" {
+		var series map[string][]TrafficSummary
+		var err error
+		if includeArchive {
+			series, err = combinedTrafficSeries(r.Context(), db, archiveDB, format, key, where+dateWhere, append(filterArgs, dateArgs...))
+		} else {
+			source, sourceArgs := summarySource(format, granularity == "day", where, filterArgs, startDate, endDate)
+			series, err = trafficSeriesBy(r.Context(), db, key, source, sourceArgs)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+			return
+		}
+		// 没有数据的主机也返回一个空数组，前端可以据此显示图例。
+		for _, h := range hosts {
+			if series[h] == nil {
+				series[h] = []TrafficSummary{}
+			}
+		}
+		for _, summaries := range series {
+			for i := range summaries {
+				scale.Scale(&summaries[i].Upload, &summaries[i].Download, &summaries[i].Connections)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(series)
+		return
+	}
+
+	var summaries []TrafficSummary
+	if includeArchive {
+		series, err := combinedTrafficSeries(r.Context(), db, archiveDB, format, "''", where+dateWhere, append(filterArgs, dateArgs...))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+			return
+		}
+		summaries = series[""]
+		for i := range summaries {
+			scale.Scale(&summaries[i].Upload, &summaries[i].Download, &summaries[i].Connections)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summaries)
+		return
+	}
+
+	// 构建 SQL 查询。
+	source, args := summarySource(format, granularity == "day", where, filterArgs, startDate, endDate)
+	query := `
+		SELECT
+			time,
+			SUM(upload) as upload,
+			SUM(download) as download,
+			SUM(connections) as connections,
+			COUNT(DISTINCT sourceIP) as sourceIPs
+		FROM ` + source + `
+		GROUP BY time ORDER BY time`
+
+	rows, err := timedQuery(r.Context(), db, query, args...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var summary TrafficSummary
+		err := rows.Scan(&summary.Time, &summary.Upload, &summary.Download, &summary.Connections, &summary.SourceIPs)
+		if err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		scale.Scale(&summary.Upload, &summary.Download, &summary.Connections)
+		summaries = append(summaries, summary)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
+
+// trafficSeriesBy 按 key（区分曲线的 SQL 表达式，例如 `host`）分别汇总流量，返回键到时间段列表的映射，每个列表按时间排序。
+// source 和 args 是 summarySource 返回的数据来源；包含归档数据时改用 combinedTrafficSeries。
+func trafficSeriesBy(ctx context.Context, db *sql.DB, key, source string, args []interface{}) (map[string][]TrafficSummary, error) {
+	rows, err := timedQuery(ctx, db, `
+		SELECT
+			`+key+`,
+			time,
+			SUM(upload) as upload,
+			SUM(download) as download,
+			SUM(connections) as connections,
+			COUNT(DISTINCT sourceIP) as sourceIPs
+		FROM `+source+`
+		GROUP BY 1, 2 ORDER BY 1, 2`,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	series := map[string][]TrafficSummary{}
+	for rows.Next() {
+		var k string
+		var summary TrafficSummary
+		if err := rows.Scan(&k, &summary.Time, &summary.Upload, &summary.Download, &summary.Connections, &summary.SourceIPs); err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		series[k] = append(series[k], summary)
+	}
+	return series, rows.Err()
+}
+
+// combinedTrafficSeries 把主数据库和归档数据库中的记录合在一起，按 key 和 format 分组汇总流量。
+// 合并时原始记录被移入归档，主数据库中只留下按合并间隔聚合的记录 (merged_at 不为空)，
+// 每条聚合记录沿用组内第一条记录的开始时间（见 groupConnections），整个窗口的流量都记在这一个时刻上，
+// 按小时绘图时流量会集中在少数几个点上。这里改用归档中的原始记录，
+// 同时排除主数据库中的合并记录，避免同一份流量被计算两次。
+// 两个数据库是不同的文件，无法在一条 SQL 中 UNION，因此按 (曲线, 时间段, 源 IP) 分别分组后在内存中合并，
+// 这样不同源 IP 数依然是两边去重后的准确值。
+// key 是区分曲线的 SQL 表达式，例如 `host`；只需要一条曲线时传入 SQL 的空字符串字面量，结果中只有键为空字符串的一项。
+// where 和 args 是以 ` AND` 开头的筛选条件及其参数。
+func combinedTrafficSeries(ctx context.Context, db, archiveDB *sql.DB, format, key, where string, args []interface{}) (map[string][]TrafficSummary, error) {
+	type bucket struct {
+		key, time string
+	}
+	summaries := map[bucket]*TrafficSummary{}
+	sourceIPs := map[bucket]map[string]struct{}{}
+	collect := func(source *sql.DB, from string) error {
+		rows, err := timedQuery(ctx, source, `
+			SELECT
+				`+key+`,
+				strftime(?, datetime(start, 'unixepoch')) as time,
+				sourceIP,
+				SUM(upload),
+				SUM(download),
+				SUM(connections)
+			FROM `+from+where+`
+			GROUP BY 1, 2, 3`,
+			append([]interface{}{format}, args...)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var b bucket
+			var ip sql.NullString
+			var upload, download, connections uint64
+			if err := rows.Scan(&b.key, &b.time, &ip, &upload, &download, &connections); err != nil {
+				log.Printf("扫描数据库行失败: %v", err)
+				continue
+			}
+			summary, ok := summaries[b]
+			if !ok {
+				summary = &TrafficSummary{Time: b.time}
+				summaries[b] = summary
+				sourceIPs[b] = map[string]struct{}{}
+			}
+			summary.Upload += upload
+			summary.Download += download
+			summary.Connections += connections
+			// 与 COUNT(DISTINCT sourceIP) 一致，不统计为 NULL 的源 IP。
+			if ip.Valid {
+				sourceIPs[b][ip.String] = struct{}{}
+			}
+		}
+		return rows.Err()
+	}
+	if err := collect(db, " connections WHERE merged_at IS NULL"); err != nil {
+		return nil, err
+	}
+	if err := collect(archiveDB, " connections_archive WHERE 1=1"); err != nil {
+		return nil, fmt.Errorf("查询归档数据失败: %w", err)
+	}
+
+	// 与只查询主数据库时一致，没有数据时不包含对应的键（单条曲线时 JSON 中为 null）。
+	series := map[string][]TrafficSummary{}
+	for b, summary := range summaries {
+		summary.SourceIPs = uint64(len(sourceIPs[b]))
+		series[b.key] = append(series[b.key], *summary)
+	}
+	// 时间格式为 `YYYY-MM-DD HH:00:00`，按字符串排序即按时间排序。
+	for _, result := range series {
+		sort.Slice(result, func(i, j int) bool { return result[i].Time < result[j].Time })
+	}
+	return series, nil
+}
+
+// maxTZOffsetMinutes 是 tzOffset 参数允许的最大绝对值（分钟）。现实中的时区偏移在 UTC-12 到 UTC+14 之间。
+const maxTZOffsetMinutes = 14 * 60
+
+// getHeatmapHandler 是处理 `/api/summary/heatmap`（及其别名 `/api/summary/hourly-heatmap`）GET 请求的 HTTP Handler。
+// 它返回一个 7x24 的矩阵，matrix[星期][小时] 为该时段的上传 + 下载流量总和，
+// 星期从 0（周日）到 6（周六），用于绘制类似 GitHub 贡献图的热力图。
+// tzOffset 参数（相对 UTC 的分钟数，例如东八区为 480）用于按浏览器所在时区划分星期和小时；
+// 未提供时使用服务器配置的时区（TZ 环境变量），由 SQLite 的 `localtime` 逐条换算，夏令时也能正确处理。
+// 没有数据的格子为 0，前端无需自行补齐。
+func getHeatmapHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	// 解析查询参数：host, startDate, endDate, tzOffset。
+	host := r.URL.Query().Get("host")
+	startDate, _ := strconv.ParseInt(r.URL.Query().Get("startDate"), 10, 64)
+	endDate, _ := strconv.ParseInt(r.URL.Query().Get("endDate"), 10, 64)
+	// 先把时间戳换算到本地时间，再用 strftime 取出星期 (%w) 和小时 (%H)。
+	localTime := "start, 'unixepoch', 'localtime'"
+	var args []interface{}
+	// 响应中的 tzOffset 为服务器时区当前的偏移量，仅供参考。
+	_, offsetSeconds := time.Now().Zone()
+	tzOffset := offsetSeconds / 60
+	timezone := time.Local.String()
+	if v := r.URL.Query().Get("tzOffset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < -maxTZOffsetMinutes || offset > maxTZOffsetMinutes {
+			writeJSONError(w, http.StatusBadRequest, "tzOffset", fmt.Sprintf("tzOffset 必须是 -%d 到 %d 之间的分钟数", maxTZOffsetMinutes, maxTZOffsetMinutes))
+			return
+		}
+		tzOffset = offset
+		timezone = ""
+		localTime = "start + ?, 'unixepoch'"
+		shift := tzOffset * 60
+		args = append(args, shift, shift)
+	}
+
+	query := `
+		SELECT
+			CAST(strftime('%w', ` + localTime + `) AS INTEGER) as weekday,
+			CAST(strftime('%H', ` + localTime + `) AS INTEGER) as hour,
+			SUM(upload) + SUM(download) as total
+		FROM connections
+		WHERE 1=1
+	`
+
+	if host != "" {
+		query += " AND host = ?"
+		args = append(args, host)
+	}
+	if startDate > 0 {
+		query += " AND start >= ?"
+		args = append(args, startDate)
+	}
+	if endDate > 0 {
+		query += " AND start <= ?"
+		args = append(args, endDate)
+	}
+
+	query += " GROUP BY weekday, hour"
+
+	rows, err := timedQuery(r.Context(), db, query, args...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	scale := sampleScalerFor(w, r)
+	matrix := make([][]uint64, 7)
+	for i := range matrix {
+		matrix[i] = make([]uint64, 24)
+	}
+	for rows.Next() {
+		var weekday, hour int
+		var total uint64
+		if err := rows.Scan(&weekday, &hour, &total); err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		if weekday >= 0 && weekday < 7 && hour >= 0 && hour < 24 {
+			scale.Scale(&total)
+			matrix[weekday][hour] = total
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]interface{}{
+		"tzOffset": tzOffset,
+		"matrix":   matrix,
+	}
+	if timezone != "" {
+		response["timezone"] = timezone
 	}
+	json.NewEncoder(w).Encode(response)
+}
 
-	// 首先执行 COUNT 查询，获取满足条件的总记录数，用于前端分页。
-	var total int
-	err := db.QueryRow(countQuery, countArgs...).Scan(&total)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+// getHostSummaryHandler 是处理 `/api/summary/hosts` GET 请求的 HTTP Handler。
+// 它用于获取按总流量排序的主机列表，即流量排行榜。
+// `includeOther=true` 时在排行之后追加一项，汇总排名之外所有主机的流量，使各项之和等于时间范围内的总流量，
+// 避免饼图等图表只显示前 N 名时产生误导。这一项的 host 为 SUMMARY_OTHER_LABEL，并带有 `other: true`。
+// 每一项都带有 share，即该项占时间范围内所有主机总流量的比例。
+func getHostSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
 		return
 	}
 
-	// 添加排序逻辑。
-	orderByClause := " ORDER BY start DESC" // 默认按开始时间降序排序。
-	if sortBy != "" {
-		// 使用白名单验证 sortBy 参数，防止 SQL 注入。
-		allowedSortBy := map[string]bool{
-			"upload":   true,
-			"download": true,
-			"start":    true,
-			"host":     true,
-			"sourceIP": true,
-		}
-		// 前端传来的可能是 metadata.host，需要映射到数据库的 host 字段。
-		dbSortBy := sortBy
-		if sortBy == "metadata.host" {
-			dbSortBy = "host"
-		}
-		if sortBy == "metadata.sourceIP" {
-			dbSortBy = "sourceIP"
-		}
-
-		if allowedSortBy[dbSortBy] {
-			order := "ASC"
-			if strings.ToLower(sortOrder) == "desc" {
-				order = "DESC"
-			}
-			orderByClause = fmt.Sprintf(" ORDER BY %s %s", dbSortBy, order)
-		}
+	// 解析查询参数：limit, startDate, endDate, minTotal, includeOther。
+	limit := parseLimit(w, r, 10) // 默认返回前 10 名。
+	startDate, _ := strconv.ParseInt(r.URL.Query().Get("startDate"), 10, 64)
+	endDate, _ := strconv.ParseInt(r.URL.Query().Get("endDate"), 10, 64)
+	minTotal, _ := strconv.ParseUint(r.URL.Query().Get("minTotal"), 10, 64)
+	includeOther, _ := strconv.ParseBool(r.URL.Query().Get("includeOther"))
+	if !includeOther {
+		// includeOthers 是 includeOther 的别名。
+		includeOther, _ = strconv.ParseBool(r.URL.Query().Get("includeOthers"))
 	}
-	query += orderByClause
 
-	// 添加分页逻辑。
-	query += " LIMIT ? OFFSET ?"
-	queryArgs = append(queryArgs, pageSize, (page-1)*pageSize)
+	// filtered 为时间范围内的记录，per_host 按主机汇总，top 为排行中的主机。
+	// 「其他」一项需要排行之外的主机的汇总，其中 sourceIPs 为这些主机的记录中不同源 IP 的数量，不能由各主机的值相加得到，
+	// 因此从 filtered 重新统计。计算 share 所需的总流量 grandTotal 同样来自 per_host，包括排行之外和低于 minTotal 的主机。
+	// 所有部分在同一条语句中完成，只需一次查询。
+	// 排行不区分时间段，完整的日期可以从按天汇总表 daily_rollup 读取，见 summarySource。
+	source, args := summarySource("%Y-%m-%d", true, " AND host != ''", nil, startDate, endDate)
+	query := `
+		WITH filtered AS (
+			SELECT host, sourceIP, upload, download, connections
+			FROM ` + source + `
+		), per_host AS (
+			SELECT
+				host,
+				SUM(upload) as upload,
+				SUM(download) as download,
+				SUM(upload) + SUM(download) as total,
+				SUM(connections) as connections,
+				COUNT(DISTINCT sourceIP) as sourceIPs
+			FROM filtered
+			GROUP BY host
+		), top AS (
+			SELECT * FROM per_host`
+
+	scale := sampleScalerFor(w, r)
+	if minTotal > 0 {
+		// 排行按主机汇总，因此阈值作用于主机在时间范围内的总流量。
+		// 开启抽样时阈值针对的是放大后的估计值，数据库中的是抽样后的原始值，因此按比例缩小阈值。
+		// 低于阈值的主机不出现在排行中，但仍计入「其他」。
+		query += " WHERE total >= ?"
+		args = append(args, float64(minTotal)/float64(scale))
+	}
+	query += ` ORDER BY total DESC LIMIT ?
+		)
+		SELECT host, upload, download, total, connections, sourceIPs, 0 AS hosts, (SELECT SUM(total) FROM per_host) AS grandTotal FROM top`
+	args = append(args, limit)
+	if includeOther {
+		label := defaultSummaryOtherLabel
+		if cfg, ok := r.Context().Value("config").(*Config); ok && cfg.SummaryOtherLabel != "" {
+			label = cfg.SummaryOtherLabel
+		}
+		// 没有排行之外的主机时不追加「其他」。
+		query += `
+		UNION ALL
+		SELECT ?, upload, download, total, connections, sourceIPs, hosts, (SELECT SUM(total) FROM per_host) AS grandTotal FROM (
+			SELECT
+				SUM(upload) as upload,
+				SUM(download) as download,
+				SUM(total) as total,
+				SUM(connections) as connections,
+				(SELECT COUNT(DISTINCT sourceIP) FROM filtered WHERE host NOT IN (SELECT host FROM top)) as sourceIPs,
+				COUNT(*) as hosts
+			FROM per_host
+			WHERE host NOT IN (SELECT host FROM top)
+		) WHERE hosts > 0`
+		args = append(args, label)
+	}
+	// 复合查询的结果没有固定的顺序，按 hosts 排序让「其他」一项排在最后。
+	query += " ORDER BY hosts, total DESC"
 
-	// 执行最终的查询。
-	rows, err := db.Query(query, queryArgs...)
+	rows, err := timedQuery(r.Context(), db, query, args...)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
-	// 扫描查询结果到 ConnectionInfo 结构体切片中。
-	var connections []ConnectionInfo
-	for rows.Next() {
-		var conn Connection
-		var start int64
-		var metadata Metadata
-		var chain sql.NullString
+	type HostSummary struct {
+		Host        string  `json:"host"`
+		Upload      uint64  `json:"upload"`
+		Download    uint64  `json:"download"`
+		Total       uint64  `json:"total"`
+		Connections uint64  `json:"connections"`     // 贡献该流量的原始连接数（已计入合并记录所代表的连接数）。
+		SourceIPs   uint64  `json:"sourceIPs"`       // 访问过该主机的不同源 IP 数。
+		Share       float64 `json:"share"`           // 占时间范围内所有主机总流量的比例 (0-1)。
+		Other       bool    `json:"other,omitempty"` // 是否为汇总排行之外所有主机的「其他」一项。
+		Hosts       uint64  `json:"hosts,omitempty"` // 「其他」一项包含的主机数。
+	}
 
-		err := rows.Scan(&conn.ID, &metadata.SourceIP, &metadata.Host, &conn.Upload, &conn.Download, &start, &chain)
+	var summaries []HostSummary
+	for rows.Next() {
+		var summary HostSummary
+		var grandTotal uint64
+		err := rows.Scan(&summary.Host, &summary.Upload, &summary.Download, &summary.Total, &summary.Connections, &summary.SourceIPs, &summary.Hosts, &grandTotal)
 		if err != nil {
 			log.Printf("扫描数据库行失败: %v", err)
 			continue
 		}
-
-		conn.Start = time.Unix(start, 0)
-		conn.Metadata = metadata
-		if chain.Valid {
-			conn.Chains = []string{chain.String}
-		} else {
-			conn.Chains = []string{}
+		summary.Other = summary.Hosts > 0
+		// 比例在放大之前计算，抽样的采样率不影响结果。
+		if grandTotal > 0 {
+			summary.Share = float64(summary.Total) / float64(grandTotal)
 		}
-
-		connections = append(connections, ConnectionInfo{
-			Host:     conn.Metadata.Host,
-			SourceIP: conn.Metadata.SourceIP,
-			Upload:   conn.Upload,
-			Download: conn.Download,
-			Start:    conn.Start,
-			Chains:   conn.Chains,
-		})
+		scale.Scale(&summary.Upload, &summary.Download, &summary.Total, &summary.Connections)
+		summaries = append(summaries, summary)
 	}
 
-	// 返回包含分页信息的 JSON 响应。
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"total":      total,
-		"page":       page,
-		"pageSize":   pageSize,
-		"totalPages": (total + pageSize - 1) / pageSize,
-		"data":       connections,
-	})
+	json.NewEncoder(w).Encode(summaries)
 }
 
-// getTrafficSummaryHandler 是处理 `/api/summary/traffic` GET 请求的 HTTP Handler。
-// 它用于获取按时间（小时或天）分组的流量汇总数据，用于绘制图表。
-func getTrafficSummaryHandler(w http.ResponseWriter, r *http.Request) {
+// getNetworkSummaryHandler 是处理 `/api/summary/network` GET 请求的 HTTP Handler。
+// 它返回按网络类型（tcp / udp）分组的总流量，用于查看有多少流量来自 UDP（如视频、QUIC）。
+// 在记录 network 字段之前写入的旧数据归入 `unknown`。
+func getNetworkSummaryHandler(w http.ResponseWriter, r *http.Request) {
 	db, ok := r.Context().Value("db").(*sql.DB)
 	if !ok {
 		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
 		return
 	}
 
-	// 解析查询参数：host, granularity, startDate, endDate。
-	host := r.URL.Query().Get("host")
-	granularity := r.URL.Query().Get("granularity")
-	if granularity != "hour" && granularity != "day" {
-		granularity = "day" // 默认粒度为天。
-	}
+	// 解析查询参数：startDate, endDate。
 	startDate, _ := strconv.ParseInt(r.URL.Query().Get("startDate"), 10, 64)
 	endDate, _ := strconv.ParseInt(r.URL.Query().Get("endDate"), 10, 64)
 
-	// 根据粒度选择不同的 `strftime` 格式。
-	var format string
-	if granularity == "hour" {
-		format = "%Y-%m-%d %H:00:00"
-	} else {
-		format = "%Y-%m-%d 00:00:00"
-	}
-
-	// 构建 SQL 查询。
 	query := `
 		SELECT
-			strftime(?, datetime(start, 'unixepoch')) as time,
+			COALESCE(NULLIF(network, ''), 'unknown') as network,
 			SUM(upload) as upload,
-			SUM(download) as download
+			SUM(download) as download,
+			SUM(upload) + SUM(download) as total,
+			SUM(connections) as connections
 		FROM connections
 		WHERE 1=1
 	`
-	args := []interface{}{format}
+	args := []interface{}{}
 
-	if host != "" {
-		query += " AND host = ?"
-		args = append(args, host)
-	}
 	if startDate > 0 {
 		query += " AND start >= ?"
 		args = append(args, startDate)
@@ -423,29 +1329,33 @@ func getTrafficSummaryHandler(w http.ResponseWriter, r *http.Request) {
 		args = append(args, endDate)
 	}
 
-	query += " GROUP BY time ORDER BY time"
+	query += " GROUP BY 1 ORDER BY total DESC"
 
-	rows, err := db.Query(query, args...)
+	rows, err := timedQuery(r.Context(), db, query, args...)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
-	type TrafficSummary struct {
-		Time     string `json:"time"`
-		Upload   uint64 `json:"upload"`
-		Download uint64 `json:"download"`
+	type NetworkSummary struct {
+		Network     string `json:"network"`
+		Upload      uint64 `json:"upload"`
+		Download    uint64 `json:"download"`
+		Total       uint64 `json:"total"`
+		Connections uint64 `json:"connections"`
 	}
 
-	var summaries []TrafficSummary
+	scale := sampleScalerFor(w, r)
+	summaries := []NetworkSummary{}
 	for rows.Next() {
-		var summary TrafficSummary
-		err := rows.Scan(&summary.Time, &summary.Upload, &summary.Download)
+		var summary NetworkSummary
+		err := rows.Scan(&summary.Network, &summary.Upload, &summary.Download, &summary.Total, &summary.Connections)
 		if err != nil {
 			log.Printf("扫描数据库行失败: %v", err)
 			continue
 		}
+		scale.Scale(&summary.Upload, &summary.Download, &summary.Total, &summary.Connections)
 		summaries = append(summaries, summary)
 	}
 
@@ -453,9 +1363,13 @@ func getTrafficSummaryHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(summaries)
 }
 
-// getHostSummaryHandler 是处理 `/api/summary/hosts` GET 请求的 HTTP Handler。
-// 它用于获取按总流量排序的主机列表，即流量排行榜。
-func getHostSummaryHandler(w http.ResponseWriter, r *http.Request) {
+// noRuleLabel 是没有记录匹配规则的连接（包括记录 rule 字段之前写入的旧数据）在规则统计中的分组名称。
+const noRuleLabel = "(no rule)"
+
+// getRuleSummaryHandler 是处理 `/api/summary/rules` GET 请求的 HTTP Handler。
+// 它返回按 Clash 规则 (rule + rulePayload) 分组的流量汇总，按总流量降序排列，
+// 用于找出真正起作用的规则。从未匹配过流量的规则不会出现在结果中。
+func getRuleSummaryHandler(w http.ResponseWriter, r *http.Request) {
 	db, ok := r.Context().Value("db").(*sql.DB)
 	if !ok {
 		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
@@ -463,23 +1377,22 @@ func getHostSummaryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 解析查询参数：limit, startDate, endDate。
-	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
-	if limit <= 0 {
-		limit = 10 // 默认返回前 10 名。
-	}
+	limit := parseLimit(w, r, 10) // 与主机排行一致，默认返回前 10 名。
 	startDate, _ := strconv.ParseInt(r.URL.Query().Get("startDate"), 10, 64)
 	endDate, _ := strconv.ParseInt(r.URL.Query().Get("endDate"), 10, 64)
 
 	query := `
 		SELECT
-			host,
+			COALESCE(NULLIF(rule, ''), ?) as rule,
+			COALESCE(rulePayload, '') as rulePayload,
 			SUM(upload) as upload,
 			SUM(download) as download,
-			SUM(upload) + SUM(download) as total
+			SUM(upload) + SUM(download) as total,
+			SUM(connections) as connections
 		FROM connections
-		WHERE host != ''
+		WHERE 1=1
 	`
-	args := []interface{}{}
+	args := []interface{}{noRuleLabel}
 
 	if startDate > 0 {
 		query += " AND start >= ?"
@@ -490,31 +1403,35 @@ func getHostSummaryHandler(w http.ResponseWriter, r *http.Request) {
 		args = append(args, endDate)
 	}
 
-	query += " GROUP BY host ORDER BY total DESC LIMIT ?"
+	query += " GROUP BY 1, 2 ORDER BY total DESC LIMIT ?"
 	args = append(args, limit)
 
-	rows, err := db.Query(query, args...)
+	rows, err := timedQuery(r.Context(), db, query, args...)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
-	type HostSummary struct {
-		Host     string `json:"host"`
-		Upload   uint64 `json:"upload"`
-		Download uint64 `json:"download"`
-		Total    uint64 `json:"total"`
+	type RuleSummary struct {
+		Rule        string `json:"rule"`        // 规则类型，如 `DomainSuffix`、`GeoIP`、`Match`。
+		RulePayload string `json:"rulePayload"` // 规则内容，如 `google.com`、`CN`。`Match` 等规则为空字符串。
+		Upload      uint64 `json:"upload"`
+		Download    uint64 `json:"download"`
+		Total       uint64 `json:"total"`
+		Connections uint64 `json:"connections"`
 	}
 
-	var summaries []HostSummary
+	scale := sampleScalerFor(w, r)
+	summaries := []RuleSummary{}
 	for rows.Next() {
-		var summary HostSummary
-		err := rows.Scan(&summary.Host, &summary.Upload, &summary.Download, &summary.Total)
+		var summary RuleSummary
+		err := rows.Scan(&summary.Rule, &summary.RulePayload, &summary.Upload, &summary.Download, &summary.Total, &summary.Connections)
 		if err != nil {
 			log.Printf("扫描数据库行失败: %v", err)
 			continue
 		}
+		scale.Scale(&summary.Upload, &summary.Download, &summary.Total, &summary.Connections)
 		summaries = append(summaries, summary)
 	}
 
@@ -532,7 +1449,7 @@ func getHostsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	query := "SELECT DISTINCT host FROM connections WHERE host != '' ORDER BY host"
-	rows, err := db.Query(query)
+	rows, err := timedQuery(r.Context(), db, query)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
 		return
@@ -553,8 +1470,110 @@ func getHostsHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(hosts)
 }
 
+// NewHost 是 `/api/hosts/new` 返回的一项：一个近期首次出现的主机及其迄今为止的流量。
+type NewHost struct {
+	Host        string `json:"host"`
+	FirstSeen   int64  `json:"firstSeen"` // 最早的连接开始时间（Unix 时间戳，秒）。
+	Upload      uint64 `json:"upload"`
+	Download    uint64 `json:"download"`
+	Total       uint64 `json:"total"`
+	Connections uint64 `json:"connections"`
+}
+
+// getNewHostsHandler 是处理 `/api/hosts/new` GET 请求的 HTTP Handler。
+// 它返回最早一条连接的开始时间不早于 since 的主机，用于发现新出现的遥测端点或可疑域名，
+// 按首次出现时间降序排列。支持的查询参数：
+//   - since (必填)：Unix 时间戳（秒）。
+//   - includeArchive：为 true 时同时参考归档数据库，在归档中更早出现过的主机不算新主机。
+//     归档中的原始记录已经以合并记录的形式计入主数据库，因此流量只从主数据库统计，避免重复计算。
+//   - excludeWhitelisted：为 true 时排除匹配主机后缀白名单的主机。
+func getNewHostsHandler(w http.ResponseWriter, r *http.Request) {
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "since", "since 必须是 Unix 时间戳（秒）")
+		return
+	}
+	includeArchive := r.URL.Query().Get("includeArchive") == "true"
+	excludeWhitelisted := r.URL.Query().Get("excludeWhitelisted") == "true"
+
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	// 归档中在 since 之前出现过的主机。
+	seenInArchive := map[string]bool{}
+	// 关闭归档数据库时没有归档数据，忽略 includeArchive。
+	if archiveDB := archiveDBFromContext(r); includeArchive && archiveDB != nil {
+		rows, err := timedQuery(r.Context(), archiveDB, "SELECT DISTINCT host FROM connections_archive WHERE start < ?", since)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("查询归档数据失败: %v", err), http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var host string
+			if err := rows.Scan(&host); err != nil {
+				log.Printf("扫描数据库行失败: %v", err)
+				continue
+			}
+			seenInArchive[host] = true
+		}
+		rows.Close()
+	}
+
+	var whitelist []string
+	if excludeWhitelisted {
+		if cfg, ok := r.Context().Value("config").(*Config); ok {
+			whitelist = currentHostSuffixWhitelist(cfg)
+		}
+	}
+
+	query := `
+		SELECT
+			host,
+			MIN(start) as firstSeen,
+			SUM(upload) as upload,
+			SUM(download) as download,
+			SUM(connections) as connections
+		FROM connections
+		WHERE host != ''
+		GROUP BY host
+		HAVING firstSeen >= ?
+		ORDER BY firstSeen DESC
+	`
+	rows, err := timedQuery(r.Context(), db, query, since)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	scale := sampleScalerFor(w, r)
+	hosts := []NewHost{}
+	for rows.Next() {
+		var host NewHost
+		if err := rows.Scan(&host.Host, &host.FirstSeen, &host.Upload, &host.Download, &host.Connections); err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		if seenInArchive[host.Host] {
+			continue
+		}
+		if matchesAnyDomainSuffix(host.Host, whitelist) {
+			continue
+		}
+		scale.Scale(&host.Upload, &host.Download, &host.Connections)
+		host.Total = host.Upload + host.Download
+		hosts = append(hosts, host)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hosts)
+}
+
 // getChainsHandler 是处理 `/api/chains` GET 请求的 HTTP Handler。
-// 它返回数据库中所有不重复的代理链名称列表，用于前端的筛选器。
+// 它返回数据库中所有不重复的代理链名称与 Clash 中当前所有代理名称的并集，用于前端的筛选器。
 func getChainsHandler(w http.ResponseWriter, r *http.Request) {
 	db, ok := r.Context().Value("db").(*sql.DB)
 	if !ok {
@@ -563,13 +1582,17 @@ func getChainsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	query := "SELECT DISTINCT chain FROM connections WHERE chain != '' ORDER BY chain"
-	rows, err := db.Query(query)
+	rows, err := timedQuery(r.Context(), db, query)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
+	// 合并数据库中出现过的代理链和 Clash 中当前存在的代理（见 proxies.go），
+	// 让新加入、尚未产生流量的节点也能出现在筛选器中。
+	proxyTypes := clashProxies.Types()
+	recorded := map[string]bool{}
 	var chains []string
 	for rows.Next() {
 		var chain string
@@ -577,11 +1600,63 @@ func getChainsHandler(w http.ResponseWriter, r *http.Request) {
 			log.Printf("扫描数据库行失败: %v", err)
 			continue
 		}
+		recorded[chain] = true
 		chains = append(chains, chain)
 	}
+	for name := range proxyTypes {
+		if !recorded[name] {
+			chains = append(chains, name)
+		}
+	}
+	sort.Strings(chains)
+
+	w.Header().Set("Content-Type", "application/json")
+	// 默认只返回名称列表；detail=true 时返回每个代理链是否有流量记录及其类型。
+	if r.URL.Query().Get("detail") != "true" {
+		json.NewEncoder(w).Encode(chains)
+		return
+	}
+	type ChainInfo struct {
+		Name       string `json:"name"`
+		HasTraffic bool   `json:"hasTraffic"`     // 数据库中是否有经过该代理链的记录。
+		Type       string `json:"type,omitempty"` // Clash 中的代理类型（如 `Selector`），Clash 中已不存在的代理链为空。
+	}
+	details := make([]ChainInfo, 0, len(chains))
+	for _, name := range chains {
+		details = append(details, ChainInfo{Name: name, HasTraffic: recorded[name], Type: proxyTypes[name]})
+	}
+	json.NewEncoder(w).Encode(details)
+}
+
+// getTypesHandler 是处理 `/api/types` GET 请求的 HTTP Handler。
+// 它返回数据库中所有不重复的连接类型（如 `HTTP`、`HTTPS`、`Socks5`），用于前端的筛选器。
+func getTypesHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	query := "SELECT DISTINCT type FROM connections WHERE type != '' ORDER BY type"
+	rows, err := timedQuery(r.Context(), db, query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	types := []string{}
+	for rows.Next() {
+		var connType string
+		if err := rows.Scan(&connType); err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		types = append(types, connType)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(chains)
+	json.NewEncoder(w).Encode(types)
 }
 
 // replaceHostHandler 是处理 `/api/connections/replace-host` POST 请求的 HTTP Handler。
@@ -589,8 +1664,9 @@ func getChainsHandler(w http.ResponseWriter, r *http.Request) {
 func replaceHostHandler(w http.ResponseWriter, r *http.Request) {
 	// 1. 解析请求体。
 	var req ReplaceHostRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "无效的请求体", http.StatusBadRequest)
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		status, msg := requestBodyError(err)
+		http.Error(w, msg, status)
 		return
 	}
 
@@ -626,6 +1702,11 @@ func replaceHostHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("域名替换成功，后缀: %s, 更新了 %d 条记录", req.DomainSuffix, rowsAffected)
+	// 被替换的记录可能分布在任意日期，重算整张按天汇总表。
+	if rowsAffected > 0 {
+		updateDailyRollup(db, 0, 0)
+		summaryCache.Invalidate()
+	}
 
 	// 4. 返回响应。
 	w.Header().Set("Content-Type", "application/json")
@@ -634,3 +1715,209 @@ func replaceHostHandler(w http.ResponseWriter, r *http.Request) {
 		"rowsAffected": rowsAffected,
 	})
 }
+
+// DeleteConnectionsRequest 定义了删除连接记录请求的 JSON 结构。
+// 所有过滤条件之间是 AND 关系，且至少需要提供一个，以免误删整张表。
+type DeleteConnectionsRequest struct {
+	Host      string `json:"host"`      // 主机名。
+	HostMatch string `json:"hostMatch"` // 主机名匹配方式：exact (默认) 或 suffix。
+	SourceIP  string `json:"sourceIP"`  // 源 IP 地址，精确匹配。
+	Chain     string `json:"chain"`     // 代理链名称，精确匹配。
+	StartDate int64  `json:"startDate"` // 开始时间戳（秒），包含。
+	EndDate   int64  `json:"endDate"`   // 结束时间戳（秒），包含。
+	DryRun    bool   `json:"dryRun"`    // 为 true 时只统计匹配的记录数，不删除。
+	Confirm   bool   `json:"confirm"`   // 实际删除时必须为 true，防止误操作。
+}
+
+// parseDeleteQuery 从 URL 查询参数中读取删除条件，参数名与 `/api/connections` GET 请求一致。
+func parseDeleteQuery(r *http.Request) DeleteConnectionsRequest {
+	q := r.URL.Query()
+	startDate, _ := strconv.ParseInt(q.Get("startDate"), 10, 64)
+	endDate, _ := strconv.ParseInt(q.Get("endDate"), 10, 64)
+	return DeleteConnectionsRequest{
+		Host:      q.Get("host"),
+		HostMatch: q.Get("hostMatch"),
+		SourceIP:  q.Get("sourceIP"),
+		Chain:     q.Get("chain"),
+		StartDate: startDate,
+		EndDate:   endDate,
+		DryRun:    q.Get("dryRun") == "true",
+		Confirm:   q.Get("confirm") == "true",
+	}
+}
+
+// buildDeleteFilter 根据删除请求构建 WHERE 子句及其参数。
+// 当没有提供任何过滤条件时，返回的子句为空字符串。
+func buildDeleteFilter(req DeleteConnectionsRequest) (string, []interface{}) {
+	var clauses []string
+	var args []interface{}
+
+	if req.Host != "" {
+		if strings.ToLower(req.HostMatch) == "suffix" {
+			// 后缀匹配需要满足域名边界：等于该域名本身，或以 "." + 域名 结尾。
+			clauses = append(clauses, `(host = ? OR host LIKE ? ESCAPE '\')`)
+			args = append(args, req.Host, "%."+escapeLike(req.Host))
+		} else {
+			clauses = append(clauses, "host = ?")
+			args = append(args, req.Host)
+		}
+	}
+	if req.SourceIP != "" {
+		clauses = append(clauses, "sourceIP = ?")
+		args = append(args, normalizeIP(req.SourceIP))
+	}
+	if req.Chain != "" {
+		clauses = append(clauses, "chain = ?")
+		args = append(args, req.Chain)
+	}
+	if req.StartDate > 0 {
+		clauses = append(clauses, "start >= ?")
+		args = append(args, req.StartDate)
+	}
+	if req.EndDate > 0 {
+		clauses = append(clauses, "start <= ?")
+		args = append(args, req.EndDate)
+	}
+
+	return strings.Join(clauses, " AND "), args
+}
+
+// deleteConnectionsHandler 是处理 `/api/connections` DELETE 请求的 HTTP Handler。
+// 它按过滤条件直接删除主数据库中的连接记录（不归档），用于清理无用的数据。
+// 过滤条件既可以通过 URL 查询参数传递，也可以通过 JSON 请求体传递（请求体中的字段优先）。
+// 实际删除时必须携带 confirm=true，删除在事务中执行，完成后在后台执行 VACUUM。
+func deleteConnectionsHandler(w http.ResponseWriter, r *http.Request) {
+	req := parseDeleteQuery(r)
+	// 请求体是可选的，DELETE 请求不带请求体时 Decode 会返回 io.EOF。
+	if err := decodeJSONBody(w, r, &req); err != nil && err != io.EOF {
+		status, msg := requestBodyError(err)
+		writeJSONError(w, status, "", msg)
+		return
+	}
+
+	where, args := buildDeleteFilter(req)
+	if where == "" {
+		writeJSONError(w, http.StatusBadRequest, "", "至少需要提供一个过滤条件")
+		return
+	}
+	if req.StartDate > 0 && req.EndDate > 0 && req.StartDate > req.EndDate {
+		writeJSONError(w, http.StatusBadRequest, "startDate", "startDate 不能晚于 endDate")
+		return
+	}
+	if !req.DryRun && !req.Confirm {
+		writeJSONError(w, http.StatusBadRequest, "confirm", "删除操作需要 confirm=true 确认")
+		return
+	}
+
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	// 试运行时只统计匹配的记录数。
+	if req.DryRun {
+		var count int64
+		if err := timedQueryRow(r.Context(), db, "SELECT COUNT(*) FROM connections WHERE "+where, args...).Scan(&count); err != nil {
+			http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":      "试运行完成，未删除数据",
+			"dryRun":       true,
+			"rowsAffected": count,
+		})
+		return
+	}
+
+	rowsAffected, err := deleteConnections(db, where, args)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("删除失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("按条件删除连接记录成功，删除了 %d 条记录", rowsAffected)
+	// 没有指定时间范围时 StartDate、EndDate 为 0，重算所有日期。
+	if rowsAffected > 0 {
+		updateDailyRollup(db, req.StartDate, req.EndDate)
+		summaryCache.Invalidate()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":      "删除成功",
+		"dryRun":       false,
+		"rowsAffected": rowsAffected,
+	})
+
+	// 与合并操作一样，删除大量数据后在后台执行 VACUUM 回收空间。
+	if rowsAffected >= minVacuumDeletedRows {
+		go vacuumDB(db)
+	}
+}
+
+// deleteConnections 在一个事务中删除满足 where 条件的连接记录，并返回删除的行数。
+func deleteConnections(db *sql.DB, where string, args []interface{}) (rowsAffected int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("开启事务失败: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	result, err := tx.Exec("DELETE FROM connections WHERE "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// flushHandler 是处理 `/api/flush` POST 请求的 HTTP Handler。
+// 它立即把内存缓存中的连接写入数据库，而不必等待下一次定时写入，返回写入的记录数。
+// 与定时写入共用 dbWriteMu，并发调用会依次执行；缓存为空时直接返回 0，重复调用是安全的。
+func flushHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	written, err := writeCacheToDB(r.Context(), db)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("写入数据库失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"written": written,
+	})
+}
+
+// syncHandler 是处理 `/api/sync` POST 请求的 HTTP Handler。
+// 它立即从 Clash API 获取一次连接信息存入内存缓存，而不必等待下一次定时同步，返回同步到的连接数。
+// 与定时同步共用 clashSyncMu，并发调用会依次执行。同步只会刷新缓存中的流量，重复调用是安全的。
+func syncHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, ok := r.Context().Value("config").(*Config)
+	if !ok {
+		http.Error(w, "无法获取配置", http.StatusInternalServerError)
+		return
+	}
+
+	synced, err := syncClashConnections(r.Context(), cfg)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("同步 Clash 连接信息失败: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"synced": synced,
+	})
+}
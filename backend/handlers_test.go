@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateMergeRequest(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	valid := MergeRequest{StartDate: now.Unix() - 86400, EndDate: now.Unix() - 3600, Interval: 60}
+	tests := []struct {
+		name      string
+		modify    func(*MergeRequest)
+		wantField string
+	}{
+		{"valid", func(*MergeRequest) {}, ""},
+		{"zero interval", func(r *MergeRequest) { r.Interval = 0 }, "interval"},
+		{"negative interval", func(r *MergeRequest) { r.Interval = -5 }, "interval"},
+		{"interval too large", func(r *MergeRequest) { r.Interval = maxMergeIntervalMinutes + 1 }, "interval"},
+		{"missing startDate", func(r *MergeRequest) { r.StartDate = 0 }, "startDate"},
+		{"reversed date range", func(r *MergeRequest) { r.StartDate, r.EndDate = r.EndDate, r.StartDate }, "startDate"},
+		{"empty date range", func(r *MergeRequest) { r.StartDate = r.EndDate }, "startDate"},
+		{"endDate in the future", func(r *MergeRequest) { r.EndDate = now.Unix() + 1 }, "endDate"},
+		{"blank host", func(r *MergeRequest) { r.Hosts = []string{"example.com", " "} }, "hosts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := valid
+			tt.modify(&req)
+			field, msg := validateMergeRequest(req, now)
+			if field != tt.wantField {
+				t.Errorf("validateMergeRequest() field = %q (%s), want %q", field, msg, tt.wantField)
+			}
+			if (field == "") != (msg == "") {
+				t.Errorf("validateMergeRequest() = %q, %q, want both empty or both set", field, msg)
+			}
+		})
+	}
+}
+
+// TestMergeConnectionsHandlerRejectsInvalidRequest 检查校验失败的请求在访问数据库之前就返回 400 和出错的字段。
+func TestMergeConnectionsHandlerRejectsInvalidRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantField string
+	}{
+		{"zero interval", `{"startDate": 1600000000, "endDate": 1600086400, "interval": 0}`, "interval"},
+		{"negative interval", `{"startDate": 1600000000, "endDate": 1600086400, "interval": -1}`, "interval"},
+		{"reversed date range", `{"startDate": 1600086400, "endDate": 1600000000, "interval": 60}`, "startDate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mergeConnectionsHandler(w, httptest.NewRequest(http.MethodPost, "/api/connections/merge", strings.NewReader(tt.body)))
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			var body map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body["field"] != tt.wantField || body["error"] == "" {
+				t.Errorf("body = %v, want field %q with an error message", body, tt.wantField)
+			}
+		})
+	}
+}
+
+// serveWithDB 像 dbMiddleware 一样把数据库连接放入请求的 context，再交给 handler 处理。
+func serveWithDB(db *sql.DB, handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, req.WithContext(context.WithValue(req.Context(), "db", db)))
+	return w
+}
+
+// deleteFixtureStart 是删除接口测试数据的起始时间，四条记录依次晚 100 秒。
+const deleteFixtureStart = 1700000000
+
+// seedDeleteFixture 写入删除接口测试用的四条记录：
+//
+//	a  example.com      10.0.0.1  DIRECT  +0
+//	b  www.example.com  10.0.0.2  Proxy   +100
+//	c  notexample.com   10.0.0.1  Proxy   +200
+//	d  other.org        10.0.0.2  DIRECT  +300
+func seedDeleteFixture(t *testing.T, db *sql.DB) {
+	t.Helper()
+	conn := func(id, host, sourceIP, chain string, offset int64) Connection {
+		return Connection{
+			ID:       id,
+			Metadata: Metadata{Host: host, SourceIP: sourceIP},
+			Upload:   100,
+			Download: 200,
+			Start:    time.Unix(deleteFixtureStart+offset, 0),
+			Chains:   []string{chain},
+		}
+	}
+	seedConnections(t, db,
+		conn("a", "example.com", "10.0.0.1", "DIRECT", 0),
+		conn("b", "www.example.com", "10.0.0.2", "Proxy", 100),
+		conn("c", "notexample.com", "10.0.0.1", "Proxy", 200),
+		conn("d", "other.org", "10.0.0.2", "DIRECT", 300),
+	)
+}
+
+func TestBuildDeleteFilterWithoutFilters(t *testing.T) {
+	// dryRun 和 confirm 不是过滤条件，只有它们时也不能删除全部数据。
+	if where, args := buildDeleteFilter(DeleteConnectionsRequest{HostMatch: "suffix", DryRun: true, Confirm: true}); where != "" || len(args) != 0 {
+		t.Errorf("buildDeleteFilter() = %q, %v, want no clauses", where, args)
+	}
+}
+
+func TestDeleteConnectionsHandlerFilters(t *testing.T) {
+	tests := []struct {
+		name        string
+		req         DeleteConnectionsRequest
+		wantDeleted string
+	}{
+		{"host exact", DeleteConnectionsRequest{Host: "example.com"}, "a"},
+		{"host suffix", DeleteConnectionsRequest{Host: "example.com", HostMatch: "suffix"}, "a,b"},
+		{"host suffix is case insensitive", DeleteConnectionsRequest{Host: "example.com", HostMatch: "SUFFIX"}, "a,b"},
+		{"host suffix wildcards are literal", DeleteConnectionsRequest{Host: "_xample.com", HostMatch: "suffix"}, ""},
+		{"sourceIP", DeleteConnectionsRequest{SourceIP: "10.0.0.1"}, "a,c"},
+		{"chain", DeleteConnectionsRequest{Chain: "Proxy"}, "b,c"},
+		{"startDate", DeleteConnectionsRequest{StartDate: deleteFixtureStart + 200}, "c,d"},
+		{"endDate", DeleteConnectionsRequest{EndDate: deleteFixtureStart + 100}, "a,b"},
+		{"date range", DeleteConnectionsRequest{StartDate: deleteFixtureStart + 100, EndDate: deleteFixtureStart + 200}, "b,c"},
+		{"host suffix and chain", DeleteConnectionsRequest{Host: "example.com", HostMatch: "suffix", Chain: "Proxy"}, "b"},
+		{"sourceIP and chain", DeleteConnectionsRequest{SourceIP: "10.0.0.2", Chain: "DIRECT"}, "d"},
+		{"host and date range", DeleteConnectionsRequest{Host: "example.com", HostMatch: "suffix", StartDate: deleteFixtureStart + 50, EndDate: deleteFixtureStart + 300}, "b"},
+		{"all filters", DeleteConnectionsRequest{Host: "example.com", HostMatch: "suffix", SourceIP: "10.0.0.1", Chain: "DIRECT", StartDate: deleteFixtureStart, EndDate: deleteFixtureStart + 300}, "a"},
+		{"no match", DeleteConnectionsRequest{Host: "example.com", Chain: "Proxy"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			seedDeleteFixture(t, db)
+			deleteRequest := func(req DeleteConnectionsRequest) map[string]interface{} {
+				t.Helper()
+				body, _ := json.Marshal(req)
+				w := serveWithDB(db, deleteConnectionsHandler, httptest.NewRequest(http.MethodDelete, "/api/connections", bytes.NewReader(body)))
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+				}
+				var resp map[string]interface{}
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				return resp
+			}
+			wantCount := 0
+			if tt.wantDeleted != "" {
+				wantCount = len(strings.Split(tt.wantDeleted, ","))
+			}
+
+			// 试运行只统计，不删除。
+			dryRun := tt.req
+			dryRun.DryRun = true
+			if resp := deleteRequest(dryRun); resp["rowsAffected"] != float64(wantCount) {
+				t.Errorf("dry run rowsAffected = %v, want %d", resp["rowsAffected"], wantCount)
+			}
+			if got := connectionIDs(t, db); got != "a,b,c,d" {
+				t.Fatalf("dry run left %q, want all rows", got)
+			}
+
+			confirmed := tt.req
+			confirmed.Confirm = true
+			if resp := deleteRequest(confirmed); resp["rowsAffected"] != float64(wantCount) {
+				t.Errorf("rowsAffected = %v, want %d", resp["rowsAffected"], wantCount)
+			}
+			var want []string
+			for _, id := range []string{"a", "b", "c", "d"} {
+				if !strings.Contains(","+tt.wantDeleted+",", ","+id+",") {
+					want = append(want, id)
+				}
+			}
+			if got := connectionIDs(t, db); got != strings.Join(want, ",") {
+				t.Errorf("remaining = %q, want %q", got, strings.Join(want, ","))
+			}
+		})
+	}
+}
+
+// TestDeleteConnectionsHandlerQueryParams 检查过滤条件也可以通过 URL 查询参数传递。
+func TestDeleteConnectionsHandlerQueryParams(t *testing.T) {
+	db := newTestDB(t)
+	seedDeleteFixture(t, db)
+	w := serveWithDB(db, deleteConnectionsHandler, httptest.NewRequest(http.MethodDelete, "/api/connections?sourceIP=10.0.0.2&chain=DIRECT&confirm=true", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if got := connectionIDs(t, db); got != "a,b,c" {
+		t.Errorf("remaining = %q, want %q", got, "a,b,c")
+	}
+}
+
+func TestDeleteConnectionsHandlerRejectsInvalidRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantField string
+	}{
+		{"no filters", `{"confirm": true}`, ""},
+		{"only hostMatch", `{"hostMatch": "suffix", "confirm": true}`, ""},
+		{"missing confirm", `{"host": "example.com"}`, "confirm"},
+		{"reversed date range", fmt.Sprintf(`{"startDate": %d, "endDate": %d, "confirm": true}`, deleteFixtureStart+200, deleteFixtureStart), "startDate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			seedDeleteFixture(t, db)
+			w := serveWithDB(db, deleteConnectionsHandler, httptest.NewRequest(http.MethodDelete, "/api/connections", strings.NewReader(tt.body)))
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			var body map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body["field"] != tt.wantField {
+				t.Errorf("field = %q, want %q", body["field"], tt.wantField)
+			}
+			if got := connectionIDs(t, db); got != "a,b,c,d" {
+				t.Errorf("remaining = %q, want all rows", got)
+			}
+		})
+	}
+}
+
+// TestBuildDeleteFilterNormalizesSourceIP 检查 sourceIP 过滤条件与采集时使用相同的 IP 写法。
+func TestBuildDeleteFilterNormalizesSourceIP(t *testing.T) {
+	where, args := buildDeleteFilter(DeleteConnectionsRequest{SourceIP: "[fe80::1%eth0]"})
+	if where != "sourceIP = ?" || len(args) != 1 || args[0] != "fe80::1" {
+		t.Errorf("buildDeleteFilter() = %q, %v, want sourceIP = fe80::1", where, args)
+	}
+}
+
+// trafficFixtureDay 是 2023-11-14 00:00:00 UTC，流量汇总测试的数据分布在这一天和下一天。
+const trafficFixtureDay = 1699920000
+
+// seedTrafficFixture 写入流量汇总测试用的记录，上传流量各不相同，汇总结果可以唯一地确定参与计算的记录：
+//
+//	a  example.com  10.0.0.1  HK-01  第一天  1
+//	b  example.com  10.0.0.2  US-01  第一天  2
+//	c  other.org    10.0.0.1  HK-01  第二天  4
+//	d  example.com  10.0.0.1  HK-01  第二天  8
+//	e  other.org    10.0.0.1  US-01  第二天  16
+func seedTrafficFixture(t *testing.T, db *sql.DB) {
+	t.Helper()
+	conn := func(id, host, sourceIP, chain string, start int64, upload uint64) Connection {
+		return Connection{
+			ID:       id,
+			Metadata: Metadata{Host: host, SourceIP: sourceIP},
+			Upload:   upload,
+			Download: upload * 10,
+			Start:    time.Unix(start, 0),
+			Chains:   []string{chain},
+		}
+	}
+	seedConnections(t, db,
+		conn("a", "example.com", "10.0.0.1", "HK-01", trafficFixtureDay+3600, 1),
+		conn("b", "example.com", "10.0.0.2", "US-01", trafficFixtureDay+7200, 2),
+		conn("c", "other.org", "10.0.0.1", "HK-01", trafficFixtureDay+86400+3600, 4),
+		conn("d", "example.com", "10.0.0.1", "HK-01", trafficFixtureDay+86400+7200, 8),
+		conn("e", "other.org", "10.0.0.1", "US-01", trafficFixtureDay+86400+7200, 16),
+	)
+}
+
+// trafficFixtureIDs 把 seedTrafficFixture 中记录的上传流量映射回 id。
+var trafficFixtureIDs = map[uint64]string{1: "a", 2: "b", 4: "c", 8: "d", 16: "e"}
+
+func TestGetTrafficSummaryHandlerFilters(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string // 每个时间段的 `time=upload`，以 `,` 分隔。
+	}{
+		{"no filters", "", "2023-11-14 00:00:00=3,2023-11-15 00:00:00=28"},
+		{"host", "host=example.com", "2023-11-14 00:00:00=3,2023-11-15 00:00:00=8"},
+		{"chain", "chain=HK-01", "2023-11-14 00:00:00=1,2023-11-15 00:00:00=12"},
+		{"sourceIP", "sourceIP=10.0.0.1", "2023-11-14 00:00:00=1,2023-11-15 00:00:00=28"},
+		{"sourceIP is normalized", "sourceIP=::ffff:10.0.0.2", "2023-11-14 00:00:00=2"},
+		{"host and chain", "host=example.com&chain=HK-01", "2023-11-14 00:00:00=1,2023-11-15 00:00:00=8"},
+		{"host and sourceIP", "host=example.com&sourceIP=10.0.0.2", "2023-11-14 00:00:00=2"},
+		{"chain and sourceIP", "chain=US-01&sourceIP=10.0.0.1", "2023-11-15 00:00:00=16"},
+		{"host, chain and sourceIP", "host=other.org&chain=HK-01&sourceIP=10.0.0.1", "2023-11-15 00:00:00=4"},
+		{"no match", "host=example.com&chain=US-01&sourceIP=10.0.0.1", ""},
+		{"hourly", "granularity=hour&chain=HK-01", "2023-11-14 01:00:00=1,2023-11-15 01:00:00=4,2023-11-15 02:00:00=8"},
+		{"date range", fmt.Sprintf("sourceIP=10.0.0.1&startDate=%d&endDate=%d", trafficFixtureDay+86400, trafficFixtureDay+86400+3600), "2023-11-15 00:00:00=4"},
+	}
+	db := newTestDB(t)
+	seedTrafficFixture(t, db)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveWithDB(db, getTrafficSummaryHandler, httptest.NewRequest(http.MethodGet, "/api/summary/traffic?"+tt.query, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			var summaries []TrafficSummary
+			if err := json.Unmarshal(w.Body.Bytes(), &summaries); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, s := range summaries {
+				if s.Download != s.Upload*10 {
+					t.Errorf("%s: upload = %d, download = %d, want download = 10 * upload", s.Time, s.Upload, s.Download)
+				}
+				got = append(got, fmt.Sprintf("%s=%d", s.Time, s.Upload))
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("summary = %q, want %q", strings.Join(got, ","), tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectionSortExpr(t *testing.T) {
+	for field, column := range connectionSortColumns {
+		if expr, ok := connectionSortExpr(field); !ok || expr != column.expr {
+			t.Errorf("connectionSortExpr(%q) = %q, %v, want %q", field, expr, ok, column.expr)
+		}
+		// 只有位于 metadata 下的字段可以写成 `metadata.<字段>`。
+		expr, ok := connectionSortExpr("metadata." + field)
+		if ok != column.metadata || (ok && expr != column.expr) {
+			t.Errorf("connectionSortExpr(%q) = %q, %v, want ok = %v", "metadata."+field, expr, ok, column.metadata)
+		}
+	}
+	for alias, field := range connectionSortAliases {
+		if expr, ok := connectionSortExpr(alias); !ok || expr != connectionSortColumns[field].expr {
+			t.Errorf("connectionSortExpr(%q) = %q, %v, want %q", alias, expr, ok, connectionSortColumns[field].expr)
+		}
+	}
+	for _, sortBy := range []string{"", "unknown", "Start", "metadata.", "metadata.chain", "id", "start; DROP TABLE connections", "start DESC", "upload+download"} {
+		if expr, ok := connectionSortExpr(sortBy); ok {
+			t.Errorf("connectionSortExpr(%q) = %q, true, want unsupported", sortBy, expr)
+		}
+	}
+}
+
+func TestGetConnectionsHandlerSortBy(t *testing.T) {
+	db := newTestDB(t)
+	seedTrafficFixture(t, db)
+	get := func(query string) *httptest.ResponseRecorder {
+		return serveWithDB(db, getConnectionsHandler, httptest.NewRequest(http.MethodGet, "/api/connections?"+url.Values{"sortBy": {query}}.Encode(), nil))
+	}
+
+	// 每个允许的字段和别名都能生成有效的 SQL。
+	var sortBys []string
+	for field, column := range connectionSortColumns {
+		sortBys = append(sortBys, field)
+		if column.metadata {
+			sortBys = append(sortBys, "metadata."+field)
+		}
+	}
+	for alias := range connectionSortAliases {
+		sortBys = append(sortBys, alias)
+	}
+	for _, sortBy := range sortBys {
+		if w := get(sortBy); w.Code != http.StatusOK {
+			t.Errorf("sortBy=%s: status = %d, body = %s", sortBy, w.Code, w.Body.String())
+		}
+	}
+
+	for _, sortBy := range []string{"unknown", "start; DROP TABLE connections", "start; DROP TABLE connections; --"} {
+		w := get(sortBy)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("sortBy=%s: status = %d, want %d", sortBy, w.Code, http.StatusBadRequest)
+			continue
+		}
+		var body map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body["field"] != "sortBy" || !strings.Contains(body["error"], sortBy) {
+			t.Errorf("sortBy=%s: body = %v, want a sortBy error naming the value", sortBy, body)
+		}
+	}
+	if got := connectionIDs(t, db); got != "a,b,c,d,e" {
+		t.Errorf("connections after injection attempts = %q, want all rows", got)
+	}
+}
+
+// TestGetConnectionsHandlerSortOrder 检查 total 按上传与下载之和排序，chain 与别名 chains 的结果相同。
+func TestGetConnectionsHandlerSortOrder(t *testing.T) {
+	db := newTestDB(t)
+	seedTrafficFixture(t, db)
+	ids := func(query string) string {
+		t.Helper()
+		w := serveWithDB(db, getConnectionsHandler, httptest.NewRequest(http.MethodGet, "/api/connections?"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body = %s", query, w.Code, w.Body.String())
+		}
+		var resp struct {
+			Data []ConnectionInfo `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		// 响应中没有 id，测试数据中每条记录的上传流量都不同，用它找回 id。
+		var got []string
+		for _, conn := range resp.Data {
+			got = append(got, trafficFixtureIDs[conn.Upload])
+		}
+		return strings.Join(got, ",")
+	}
+	tests := []struct {
+		query, want string
+	}{
+		{"sortBy=total&sortOrder=desc", "e,d,c,b,a"},
+		{"sortBy=total&sortOrder=asc", "a,b,c,d,e"},
+		{"sortBy=chain", "a,c,d,b,e"},
+		{"sortBy=chains", "a,c,d,b,e"},
+		{"sortBy=metadata.host&sortOrder=desc", "c,e,a,b,d"},
+	}
+	for _, tt := range tests {
+		if got := ids(tt.query); got != tt.want {
+			t.Errorf("%s: ids = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+// TestGetConnectionsHandlerStablePaging 写入开始时间和流量都相同的记录，逐页读取时每条记录必须恰好出现一次，
+// 且排序字段相同的记录按 id 升序排列。SQLite 对相同的排序键通常按扫描顺序返回，即使没有第二排序键，
+// 单独检查不重复、不遗漏也可能通过，因此这里同时检查顺序：记录的插入顺序与 id 顺序不同。
+func TestGetConnectionsHandlerStablePaging(t *testing.T) {
+	const total, pageSize = 23, 5
+	db := newTestDB(t)
+	var conns []Connection
+	wantOrder := make([]string, total) // 按 id 升序排列的 host。
+	for i := 0; i < total; i++ {
+		id := (i * 7) % total
+		host := fmt.Sprintf("host-%02d.example.com", i) // 响应中没有 id，用 host 区分记录。
+		wantOrder[id] = host
+		conns = append(conns, Connection{
+			ID:       fmt.Sprintf("conn-%02d", id),
+			Metadata: Metadata{Host: host, SourceIP: "10.0.0.1"},
+			Upload:   100,
+			Download: 100,
+			Start:    time.Unix(1700000000, 0),
+			Chains:   []string{"DIRECT"},
+		})
+	}
+	seedConnections(t, db, conns...)
+	r := newRouter(db, nil, &Config{})
+
+	for _, sort := range []string{"", "&sortBy=start&sortOrder=desc", "&sortBy=upload&sortOrder=asc", "&sortBy=total&sortOrder=desc", "&sortBy=chain"} {
+		var got []string
+		for page := 1; page <= (total+pageSize-1)/pageSize; page++ {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/connections?page=%d&pageSize=%d%s", page, pageSize, sort), nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("%q page %d: status = %d, body = %s", sort, page, w.Code, w.Body.String())
+			}
+			var resp struct {
+				Data []ConnectionInfo `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			for _, conn := range resp.Data {
+				got = append(got, conn.Host)
+			}
+		}
+
+		seen := map[string]int{}
+		for _, host := range got {
+			seen[host]++
+		}
+		if len(seen) != total {
+			t.Errorf("%q: saw %d distinct rows across all pages, want %d", sort, len(seen), total)
+		}
+		for host, n := range seen {
+			if n != 1 {
+				t.Errorf("%q: %s appeared on %d pages", sort, host, n)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(wantOrder, ",") {
+			t.Errorf("%q: rows with equal sort keys are not ordered by id:\n got %v\nwant %v", sort, got, wantOrder)
+		}
+	}
+}
+
+// TestGetConnectionsHandlerHostMatch 检查各种 hostMatch 的结果，host 中的 `%`、`_` 和 `\` 按字面匹配，未知的取值返回 400。
+func TestGetConnectionsHandlerHostMatch(t *testing.T) {
+	db := newTestDB(t)
+	hosts := []string{"a_b.example.com", "axb.example.com", "100%.example.com", "1000.example.com", `back\slash.com`, "example.com"}
+	for i, host := range hosts {
+		seedConnections(t, db, Connection{ID: strconv.Itoa(i), Metadata: Metadata{Host: host, SourceIP: "10.0.0.1"}, Start: time.Unix(1700000000, 0)})
+	}
+	hostsFor := func(query string) (int, string) {
+		t.Helper()
+		w := serveWithDB(db, getConnectionsHandler, httptest.NewRequest(http.MethodGet, "/api/connections?sortBy=host&"+query, nil))
+		if w.Code != http.StatusOK {
+			return w.Code, ""
+		}
+		var resp struct {
+			Data []ConnectionInfo `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, conn := range resp.Data {
+			got = append(got, conn.Host)
+		}
+		return w.Code, strings.Join(got, ",")
+	}
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		want       string
+	}{
+		{url.Values{"host": {"a_b"}}.Encode(), http.StatusOK, "a_b.example.com"},
+		{url.Values{"host": {"100%"}, "hostMatch": {"contains"}}.Encode(), http.StatusOK, "100%.example.com"},
+		{url.Values{"host": {"a_b."}, "hostMatch": {"prefix"}}.Encode(), http.StatusOK, "a_b.example.com"},
+		{url.Values{"host": {"%.example.com"}, "hostMatch": {"suffix"}}.Encode(), http.StatusOK, "100%.example.com"},
+		{url.Values{"host": {`back\slash`}, "hostMatch": {"prefix"}}.Encode(), http.StatusOK, `back\slash.com`},
+		{url.Values{"host": {"example.com"}, "hostMatch": {"exact"}}.Encode(), http.StatusOK, "example.com"},
+		{url.Values{"host": {"example.com"}, "hostMatch": {"regex"}}.Encode(), http.StatusBadRequest, ""},
+		{url.Values{"hostMatch": {"regex"}}.Encode(), http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		status, got := hostsFor(tt.query)
+		if status != tt.wantStatus || got != tt.want {
+			t.Errorf("%s: status = %d, hosts = %q, want %d, %q", tt.query, status, got, tt.wantStatus, tt.want)
+		}
+	}
+}
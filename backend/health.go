@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 这个文件记录与 Clash API 的连接状态，并提供 `/api/health` 健康检查接口。
+// URL 或 Token 配置错误时，程序仍会正常启动，只是每秒记录一次失败日志，很容易被忽略。
+// 因此启动时会先尝试连接一次并给出明确的提示，之后每次同步的结果也会被记录下来，
+// 让健康检查能区分“从未成功连接过”（多半是配置错误）和“之前正常、现在失败”（多半是 Clash 挂了）。
+
+// Clash 连接状态。
+const (
+	ClashStateNeverConnected = "never_connected" // 从未成功连接过。
+	ClashStateConnected      = "connected"       // 最近一次同步成功。
+	ClashStateFailing        = "failing"         // 曾经成功过，但最近一次同步失败。
+)
+
+// ClashHealth 是 Clash 连接状态的快照。
+type ClashHealth struct {
+	State               string `json:"state"`
+	LastSuccess         int64  `json:"lastSuccess,omitempty"` // 最近一次成功同步的时间（Unix 时间戳，秒）。
+	LastError           string `json:"lastError,omitempty"`   // 最近一次失败的错误信息。
+	LastErrorAt         int64  `json:"lastErrorAt,omitempty"` // 最近一次失败的时间（Unix 时间戳，秒）。
+	ConsecutiveFailures int    `json:"consecutiveFailures"`   // 自最近一次成功以来的连续失败次数。
+	SkippedPolls        int64  `json:"skippedPolls"`          // 程序启动以来因上一次同步尚未结束而跳过的定时同步次数。
+}
+
+// clashHealthTracker 记录每次与 Clash API 同步的结果。
+type clashHealthTracker struct {
+	mu     sync.Mutex
+	health ClashHealth
+}
+
+// clashHealth 是全局唯一的 Clash 连接状态记录。
+var clashHealth = &clashHealthTracker{health: ClashHealth{State: ClashStateNeverConnected}}
+
+// Record 记录一次同步的结果。err 为 nil 表示成功。
+func (t *clashHealthTracker) Record(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now().Unix()
+	if err == nil {
+		t.health.State = ClashStateConnected
+		t.health.LastSuccess = now
+		t.health.ConsecutiveFailures = 0
+		return
+	}
+	if t.health.LastSuccess > 0 {
+		t.health.State = ClashStateFailing
+	}
+	t.health.LastError = err.Error()
+	t.health.LastErrorAt = now
+	t.health.ConsecutiveFailures++
+}
+
+// RecordSkippedPoll 记录一次因上一次同步尚未结束而跳过的定时同步。
+func (t *clashHealthTracker) RecordSkippedPoll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.health.SkippedPolls++
+}
+
+// Snapshot 返回当前的连接状态。
+func (t *clashHealthTracker) Snapshot() ClashHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.health
+}
+
+// clashErrorHint 根据错误类型给出可操作的排查建议，无法识别时返回空字符串。
+func clashErrorHint(err error, cfg *Config) string {
+	var statusErr *ClashStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			// 不同的 Clash 分支和版本接受的认证方式不同，Token 正确时也可能因为认证方式不对而返回 401。
+			return fmt.Sprintf("认证失败，请检查 CLASH_API_TOKEN（-t）是否与 Clash 的 secret 一致。"+
+				"如果确认 Token 无误，当前的认证方式 %q 可能不被支持，可以尝试设置 CLASH_API_AUTH_STYLE 为 %s 中的其他值。",
+				cfg.ClashAPIAuthStyle, "bearer、query、header:<name>、basic")
+		case http.StatusNotFound:
+			return "接口不存在，请检查 CLASH_API_URL（-url）是否以 /connections 结尾。"
+		}
+		return ""
+	}
+	var netErr net.Error
+	var opErr *net.OpError
+	if errors.As(err, &opErr) || errors.As(err, &netErr) {
+		return "无法连接到 Clash API，请检查 CLASH_API_URL（-url）的地址和端口，以及 Clash 的 external-controller 是否已开启。"
+	}
+	return ""
+}
+
+// checkClashAPI 在启动时尝试连接一次 Clash API，并记录结果。
+func checkClashAPI(ctx context.Context, cfg *Config) error {
+	_, err := GetClashConnections(ctx, cfg)
+	clashHealth.Record(err)
+	return err
+}
+
+// getHealthHandler 是处理 `/api/health` GET 请求的 HTTP Handler。
+// 它返回 Clash 连接状态、主数据库的可用性和缓存写入数据库的状态。
+// Clash 已连接、数据库可用且最近一次写入没有失败时返回 200，否则返回 503，
+// 便于 Docker 等工具直接根据状态码判断服务是否健康。
+func getHealthHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	clash := clashHealth.Snapshot()
+	dbWrite := dbWriteHealth.Snapshot()
+	dbStatus := "ok"
+	if err := db.PingContext(r.Context()); err != nil {
+		dbStatus = err.Error()
+	}
+
+	status := http.StatusOK
+	overall := "ok"
+	if clash.State != ClashStateConnected || dbStatus != "ok" || dbWrite.ConsecutiveFailures > 0 {
+		status = http.StatusServiceUnavailable
+		overall = "unhealthy"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":        overall,
+		"clash":         clash,
+		"database":      dbStatus,
+		"databaseWrite": dbWrite,
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClashErrorHintUnauthorized(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	cfg := &Config{ClashAPIURL: server.URL + "/connections", ClashAPIToken: "wrong", ClashAPIAuthStyle: ClashAuthBearer}
+	_, err := GetClashConnections(context.Background(), cfg)
+	if err == nil {
+		t.Fatal("GetClashConnections() error = nil, want 401")
+	}
+	hint := clashErrorHint(err, cfg)
+	for _, want := range []string{"CLASH_API_TOKEN", "CLASH_API_AUTH_STYLE", `"bearer"`} {
+		if !strings.Contains(hint, want) {
+			t.Errorf("clashErrorHint() = %q, want it to mention %s", hint, want)
+		}
+	}
+}
+
+func TestClashErrorHint(t *testing.T) {
+	cfg := &Config{ClashAPIAuthStyle: ClashAuthBearer}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"forbidden", &ClashStatusError{StatusCode: http.StatusForbidden, Status: "403 Forbidden"}, "CLASH_API_AUTH_STYLE"},
+		{"not found", &ClashStatusError{StatusCode: http.StatusNotFound, Status: "404 Not Found"}, "/connections"},
+		{"server error", &ClashStatusError{StatusCode: http.StatusInternalServerError, Status: "500 Internal Server Error"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hint := clashErrorHint(tt.err, cfg)
+			if tt.want == "" && hint != "" || !strings.Contains(hint, tt.want) {
+				t.Errorf("clashErrorHint() = %q, want it to contain %q", hint, tt.want)
+			}
+		})
+	}
+}
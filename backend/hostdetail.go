@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// 这个文件包含了主机详情接口。点击流量排行榜中的某个主机时，
+// 前端需要该主机的总流量、首次/最近出现时间、主要来源设备、主要代理链和每日趋势，
+// 这里把这些查询打包到一个接口中，避免前端发起多次请求。
+
+// HostDetail 是 `/api/hosts/{host}/detail` 的响应结构。
+type HostDetail struct {
+	Host         string              `json:"host"`
+	Upload       uint64              `json:"upload"`       // 时间范围内的上传流量。
+	Download     uint64              `json:"download"`     // 时间范围内的下载流量。
+	Total        uint64              `json:"total"`        // 时间范围内的总流量。
+	Connections  uint64              `json:"connections"`  // 时间范围内的原始连接数。
+	FirstSeen    int64               `json:"firstSeen"`    // 有记录以来最早的连接开始时间（Unix 时间戳，秒），不受时间范围限制。
+	LastSeen     int64               `json:"lastSeen"`     // 有记录以来最晚的连接开始时间（Unix 时间戳，秒），不受时间范围限制。
+	TopSourceIPs []HostDetailSource  `json:"topSourceIPs"` // 时间范围内流量最多的源 IP。
+	TopChains    []HostDetailChain   `json:"topChains"`    // 时间范围内流量最多的代理链。
+	Daily        []HostDetailTraffic `json:"daily"`        // 时间范围内按天汇总的流量。
+}
+
+// HostDetailSource 是主机详情中按源 IP 汇总的一项。
+type HostDetailSource struct {
+	SourceIP   string `json:"sourceIP"`
+	DeviceName string `json:"deviceName,omitempty"`
+	Upload     uint64 `json:"upload"`
+	Download   uint64 `json:"download"`
+	Total      uint64 `json:"total"`
+}
+
+// HostDetailChain 是主机详情中按代理链汇总的一项。
+type HostDetailChain struct {
+	Chain    string `json:"chain"`
+	Upload   uint64 `json:"upload"`
+	Download uint64 `json:"download"`
+	Total    uint64 `json:"total"`
+}
+
+// HostDetailTraffic 是主机详情中每日趋势的一项。
+type HostDetailTraffic struct {
+	Time     string `json:"time"`
+	Upload   uint64 `json:"upload"`
+	Download uint64 `json:"download"`
+}
+
+// getHostDetailHandler 是处理 `/api/hosts/{host}/detail` GET 请求的 HTTP Handler。
+// 支持的查询参数：startDate、endDate（限定流量统计的时间范围）和 limit（排行的条数，默认 5）。
+// 主机从未出现过时返回 404。
+func getHostDetailHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	// mux 会对路径中的 URL 编码进行解码，包含点号和短横线的主机名可以直接匹配。
+	host := mux.Vars(r)["host"]
+	limit := parseLimit(w, r, 5)
+	startDate, _ := strconv.ParseInt(r.URL.Query().Get("startDate"), 10, 64)
+	endDate, _ := strconv.ParseInt(r.URL.Query().Get("endDate"), 10, 64)
+
+	detail := HostDetail{Host: host}
+	scale := sampleScalerFor(w, r)
+
+	// 1. 首次和最近出现时间，不受时间范围限制。
+	var firstSeen, lastSeen sql.NullInt64
+	err := timedQueryRow(r.Context(), db, "SELECT MIN(start), MAX(start) FROM connections WHERE host = ?", host).Scan(&firstSeen, &lastSeen)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !firstSeen.Valid {
+		writeJSONError(w, http.StatusNotFound, "host", "主机不存在")
+		return
+	}
+	detail.FirstSeen = firstSeen.Int64
+	detail.LastSeen = lastSeen.Int64
+
+	// 以下查询共用同一组过滤条件：指定主机 + 时间范围。
+	where := " WHERE host = ?"
+	args := []interface{}{host}
+	if startDate > 0 {
+		where += " AND start >= ?"
+		args = append(args, startDate)
+	}
+	if endDate > 0 {
+		where += " AND start <= ?"
+		args = append(args, endDate)
+	}
+
+	// 2. 时间范围内的总流量。
+	err = timedQueryRow(r.Context(), db, "SELECT COALESCE(SUM(upload), 0), COALESCE(SUM(download), 0), COALESCE(SUM(connections), 0) FROM connections"+where, args...).
+		Scan(&detail.Upload, &detail.Download, &detail.Connections)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	scale.Scale(&detail.Upload, &detail.Download, &detail.Connections)
+	detail.Total = detail.Upload + detail.Download
+
+	// 3. 流量最多的源 IP，附带设备名称。
+	detail.TopSourceIPs = []HostDetailSource{}
+	rows, err := timedQuery(r.Context(), db, `
+		SELECT sourceIP, name, SUM(upload), SUM(download), SUM(upload) + SUM(download) as total
+		FROM connections LEFT JOIN devices ON devices.ip = connections.sourceIP`+where+`
+		GROUP BY sourceIP ORDER BY total DESC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var item HostDetailSource
+		var sourceIP, name sql.NullString
+		if err := rows.Scan(&sourceIP, &name, &item.Upload, &item.Download, &item.Total); err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		scale.Scale(&item.Upload, &item.Download, &item.Total)
+		item.SourceIP = sourceIP.String
+		item.DeviceName = name.String
+		detail.TopSourceIPs = append(detail.TopSourceIPs, item)
+	}
+	rows.Close()
+
+	// 4. 流量最多的代理链。
+	detail.TopChains = []HostDetailChain{}
+	rows, err = timedQuery(r.Context(), db, `
+		SELECT chain, SUM(upload), SUM(download), SUM(upload) + SUM(download) as total
+		FROM connections`+where+`
+		GROUP BY chain ORDER BY total DESC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var item HostDetailChain
+		var chain sql.NullString
+		if err := rows.Scan(&chain, &item.Upload, &item.Download, &item.Total); err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		scale.Scale(&item.Upload, &item.Download, &item.Total)
+		item.Chain = chain.String
+		detail.TopChains = append(detail.TopChains, item)
+	}
+	rows.Close()
+
+	// 5. 按天汇总的流量趋势，格式与 `/api/summary/traffic` 的 day 粒度相同。
+	detail.Daily = []HostDetailTraffic{}
+	rows, err = timedQuery(r.Context(), db, `
+		SELECT strftime('%Y-%m-%d 00:00:00', datetime(start, 'unixepoch')) as time, SUM(upload), SUM(download)
+		FROM connections`+where+`
+		GROUP BY time ORDER BY time`, args...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var item HostDetailTraffic
+		if err := rows.Scan(&item.Time, &item.Upload, &item.Download); err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		scale.Scale(&item.Upload, &item.Download)
+		detail.Daily = append(detail.Daily, item)
+	}
+	rows.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// 这个文件实现了基于正则表达式的 host 改写规则。
+// 后缀白名单只能把 host 折叠为某个后缀，而像 `img-1.cdn.example.net`、`shard42.example.com`
+// 这样带编号的主机名需要更灵活的“正则 → 替换模板”映射。
+// 规则从 HOST_REWRITE_RULES_FILE 指定的文件加载，每行一条，格式为：
+//
+//	<正则表达式> => <替换模板>
+//
+// 替换模板支持 `$1`、`${name}` 等分组引用（与 regexp.ReplaceAllString 相同）。
+// 空行和以 `#` 开头的行会被忽略。规则在启动时编译一次，按文件中的顺序依次尝试，
+// 每个连接只应用第一条匹配的规则。
+
+// hostRewriteSeparator 分隔规则中的正则表达式与替换模板。
+const hostRewriteSeparator = "=>"
+
+// hostRewriteRule 是一条已编译的 host 改写规则。
+type hostRewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// hostRewriteRules 是启动时加载的 host 改写规则，加载后只读。为空时不做任何改写。
+var hostRewriteRules []hostRewriteRule
+
+// loadHostRewriteRules 读取并编译规则文件。任意一条规则无效都会返回错误，并指明行号。
+func loadHostRewriteRules(path string) ([]hostRewriteRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []hostRewriteRule
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern, replacement, ok := strings.Cut(line, hostRewriteSeparator)
+		if !ok {
+			return nil, fmt.Errorf("第 %d 行缺少 %q 分隔符", lineNo, hostRewriteSeparator)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("第 %d 行的正则表达式无效: %w", lineNo, err)
+		}
+		rules = append(rules, hostRewriteRule{pattern: re, replacement: strings.TrimSpace(replacement)})
+	}
+	return rules, scanner.Err()
+}
+
+// rewriteHost 依次尝试每条规则，用第一条匹配的规则改写 host。
+// 第二个返回值表示是否有规则匹配。
+func rewriteHost(rules []hostRewriteRule, host string) (string, bool) {
+	for _, rule := range rules {
+		if rule.pattern.MatchString(host) {
+			return rule.pattern.ReplaceAllString(host, rule.replacement), true
+		}
+	}
+	return host, false
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// 这个文件实现了字节数的易读格式（例如 `4.2 GiB`），供 API 的 `humanize=true` 参数、CSV 导出和告警消息共用。
+// 接口中的字节数始终以原始整数返回，易读格式只是额外附加的字段，方便直接阅读或在表格中展示，不适合用于计算。
+
+// humanizeByteKeys 是 `humanize=true` 时附加易读格式的字段，它们在汇总接口的响应中都以字节为单位。
+var humanizeByteKeys = []string{"upload", "download", "total", "uploadTotal", "downloadTotal", "memory"}
+
+// humanizeSuffix 是易读格式字段名的后缀，例如 `upload` 对应 `uploadHuman`。
+const humanizeSuffix = "Human"
+
+// humanizeBytes 把字节数格式化为使用二进制单位 (1 KiB = 1024 B) 的易读形式，保留一位小数，例如 `4509715660` → `4.2 GiB`。
+func humanizeBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	suffixes := []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	i := -1
+	for value >= unit && i < len(suffixes)-1 {
+		value /= unit
+		i++
+	}
+	// 四舍五入后达到 1024 时（例如 1048575 B），进到下一个单位，避免出现 `1024.0 KiB`。
+	if value >= unit-0.05 && i < len(suffixes)-1 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", value, suffixes[i])
+}
+
+// addHumanizedBytes 递归地为 v 中所有对象的字节字段（见 humanizeByteKeys）附加易读格式的字段。
+// v 必须是使用 UseNumber 解析的 JSON，数字为 json.Number。
+func addHumanizedBytes(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, child := range v {
+			addHumanizedBytes(child)
+		}
+		for _, key := range humanizeByteKeys {
+			number, ok := v[key].(json.Number)
+			if !ok {
+				continue
+			}
+			if n, err := strconv.ParseUint(number.String(), 10, 64); err == nil {
+				v[key+humanizeSuffix] = humanizeBytes(n)
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			addHumanizedBytes(child)
+		}
+	}
+}
+
+// bufferedResponseWriter 先把响应保存在内存中，由调用方决定最终写出的内容。
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// humanizedHandler 用于注册汇总接口：请求带有 `humanize=true` 时，为响应中的字节字段附加易读格式，
+// 例如 `"upload": 4509715660` 旁边增加 `"uploadHuman": "4.2 GiB"`，原始数值保持不变。
+// 只处理 200 的 JSON 响应，错误响应原样返回。它应放在 cachedSummaryHandler 之内，使缓存保存的是处理之后的响应。
+func humanizedHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("humanize") != "true" {
+			h(w, r)
+			return
+		}
+
+		bw := &bufferedResponseWriter{ResponseWriter: w}
+		h(bw, r)
+		if bw.status == 0 {
+			bw.status = http.StatusOK
+		}
+
+		body := bw.body.Bytes()
+		if bw.status == http.StatusOK {
+			dec := json.NewDecoder(bytes.NewReader(body))
+			dec.UseNumber()
+			var v interface{}
+			if err := dec.Decode(&v); err == nil {
+				addHumanizedBytes(v)
+				if humanized, err := json.Marshal(v); err == nil {
+					body = append(humanized, '\n')
+				}
+			}
+		}
+		w.WriteHeader(bw.status)
+		w.Write(body)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 这个文件实现了数据库完整性检查，用于在非正常关机（断电、强制结束进程）之后确认 SQLite 文件没有损坏。
+// 检查通过 `PRAGMA quick_check`（默认）或更彻底的 `PRAGMA integrity_check` 进行，会读取整个数据库文件，
+// 文件较大时需要几十秒甚至更久，因此 `/api/admin/integrity-check` 在后台 Goroutine 中执行检查，
+// 接口只返回检查的进度和最近一次的结果，而不是让 HTTP 请求一直等待。
+
+// 完整性检查的模式。
+const (
+	IntegrityModeQuick = "quick" // PRAGMA quick_check：跳过索引与表内容是否一致的检查，速度快得多。
+	IntegrityModeFull  = "full"  // PRAGMA integrity_check：完整检查，包括索引。
+)
+
+// 完整性检查任务的状态。
+const (
+	IntegrityStatusIdle    = "idle"    // 尚未执行过检查。
+	IntegrityStatusRunning = "running" // 正在检查。
+	IntegrityStatusDone    = "done"    // 检查已完成，结果见 ok 和 databases。
+)
+
+// IntegrityCheckResult 是一个数据库的检查结果。
+type IntegrityCheckResult struct {
+	Database string   `json:"database"`           // main（主数据库）或 archive（归档数据库）。
+	OK       bool     `json:"ok"`                 // 检查是否通过。
+	Messages []string `json:"messages,omitempty"` // 未通过时 SQLite 报告的问题，最多 100 条。
+	Error    string   `json:"error,omitempty"`    // 检查本身失败（例如文件无法读取）时的错误信息。
+}
+
+// IntegrityCheckStatus 是完整性检查任务的状态，由 `/api/admin/integrity-check` 返回。
+type IntegrityCheckStatus struct {
+	Status     string                 `json:"status"`               // idle、running 或 done。
+	Mode       string                 `json:"mode,omitempty"`       // 当前（或最近一次）检查的模式。
+	StartedAt  int64                  `json:"startedAt,omitempty"`  // 开始时间 (Unix 时间戳, 秒)。
+	FinishedAt int64                  `json:"finishedAt,omitempty"` // 完成时间 (Unix 时间戳, 秒)，检查中为 0。
+	DurationMs int64                  `json:"durationMs,omitempty"` // 检查的耗时（毫秒）。
+	OK         bool                   `json:"ok"`                   // 所有数据库是否都通过了检查，检查完成之前为 false。
+	Databases  []IntegrityCheckResult `json:"databases,omitempty"`  // 每个数据库的检查结果。
+}
+
+// integrityCheckJob 保存后台完整性检查任务的状态，同一时间只运行一个检查。
+type integrityCheckJob struct {
+	mu     sync.Mutex
+	status IntegrityCheckStatus
+}
+
+// integrityJob 是全局唯一的完整性检查任务。
+var integrityJob = &integrityCheckJob{status: IntegrityCheckStatus{Status: IntegrityStatusIdle}}
+
+// Start 在后台开始一次检查，已有检查正在进行时不重复开始。返回开始之后的状态。
+func (j *integrityCheckJob) Start(db, archiveDB *sql.DB, mode string) IntegrityCheckStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status.Status == IntegrityStatusRunning {
+		return j.status
+	}
+	started := time.Now()
+	j.status = IntegrityCheckStatus{Status: IntegrityStatusRunning, Mode: mode, StartedAt: started.Unix()}
+
+	go func() {
+		results, ok := checkDatabasesIntegrity(context.Background(), db, archiveDB, mode)
+		for _, result := range results {
+			if result.Error != "" {
+				log.Printf("警告: 数据库 %s 完整性检查 (%s) 失败: %s", result.Database, mode, result.Error)
+			} else if !result.OK {
+				log.Printf("警告: 数据库 %s 未通过完整性检查 (%s): %s", result.Database, mode, strings.Join(result.Messages, "; "))
+			}
+		}
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.status.Status = IntegrityStatusDone
+		j.status.FinishedAt = time.Now().Unix()
+		j.status.DurationMs = time.Since(started).Milliseconds()
+		j.status.OK = ok
+		j.status.Databases = results
+	}()
+	return j.status
+}
+
+// Snapshot 返回当前的状态。
+func (j *integrityCheckJob) Snapshot() IntegrityCheckStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// checkIntegrity 对一个数据库执行完整性检查，返回检查是否通过以及 SQLite 报告的问题。
+// 检查通过时 SQLite 只返回一行 `ok`。
+func checkIntegrity(ctx context.Context, db *sql.DB, mode string) (bool, []string, error) {
+	pragma := "PRAGMA quick_check"
+	if mode == IntegrityModeFull {
+		pragma = "PRAGMA integrity_check"
+	}
+	rows, err := db.QueryContext(ctx, pragma)
+	if err != nil {
+		return false, nil, err
+	}
+	defer rows.Close()
+
+	var messages []string
+	for rows.Next() {
+		var message string
+		if err := rows.Scan(&message); err != nil {
+			return false, nil, err
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return false, nil, err
+	}
+	if len(messages) == 1 && messages[0] == "ok" {
+		return true, nil, nil
+	}
+	return false, messages, nil
+}
+
+// checkDatabasesIntegrity 依次检查主数据库和归档数据库（archiveDB 为 nil 时跳过），返回每个数据库的结果和是否全部通过。
+func checkDatabasesIntegrity(ctx context.Context, db, archiveDB *sql.DB, mode string) ([]IntegrityCheckResult, bool) {
+	databases := []struct {
+		name string
+		db   *sql.DB
+	}{{"main", db}, {"archive", archiveDB}}
+
+	var results []IntegrityCheckResult
+	allOK := true
+	for _, database := range databases {
+		if database.db == nil {
+			continue
+		}
+		result := IntegrityCheckResult{Database: database.name}
+		ok, messages, err := checkIntegrity(ctx, database.db, mode)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.OK = ok
+		result.Messages = messages
+		allOK = allOK && ok
+		results = append(results, result)
+	}
+	return results, allOK
+}
+
+// runStartupIntegrityCheck 在启动时（-check-on-start）对数据库执行 quick_check，未通过时拒绝启动，
+// 以免继续向一个已经损坏的文件写入数据，让损坏进一步扩大。name 用于日志，例如「主数据库」。
+func runStartupIntegrityCheck(db *sql.DB, name string) {
+	started := time.Now()
+	ok, messages, err := checkIntegrity(context.Background(), db, IntegrityModeQuick)
+	if err != nil {
+		log.Fatalf("%s完整性检查失败: %v", name, err)
+	}
+	if !ok {
+		for _, message := range messages {
+			log.Printf("%s完整性检查: %s", name, message)
+		}
+		log.Fatalf("%s未通过完整性检查，拒绝启动。请从备份恢复，或尝试使用 sqlite3 的 .recover 命令导出数据。", name)
+	}
+	log.Printf("%s完整性检查通过，耗时 %v。", name, time.Since(started).Round(time.Millisecond))
+}
+
+// integrityCheckHandler 是处理 `/api/admin/integrity-check` GET 请求的 HTTP Handler。
+// 第一次请求（或带有 `refresh=true` 且当前没有检查在进行时）在后台开始一次检查，之后的请求返回检查的进度和结果。
+// 检查进行中返回 202，其余情况返回 200；检查只读取数据库，只读模式下同样可用。
+func integrityCheckHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "":
+		mode = IntegrityModeQuick
+	case IntegrityModeQuick, IntegrityModeFull:
+	default:
+		writeJSONError(w, http.StatusBadRequest, "mode", fmt.Sprintf("无效的 mode: %s，可选值为 quick、full", mode))
+		return
+	}
+
+	status := integrityJob.Snapshot()
+	if status.Status == IntegrityStatusIdle || (status.Status == IntegrityStatusDone && r.URL.Query().Get("refresh") == "true") {
+		status = integrityJob.Start(db, archiveDBFromContext(r), mode)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status.Status == IntegrityStatusRunning {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(status)
+}
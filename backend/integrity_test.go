@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// waitIntegrityJob 等待后台检查完成并返回最终状态，避免测试结束、数据库关闭时检查仍在进行。
+func waitIntegrityJob(t *testing.T, job *integrityCheckJob) IntegrityCheckStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	status := job.Snapshot()
+	for status.Status == IntegrityStatusRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		status = job.Snapshot()
+	}
+	if status.Status != IntegrityStatusDone {
+		t.Fatalf("status = %q, want %q", status.Status, IntegrityStatusDone)
+	}
+	return status
+}
+
+// TestIntegrityCheckJobLifecycle 检查完整性检查任务从 idle 经 running 到 done 的状态变化。
+func TestIntegrityCheckJobLifecycle(t *testing.T) {
+	db := newTestDB(t)
+	job := &integrityCheckJob{status: IntegrityCheckStatus{Status: IntegrityStatusIdle}}
+	if got := job.Snapshot().Status; got != IntegrityStatusIdle {
+		t.Fatalf("initial status = %q, want %q", got, IntegrityStatusIdle)
+	}
+
+	started := job.Start(db, nil, IntegrityModeFull)
+	if started.Status != IntegrityStatusRunning || started.Mode != IntegrityModeFull || started.StartedAt == 0 {
+		t.Fatalf("Start() = %+v, want running full check", started)
+	}
+
+	status := waitIntegrityJob(t, job)
+	if !status.OK || status.FinishedAt == 0 || status.StartedAt != started.StartedAt {
+		t.Errorf("finished status = %+v", status)
+	}
+	if len(status.Databases) != 1 || status.Databases[0].Database != "main" || !status.Databases[0].OK {
+		t.Errorf("databases = %+v, want only a passing main database", status.Databases)
+	}
+
+	// 完成之后可以再次开始新的检查。
+	if again := job.Start(db, nil, IntegrityModeQuick); again.Status != IntegrityStatusRunning || again.Mode != IntegrityModeQuick {
+		t.Errorf("Start() after done = %+v, want running quick check", again)
+	}
+	waitIntegrityJob(t, job)
+}
+
+// TestIntegrityCheckJobStartWhileRunning 检查已有检查正在进行时 Start 不会重复开始，而是返回当前的状态。
+func TestIntegrityCheckJobStartWhileRunning(t *testing.T) {
+	running := IntegrityCheckStatus{Status: IntegrityStatusRunning, Mode: IntegrityModeFull, StartedAt: 1700000000}
+	job := &integrityCheckJob{status: running}
+	if got := job.Start(nil, nil, IntegrityModeQuick); got.Status != running.Status || got.Mode != running.Mode || got.StartedAt != running.StartedAt {
+		t.Errorf("Start() = %+v, want unchanged %+v", got, running)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 这个文件实现了“累计总流量”计数器。
+// Clash 的 `/connections` 响应中包含 `uploadTotal` 和 `downloadTotal` 两个全局计数器，
+// 但它们会在 Clash 重启后归零。这里通过对相邻两次采样求差值（delta）来累加流量，
+// 从而得到一个跨越 Clash 与本程序重启的“有史以来”的总流量。
+
+// metadata 表中用于存储累计流量计数器的 key。
+const (
+	metaLifetimeUpload   = "lifetime_upload"     // 累计上传流量（字节）。
+	metaLifetimeDownload = "lifetime_download"   // 累计下载流量（字节）。
+	metaLastUploadTotal  = "last_upload_total"   // 最近一次观察到的 Clash uploadTotal。
+	metaLastDownTotal    = "last_download_total" // 最近一次观察到的 Clash downloadTotal。
+	metaLifetimeUpdated  = "lifetime_updated_at" // 累计值最近一次写入数据库的 Unix 时间戳。
+)
+
+// lifetimeCounter 是一个并发安全的累计流量计数器。
+// 采集 Goroutine 通过 Observe 不断喂入 Clash 的全局计数器，
+// 写库 Goroutine 通过 Flush 把尚未持久化的增量写入 `metadata` 表。
+type lifetimeCounter struct {
+	mu          sync.Mutex
+	hasLast     bool   // 是否已有上一次的观察值。
+	lastUp      uint64 // 上一次观察到的 uploadTotal。
+	lastDown    uint64 // 上一次观察到的 downloadTotal。
+	pendingUp   uint64 // 尚未写入数据库的上传增量。
+	pendingDown uint64 // 尚未写入数据库的下载增量。
+}
+
+// lifetimeTotals 是全局唯一的累计流量计数器实例。
+var lifetimeTotals = &lifetimeCounter{}
+
+// Load 从数据库中恢复上一次观察到的 Clash 计数器，
+// 这样本程序重启后不会把 Clash 已有的计数重复累加一遍。
+func (c *lifetimeCounter) Load(db *sql.DB) error {
+	up, okUp, err := getMetadata(db, metaLastUploadTotal)
+	if err != nil {
+		return err
+	}
+	down, okDown, err := getMetadata(db, metaLastDownTotal)
+	if err != nil {
+		return err
+	}
+	if !okUp || !okDown {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastUp, _ = strconv.ParseUint(up, 10, 64)
+	c.lastDown, _ = strconv.ParseUint(down, 10, 64)
+	c.hasLast = true
+	return nil
+}
+
+// Observe 记录一次 Clash 全局计数器的采样，并累加与上一次采样之间的增量。
+// 如果新值小于旧值，说明 Clash 发生了重启、计数器已归零，此时直接把新值作为增量。
+func (c *lifetimeCounter) Observe(uploadTotal, downloadTotal uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hasLast {
+		c.pendingUp += counterDelta(c.lastUp, uploadTotal)
+		c.pendingDown += counterDelta(c.lastDown, downloadTotal)
+	}
+	c.lastUp = uploadTotal
+	c.lastDown = downloadTotal
+	c.hasLast = true
+}
+
+// counterDelta 计算单调计数器两次采样之间的增量，并处理计数器重置的情况。
+func counterDelta(last, current uint64) uint64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
+
+// Totals 返回数据库中已持久化的累计流量加上内存中尚未写入的增量，以及最近一次持久化的时间。
+// 读取期间持有锁，避免与 Flush 交错导致增量被重复计算。
+func (c *lifetimeCounter) Totals(db *sql.DB) (uint64, uint64, int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	upload, download, updatedAt, err := readLifetimeTotals(db)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return upload + c.pendingUp, download + c.pendingDown, updatedAt, nil
+}
+
+// Flush 在一个事务中把尚未持久化的增量累加到数据库中，并保存最近一次的观察值。
+// 写入成功后才会清空内存中的增量，失败时增量保留到下一次 Flush。
+func (c *lifetimeCounter) Flush(db *sql.DB) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.hasLast {
+		return nil
+	}
+
+	storedUp, storedDown, _, err := readLifetimeTotals(db)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("开启事务失败: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	values := map[string]string{
+		metaLifetimeUpload:   strconv.FormatUint(storedUp+c.pendingUp, 10),
+		metaLifetimeDownload: strconv.FormatUint(storedDown+c.pendingDown, 10),
+		metaLastUploadTotal:  strconv.FormatUint(c.lastUp, 10),
+		metaLastDownTotal:    strconv.FormatUint(c.lastDown, 10),
+		metaLifetimeUpdated:  strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	for key, value := range values {
+		if err = setMetadata(tx, key, value); err != nil {
+			return fmt.Errorf("写入累计流量失败: %w", err)
+		}
+	}
+
+	c.pendingUp = 0
+	c.pendingDown = 0
+	return nil
+}
+
+// readLifetimeTotals 从数据库中读取已持久化的累计上传、下载流量和最近更新时间。
+func readLifetimeTotals(db *sql.DB) (uint64, uint64, int64, error) {
+	up, _, err := getMetadata(db, metaLifetimeUpload)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	down, _, err := getMetadata(db, metaLifetimeDownload)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	updated, _, err := getMetadata(db, metaLifetimeUpdated)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	upload, _ := strconv.ParseUint(up, 10, 64)
+	download, _ := strconv.ParseUint(down, 10, 64)
+	updatedAt, _ := strconv.ParseInt(updated, 10, 64)
+	return upload, download, updatedAt, nil
+}
+
+// getLifetimeSummaryHandler 是处理 `/api/summary/lifetime` GET 请求的 HTTP Handler。
+// 它返回数据库中已持久化的累计流量，加上内存中尚未写入的增量。
+func getLifetimeSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	upload, download, updatedAt, err := lifetimeTotals.Totals(db)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"upload":    upload,
+		"download":  download,
+		"total":     upload + download,
+		"updatedAt": updatedAt,
+	})
+}
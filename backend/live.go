@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// 这个文件提供直接读取内存缓存 (connectionsCache) 的实时接口。
+// 汇总接口只能看到已经写入数据库的数据，最多落后一个写入周期（默认 3 分钟）；
+// 这里不经过数据库，反映的是最近一次同步时的状态，适合回答“现在是谁在占用带宽”。
+
+// LiveHostTraffic 是内存缓存中一个主机的流量。
+type LiveHostTraffic struct {
+	Host        string `json:"host"`
+	Upload      uint64 `json:"upload"`
+	Download    uint64 `json:"download"`
+	Total       uint64 `json:"total"`
+	Connections uint64 `json:"connections"` // 缓存中属于该主机的连接数。
+	SourceIPs   uint64 `json:"sourceIPs"`   // 缓存中访问该主机的不同源 IP 数。
+}
+
+// getLiveTopHandler 是处理 `/api/live/top` GET 请求的 HTTP Handler。
+// 它遍历内存缓存，按主机汇总上传和下载流量，返回总流量最大的前 limit 个主机（默认 10 个）。
+// 缓存中是自上一次写入数据库以来同步到的连接，流量是每条连接从建立到最近一次同步的累计值。
+// host 为空的连接不会被写入数据库，这里同样跳过。
+func getLiveTopHandler(w http.ResponseWriter, r *http.Request) {
+	limit := parseLimit(w, r, 10) // 与主机排行一致，默认返回前 10 名。
+
+	// sync.Map 的 Range 可以与 Store、Delete 并发执行，遍历期间被更新或删除的连接可能被看到、也可能被跳过，
+	// 但不会出错。缓存中的 *Connection 存入后不会再被修改（每次同步都存入新的指针），因此可以直接读取字段。
+	hosts := map[string]*LiveHostTraffic{}
+	sourceIPs := map[string]map[string]struct{}{}
+	cached := 0
+	connectionsCache.Range(func(key, value interface{}) bool {
+		conn := value.(*Connection)
+		cached++
+		host := conn.Metadata.Host
+		if host == "" {
+			return true
+		}
+		traffic, ok := hosts[host]
+		if !ok {
+			traffic = &LiveHostTraffic{Host: host}
+			hosts[host] = traffic
+			sourceIPs[host] = map[string]struct{}{}
+		}
+		traffic.Upload += conn.Upload
+		traffic.Download += conn.Download
+		traffic.Connections++
+		sourceIPs[host][conn.Metadata.SourceIP] = struct{}{}
+		return true
+	})
+
+	scale := sampleScalerFor(w, r)
+	top := make([]LiveHostTraffic, 0, len(hosts))
+	for host, traffic := range hosts {
+		traffic.Total = traffic.Upload + traffic.Download
+		traffic.SourceIPs = uint64(len(sourceIPs[host]))
+		scale.Scale(&traffic.Upload, &traffic.Download, &traffic.Total, &traffic.Connections)
+		top = append(top, *traffic)
+	}
+	// 总流量相同时按主机名排序，保证结果稳定。
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Total != top[j].Total {
+			return top[i].Total > top[j].Total
+		}
+		return top[i].Host < top[j].Host
+	})
+	if len(top) > limit {
+		top = top[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"cachedConnections": cached,
+		"data":              top,
+	})
+}
@@ -0,0 +1,14 @@
+package main
+
+import "log"
+
+// debugLogging 为 true 时输出调试日志，由 LOG_LEVEL=debug 开启。
+var debugLogging bool
+
+// debugf 在开启调试日志时输出一行带 `[DEBUG]` 前缀的日志，参数与 log.Printf 相同。
+// 用于输出正常运行时不需要关心、但排查性能问题时有用的细节。
+func debugf(format string, v ...interface{}) {
+	if debugLogging {
+		log.Printf("[DEBUG] "+format, v...)
+	}
+}
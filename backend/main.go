@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -15,11 +19,27 @@ import (
 // connectionsCache 是一个全局的、线程安全的内存缓存。
 // 它使用 `sync.Map` 来存储从 Clash API 获取的最新连接信息。
 // 这样做可以减少对 API 的请求频率，并将数据库写入操作批量化，提高性能。
-// key 是连接的 ID (string)，value 是 Connection 结构体。
+// key 是连接的 ID (string)，value 是指向 Connection 结构体的指针 (*Connection)。
+// 每次同步都会存入新的指针，因此写库时可以通过比较指针判断某个连接在快照之后是否被更新过（见 writeCacheToDB）。
+// 存入缓存应通过 cacheConnection，以便维护缓存中的连接数 cacheEntries，并在计数器变小时保留已观察到的最大流量。
 var connectionsCache = sync.Map{}
 
 // main 函数是程序的入口点。
+// 第一个参数不以 `-` 开头时视为子命令（见 commands.go）：`serve` 启动采集和 Web 服务，其余子命令直接操作数据库文件后退出。
+// 没有子命令时与 `serve` 相同，兼容以前的启动方式。
 func main() {
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		if args[0] != "serve" {
+			os.Exit(runCommand(args[0], args[1:]))
+		}
+		args = args[1:]
+	}
+	serve(args)
+}
+
+// serve 启动采集程序和 Web 服务，直到收到退出信号。args 为子命令之后的命令行参数。
+func serve(args []string) {
 	// 1. 定义命令行参数
 	// 使用 flag 包来处理命令行输入。每个参数都用指针接收，以便后续判断是否由用户显式设置。
 	clashAPIURL := flag.String("url", "", "Clash API 的 URL (例如：http://192.168.1.1:9090/connections)")
@@ -27,12 +47,25 @@ func main() {
 	databasePath := flag.String("db", "", "主数据库文件的路径 (例如：./clash_traffic.db)")
 	archiveDatabasePath := flag.String("adb", "", "归档数据库文件的路径 (例如：./clash_traffic_archive.db)")
 	dbWriteInterval := flag.Int("i", 0, "数据库写入间隔（分钟）")
+	dbWriteIntervalSeconds := flag.Int("is", 0, "数据库写入间隔（秒），设置时优先于 -i")
 	webPort := flag.String("p", "", "Web 服务监听的端口 (例如：8081)")
+	showVersion := flag.Bool("version", false, "显示版本信息并退出")
+	strict := flag.Bool("strict", false, "启动时无法连接 Clash API 则直接退出")
+	checkOnStart := flag.Bool("check-on-start", false, "启动时检查数据库文件的完整性，未通过则拒绝启动")
 
 	// 自定义帮助信息
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  ./infoclash -url <api_url> -t <token> [options]\n\n")
+		fmt.Fprintf(os.Stderr, "  ./infoclash [serve] -url <api_url> -t <token> [options]\n")
+		fmt.Fprintf(os.Stderr, "  ./infoclash <merge|export|vacuum|ingest|rebuild-rollup> [options]\n\n")
+		fmt.Fprintf(os.Stderr, "子命令:\n")
+		fmt.Fprintf(os.Stderr, "  serve   启动采集程序和 Web 服务（默认）\n")
+		fmt.Fprintf(os.Stderr, "  merge   合并并归档旧的连接记录后退出\n")
+		fmt.Fprintf(os.Stderr, "  export  把连接记录导出为 CSV 或 JSON 后退出\n")
+		fmt.Fprintf(os.Stderr, "  vacuum  回收数据库文件中的空闲空间后退出\n")
+		fmt.Fprintf(os.Stderr, "  ingest  回放录制的 Clash /connections 响应并写入数据库后退出\n")
+		fmt.Fprintf(os.Stderr, "  rebuild-rollup  从连接记录重新生成按天汇总表后退出\n")
+		fmt.Fprintf(os.Stderr, "  使用 ./infoclash <子命令> -h 查看子命令的参数\n\n")
 		fmt.Fprintf(os.Stderr, "参数说明:\n")
 		fmt.Fprintf(os.Stderr, "  -url string\n")
 		fmt.Fprintf(os.Stderr, "        (必须) Clash API 的 URL, 例如：http://192.168.1.1:9090/connections\n")
@@ -44,13 +77,28 @@ func main() {
 		fmt.Fprintf(os.Stderr, "        归档数据库文件的路径 (默认: ./clash_traffic_archive.db)\n")
 		fmt.Fprintf(os.Stderr, "  -i int\n")
 		fmt.Fprintf(os.Stderr, "        数据库写入间隔,单位为分钟 (默认: 3)\n")
+		fmt.Fprintf(os.Stderr, "  -is int\n")
+		fmt.Fprintf(os.Stderr, "        数据库写入间隔,单位为秒,至少为 1。设置时优先于 -i,可用于设置小于 1 分钟的间隔\n")
 		fmt.Fprintf(os.Stderr, "  -p string\n")
 		fmt.Fprintf(os.Stderr, "        Web 服务监听的端口 (默认: 8081)\n")
+		fmt.Fprintf(os.Stderr, "  -version\n")
+		fmt.Fprintf(os.Stderr, "        显示版本信息并退出\n")
+		fmt.Fprintf(os.Stderr, "  -strict\n")
+		fmt.Fprintf(os.Stderr, "        启动时无法连接 Clash API（地址错误、认证失败等）则以非零状态码退出\n")
+		fmt.Fprintf(os.Stderr, "  -check-on-start\n")
+		fmt.Fprintf(os.Stderr, "        启动时对数据库执行 PRAGMA quick_check，文件损坏时拒绝启动。数据库较大时会延长启动时间\n")
 		fmt.Fprintf(os.Stderr, "  -h, -help, --help\n")
 		fmt.Fprintf(os.Stderr, "        显示此帮助信息\n")
 	}
 
-	flag.Parse()
+	flag.CommandLine.Parse(args)
+
+	// 只查看版本时，在加载配置和打开数据库之前直接退出。
+	if *showVersion {
+		fmt.Println(currentVersionInfo())
+		return
+	}
+	log.Println(currentVersionInfo())
 
 	// 2. 加载配置
 	// 将解析到的命令行参数传递给 LoadConfig 函数。
@@ -62,7 +110,17 @@ func main() {
 		*archiveDatabasePath,
 		*webPort,
 		*dbWriteInterval,
+		*dbWriteIntervalSeconds,
 	)
+	debugLogging = cfg.LogLevel == LogLevelDebug
+	vacuumMode = cfg.VacuumMode
+	dailyRollupEnabled = cfg.DailyRollup
+	clashHTTPClient = newClashHTTPClient(cfg.ClashAPITimeout)
+
+	// 校验 SQLite PRAGMA 调优选项，它们会在每个数据库连接建立时执行。
+	if err := configureSQLitePragmas(cfg); err != nil {
+		log.Fatalf("SQLite PRAGMA 配置无效: %v", err)
+	}
 
 	// 3. 初始化主数据库
 	db, err := InitDB(cfg.DatabasePath)
@@ -71,17 +129,108 @@ func main() {
 	}
 	defer db.Close() // 确保在 main 函数退出时关闭数据库连接。
 	log.Println("数据库初始化成功。")
+	// 非正常关机之后，在写入任何数据之前确认数据库文件没有损坏。
+	if *checkOnStart {
+		runStartupIntegrityCheck(db, "主数据库")
+	}
+	// VACUUM_MODE=incremental 时确保主数据库启用了 auto_vacuum = INCREMENTAL。
+	if err := enableIncrementalVacuum(db); err != nil {
+		log.Printf("启用增量 VACUUM 失败，合并和删除后将无法回收空间: %v", err)
+	}
+
+	// 创建按天汇总表。升级后第一次启动时需要从全部连接记录生成，数据量大时耗时较长，因此在后台进行，
+	// 生成完成之前汇总接口直接查询连接记录。
+	if needsRebuild, err := initDailyRollup(db); err != nil {
+		log.Fatalf("初始化按天汇总表失败: %v", err)
+	} else if needsRebuild {
+		go func() {
+			if _, err := rebuildDailyRollup(db); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
+	// 恢复累计流量计数器的状态，避免重启后重复累加 Clash 已有的计数。
+	if err := lifetimeTotals.Load(db); err != nil {
+		log.Printf("加载累计流量计数器失败: %v", err)
+	}
+	// 恢复最近一次记录的 Clash 计数器，用于检测本程序停止期间 Clash 是否重启过。
+	if err := clashStats.Load(db); err != nil {
+		log.Printf("加载 Clash 状态采样失败: %v", err)
+	}
+
+	// 配置了缓存溢出文件时，加载上次因数据库写入失败而保存下来的连接，它们会在下一次写入时落库。
+	if cfg.CacheSpillFile != "" {
+		cacheSpill = &cacheSpillFile{path: cfg.CacheSpillFile}
+		if n, err := cacheSpill.Load(); err != nil {
+			log.Printf("加载缓存溢出文件 %s 失败: %v", cfg.CacheSpillFile, err)
+		} else if n > 0 {
+			log.Printf("已从缓存溢出文件 %s 恢复 %d 条尚未写入数据库的连接。", cfg.CacheSpillFile, n)
+		}
+	}
+
+	// 初始化清洗连接时使用的源 IP 匿名化、GeoIP 数据库、主机后缀白名单和改写规则。
+	if err := initConnectionCleaning(cfg, db); err != nil {
+		log.Fatalln(err)
+	}
+
+	// 开启反向解析时，为 host 为空的连接补充主机名。
+	if cfg.ReverseDNS {
+		hostReverseDNS = newReverseDNSResolver()
+		log.Println("已开启目标 IP 反向解析。")
+	}
+
+	// 配置了告警 Webhook 时，在连接数或流量超过阈值时发送告警。
+	if cfg.AlertWebhookURL != "" {
+		alerter = newTrafficAlerter(cfg)
+		log.Println("已开启流量告警。")
+	}
 
 	// 3. 初始化归档数据库
-	archiveDB, err := InitArchiveDB(cfg.ArchiveDatabasePath)
-	if err != nil {
-		log.Fatalf("初始化归档数据库失败: %v", err)
+	// 关闭归档 (ARCHIVE_ENABLED=false) 时不创建归档数据库文件，archiveDB 保持为 nil。
+	var archiveDB *sql.DB
+	if cfg.ArchiveEnabled {
+		archiveDB, err = InitArchiveDB(cfg.ArchiveDatabasePath)
+		if err != nil {
+			log.Fatalf("初始化归档数据库失败: %v", err)
+		}
+		defer archiveDB.Close()
+		log.Println("归档数据库初始化成功。")
+		if *checkOnStart {
+			runStartupIntegrityCheck(archiveDB, "归档数据库")
+		}
+	} else {
+		log.Println("已关闭归档数据库，合并时将直接删除原始记录。")
 	}
-	defer archiveDB.Close()
-	log.Println("归档数据库初始化成功。")
 
 	log.Printf("配置加载完成：数据库写入间隔为 %v。", cfg.DBWriteInterval)
 
+	// 根 context 在收到退出信号 (SIGINT / SIGTERM) 时被取消。
+	// 所有后台任务都从它派生，退出时正在进行的 Clash API 请求和数据库写入会立即中止，而不是等它们自然结束。
+	// `signal.NotifyContext` 会将指定的信号转发给 ctx；SIGINT 通常是 Ctrl+C，SIGTERM 是 kill 命令的默认信号。
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// 启动时先尝试连接一次 Clash API。地址或 Token 配置错误时，之后只会每秒打印一行失败日志，
+	// 很容易被忽略，因此这里打印醒目的错误和排查建议；开启 -strict 时直接退出。
+	err = checkClashAPI(ctx, cfg)
+	switch {
+	case ctx.Err() != nil:
+		// 检查期间收到退出信号时请求会被取消，这不是配置问题，不打印提示，后面会直接进入退出流程。
+	case err != nil:
+		log.Println("==================================================")
+		log.Printf("无法连接 Clash API (%s): %v", redactURLPassword(cfg.ClashAPIURL), err)
+		if hint := clashErrorHint(err, cfg); hint != "" {
+			log.Println(hint)
+		}
+		log.Println("==================================================")
+		if *strict {
+			log.Fatalln("已开启 -strict，程序退出。")
+		}
+	default:
+		log.Println("Clash API 连接成功。")
+	}
+
 	// --- 启动并发任务 ---
 	// Go 语言的并发模型基于 Goroutine 和 Channel，非常适合处理这类需要同时执行多个独立任务的场景。
 
@@ -90,83 +239,292 @@ func main() {
 	apiTicker := time.NewTicker(cfg.APISyncInterval)
 	defer apiTicker.Stop()
 
+	// Clash API 响应很慢时（例如通过 VPN 获取很大的连接列表），一次同步可能超过同步间隔。
+	// 同步在单独的 Goroutine 中执行，上一次还没有结束时跳过这个周期并计数，而不是让请求堆积或背靠背地连续发出。
 	go func() {
-		for range apiTicker.C {
-			connections, err := GetClashConnections(cfg.ClashAPIURL, cfg.ClashAPIToken, cfg.HostSuffixWhitelist)
-			if err != nil {
-				log.Printf("获取 Clash 连接信息失败: %v", err)
-				continue // 如果获取失败，记录日志并等待下一次触发。
+		var polling atomic.Bool
+		var skipped atomic.Int64 // 当前这次同步期间跳过的周期数。
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-apiTicker.C:
 			}
-			// 将获取到的连接信息存入 sync.Map。
-			// Store 方法是线程安全的，可以安全地在多个 Goroutine 中调用。
-			for _, conn := range connections.Connections {
-				connectionsCache.Store(conn.ID, conn)
+			if !polling.CompareAndSwap(false, true) {
+				skipped.Add(1)
+				clashHealth.RecordSkippedPoll()
+				continue
 			}
-			log.Printf("已从 API 同步 %d 个连接到内存。", len(connections.Connections))
+			go func() {
+				defer polling.Store(false)
+				pollClashConnections(ctx, cfg)
+				if n := skipped.Swap(0); n > 0 {
+					log.Printf("警告: 上一次同步耗时超过同步间隔，跳过了 %d 次同步。", n)
+				}
+			}()
 		}
 	}()
 
 	// Goroutine 2: 定时将内存缓存中的数据批量写入数据库。
 	// 这个 Goroutine 的执行频率由配置中的 DBWriteInterval 控制。
-	// 这种“批处理”的方式可以显著减少数据库的写入次数，提高性能。
-	dbTicker := time.NewTicker(cfg.DBWriteInterval)
-	defer dbTicker.Stop()
+	// 这种“批处理”的方式可以显著减少数据库的写入次数，提高性能。写入失败时的重试见 runDBWriter。
+	// 告警规则检查器在每次写入之后检查规则，必须在 runDBWriter 之前创建。
+	ruleAlerter = newAlertRuleChecker(db, cfg)
+	go ruleAlerter.Run(ctx)
+	go runDBWriter(ctx, db, cfg.DBWriteInterval)
 
-	go func() {
-		for range dbTicker.C {
-			writeCacheToDB(db)
-		}
-	}()
+	// Goroutine: 定期从 Clash 的 `/proxies` 获取代理名称，补全代理链筛选器。
+	go clashProxies.Run(cfg)
+
+	// 可选的 Goroutine: 订阅 Clash 的 `/traffic` 推送，记录实时带宽。
+	if cfg.EnableTrafficStream {
+		trafficStream = newTrafficStreamCollector(cfg, db)
+		go trafficStream.Run()
+		log.Println("已开启实时带宽采集。")
+	}
+
+	// 可选的 Goroutine: 每天零点轮转主数据库文件。
+	if cfg.DBRotateDaily {
+		go runDailyRotation(ctx, db, cfg.DatabasePath)
+		log.Println("已开启主数据库每日轮转。")
+	}
 
 	// Goroutine 3: 启动 Web 服务器。
 	// Web 服务器在一个独立的 Goroutine 中运行，不会阻塞主线程。
-	go StartWebServer(db, archiveDB, cfg.WebPort)
+	go StartWebServer(db, archiveDB, cfg)
 
 	// --- 优雅退出处理 ---
 	// 为了防止在程序退出时丢失内存中尚未写入数据库的数据，我们需要实现“优雅退出”。
 	// 这意味着程序在收到退出信号后，会先完成一些清理工作（比如保存数据），然后再真正退出。
 
-	// 创建一个 channel 来接收操作系统信号。
-	quitChan := make(chan os.Signal, 1)
-	// `signal.Notify` 会将指定的信号（这里是 SIGINT 和 SIGTERM）转发到 quitChan。
-	// SIGINT 通常是 Ctrl+C，SIGTERM 是 kill 命令的默认信号。
-	signal.Notify(quitChan, syscall.SIGINT, syscall.SIGTERM)
-
 	log.Println("程序已启动，按 Ctrl+C 退出。")
-	// 程序会在这里阻塞，直到从 quitChan 中接收到一个信号。
-	<-quitChan
+	// 程序会在这里阻塞，直到收到退出信号、根 context 被取消。
+	<-ctx.Done()
+	// 恢复默认的信号处理，再次按 Ctrl+C 可以强制退出。
+	stop()
 
 	// 收到退出信号后，执行最后的清理工作。
 	log.Println("接收到退出信号，正在将缓存数据写入数据库...")
 	// 在退出前，最后一次将内存缓存中的所有数据写入数据库。
-	writeCacheToDB(db)
+	// 根 context 已被取消，这次写入使用新的 context，避免刚开始就被中止；
+	// 被取消的周期性写入已经回滚，缓存没有被清空，数据会在这里写入。
+	writeCacheToDB(context.Background(), db)
+	if trafficStream != nil {
+		if err := trafficStream.Flush(); err != nil {
+			log.Printf("写入带宽采样失败: %v", err)
+		}
+	}
 	log.Println("数据已保存，程序即将退出。")
 }
 
-// writeCacheToDB 负责将全局内存缓存 `connectionsCache` 中的数据写入数据库。
-func writeCacheToDB(db *sql.DB) {
+// pollClashConnections 执行一次定时同步，并记录同步的结果。
+func pollClashConnections(ctx context.Context, cfg *Config) {
+	synced, err := syncClashConnections(ctx, cfg)
+	if ctx.Err() != nil {
+		return // 程序正在退出，请求是被主动取消的。
+	}
+	if err != nil {
+		// 响应无法解析通常是 Clash 负载过高时的偶发情况，跳过这一次同步，缓存保持上一次的内容。
+		var decodeErr *ClashDecodeError
+		if errors.As(err, &decodeErr) {
+			log.Printf("警告: 本次同步跳过，保留上一次的缓存: %v", err)
+			return
+		}
+		log.Printf("获取 Clash 连接信息失败: %v", err)
+		// 每次开始连续失败时提示一次排查建议，避免每秒重复打印。
+		if clashHealth.Snapshot().ConsecutiveFailures == 1 {
+			if hint := clashErrorHint(err, cfg); hint != "" {
+				log.Println(hint)
+			}
+		}
+		return // 如果获取失败，记录日志并等待下一次触发。
+	}
+	log.Printf("已从 API 同步 %d 个连接到内存。", synced)
+}
+
+// clashSyncMu 用于串行化对 Clash API 的同步，避免定时同步与手动触发的同步 (`POST /api/sync`) 相互交错。
+var clashSyncMu sync.Mutex
+
+// openConnections 是上一次同步时 Clash 中仍在进行的连接（只包含被抽样保留的连接），由 clashSyncMu 保护。
+// 与本次同步的结果对比，上一次还在、这一次消失的连接就是在两次同步之间关闭的连接。
+var openConnections map[string]*Connection
+
+// syncClashConnections 从 Clash API 获取一次连接信息并存入内存缓存，返回存入缓存的连接数。
+// 结果会记录到 clashHealth 中；ctx 被取消导致的失败不是 Clash 的问题，不会被记录。
+func syncClashConnections(ctx context.Context, cfg *Config) (int, error) {
+	clashSyncMu.Lock()
+	defer clashSyncMu.Unlock()
+
+	connections, err := GetClashConnections(ctx, cfg)
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	clashHealth.Record(err)
+	if err != nil {
+		return 0, err
+	}
+	return ingestConnections(connections, cfg, time.Now()), nil
+}
+
+// ingestConnections 把一次同步得到的（已清洗的）连接存入内存缓存，返回存入缓存的连接数。
+// now 是这次同步的时间，用于状态采样和标记关闭的连接；回放录制的数据时为合成的时间。调用方必须持有 clashSyncMu。
+func ingestConnections(connections *Connections, cfg *Config, now time.Time) int {
+	// 用 Clash 的全局计数器更新累计流量和运行状态采样，并检查活跃连接数、为流量告警累计本周期的流量。
+	// 响应不完整时全局计数器可能缺失（为 0），会被误判为 Clash 重启，因此跳过。
+	if !connections.Partial {
+		lifetimeTotals.Observe(connections.UploadTotal, connections.DownloadTotal)
+		clashStats.Observe(now, uint64(connections.Memory), connections.UploadTotal, connections.DownloadTotal)
+		if alerter != nil {
+			alerter.ObserveSync(len(connections.Connections), connections.UploadTotal, connections.DownloadTotal)
+		}
+	}
+	// 将获取到的连接信息存入 sync.Map。开启抽样 (SAMPLE_RATE) 时，未被抽中的连接不会进入缓存，也就不会被写入数据库。
+	// 同一个 ID 在本写入周期内的流量取观察到的最大值（见 cacheConnection），计数器偶尔变小时不会丢失流量。
+	// 存入之前确定开始时间：Clash 的开始时间无效或 START_TIME_SOURCE=ingest 时改用同步时间，见 resolveConnectionStart。
+	synced, invalidStarts := 0, 0
+	entries := cacheEntries.Load()
+	for i := range connections.Connections {
+		conn := &connections.Connections[i]
+		if !sampleKeep(conn.ID, cfg.SampleRate) {
+			continue
+		}
+		if resolveConnectionStart(conn, cfg.StartTimeSource, now) {
+			invalidStarts++
+		}
+		entries = cacheConnection(conn)
+		synced++
+	}
+	logInvalidStarts(invalidStarts)
+	// 响应不完整时，缺失的连接不一定已经关闭，这一次不做对比，保留上一次的结果。
+	if !connections.Partial {
+		entries = markClosedConnections(connections.Connections, cfg.SampleRate, now)
+		if pruned := pruneIdleCacheEntries(connections.Connections, cfg.SampleRate, cfg.CacheIdleSyncs); pruned > 0 {
+			debugf("已从内存缓存中清理 %d 个超过 %d 次同步没有出现、host 为空的连接。", pruned, cfg.CacheIdleSyncs)
+			entries = cacheEntries.Load()
+		}
+	}
+	// 缓存中的连接数超过阈值时（短连接很多，或数据库持续写入失败），通知写库 Goroutine 立即写入，
+	// 而不是在这里同步写入，避免写库期间阻塞下一次同步。
+	notifyCacheFull(entries, cfg.CacheFlushThreshold)
+	return synced
+}
+
+// markClosedConnections 对比 current 与 openConnections，把上一次同步中存在、本次已经消失的连接标记为在 now 关闭，
+// 连同持续时间存入缓存，然后用 current 中被抽样保留的连接替换 openConnections。返回存入后缓存中的连接数。
+// 关闭的连接可能已在之前的写入周期中写入数据库并移出缓存，这里重新存入最后一次观察到的流量，
+// 下一次写入时由 Upsert 补上关闭时间。调用方必须持有 clashSyncMu。
+func markClosedConnections(current []Connection, sampleRate float64, now time.Time) int64 {
+	open := make(map[string]*Connection, len(current))
+	for i := range current {
+		if sampleKeep(current[i].ID, sampleRate) {
+			open[current[i].ID] = &current[i]
+		}
+	}
+	entries := cacheEntries.Load()
+	for id, prev := range openConnections {
+		if _, ok := open[id]; ok {
+			continue
+		}
+		closed := *prev
+		closed.End = now.Unix()
+		closed.Duration = max(0, closed.End-closed.Start.Unix())
+		entries = cacheConnection(&closed)
+	}
+	openConnections = open
+	return entries
+}
+
+// dbWriteMu 用于串行化对主数据库的批量写入和轮转等操作，避免它们相互交错。
+var dbWriteMu sync.Mutex
+
+// writeCacheToDB 负责将全局内存缓存 `connectionsCache` 中的数据写入数据库，返回写入的记录数。
+// 连接按 dbWriteChunkSize 分批写入，每批一个事务；某一批失败时停止写入，之前已提交的批次不受影响，
+// 返回已写入的记录数和错误。ctx 被取消时正在写入的批次会中止并回滚，未写入的连接保留在缓存中。
+// 其他原因导致的失败会计入 dbWriteHealth；配置了溢出文件时，还会把未写入的连接保存到溢出文件，全部写入成功后删除该文件。
+func writeCacheToDB(ctx context.Context, db *sql.DB) (int, error) {
+	dbWriteMu.Lock()
+	defer dbWriteMu.Unlock()
+
+	// 先持久化累计流量计数器的增量和 Clash 状态采样，它们与连接缓存是否为空无关。
+	if err := lifetimeTotals.Flush(db); err != nil {
+		log.Printf("写入累计流量计数器失败: %v", err)
+	}
+	if err := clashStats.Flush(db); err != nil {
+		log.Printf("写入 Clash 状态采样失败: %v", err)
+	}
+
 	var connsToSave []Connection
+	// 记录快照中每个连接对应的指针（与 connsToSave 一一对应），写入成功后只删除之后没有被更新过的条目。
+	var snapshot []*Connection
 	// `connectionsCache.Range` 是一个线程安全的方式来遍历 sync.Map。
 	connectionsCache.Range(func(key, value interface{}) bool {
-		connsToSave = append(connsToSave, value.(Connection))
+		conn := value.(*Connection)
+		connsToSave = append(connsToSave, *conn)
+		snapshot = append(snapshot, conn)
 		return true // 返回 true 以继续遍历。
 	})
 
 	if len(connsToSave) == 0 {
 		log.Println("内存缓存为空，无需写入数据库。")
-		return
+		return 0, nil
 	}
 
 	log.Printf("准备将 %d 条连接数据从内存写入数据库...", len(connsToSave))
-	if err := BulkUpsertConnections(db, connsToSave); err != nil {
-		log.Printf("最终写入数据库失败: %v", err)
-	} else {
-		log.Println("缓存数据成功写入数据库。")
-		// 写入成功后，清空缓存，避免重复写入。
-		// 这里再次遍历并删除是 sync.Map 的一种清空方式。
-		connectionsCache.Range(func(key, value interface{}) bool {
-			connectionsCache.Delete(key)
-			return true
-		})
+	written := 0
+	var batches []UpsertStats
+	// 已提交的连接涉及的日期 (UTC)，返回前重算这些日期的按天汇总并清空汇总接口的缓存，之后的批次失败时也不会遗漏已提交的部分。
+	days := map[int64]struct{}{}
+	defer func() {
+		for day := range days {
+			updateDailyRollup(db, day, day)
+		}
+		if len(days) > 0 {
+			summaryCache.Invalidate()
+		}
+	}()
+	for start := 0; start < len(connsToSave); start += dbWriteChunkSize {
+		end := min(start+dbWriteChunkSize, len(connsToSave))
+		stats, err := BulkUpsertConnections(ctx, db, connsToSave[start:end])
+		if err != nil {
+			log.Printf("最终写入数据库失败: %v", err)
+			if ctx.Err() == nil {
+				dbWriteHealth.Record(err)
+				if cacheSpill != nil {
+					unwritten := connsToSave[start:]
+					if err := cacheSpill.Save(unwritten); err != nil {
+						log.Printf("保存缓存溢出文件失败: %v", err)
+					} else {
+						log.Printf("已将 %d 条未写入的连接保存到 %s。", len(unwritten), cacheSpill.path)
+					}
+				}
+			}
+			return written, err
+		}
+		debugf("已写入第 %d 批连接：%d 条，新增 %d 条，更新 %d 条，跳过 %d 条 host 为空的连接，耗时 %v。",
+			start/dbWriteChunkSize+1, end-start, stats.Inserted, stats.Updated, stats.SkippedEmptyHost, stats.Duration)
+		written += stats.Written()
+		batches = append(batches, stats)
+		dbWriteMetrics.RecordBatch(stats)
+		// 每批提交后立即从缓存中删除这一批连接，之后的批次失败时它们不会被重复写入。
+		// 写入期间采集 Goroutine 可能已经存入了更新的流量，此时指针不同，CompareAndDelete 会保留这个条目，
+		// 让它在下一次写入时落库；直接 Delete 会把这些最新的数据丢掉。
+		for i := start; i < end; i++ {
+			if connectionsCache.CompareAndDelete(snapshot[i].ID, snapshot[i]) {
+				cacheEntries.Add(-1)
+			}
+			days[dayStart(connsToSave[i].Start.Unix())] = struct{}{}
+		}
+	}
+	total := newDBWriteStats(batches)
+	log.Printf("缓存数据成功写入数据库：新增 %d 条，更新 %d 条，跳过 %d 条 host 为空的连接，共 %d 个事务，耗时 %d 毫秒。",
+		total.Inserted, total.Updated, total.SkippedEmptyHost, total.Batches, total.DurationMs)
+	dbWriteMetrics.RecordWrite(total)
+	dbWriteHealth.Record(nil)
+	// 溢出文件中的连接都已包含在这次写入的快照中。
+	if cacheSpill != nil {
+		if err := cacheSpill.Remove(); err != nil {
+			log.Printf("删除缓存溢出文件失败: %v", err)
+		}
 	}
+	return written, nil
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 这个文件统计把内存缓存写入数据库的效果，并通过 `/api/metrics` 提供。
+// 连接在一个写入周期内无论同步多少次都只写入一次，统计插入与更新的记录数可以看出批量写入节省了多少写入；
+// host 为空的连接不会被写入数据库，这里也把被跳过的数量统计出来，否则它们被丢弃这件事在任何地方都看不到。
+
+// DBWriteStats 是一次把缓存写入数据库的汇总结果。
+type DBWriteStats struct {
+	Time             int64 `json:"time"`             // 写入完成的时间（Unix 时间戳，秒）。
+	Batches          int   `json:"batches"`          // 提交的事务数。
+	Inserted         int   `json:"inserted"`         // 新插入的记录数。
+	Updated          int   `json:"updated"`          // 已存在而被更新的记录数。
+	SkippedEmptyHost int   `json:"skippedEmptyHost"` // host 为空而被跳过的连接数。
+	DurationMs       int64 `json:"durationMs"`       // 所有事务的总耗时（毫秒）。
+}
+
+// DBWriteMetrics 是程序启动以来写入数据库的累计统计。
+type DBWriteMetrics struct {
+	Writes           int64         `json:"writes"`           // 全部批次都成功提交的写入次数。
+	Batches          int64         `json:"batches"`          // 成功提交的事务数，包括之后有批次失败的写入中已提交的部分。
+	Inserted         int64         `json:"inserted"`         // 累计插入的记录数。
+	Updated          int64         `json:"updated"`          // 累计更新的记录数。
+	SkippedEmptyHost int64         `json:"skippedEmptyHost"` // 累计因 host 为空而被跳过的连接数。
+	DurationMs       int64         `json:"durationMs"`       // 累计的事务耗时（毫秒）。
+	LastWrite        *DBWriteStats `json:"lastWrite"`        // 最近一次成功的写入，尚未成功写入过时为 null。
+}
+
+// dbWriteMetricsTracker 累计每个写入批次的结果。
+type dbWriteMetricsTracker struct {
+	mu       sync.Mutex
+	metrics  DBWriteMetrics
+	duration time.Duration // 累计的事务耗时，Snapshot 时才换算为毫秒，避免每个批次都被截断。
+}
+
+// dbWriteMetrics 是全局唯一的写入统计。
+var dbWriteMetrics = &dbWriteMetricsTracker{}
+
+// RecordBatch 累计一个成功提交的批次。
+func (t *dbWriteMetricsTracker) RecordBatch(stats UpsertStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.metrics.Batches++
+	t.metrics.Inserted += int64(stats.Inserted)
+	t.metrics.Updated += int64(stats.Updated)
+	t.metrics.SkippedEmptyHost += int64(stats.SkippedEmptyHost)
+	t.duration += stats.Duration
+}
+
+// RecordWrite 记录一次全部批次都成功提交的写入。
+func (t *dbWriteMetricsTracker) RecordWrite(stats DBWriteStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.metrics.Writes++
+	t.metrics.LastWrite = &stats
+}
+
+// Snapshot 返回当前的累计统计。
+func (t *dbWriteMetricsTracker) Snapshot() DBWriteMetrics {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	metrics := t.metrics
+	metrics.DurationMs = t.duration.Milliseconds()
+	return metrics
+}
+
+// newDBWriteStats 汇总一次写入中各批次的结果。
+func newDBWriteStats(batches []UpsertStats) DBWriteStats {
+	stats := DBWriteStats{Time: time.Now().Unix(), Batches: len(batches)}
+	var duration time.Duration
+	for _, batch := range batches {
+		stats.Inserted += batch.Inserted
+		stats.Updated += batch.Updated
+		stats.SkippedEmptyHost += batch.SkippedEmptyHost
+		duration += batch.Duration
+	}
+	stats.DurationMs = duration.Milliseconds()
+	return stats
+}
+
+// getMetricsHandler 是处理 `/api/metrics` GET 请求的 HTTP Handler。
+// 它返回程序启动以来写入数据库、汇总接口缓存和各接口查询耗时的累计统计，重启后清零。
+func getMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dbWrite":      dbWriteMetrics.Snapshot(),
+		"summaryCache": summaryCache.Snapshot(),
+		"queries": map[string]interface{}{
+			"bucketsMs": queryDurationBucketsMs,
+			"endpoints": queryMetrics.Snapshot(),
+		},
+	})
+}
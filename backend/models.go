@@ -12,6 +12,9 @@ type Connections struct {
 	UploadTotal   uint64       `json:"uploadTotal"`   // 总上传流量
 	Connections   []Connection `json:"connections"`   // 当前连接的列表
 	Memory        uint         `json:"memory"`        // 内存使用情况（Clash 相关）
+	// Partial 表示响应体被截断，只解析出了一部分连接（见 decodeConnections），
+	// 此时 DownloadTotal 和 UploadTotal 可能缺失，不能用于计算累计流量。
+	Partial bool `json:"-"`
 }
 
 // Connection 结构体对应每个网络连接的详细信息。
@@ -25,6 +28,12 @@ type Connection struct {
 	Chains      []string  `json:"chains"`      // 连接经过的代理链
 	Rule        string    `json:"rule"`        // 匹配到的规则
 	RulePayload string    `json:"rulePayload"` // 规则的附加信息
+	// 以下字段不来自 Clash API，而是由本程序在采集时补充。
+	Country     string `json:"country,omitempty"`     // 目标 IP 所属国家的 ISO 代码（需配置 GeoIP 数据库）
+	Connections int64  `json:"connections,omitempty"` // 这条记录代表的原始连接数，合并生成的记录大于 1
+	End         int64  `json:"end,omitempty"`         // 连接关闭的时间（Unix 时间戳，秒），仍在进行中时为 0
+	Duration    int64  `json:"duration,omitempty"`    // 连接持续的秒数，仅在 End 不为 0 时有意义；合并生成的记录为各连接之和
+	HostUnknown bool   `json:"hostUnknown,omitempty"` // Clash 没有提供主机名，host 是按 EMPTY_HOST_POLICY / STORE_UNKNOWN_HOSTS 填充的目标 IP 或占位值
 }
 
 // Metadata 结构体包含了关于网络连接的更详细的元数据。
@@ -45,10 +54,34 @@ type Metadata struct {
 // 当前端请求连接列表时，我们不需要返回所有原始字段，只返回前端需要展示的数据，
 // 这样可以减少网络传输的数据量。
 type ConnectionInfo struct {
-	Host     string    `json:"host"`     // 目标主机名
-	SourceIP string    `json:"sourceIP"` // 源 IP 地址
-	Upload   uint64    `json:"upload"`   // 上传流量
-	Download uint64    `json:"download"` // 下载流量
-	Start    time.Time `json:"start"`    // 开始时间
-	Chains   []string  `json:"chains"`   // 代理链
+	Host        string    `json:"host"`                      // 目标主机名
+	SourceIP    string    `json:"sourceIP"`                  // 源 IP 地址
+	DeviceName  string    `json:"deviceName,omitempty"`      // 源 IP 对应的设备名称（如果设置过）
+	Upload      uint64    `json:"upload"`                    // 上传流量
+	Download    uint64    `json:"download"`                  // 下载流量
+	Start       time.Time `json:"start"`                     // 开始时间
+	Chains      []string  `json:"chains"`                    // 代理链，默认只包含策略组（chain），`fullChain=true` 时为完整的代理链
+	Chain       string    `json:"chain"`                     // 规则选中的策略组（代理链的最后一个元素），与 chain 过滤参数对应
+	ChainFull   string    `json:"chainFull"`                 // 用 ` → ` 连接的完整代理链，与 chainFull 过滤参数对应
+	Country     string    `json:"country,omitempty"`         // 目标 IP 所属国家的 ISO 代码（如果有）
+	Type        string    `json:"type,omitempty"`            // 连接的入站类型（如 `HTTP`、`HTTPS`、`Socks5`），旧记录为空
+	Network     string    `json:"network,omitempty"`         // 网络类型（`tcp` / `udp`），旧记录为空
+	Port        int       `json:"destinationPort,omitempty"` // 目标端口，旧记录为 0 并省略
+	PortLabel   string    `json:"portLabel,omitempty"`       // 目标端口对应的服务名称（如 `HTTPS`），见 wellKnownPorts
+	Connections int64     `json:"connections"`               // 这条记录代表的原始连接数，合并生成的记录大于 1
+	End         int64     `json:"end,omitempty"`             // 连接关闭的时间（Unix 时间戳，秒），尚未观察到关闭时省略
+	Duration    *int64    `json:"duration"`                  // 连接持续的秒数，尚未观察到关闭时为 null
+	HostUnknown bool      `json:"hostUnknown,omitempty"`     // host 不是真正的主机名（目标 IP 或占位值），前端可以据此区分显示
+}
+
+// ConnectionRecord 是带有记录 id 的 ConnectionInfo，用于查看归档批次 (`/api/archive`) 和导出连接记录。
+type ConnectionRecord struct {
+	ID string `json:"id"`
+	ConnectionInfo
+}
+
+// Device 表示一个源 IP 与其友好名称之间的映射，例如 `192.168.1.23` → `客厅电视`。
+type Device struct {
+	IP   string `json:"ip"`   // 源 IP 地址
+	Name string `json:"name"` // 设备名称
 }
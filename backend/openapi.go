@@ -0,0 +1,111 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// 这个文件负责提供机器可读的 API 描述。
+// openapi.json 是手工维护的 OpenAPI 3 文档，描述了所有 `/api` 接口的参数和响应结构，
+// 它被嵌入到可执行文件中，通过 `/api/openapi.json` 提供，`/api/docs` 则是基于它渲染的文档页面。
+// 新增或修改接口时需要同步更新 openapi.json；openapi_test.go 会检查两者是否一致，启动时也会对不一致的地方记录警告。
+
+// openAPISpec 是嵌入的 OpenAPI 文档原文。
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// apiDocsPage 是 `/api/docs` 返回的页面，使用 Redoc 渲染 `/api/openapi.json`。
+// Redoc 的脚本从 CDN 加载，固定为 redocVersion，避免页面随上游发布而变化；离线环境下页面无法渲染，但 `/api/openapi.json` 不受影响。
+const apiDocsPage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>infoclash API</title>
+</head>
+<body>
+  <redoc spec-url="openapi.json"></redoc>
+  <script src="https://cdn.jsdelivr.net/npm/redoc@` + redocVersion + `/bundles/redoc.standalone.js"></script>
+</body>
+</html>
+`
+
+// redocVersion 是 `/api/docs` 使用的 Redoc 版本。
+const redocVersion = "2.1.5"
+
+// getOpenAPIHandler 是处理 `/api/openapi.json` GET 请求的 HTTP Handler。
+func getOpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// getAPIDocsHandler 是处理 `/api/docs` GET 请求的 HTTP Handler。
+func getAPIDocsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(apiDocsPage))
+}
+
+// openAPIRouteMismatches 遍历路由器中注册的所有 `/api` 路由，返回没有出现在 OpenAPI 文档中的接口，
+// 以及文档中描述了但没有注册的接口（接口被删除或改名后文档中残留的旧路径）。两者一致时返回空列表。
+func openAPIRouteMismatches(r *mux.Router) []string {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		return []string{fmt.Sprintf("解析 OpenAPI 文档失败: %v", err)}
+	}
+
+	var mismatches []string
+	registered := map[string]bool{}
+	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, "/api/") {
+			return nil
+		}
+		// 只有路径前缀、没有方法限制的路由（例如 `/api` 子路由器本身）不是具体的接口。
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			registered[strings.ToLower(method)+" "+path] = true
+			if _, ok := spec.Paths[path][strings.ToLower(method)]; !ok {
+				mismatches = append(mismatches, fmt.Sprintf("接口 %s %s 未在 openapi.json 中描述。", method, path))
+			}
+		}
+		return nil
+	})
+
+	// 按路径排序，让每次输出的顺序一致。
+	paths := make([]string, 0, len(spec.Paths))
+	for path := range spec.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		methods := make([]string, 0, len(spec.Paths[path]))
+		for method := range spec.Paths[path] {
+			// 路径下除了 get、post 等操作外还可以有 parameters 等公共字段，它们不是接口。
+			if openAPIMethods[method] && !registered[method+" "+path] {
+				methods = append(methods, method)
+			}
+		}
+		sort.Strings(methods)
+		for _, method := range methods {
+			mismatches = append(mismatches, fmt.Sprintf("openapi.json 中描述的接口 %s %s 未注册。", strings.ToUpper(method), path))
+		}
+	}
+	return mismatches
+}
+
+// openAPIMethods 是 OpenAPI 文档中路径对象下表示操作的字段。
+var openAPIMethods = map[string]bool{
+	"get": true, "put": true, "post": true, "delete": true, "options": true, "head": true, "patch": true, "trace": true,
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestOpenAPIMatchesRoutes 检查 newRouter 注册的每个接口都在 openapi.json 中描述，且文档中没有未注册的接口。
+// 新增、删除或改名接口后需要同步更新 openapi.json。
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	r := newRouter(nil, nil, &Config{})
+	for _, mismatch := range openAPIRouteMismatches(r) {
+		t.Error(mismatch)
+	}
+}
+
+func TestOpenAPIRouteMismatchesReportsUndocumentedRoute(t *testing.T) {
+	r := newRouter(nil, nil, &Config{})
+	r.HandleFunc("/api/undocumented", getOpenAPIHandler).Methods("GET")
+	mismatches := openAPIRouteMismatches(r)
+	if len(mismatches) != 1 || !strings.Contains(mismatches[0], "GET /api/undocumented") {
+		t.Errorf("openAPIRouteMismatches() = %q, want only GET /api/undocumented", mismatches)
+	}
+}
+
+// TestOpenAPIRouteMismatchesReportsUnregisteredRoute 检查文档中描述了但没有注册的接口也会被报告。
+func TestOpenAPIRouteMismatchesReportsUnregisteredRoute(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/api/openapi.json", getOpenAPIHandler).Methods("GET")
+	mismatches := openAPIRouteMismatches(r)
+	reported := strings.Join(mismatches, "\n")
+	if !strings.Contains(reported, "GET /api/connections 未注册") {
+		t.Errorf("openAPIRouteMismatches() = %q, want GET /api/connections reported as unregistered", mismatches)
+	}
+	if strings.Contains(reported, "/api/openapi.json") {
+		t.Errorf("openAPIRouteMismatches() = %q, want the registered route not reported", mismatches)
+	}
+}
+
+func TestGetOpenAPIHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	getOpenAPIHandler(w, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if !json.Valid(w.Body.Bytes()) {
+		t.Error("openapi.json is not valid JSON")
+	}
+}
+
+func TestAPIDocsPagePinsRedocVersion(t *testing.T) {
+	if strings.Contains(apiDocsPage, "/latest/") || !strings.Contains(apiDocsPage, "redoc@"+redocVersion+"/") {
+		t.Errorf("apiDocsPage does not load Redoc %s", redocVersion)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// 这个文件集中处理分页参数 (page / pageSize) 和排行数量 (limit) 的解析与上限。
+// 这些参数直接来自查询字符串，`?pageSize=1000000` 会让服务器一次读出大量记录、构建巨大的 JSON，
+// 查询期间还会长时间占用数据库。因此 pageSize 和 limit 超过 MAX_PAGE_SIZE 时被截断为上限，
+// 实际使用的值在响应中返回（分页接口的 pageSize 字段，排行接口的 `X-Limit` 响应头），前端可以据此发现被截断。
+
+// defaultMaxPageSize 是 MAX_PAGE_SIZE 的默认值。
+const defaultMaxPageSize = 500
+
+// maxPageSizeFor 返回当前配置的 pageSize / limit 上限。
+func maxPageSizeFor(r *http.Request) int {
+	if cfg, ok := r.Context().Value("config").(*Config); ok && cfg.MaxPageSize > 0 {
+		return cfg.MaxPageSize
+	}
+	return defaultMaxPageSize
+}
+
+// parsePagination 解析 page 和 pageSize 参数。page 未提供时为 1，不是正整数时返回 400 需要的字段名和错误信息；
+// pageSize 未提供或不是正整数时为 defaultPageSize，超过上限时截断为上限。
+func parsePagination(r *http.Request, defaultPageSize int) (page, pageSize int, field, msg string) {
+	page = 1
+	if v := r.URL.Query().Get("page"); v != "" {
+		var err error
+		page, err = strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return 0, 0, "page", "page 必须是大于 0 的整数"
+		}
+	}
+	pageSize, _ = strconv.Atoi(r.URL.Query().Get("pageSize"))
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if max := maxPageSizeFor(r); pageSize > max {
+		pageSize = max
+	}
+	return page, pageSize, "", ""
+}
+
+// parseLimit 解析排行接口的 limit 参数。未提供或不是正整数时为 defaultLimit，超过上限时截断为上限。
+// 实际使用的值写入响应头 `X-Limit`。
+func parseLimit(w http.ResponseWriter, r *http.Request, defaultLimit int) int {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if max := maxPageSizeFor(r); limit > max {
+		limit = max
+	}
+	w.Header().Set("X-Limit", strconv.Itoa(limit))
+	return limit
+}
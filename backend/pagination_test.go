@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// newPaginationRequest 创建带有查询字符串的请求；maxPageSize 大于 0 时像 configMiddleware 一样附加配置。
+func newPaginationRequest(query string, maxPageSize int) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/api/connections?"+query, nil)
+	if maxPageSize > 0 {
+		r = r.WithContext(context.WithValue(r.Context(), "config", &Config{MaxPageSize: maxPageSize}))
+	}
+	return r
+}
+
+func TestParsePagination(t *testing.T) {
+	tests := []struct {
+		name         string
+		query        string
+		maxPageSize  int
+		wantPage     int
+		wantPageSize int
+		wantField    string
+	}{
+		{"defaults", "", 0, 1, 20, ""},
+		{"page", "page=3&pageSize=50", 0, 3, 50, ""},
+		{"page zero", "page=0", 0, 0, 0, "page"},
+		{"negative page", "page=-1", 0, 0, 0, "page"},
+		{"non-numeric page", "page=abc", 0, 0, 0, "page"},
+		{"fractional page", "page=1.5", 0, 0, 0, "page"},
+		{"pageSize zero", "pageSize=0", 0, 1, 20, ""},
+		{"negative pageSize", "pageSize=-5", 0, 1, 20, ""},
+		{"non-numeric pageSize", "pageSize=abc", 0, 1, 20, ""},
+		{"pageSize equal to default max", "pageSize=" + strconv.Itoa(defaultMaxPageSize), 0, 1, defaultMaxPageSize, ""},
+		{"pageSize above default max", "pageSize=" + strconv.Itoa(defaultMaxPageSize+1), 0, 1, defaultMaxPageSize, ""},
+		{"pageSize equal to MAX_PAGE_SIZE", "pageSize=50", 50, 1, 50, ""},
+		{"pageSize above MAX_PAGE_SIZE", "pageSize=51", 50, 1, 50, ""},
+		{"pageSize far above MAX_PAGE_SIZE", "pageSize=1000000", 50, 1, 50, ""},
+		{"default above MAX_PAGE_SIZE", "", 10, 1, 10, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, pageSize, field, msg := parsePagination(newPaginationRequest(tt.query, tt.maxPageSize), 20)
+			if page != tt.wantPage || pageSize != tt.wantPageSize || field != tt.wantField {
+				t.Errorf("parsePagination() = %d, %d, %q, want %d, %d, %q", page, pageSize, field, tt.wantPage, tt.wantPageSize, tt.wantField)
+			}
+			if (field == "") != (msg == "") {
+				t.Errorf("parsePagination() field = %q, msg = %q, want both empty or both set", field, msg)
+			}
+		})
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		maxPageSize int
+		want        int
+	}{
+		{"default", "", 0, 10},
+		{"limit", "limit=25", 0, 25},
+		{"limit zero", "limit=0", 0, 10},
+		{"negative limit", "limit=-1", 0, 10},
+		{"non-numeric limit", "limit=abc", 0, 10},
+		{"limit equal to default max", "limit=" + strconv.Itoa(defaultMaxPageSize), 0, defaultMaxPageSize},
+		{"limit above default max", "limit=" + strconv.Itoa(defaultMaxPageSize+1), 0, defaultMaxPageSize},
+		{"limit equal to MAX_PAGE_SIZE", "limit=50", 50, 50},
+		{"limit above MAX_PAGE_SIZE", "limit=51", 50, 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if got := parseLimit(w, newPaginationRequest(tt.query, tt.maxPageSize), 10); got != tt.want {
+				t.Errorf("parseLimit() = %d, want %d", got, tt.want)
+			}
+			if got := w.Header().Get("X-Limit"); got != strconv.Itoa(tt.want) {
+				t.Errorf("X-Limit = %q, want %q", got, strconv.Itoa(tt.want))
+			}
+		})
+	}
+}
+
+// TestGetConnectionsHandlerPagination 检查连接列表接口对无效的 page 返回 400，并在响应中返回截断后的 pageSize。
+func TestGetConnectionsHandlerPagination(t *testing.T) {
+	db := newTestDB(t)
+	r := newRouter(db, nil, &Config{MaxPageSize: 50})
+	for _, page := range []string{"0", "-1", "abc"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/connections?page="+page, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("page=%s: status = %d, want %d", page, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/connections?pageSize=51", nil))
+	var resp struct {
+		PageSize    int `json:"pageSize"`
+		MaxPageSize int `json:"maxPageSize"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.PageSize != 50 || resp.MaxPageSize != 50 {
+		t.Errorf("pageSize = %d, maxPageSize = %d, want 50, 50", resp.PageSize, resp.MaxPageSize)
+	}
+}
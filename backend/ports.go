@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 这个文件实现了按目标端口识别服务。
+// 很多连接只有 IP 没有域名（例如 QUIC、WireGuard、游戏），仅凭主机名很难看出是什么流量；
+// 目标端口和网络类型 (tcp / udp) 往往就足以判断协议，例如 `udp/51820` 基本就是 WireGuard。
+// `/api/summary/ports` 按目标端口汇总流量，并用 wellKnownPorts 为常见端口附上服务名称，方便发现意料之外的协议。
+
+// wellKnownPorts 是常见端口到服务名称的映射。只收录家庭网络中常见、含义明确的端口，未收录的端口没有名称。
+var wellKnownPorts = map[int]string{
+	20:    "FTP-Data",
+	21:    "FTP",
+	22:    "SSH",
+	23:    "Telnet",
+	25:    "SMTP",
+	53:    "DNS",
+	67:    "DHCP",
+	80:    "HTTP",
+	110:   "POP3",
+	123:   "NTP",
+	143:   "IMAP",
+	443:   "HTTPS",
+	465:   "SMTPS",
+	500:   "IKE",
+	587:   "SMTP-Submission",
+	853:   "DoT",
+	993:   "IMAPS",
+	995:   "POP3S",
+	1194:  "OpenVPN",
+	1723:  "PPTP",
+	1883:  "MQTT",
+	3389:  "RDP",
+	3478:  "STUN",
+	4500:  "IPsec-NAT-T",
+	5060:  "SIP",
+	5222:  "XMPP",
+	5353:  "mDNS",
+	8080:  "HTTP-Alt",
+	8443:  "HTTPS-Alt",
+	8883:  "MQTTS",
+	51820: "WireGuard",
+}
+
+// parsePort 把 Clash 返回的端口字符串解析为整数。为空、无法解析或超出 1-65535 时返回 0。
+func parsePort(port string) int {
+	p, err := strconv.Atoi(strings.TrimSpace(port))
+	if err != nil || p < 1 || p > 65535 {
+		return 0
+	}
+	return p
+}
+
+// portLabel 返回端口对应的服务名称，未收录的端口返回空字符串。
+func portLabel(port int) string {
+	return wellKnownPorts[port]
+}
+
+// PortSummary 是 `/api/summary/ports` 返回的一个端口的流量汇总。
+type PortSummary struct {
+	Port        int    `json:"port"`            // 目标端口，记录端口之前写入的旧数据为 0。
+	Label       string `json:"label,omitempty"` // 端口对应的服务名称（如 `HTTPS`），未收录的端口省略。
+	Network     string `json:"network"`         // 网络类型 (`tcp` / `udp`)，旧数据为 `unknown`。
+	Upload      uint64 `json:"upload"`
+	Download    uint64 `json:"download"`
+	Total       uint64 `json:"total"`
+	Connections uint64 `json:"connections"`
+}
+
+// getPortSummaryHandler 是处理 `/api/summary/ports` GET 请求的 HTTP Handler。
+// 它返回按目标端口和网络类型分组的流量，按总流量降序排列，同一端口的 tcp 和 udp 分别统计（如 `tcp/443` 与 QUIC 的 `udp/443`）。
+// 支持 limit（默认 20）、network、startDate 和 endDate 参数。记录端口之前写入的旧数据归入端口 0。
+func getPortSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	limit := parseLimit(w, r, 20)
+	network := strings.ToLower(r.URL.Query().Get("network"))
+	startDate, _ := strconv.ParseInt(r.URL.Query().Get("startDate"), 10, 64)
+	endDate, _ := strconv.ParseInt(r.URL.Query().Get("endDate"), 10, 64)
+
+	query := `
+		SELECT
+			COALESCE(destinationPort, 0) as port,
+			COALESCE(NULLIF(network, ''), 'unknown') as network,
+			SUM(upload) as upload,
+			SUM(download) as download,
+			SUM(upload) + SUM(download) as total,
+			SUM(connections) as connections
+		FROM connections
+		WHERE 1=1
+	`
+	args := []interface{}{}
+
+	if network != "" {
+		query += " AND network = ?"
+		args = append(args, network)
+	}
+	if startDate > 0 {
+		query += " AND start >= ?"
+		args = append(args, startDate)
+	}
+	if endDate > 0 {
+		query += " AND start <= ?"
+		args = append(args, endDate)
+	}
+
+	query += " GROUP BY 1, 2 ORDER BY total DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := timedQuery(r.Context(), db, query, args...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	scale := sampleScalerFor(w, r)
+	summaries := []PortSummary{}
+	for rows.Next() {
+		var summary PortSummary
+		err := rows.Scan(&summary.Port, &summary.Network, &summary.Upload, &summary.Download, &summary.Total, &summary.Connections)
+		if err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		summary.Label = portLabel(summary.Port)
+		scale.Scale(&summary.Upload, &summary.Download, &summary.Total, &summary.Connections)
+		summaries = append(summaries, summary)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// 这个文件实现了可选的 SQLite PRAGMA 调优（synchronous、cache_size、mmap_size）。
+// 这些 PRAGMA 只对执行它的那一个连接生效，而 *sql.DB 是一个连接池，
+// 在打开数据库后执行一次 `db.Exec("PRAGMA ...")` 只能影响池中的某一个连接。
+// 因此这里注册了一个带 ConnectHook 的 sqlite3 驱动，在连接池每次新建连接时执行配置的 PRAGMA。
+// 未配置任何 PRAGMA 时，行为与直接使用 sqlite3 驱动完全相同。
+
+// sqliteDriverName 是注册的驱动名称，InitDB 和 InitArchiveDB 都通过它打开数据库。
+const sqliteDriverName = "sqlite3_infoclash"
+
+// PRAGMA 取值的合理范围，超出范围的配置会被忽略。
+const (
+	maxSQLiteCacheSizeKiB = 1 << 20 // cache_size 为负数时以 KiB 为单位，最多 1 GiB。
+	maxSQLiteCachePages   = 1 << 20 // cache_size 为正数时以页为单位。
+	maxSQLiteMmapSize     = 1 << 34 // mmap_size 以字节为单位，最多 16 GiB。
+)
+
+// sqlitePragmaStatements 是每个新连接需要执行的 PRAGMA 语句，由 configureSQLitePragmas 在打开数据库之前设置。
+var sqlitePragmaStatements []string
+
+func init() {
+	sql.Register(sqliteDriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			for _, stmt := range sqlitePragmaStatements {
+				if _, err := conn.Exec(stmt, nil); err != nil {
+					return fmt.Errorf("执行 %q 失败: %w", stmt, err)
+				}
+			}
+			return nil
+		},
+	})
+}
+
+// configureSQLitePragmas 校验配置中的 PRAGMA 取值并生成对应的语句。必须在打开数据库之前调用。
+// 取值为空或 0 的项保持 SQLite 驱动的默认值（synchronous 默认为 NORMAL）。
+func configureSQLitePragmas(cfg *Config) error {
+	var stmts []string
+
+	if cfg.SQLiteSynchronous != "" {
+		mode := strings.ToUpper(cfg.SQLiteSynchronous)
+		switch mode {
+		case "OFF", "NORMAL", "FULL", "EXTRA":
+		default:
+			return fmt.Errorf("无效的 SQLITE_SYNCHRONOUS 值 %q，可选值为 OFF、NORMAL、FULL、EXTRA", cfg.SQLiteSynchronous)
+		}
+		stmts = append(stmts, "PRAGMA synchronous = "+mode)
+	}
+
+	if cfg.SQLiteCacheSize != 0 {
+		if cfg.SQLiteCacheSize < -maxSQLiteCacheSizeKiB || cfg.SQLiteCacheSize > maxSQLiteCachePages {
+			return fmt.Errorf("SQLITE_CACHE_SIZE 超出范围: %d（负数表示 KiB，最小 %d；正数表示页数，最大 %d）",
+				cfg.SQLiteCacheSize, -maxSQLiteCacheSizeKiB, maxSQLiteCachePages)
+		}
+		stmts = append(stmts, fmt.Sprintf("PRAGMA cache_size = %d", cfg.SQLiteCacheSize))
+	}
+
+	if cfg.SQLiteMmapSize != 0 {
+		if cfg.SQLiteMmapSize < 0 || cfg.SQLiteMmapSize > maxSQLiteMmapSize {
+			return fmt.Errorf("SQLITE_MMAP_SIZE 超出范围: %d（0 到 %d 字节）", cfg.SQLiteMmapSize, int64(maxSQLiteMmapSize))
+		}
+		stmts = append(stmts, fmt.Sprintf("PRAGMA mmap_size = %d", cfg.SQLiteMmapSize))
+	}
+
+	sqlitePragmaStatements = stmts
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 这个文件实现了 Clash `/proxies` 接口的客户端，用于补全代理链筛选器。
+// `/api/chains` 原本只返回数据库中出现过的代理链，新加入的节点在产生流量之前不会出现在下拉菜单中。
+// 这里定期获取 Clash 中所有代理和策略组的名称并缓存起来，供 getChainsHandler 与数据库中的代理链合并，
+// 同时记录每个代理的类型、所属的策略组以及策略组当前选中的代理，通过 `/api/proxies` 提供给前端用于显示。
+// 旧版本的 Clash 可能没有这个接口，获取失败时缓存保持为空（或保留上一次的结果），不影响其他功能。
+
+const (
+	clashProxiesRefreshInterval = 5 * time.Minute  // 刷新代理列表的间隔。
+	clashProxiesTimeout         = 10 * time.Second // 请求 `/proxies` 的超时时间。
+)
+
+// ClashProxy 是 Clash 中的一个代理或策略组。
+type ClashProxy struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`          // 代理类型，如 `Shadowsocks`、`Vmess`；策略组为 `Selector`、`URLTest` 等。
+	Now    string   `json:"now,omitempty"` // 策略组当前选中的代理，普通代理为空。
+	Groups []string `json:"groups"`        // 包含该代理的策略组，按名称排序。
+}
+
+// clashProxyCache 缓存从 Clash `/proxies` 获取的代理信息。
+type clashProxyCache struct {
+	client *http.Client
+
+	mu        sync.RWMutex
+	types     map[string]string // 代理名称 → 类型（如 `Selector`、`Shadowsocks`）。
+	proxies   []ClashProxy      // 按名称排序的代理列表。
+	updatedAt int64             // 最近一次获取成功的时间（Unix 时间戳，秒），从未成功时为 0。
+	hasFailed bool              // 是否已记录过获取失败的日志，避免每次刷新都打印。
+}
+
+// clashProxies 是全局的代理名称缓存。
+// 与同步连接信息共用 clashTransport，复用与 Clash 控制器的长连接。
+var clashProxies = &clashProxyCache{client: &http.Client{Transport: clashTransport, Timeout: clashProxiesTimeout}}
+
+// clashEndpointURL 把配置的 `/connections` 地址替换为同一控制器下的其他接口，
+// 例如 `http://192.168.1.1:9090/connections` → `http://192.168.1.1:9090/proxies`。查询参数原样保留。
+func clashEndpointURL(connectionsURL *url.URL, endpoint string) *url.URL {
+	u := *connectionsURL
+	path := strings.TrimSuffix(u.Path, "/")
+	u.Path = strings.TrimSuffix(path, "/connections") + "/" + endpoint
+	u.RawPath = ""
+	return &u
+}
+
+// Run 立即获取一次代理列表，之后定期刷新。它会一直阻塞，应在 Goroutine 中调用。
+func (c *clashProxyCache) Run(cfg *Config) {
+	ticker := time.NewTicker(clashProxiesRefreshInterval)
+	defer ticker.Stop()
+	for {
+		c.refresh(cfg)
+		<-ticker.C
+	}
+}
+
+// refresh 获取一次代理列表并更新缓存。失败时保留上一次的结果。
+func (c *clashProxyCache) refresh(cfg *Config) {
+	proxies, err := c.fetch(cfg)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		if !c.hasFailed {
+			log.Printf("获取 Clash 代理列表失败（旧版本 Clash 可能不支持 /proxies，可以忽略）: %v", err)
+			c.hasFailed = true
+		}
+		return
+	}
+	c.types = make(map[string]string, len(proxies))
+	for _, proxy := range proxies {
+		c.types[proxy.Name] = proxy.Type
+	}
+	c.proxies = proxies
+	c.updatedAt = time.Now().Unix()
+	c.hasFailed = false
+}
+
+// fetch 请求 Clash 的 `/proxies` 接口，返回按名称排序的代理列表。
+func (c *clashProxyCache) fetch(cfg *Config) ([]ClashProxy, error) {
+	req, err := http.NewRequest("GET", cfg.ClashAPIURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("创建请求失败: %w", err)
+	}
+	// 先在 `/connections` 地址上添加认证信息（query 方式会修改 URL），再替换为 `/proxies`。
+	setClashAuth(req, cfg)
+	req.URL = clashEndpointURL(req.URL, "proxies")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		// 与 GetClashConnections 一样，避免把 query 方式中的 Token 写入日志。
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = redactURLPassword(cfg.ClashAPIURL)
+		}
+		return nil, fmt.Errorf("请求 Clash API 失败: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &ClashStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	var body struct {
+		Proxies map[string]struct {
+			Type string   `json:"type"`
+			Now  string   `json:"now"` // 仅策略组有值。
+			All  []string `json:"all"` // 策略组包含的代理，仅策略组有值。
+		} `json:"proxies"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("解析 JSON 失败: %w", err)
+	}
+
+	// Clash 只在策略组上记录它包含哪些代理，这里反过来为每个代理记录它所属的策略组。
+	groups := make(map[string][]string)
+	for name, proxy := range body.Proxies {
+		for _, member := range proxy.All {
+			groups[member] = append(groups[member], name)
+		}
+	}
+	proxies := make([]ClashProxy, 0, len(body.Proxies))
+	for name, proxy := range body.Proxies {
+		memberOf := groups[name]
+		if memberOf == nil {
+			memberOf = []string{}
+		}
+		sort.Strings(memberOf)
+		proxies = append(proxies, ClashProxy{Name: name, Type: proxy.Type, Now: proxy.Now, Groups: memberOf})
+	}
+	sort.Slice(proxies, func(i, j int) bool { return proxies[i].Name < proxies[j].Name })
+	return proxies, nil
+}
+
+// Types 返回缓存的代理名称到类型的映射。尚未获取成功时返回 nil。返回的 map 不能被修改。
+func (c *clashProxyCache) Types() map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.types
+}
+
+// Proxies 返回缓存的代理列表和最近一次获取成功的时间。尚未获取成功时返回 nil 和 0。返回的切片不能被修改。
+func (c *clashProxyCache) Proxies() ([]ClashProxy, int64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.proxies, c.updatedAt
+}
+
+// getProxiesHandler 是处理 `/api/proxies` GET 请求的 HTTP Handler。
+// 它返回缓存的 Clash 代理列表，包括类型、所属的策略组和策略组当前选中的代理，用于美化代理链的显示。
+// 从未成功获取过代理列表时（例如 Clash 不支持 `/proxies`）返回空列表，available 为 false。
+func getProxiesHandler(w http.ResponseWriter, r *http.Request) {
+	proxies, updatedAt := clashProxies.Proxies()
+	if proxies == nil {
+		proxies = []ClashProxy{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"available": updatedAt > 0,
+		"updatedAt": updatedAt,
+		"proxies":   proxies,
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 这个文件实现了可选的反向 DNS 解析，用于为 host 和 remoteDestination 都为空的连接补充主机名。
+// 反向解析可能很慢甚至超时，因此它完全异步进行：采集器只读取缓存，缓存未命中时把 IP 放入队列
+// 交给后台 Goroutine 解析，本轮同步照常继续。由于采集器每秒都会重新获取同一批连接，
+// 解析完成后的下一次同步就能用上结果。
+
+const (
+	// reverseDNSCacheSize 是反向解析缓存的最大条目数，写满后清空重建。
+	reverseDNSCacheSize = 10000
+	// reverseDNSQueueSize 是等待解析的 IP 队列长度，队列满时新的请求会被丢弃，下次同步再重试。
+	reverseDNSQueueSize = 256
+	// reverseDNSWorkers 是并发执行反向解析的 Goroutine 数量。
+	reverseDNSWorkers = 4
+	// reverseDNSTimeout 是单次反向解析的超时时间。
+	reverseDNSTimeout = 2 * time.Second
+)
+
+// reverseDNSResolver 异步解析 IP 地址的 PTR 记录，并缓存结果（包括解析失败的结果）。
+type reverseDNSResolver struct {
+	mu      sync.Mutex
+	cache   map[string]string // IP → 主机名，解析失败时为空字符串。
+	pending map[string]bool   // 已在队列中或正在解析的 IP。
+	queue   chan string
+	lookup  func(ctx context.Context, addr string) ([]string, error)
+}
+
+// hostReverseDNS 是全局的反向解析器。为 nil 时表示未开启反向解析。
+var hostReverseDNS *reverseDNSResolver
+
+// newReverseDNSResolver 创建反向解析器并启动后台解析 Goroutine。
+func newReverseDNSResolver() *reverseDNSResolver {
+	rd := &reverseDNSResolver{
+		cache:   make(map[string]string),
+		pending: make(map[string]bool),
+		queue:   make(chan string, reverseDNSQueueSize),
+		lookup:  net.DefaultResolver.LookupAddr,
+	}
+	for i := 0; i < reverseDNSWorkers; i++ {
+		go rd.worker()
+	}
+	return rd
+}
+
+// Host 返回 IP 地址对应的主机名。结果尚未缓存时会安排一次后台解析并立即返回空字符串，
+// 因此它从不阻塞调用方。
+func (rd *reverseDNSResolver) Host(ip string) string {
+	if ip == "" {
+		return ""
+	}
+
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	if host, ok := rd.cache[ip]; ok {
+		return host
+	}
+	if !rd.pending[ip] {
+		select {
+		case rd.queue <- ip:
+			rd.pending[ip] = true
+		default:
+			// 队列已满，放弃本次解析，下次同步时会再次尝试。
+		}
+	}
+	return ""
+}
+
+// worker 从队列中取出 IP 并执行反向解析，把结果写入缓存。
+func (rd *reverseDNSResolver) worker() {
+	for ip := range rd.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), reverseDNSTimeout)
+		names, err := rd.lookup(ctx, ip)
+		cancel()
+
+		var host string
+		if err == nil && len(names) > 0 {
+			// PTR 记录以 `.` 结尾，例如 `server-1-2-3-4.example.net.`。
+			host = strings.ToLower(strings.TrimSuffix(names[0], "."))
+		}
+
+		rd.mu.Lock()
+		if len(rd.cache) >= reverseDNSCacheSize {
+			rd.cache = make(map[string]string)
+		}
+		rd.cache[ip] = host
+		delete(rd.pending, ip)
+		rd.mu.Unlock()
+	}
+}
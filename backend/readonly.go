@@ -0,0 +1,46 @@
+package main
+
+import "net/http"
+
+// 这个文件实现了只读模式 (READ_ONLY=true)，用于把仪表盘公开给其他人查看。
+// 只读模式下所有修改数据或触发维护操作的接口（合并、替换主机名、删除、恢复归档、修改设备名称、立即写入/同步等）返回 403，
+// GET 接口和前端页面不受影响。
+// 保护分为两层：注册路由时把修改数据的接口替换为 readOnlyHandler；readOnlyMiddleware 再拒绝所有非只读方法的 API 请求，
+// 之后新增的 POST 等接口即使忘记在注册时处理，也不会在只读模式下被调用。
+
+// errReadOnly 是只读模式下修改数据的请求返回的错误信息。
+const errReadOnly = "服务器处于只读模式 (READ_ONLY=true)，不允许修改数据"
+
+// isReadOnlyMethod 判断 method 是否为不修改数据的 HTTP 方法。
+func isReadOnlyMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// readOnlyHandler 是只读模式下替代修改数据的接口的 Handler，始终返回 403。
+func readOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusForbidden, "", errReadOnly)
+}
+
+// mutatingHandler 用于注册修改数据的接口：只读模式下返回 readOnlyHandler，否则原样返回 h。
+func mutatingHandler(cfg *Config, h http.HandlerFunc) http.HandlerFunc {
+	if cfg.ReadOnly {
+		return readOnlyHandler
+	}
+	return h
+}
+
+// readOnlyMiddleware 在只读模式下拒绝所有使用非只读方法的请求。它只在 READ_ONLY=true 时注册。
+func readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isReadOnlyMethod(r.Method) {
+			debugf("只读模式: 拒绝了 %s %s", r.Method, r.URL.Path)
+			readOnlyHandler(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
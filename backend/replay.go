@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// 这个文件实现了回放录制的 Clash `/connections` 响应 (`infoclash ingest`)，用于开发、演示和截图，不需要运行中的 Clash。
+// 录制文件包含一个或多个与 Clash API 返回格式相同的快照：每行一个快照 (JSON Lines)，或者一个由快照组成的 JSON 数组。
+// 录制方法例如：`while true; do curl -s -H "Authorization: Bearer $TOKEN" http://127.0.0.1:9090/connections; echo; sleep 1; done > replay.json`。
+// 每个快照依次经过与实时同步相同的解析 (decodeConnections)、清洗 (cleanConnections) 和缓存 (ingestConnections)，
+// 最后通过 writeCacheToDB 写入数据库，因此 EMPTY_HOST_POLICY、主机后缀白名单、抽样等配置同样生效。
+// 录制时的时间没有意义，快照使用合成的时间：第 i 个快照的时间为 start + i × step，
+// 连接的开始时间为它第一次出现的快照的时间，从快照中消失时按当时的快照时间记为关闭。
+
+// readReplaySnapshots 读取录制文件中的所有快照，返回每个快照的原始 JSON。
+// 第一个非空白字符为 `[` 时按快照数组解析，否则按连续的 JSON 值（通常是每行一个）解析。
+func readReplaySnapshots(r io.Reader) ([]json.RawMessage, error) {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' {
+			br.ReadByte()
+			continue
+		}
+		break
+	}
+
+	dec := json.NewDecoder(br)
+	if b, _ := br.Peek(1); b[0] == '[' {
+		var snapshots []json.RawMessage
+		if err := dec.Decode(&snapshots); err != nil {
+			return nil, fmt.Errorf("解析快照数组失败: %w", err)
+		}
+		return snapshots, nil
+	}
+	var snapshots []json.RawMessage
+	for {
+		var snapshot json.RawMessage
+		err := dec.Decode(&snapshot)
+		if err == io.EOF {
+			return snapshots, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("解析第 %d 个快照失败: %w", len(snapshots)+1, err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+}
+
+// ReplayResult 描述了一次回放的结果。
+type ReplayResult struct {
+	Snapshots   int // 回放的快照数。
+	Skipped     int // 无法解析而被跳过的快照数。
+	Connections int // 不同的连接数（按 ID 统计，包括未被抽样保留的连接）。
+	Written     int // 写入数据库的记录数。
+}
+
+// replaySnapshots 按顺序回放 snapshots，第 i 个快照的时间为 start + i × step，最后把缓存写入数据库。
+// 缓存中的连接数达到 CACHE_FLUSH_THRESHOLD 时提前写入一次，避免很大的录制文件占用过多内存。
+// 无法解析的快照会被跳过并记录日志，与实时同步时跳过一次同步相同。
+func replaySnapshots(ctx context.Context, db *sql.DB, cfg *Config, snapshots []json.RawMessage, start time.Time, step time.Duration) (ReplayResult, error) {
+	result := ReplayResult{Snapshots: len(snapshots)}
+	firstSeen := make(map[string]time.Time)
+
+	clashSyncMu.Lock()
+	defer clashSyncMu.Unlock()
+	for i, raw := range snapshots {
+		now := start.Add(time.Duration(i) * step)
+		connections, err := decodeConnections(bytes.NewReader(raw))
+		if err != nil {
+			log.Printf("警告: 跳过第 %d 个快照: %v", i+1, err)
+			result.Skipped++
+			continue
+		}
+		cleanConnections(connections, cfg)
+		for j := range connections.Connections {
+			conn := &connections.Connections[j]
+			seen, ok := firstSeen[conn.ID]
+			if !ok {
+				seen = now
+				firstSeen[conn.ID] = now
+			}
+			conn.Start = seen
+		}
+		ingestConnections(connections, cfg, now)
+
+		if cfg.CacheFlushThreshold > 0 && cacheEntries.Load() >= cfg.CacheFlushThreshold {
+			written, err := writeCacheToDB(ctx, db)
+			result.Written += written
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+	result.Connections = len(firstSeen)
+
+	written, err := writeCacheToDB(ctx, db)
+	result.Written += written
+	return result, err
+}
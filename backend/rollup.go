@@ -0,0 +1,271 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// 这个文件实现了按天预聚合的流量汇总表 `daily_rollup` (DAILY_ROLLUP)。
+// `/api/summary/traffic` 和 `/api/summary/hosts` 原本每次请求都要对 connections 表做一次全表 SUM / GROUP BY，
+// 积累了一年的数据之后仪表盘需要好几秒才能加载完成。daily_rollup 按 (日期, host, sourceIP, chain) 保存每天的流量之和，
+// 按天查询时只需读取少得多的行。
+//
+// daily_rollup 中的每一天都是由 connections 表中这一天的记录重新计算得到的，而不是在写入时累加增量：
+// 同一条连接在它存活期间会被写入多次（每次都是累计值），合并、删除、替换主机名等操作也会改写已有的记录，
+// 按天重算可以保证结果与直接查询 connections 表完全一致。需要重算的只有被修改过的日期，
+// 例如每次写入缓存 (writeCacheToDB) 通常只涉及当天，借助 start 列上的索引只需扫描这一天的记录。
+//
+// 日期按 UTC 划分，与 `/api/summary/traffic` 按天分组时使用的时间一致。
+// 查询范围的两端不足一天的部分（例如最近几个小时）仍然从 connections 表读取，见 dailyRollupSplit。
+// 程序升级后第一次启动，或者某次重算失败后，会在后台从 connections 表重新生成整张表，生成完成之前汇总接口直接查询 connections 表。
+
+// metaDailyRollupKey 是 metadata 表中记录 daily_rollup 版本的 key。值与 dailyRollupVersion 不一致时需要重新生成。
+const metaDailyRollupKey = "daily_rollup_version"
+
+// dailyRollupVersion 是 daily_rollup 的版本，表结构或计算方式变化时修改它，启动时会自动重新生成。
+const dailyRollupVersion = "1"
+
+// secondsPerDay 是一天的秒数。
+const secondsPerDay = 24 * 60 * 60
+
+// dailyRollupEnabled 表示是否维护 daily_rollup，由 main 在打开数据库之前根据 DAILY_ROLLUP 设置。
+var dailyRollupEnabled bool
+
+// dailyRollupReady 表示 daily_rollup 已经与 connections 表一致，汇总接口可以读取。
+var dailyRollupReady atomic.Bool
+
+// initDailyRollup 创建 daily_rollup 表，返回是否需要重新生成（升级后第一次启动或者之前的重算失败过）。
+// 关闭 DAILY_ROLLUP 时删除这张表，之后重新开启会从头生成，不会读到过时的数据。
+func initDailyRollup(db *sql.DB) (needsRebuild bool, err error) {
+	if !dailyRollupEnabled {
+		if _, err := db.Exec("DROP TABLE IF EXISTS daily_rollup"); err != nil {
+			return false, err
+		}
+		return false, setMetadata(db, metaDailyRollupKey, "")
+	}
+
+	createRollupSQL := `CREATE TABLE IF NOT EXISTS daily_rollup (
+		"date" TEXT NOT NULL,
+		"host" TEXT,
+		"sourceIP" TEXT,
+		"chain" TEXT,
+		"upload" INTEGER NOT NULL DEFAULT 0,
+		"download" INTEGER NOT NULL DEFAULT 0,
+		"connections" INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX IF NOT EXISTS idx_daily_rollup_date ON daily_rollup (date);`
+	if _, err := db.Exec(createRollupSQL); err != nil {
+		return false, err
+	}
+	version, _, err := getMetadata(db, metaDailyRollupKey)
+	if err != nil {
+		return false, err
+	}
+	if version != dailyRollupVersion {
+		return true, nil
+	}
+	dailyRollupReady.Store(true)
+	return false, nil
+}
+
+// rebuildDailyRollup 从 connections 表重新生成整张 daily_rollup 表，返回生成的行数。
+func rebuildDailyRollup(db *sql.DB) (int64, error) {
+	if !dailyRollupEnabled {
+		return 0, fmt.Errorf("未启用按天汇总表 (DAILY_ROLLUP=false)")
+	}
+	log.Println("开始生成按天汇总表 daily_rollup...")
+	started := time.Now()
+	rows, err := refreshDailyRollup(db, 0, 0)
+	if err == nil {
+		err = setMetadata(db, metaDailyRollupKey, dailyRollupVersion)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("生成按天汇总表失败: %w", err)
+	}
+	dailyRollupReady.Store(true)
+	log.Printf("按天汇总表生成完成，共 %d 行，耗时 %v。", rows, time.Since(started))
+	return rows, nil
+}
+
+// updateDailyRollup 在修改 connections 表之后重算 [from, to] 所在的每一天，from、to 为 0 表示不限。
+// 失败时不影响调用方的主操作：记录日志，并让汇总接口改为直接查询 connections 表，直到重新生成成功。
+func updateDailyRollup(db *sql.DB, from, to int64) {
+	if !dailyRollupEnabled {
+		return
+	}
+	if _, err := refreshDailyRollup(db, from, to); err != nil {
+		log.Printf("更新按天汇总表失败，汇总接口将直接查询连接记录，下次启动时（或调用 /api/maintenance/rebuild-rollup 后）重新生成: %v", err)
+		dailyRollupReady.Store(false)
+		if err := setMetadata(db, metaDailyRollupKey, ""); err != nil {
+			log.Printf("写入 metadata 失败: %v", err)
+		}
+	}
+}
+
+// refreshDailyRollup 在一个事务中删除 [from, to] 所在日期的汇总行，再从 connections 表重新计算这些日期，返回生成的行数。
+// from、to 为 0 表示不限，两者都为 0 时重算整张表。
+func refreshDailyRollup(db *sql.DB, from, to int64) (rows int64, err error) {
+	deleteSQL := "DELETE FROM daily_rollup WHERE 1=1"
+	insertSQL := `INSERT INTO daily_rollup (date, host, sourceIP, chain, upload, download, connections)
+		SELECT strftime('%Y-%m-%d', start, 'unixepoch'), host, sourceIP, chain, SUM(upload), SUM(download), SUM(connections)
+		FROM connections WHERE start IS NOT NULL`
+	var deleteArgs, insertArgs []interface{}
+	if from > 0 {
+		first := dayStart(from)
+		deleteSQL += " AND date >= ?"
+		deleteArgs = append(deleteArgs, rollupDate(first))
+		insertSQL += " AND start >= ?"
+		insertArgs = append(insertArgs, first)
+	}
+	if to > 0 {
+		last := dayStart(to)
+		deleteSQL += " AND date <= ?"
+		deleteArgs = append(deleteArgs, rollupDate(last))
+		insertSQL += " AND start < ?"
+		insertArgs = append(insertArgs, last+secondsPerDay)
+	}
+	insertSQL += " GROUP BY 1, 2, 3, 4"
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("开启事务失败: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	if _, err = tx.Exec(deleteSQL, deleteArgs...); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(insertSQL, insertArgs...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// dayStart 返回 ts 所在 UTC 日期零点的时间戳。
+func dayStart(ts int64) int64 {
+	return ts - ((ts%secondsPerDay)+secondsPerDay)%secondsPerDay
+}
+
+// rollupDate 返回时间戳 ts 在 daily_rollup 中对应的日期（UTC）。
+func rollupDate(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format("2006-01-02")
+}
+
+// dailyRollupSplit 把查询范围 [startDate, endDate]（为 0 表示不限）拆分为 daily_rollup 能完整覆盖的日期，
+// 和两端不足一天、需要从 connections 表读取的部分。
+// rollupWhere 是 daily_rollup 的日期条件，rawWhere 是 connections 中其余部分的条件，均以 ` AND` 开头；
+// 不需要读取 connections 时 rawWhere 为 ` AND 0`。范围内没有完整的一天时第五个返回值为 false，调用方应直接查询 connections 表。
+func dailyRollupSplit(startDate, endDate int64) (rollupWhere string, rollupArgs []interface{}, rawWhere string, rawArgs []interface{}, ok bool) {
+	// [first, last) 是范围内完整的日期。
+	var first, last int64
+	if startDate > 0 {
+		first = dayStart(startDate + secondsPerDay - 1)
+		rollupWhere += " AND date >= ?"
+		rollupArgs = append(rollupArgs, rollupDate(first))
+	}
+	if endDate > 0 {
+		last = dayStart(endDate + 1)
+		rollupWhere += " AND date < ?"
+		rollupArgs = append(rollupArgs, rollupDate(last))
+	}
+	if startDate > 0 && endDate > 0 && first >= last {
+		return "", nil, "", nil, false
+	}
+
+	var parts []string
+	if startDate > 0 && startDate < first {
+		parts = append(parts, "(start >= ? AND start < ?)")
+		rawArgs = append(rawArgs, startDate, first)
+	}
+	if endDate > 0 && last <= endDate {
+		parts = append(parts, "(start >= ? AND start <= ?)")
+		rawArgs = append(rawArgs, last, endDate)
+	}
+	switch len(parts) {
+	case 0:
+		rawWhere = " AND 0"
+	case 1:
+		rawWhere = " AND " + parts[0]
+	default:
+		rawWhere = " AND (" + parts[0] + " OR " + parts[1] + ")"
+	}
+	return rollupWhere, rollupArgs, rawWhere, rawArgs, true
+}
+
+// summarySource 返回汇总查询的数据来源：一个带有 time、host、sourceIP、chain、upload、download、connections 列的子查询及其参数。
+// time 为按 format（strftime 格式）格式化的开始时间。where 和 args 是只涉及 host、sourceIP、chain 列的筛选条件（以 ` AND` 开头），
+// startDate、endDate 为查询范围（为 0 表示不限）。
+// byDay 为 true（按天或更粗的粒度汇总）且 daily_rollup 可用时，完整的日期从 daily_rollup 读取，其余部分从 connections 读取，
+// 此时 format 必须以 `%Y-%m-%d` 开头、其余部分为固定的 ` 00:00:00`（或为空），否则直接查询 connections 表。
+func summarySource(format string, byDay bool, where string, args []interface{}, startDate, endDate int64) (string, []interface{}) {
+	rawSource := func(dateWhere string, dateArgs []interface{}) (string, []interface{}) {
+		query := "SELECT strftime(?, datetime(start, 'unixepoch')) AS time, host, sourceIP, chain, upload, download, connections FROM connections WHERE 1=1" + where + dateWhere
+		queryArgs := append([]interface{}{format}, args...)
+		return query, append(queryArgs, dateArgs...)
+	}
+
+	var dateWhere string
+	var dateArgs []interface{}
+	if startDate > 0 {
+		dateWhere += " AND start >= ?"
+		dateArgs = append(dateArgs, startDate)
+	}
+	if endDate > 0 {
+		dateWhere += " AND start <= ?"
+		dateArgs = append(dateArgs, endDate)
+	}
+	if !byDay || !dailyRollupReady.Load() {
+		query, queryArgs := rawSource(dateWhere, dateArgs)
+		return "(" + query + ")", queryArgs
+	}
+	rollupWhere, rollupArgs, rawWhere, rawArgs, ok := dailyRollupSplit(startDate, endDate)
+	if !ok {
+		query, queryArgs := rawSource(dateWhere, dateArgs)
+		return "(" + query + ")", queryArgs
+	}
+
+	// daily_rollup 中的日期为 `YYYY-MM-DD`，用 strftime 按同一格式重新格式化，得到与 connections 一致的 time。
+	query := "SELECT strftime(?, date) AS time, host, sourceIP, chain, upload, download, connections FROM daily_rollup WHERE 1=1" + where + rollupWhere
+	queryArgs := append([]interface{}{format}, args...)
+	queryArgs = append(queryArgs, rollupArgs...)
+	raw, rawQueryArgs := rawSource(rawWhere, rawArgs)
+	return "(" + query + " UNION ALL " + raw + ")", append(queryArgs, rawQueryArgs...)
+}
+
+// rebuildRollupHandler 是处理 `/api/maintenance/rebuild-rollup` POST 请求的 HTTP Handler。
+// 它从 connections 表重新生成 daily_rollup，用于修复按天汇总表（例如直接修改过数据库文件之后）。
+func rebuildRollupHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+	if !dailyRollupEnabled {
+		writeJSONError(w, http.StatusBadRequest, "", "未启用按天汇总表 (DAILY_ROLLUP=false)")
+		return
+	}
+
+	started := time.Now()
+	rows, err := rebuildDailyRollup(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "按天汇总表已重新生成",
+		"rows":       rows,
+		"durationMs": time.Since(started).Milliseconds(),
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 这个文件实现了主数据库的每日轮转功能。
+// 对于长期运行的部署，单个不断增长的数据库文件难以管理和备份。开启轮转后，
+// 每天本地时间零点会把主数据库中的连接记录另存为一个带日期后缀的文件
+// （例如 `clash_traffic.2024-01-01.db`），然后从主数据库中删除已写入快照的记录。
+//
+// 这里使用 SQLite 的 `VACUUM INTO` 生成一致的快照，而不是直接重命名正在使用的文件，
+// 这样程序中共享的 *sql.DB 连接池无需替换，所有 Handler 都能继续正常工作。
+// 注意：跨越零点仍然活跃的连接会在新旧两个文件中各有一条记录，
+// 新文件中记录的是该连接的累计流量。
+//
+// 合并、删除、恢复等 Handler 写入时不持有 dbWriteMu，它们可能恰好发生在快照和删除之间。
+// 因此删除时只删除与快照中完全一致的行：快照之后新增或修改过的行会保留在主数据库中，
+// 留到下一次轮转，而不会在未保存的情况下被删除。
+
+// rotatedDBLayout 是轮转文件名中日期部分的格式。
+const rotatedDBLayout = "2006-01-02"
+
+// RotatedDB 描述一个已轮转的数据库文件。
+type RotatedDB struct {
+	Date string `json:"date"` // 文件对应的日期 (YYYY-MM-DD)。
+	Path string `json:"path"` // 文件路径。
+	Size int64  `json:"size"` // 文件大小（字节）。
+}
+
+// rotatedDBPath 返回指定日期的轮转文件路径。
+// 例如 `./clash_traffic.db` 在 2024-01-01 的轮转文件为 `./clash_traffic.2024-01-01.db`。
+func rotatedDBPath(dbPath string, date time.Time) string {
+	ext := filepath.Ext(dbPath)
+	return strings.TrimSuffix(dbPath, ext) + "." + date.Format(rotatedDBLayout) + ext
+}
+
+// runDailyRotation 在每天本地时间零点轮转主数据库。它会一直阻塞直到 ctx 被取消，应在 Goroutine 中调用。
+func runDailyRotation(ctx context.Context, db *sql.DB, dbPath string) {
+	for {
+		now := time.Now()
+		nextMidnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(nextMidnight)):
+		}
+
+		// 轮转文件以刚刚结束的那一天命名。
+		day := nextMidnight.AddDate(0, 0, -1)
+		if err := rotateDB(ctx, db, rotatedDBPath(dbPath, day)); err != nil {
+			log.Printf("轮转主数据库失败: %v", err)
+		}
+	}
+}
+
+// rotateDB 先把内存缓存写入数据库，然后将 `connections` 表的快照保存到 target，
+// 成功后从 `connections` 表中删除快照里已保存的记录。整个过程持有 dbWriteMu，避免与批量写入交错。
+func rotateDB(ctx context.Context, db *sql.DB, target string) error {
+	writeCacheToDB(ctx, db)
+
+	dbWriteMu.Lock()
+	defer dbWriteMu.Unlock()
+
+	if _, err := os.Stat(target); err == nil {
+		return fmt.Errorf("轮转文件 %s 已存在", target)
+	}
+
+	log.Printf("开始轮转主数据库到 %s ...", target)
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", target); err != nil {
+		return fmt.Errorf("保存数据库快照失败: %w", err)
+	}
+	deleted, err := deleteSnapshottedConnections(ctx, db, target)
+	if err != nil {
+		return fmt.Errorf("清理主数据库失败: %w", err)
+	}
+	updateDailyRollup(db, 0, 0)
+	summaryCache.Invalidate()
+	log.Printf("主数据库轮转完成，已将 %d 条记录保存到 %s。", deleted, target)
+
+	go vacuumDB(db)
+	return nil
+}
+
+// deleteSnapshottedConnections 挂载快照文件，并删除主数据库中与快照内容完全一致的连接记录。
+// 快照之后才写入或被修改的记录不会被删除。ATTACH 只对单个连接生效，所以这里使用独立的 *sql.Conn。
+func deleteSnapshottedConnections(ctx context.Context, db *sql.DB, snapshot string) (int64, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS rotated", snapshot); err != nil {
+		return 0, fmt.Errorf("挂载快照失败: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "DETACH DATABASE rotated")
+
+	// 使用 IS 而不是 = 比较，使两边均为 NULL 的列也视为一致。
+	var conds []string
+	for _, col := range strings.Split(connectionColumns, ", ") {
+		conds = append(conds, fmt.Sprintf("s.%[1]s IS c.%[1]s", col))
+	}
+	result, err := conn.ExecContext(ctx, "DELETE FROM main.connections AS c WHERE EXISTS (SELECT 1 FROM rotated.connections AS s WHERE "+strings.Join(conds, " AND ")+")")
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// listRotatedDBs 列出主数据库旁边所有已轮转的数据库文件，按日期升序排列。
+func listRotatedDBs(dbPath string) ([]RotatedDB, error) {
+	ext := filepath.Ext(dbPath)
+	prefix := strings.TrimSuffix(dbPath, ext) + "."
+	matches, err := filepath.Glob(prefix + "????-??-??" + ext)
+	if err != nil {
+		return nil, err
+	}
+
+	rotated := []RotatedDB{}
+	for _, path := range matches {
+		date := strings.TrimSuffix(strings.TrimPrefix(path, prefix), ext)
+		if _, err := time.Parse(rotatedDBLayout, date); err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		rotated = append(rotated, RotatedDB{Date: date, Path: path, Size: info.Size()})
+	}
+	sort.Slice(rotated, func(i, j int) bool { return rotated[i].Date < rotated[j].Date })
+	return rotated, nil
+}
+
+// getRotatedDBsHandler 是处理 `/api/rotations` GET 请求的 HTTP Handler。
+// 它返回所有已轮转的主数据库文件列表。
+func getRotatedDBsHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, ok := r.Context().Value("config").(*Config)
+	if !ok {
+		http.Error(w, "无法获取配置", http.StatusInternalServerError)
+		return
+	}
+
+	rotated, err := listRotatedDBs(cfg.DatabasePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("列出轮转文件失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rotated)
+}
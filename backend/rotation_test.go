@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestDeleteSnapshottedConnections 检查轮转时只删除与快照完全一致的记录，
+// 快照之后新增或被修改的记录必须保留在主数据库中。
+func TestDeleteSnapshottedConnections(t *testing.T) {
+	db := newTestDB(t)
+	start := time.Unix(1700000000, 0)
+	seedConnections(t, db,
+		Connection{ID: "a", Metadata: Metadata{Host: "a.example.com", SourceIP: "10.0.0.1"}, Upload: 1, Start: start},
+		Connection{ID: "b", Metadata: Metadata{Host: "b.example.com", SourceIP: "10.0.0.1"}, Upload: 1, Start: start},
+	)
+
+	target := filepath.Join(t.TempDir(), "snapshot.db")
+	if _, err := db.Exec("VACUUM INTO ?", target); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟快照和删除之间发生的写入：修改 b，新增 c。
+	seedConnections(t, db,
+		Connection{ID: "b", Metadata: Metadata{Host: "b.example.com", SourceIP: "10.0.0.1"}, Upload: 2, Start: start},
+		Connection{ID: "c", Metadata: Metadata{Host: "c.example.com", SourceIP: "10.0.0.1"}, Upload: 1, Start: start},
+	)
+
+	deleted, err := deleteSnapshottedConnections(context.Background(), db, target)
+	if err != nil {
+		t.Fatalf("deleteSnapshottedConnections() error = %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("deleted = %d, want 1", deleted)
+	}
+	if got, want := connectionIDs(t, db), "b,c"; got != want {
+		t.Errorf("remaining ids = %q, want %q", got, want)
+	}
+}
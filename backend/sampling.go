@@ -0,0 +1,49 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// 这个文件实现了可选的连接抽样 (SAMPLE_RATE)。
+// 在非常繁忙的网络中，如果只关心流量趋势，记录每一条连接会占用大量存储空间。
+// 设置采样率后，采集时只保留一部分连接：按连接 ID 的哈希值决定去留，
+// 因此同一条连接在每次同步中要么一直被保留、要么一直被丢弃，不会出现只记录了一半流量的连接。
+// 汇总接口会把统计结果按采样率的倒数放大，作为总量的估计值。
+
+// sampleKeep 判断 ID 为 id 的连接在采样率 rate 下是否被保留。rate 不小于 1 时保留所有连接。
+func sampleKeep(id string, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	// 取哈希值的高 53 位映射到 [0, 1)，与 rate 比较。
+	return float64(h.Sum64()>>11)/(1<<53) < rate
+}
+
+// sampleScaler 是汇总结果的放大倍数，即采样率的倒数。未开启抽样时为 1。
+type sampleScaler float64
+
+// sampleScalerFor 返回当前配置的放大倍数。开启抽样时在响应头 `X-Sample-Rate` 中返回采样率，
+// 让调用方知道结果是估计值。
+func sampleScalerFor(w http.ResponseWriter, r *http.Request) sampleScaler {
+	cfg, ok := r.Context().Value("config").(*Config)
+	if !ok || cfg.SampleRate >= 1 || cfg.SampleRate <= 0 {
+		return 1
+	}
+	w.Header().Set("X-Sample-Rate", strconv.FormatFloat(cfg.SampleRate, 'g', -1, 64))
+	return sampleScaler(1 / cfg.SampleRate)
+}
+
+// Scale 把 values 指向的统计值原地放大为估计值。
+func (s sampleScaler) Scale(values ...*uint64) {
+	if s == 1 {
+		return
+	}
+	for _, v := range values {
+		*v = uint64(math.Round(float64(*v) * float64(s)))
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"database/sql"
 	"log"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
@@ -37,27 +39,36 @@ func archiveDBMiddleware(archiveDB *sql.DB) mux.MiddlewareFunc {
 	}
 }
 
+// archiveDBFromContext 返回请求 context 中的归档数据库连接池。
+// 关闭归档数据库 (ARCHIVE_ENABLED=false) 时中间件没有注册，返回 nil。
+func archiveDBFromContext(r *http.Request) *sql.DB {
+	archiveDB, _ := r.Context().Value("archiveDB").(*sql.DB)
+	return archiveDB
+}
+
+// errArchiveDisabled 是关闭归档数据库时，只能操作归档数据的接口返回的错误信息。
+const errArchiveDisabled = "未启用归档数据库 (ARCHIVE_ENABLED=false)"
+
+// configMiddleware 与 dbMiddleware 功能类似，它将应用程序的配置注入到请求的 context 中，
+// 供需要读取配置的 Handler 使用。
+func configMiddleware(cfg *Config) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), "config", cfg)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
 // StartWebServer 函数负责初始化和启动 Web 服务器。
 // 它配置了所有的 API 路由、中间件和 CORS（跨域资源共享）策略。
-func StartWebServer(db *sql.DB, archiveDB *sql.DB, port string) {
-	// 创建一个新的 `gorilla/mux` 路由器实例。`mux` 提供了比标准库更强大的路由功能。
-	r := mux.NewRouter()
+func StartWebServer(db *sql.DB, archiveDB *sql.DB, cfg *Config) {
+	r := newRouter(db, archiveDB, cfg)
 
-	// 使用我们定义的中间件。中间件会按照它们被添加的顺序执行。
-	r.Use(dbMiddleware(db))
-	r.Use(archiveDBMiddleware(archiveDB))
-
-	// --- API 路由定义 ---
-	// `r.PathPrefix("/api")` 创建了一个子路由器，所有路径以 `/api` 开头的请求都将由它处理。
-	// 这样做有助于将 API 路由和前端路由清晰地分离开。
-	apiRouter := r.PathPrefix("/api").Subrouter()
-	apiRouter.HandleFunc("/connections", getConnectionsHandler).Methods("GET")
-	apiRouter.HandleFunc("/summary/traffic", getTrafficSummaryHandler).Methods("GET")
-	apiRouter.HandleFunc("/summary/hosts", getHostSummaryHandler).Methods("GET")
-	apiRouter.HandleFunc("/hosts", getHostsHandler).Methods("GET")
-	apiRouter.HandleFunc("/chains", getChainsHandler).Methods("GET")
-	apiRouter.HandleFunc("/connections/merge", mergeConnectionsHandler).Methods("POST")
-	apiRouter.HandleFunc("/connections/replace-host", replaceHostHandler).Methods("POST")
+	// 检查注册的接口是否都已在 OpenAPI 文档中描述。
+	for _, mismatch := range openAPIRouteMismatches(r) {
+		log.Printf("警告: %s", mismatch)
+	}
 
 	// --- 前端路由处理 ---
 	// 调用 `addFrontendRoutes` 函数来处理前端静态文件的服务。
@@ -80,10 +91,133 @@ func StartWebServer(db *sql.DB, archiveDB *sql.DB, port string) {
 	// 将 CORS 中间件包装在我们的主路由器上。
 	handler := c.Handler(r)
 
-	log.Printf("Web 服务器已启动，正在监听端口 %s", port)
+	// 使用 `net.JoinHostPort` 拼接地址，这样 WEB_HOST 也可以是 `::1` 这样的 IPv6 地址。
+	addr := net.JoinHostPort(cfg.WebHost, cfg.WebPort)
+
+	// 配置了证书和私钥时使用 HTTPS，避免在局域网中明文传输浏览记录。
+	if cfg.TLSCertFile != "" {
+		if cfg.TLSRedirectPort != "" {
+			go startTLSRedirectServer(cfg)
+		}
+		log.Printf("Web 服务器已启动 (HTTPS)，正在监听 %s", addr)
+		if err := http.ListenAndServeTLS(addr, cfg.TLSCertFile, cfg.TLSKeyFile, handler); err != nil {
+			log.Fatalf("启动 Web 服务器失败: %v", err)
+		}
+		return
+	}
+
+	log.Printf("Web 服务器已启动，正在监听 %s", addr)
 	// `http.ListenAndServe` 启动 HTTP 服务器并开始监听指定的地址和端口。
 	// 这是一个阻塞操作，因此我们通常在 main.go 中使用一个 Goroutine 来调用它。
-	if err := http.ListenAndServe("0.0.0.0:"+port, handler); err != nil {
+	if err := http.ListenAndServe(addr, handler); err != nil {
 		log.Fatalf("启动 Web 服务器失败: %v", err)
 	}
 }
+
+// newRouter 创建包含所有中间件和 `/api` 路由的路由器，不包含前端路由。
+// 测试通过它检查注册的接口与 OpenAPI 文档是否一致。
+func newRouter(db *sql.DB, archiveDB *sql.DB, cfg *Config) *mux.Router {
+	// 创建一个新的 `gorilla/mux` 路由器实例。`mux` 提供了比标准库更强大的路由功能。
+	r := mux.NewRouter()
+
+	// 使用我们定义的中间件。中间件会按照它们被添加的顺序执行。
+	r.Use(dbMiddleware(db))
+	// 关闭归档数据库时不注册该中间件，依赖归档数据库的 Handler 通过 archiveDBFromContext 得到 nil。
+	if archiveDB != nil {
+		r.Use(archiveDBMiddleware(archiveDB))
+	}
+	r.Use(configMiddleware(cfg))
+	// 记录每个请求匹配到的接口，用于统计查询耗时和记录慢查询日志，见 slowquery.go。
+	r.Use(endpointMiddleware)
+	slowQueryThreshold = time.Duration(cfg.SlowQueryMs) * time.Millisecond
+	// 只读模式下拒绝所有修改数据的请求。修改数据的接口在注册时已经被替换为 readOnlyHandler，
+	// 这个中间件是额外的一层保护，覆盖之后新增但没有用 mutatingHandler 注册的接口。
+	if cfg.ReadOnly {
+		r.Use(readOnlyMiddleware)
+		log.Println("已开启只读模式 (READ_ONLY=true)，修改数据的接口将返回 403。")
+	}
+
+	// 基于连接记录的汇总接口通过 cachedSummaryHandler 注册，数据只在每个写入周期变化一次，缓存的有效期为写入间隔。
+	// lifetime、bandwidth、clash 的数据来自每次同步都会更新的 Clash 计数器，不缓存。
+	if cfg.SummaryCache {
+		summaryCache.Enable(cfg.DBWriteInterval)
+	}
+
+	// --- API 路由定义 ---
+	// `r.PathPrefix("/api")` 创建了一个子路由器，所有路径以 `/api` 开头的请求都将由它处理。
+	// 这样做有助于将 API 路由和前端路由清晰地分离开。
+	// 修改数据的接口（POST、PUT、DELETE）通过 mutatingHandler 注册，只读模式下返回 403。
+	apiRouter := r.PathPrefix("/api").Subrouter()
+	apiRouter.HandleFunc("/connections", getConnectionsHandler).Methods("GET")
+	apiRouter.HandleFunc("/connections", mutatingHandler(cfg, deleteConnectionsHandler)).Methods("DELETE")
+	apiRouter.HandleFunc("/summary/traffic", cachedSummaryHandler(humanizedHandler(getTrafficSummaryHandler))).Methods("GET")
+	apiRouter.HandleFunc("/summary/hosts", cachedSummaryHandler(humanizedHandler(getHostSummaryHandler))).Methods("GET")
+	apiRouter.HandleFunc("/summary/lifetime", humanizedHandler(getLifetimeSummaryHandler)).Methods("GET")
+	apiRouter.HandleFunc("/summary/compare", cachedSummaryHandler(humanizedHandler(getCompareSummaryHandler))).Methods("GET")
+	apiRouter.HandleFunc("/summary/billing", cachedSummaryHandler(humanizedHandler(getBillingSummaryHandler))).Methods("GET")
+	apiRouter.HandleFunc("/summary/countries", cachedSummaryHandler(humanizedHandler(getCountrySummaryHandler))).Methods("GET")
+	apiRouter.HandleFunc("/summary/network", cachedSummaryHandler(humanizedHandler(getNetworkSummaryHandler))).Methods("GET")
+	apiRouter.HandleFunc("/summary/ports", cachedSummaryHandler(humanizedHandler(getPortSummaryHandler))).Methods("GET")
+	apiRouter.HandleFunc("/summary/rules", cachedSummaryHandler(humanizedHandler(getRuleSummaryHandler))).Methods("GET")
+	apiRouter.HandleFunc("/summary/heatmap", cachedSummaryHandler(humanizedHandler(getHeatmapHandler))).Methods("GET")
+	apiRouter.HandleFunc("/summary/bandwidth", humanizedHandler(getBandwidthSummaryHandler)).Methods("GET")
+	apiRouter.HandleFunc("/summary/clash", humanizedHandler(getClashStatsSummaryHandler)).Methods("GET")
+	apiRouter.HandleFunc("/summary/hourly-heatmap", cachedSummaryHandler(humanizedHandler(getHeatmapHandler))).Methods("GET")
+	apiRouter.HandleFunc("/hosts", getHostsHandler).Methods("GET")
+	apiRouter.HandleFunc("/hosts/new", getNewHostsHandler).Methods("GET")
+	apiRouter.HandleFunc("/hosts/{host}/detail", humanizedHandler(getHostDetailHandler)).Methods("GET")
+	apiRouter.HandleFunc("/chains", getChainsHandler).Methods("GET")
+	apiRouter.HandleFunc("/proxies", getProxiesHandler).Methods("GET")
+	apiRouter.HandleFunc("/types", getTypesHandler).Methods("GET")
+	apiRouter.HandleFunc("/connections/merge", mutatingHandler(cfg, mergeConnectionsHandler)).Methods("POST")
+	apiRouter.HandleFunc("/connections/replace-host", mutatingHandler(cfg, replaceHostHandler)).Methods("POST")
+	apiRouter.HandleFunc("/archive/merge", mutatingHandler(cfg, compactArchiveHandler)).Methods("POST")
+	apiRouter.HandleFunc("/archive/restore", mutatingHandler(cfg, restoreArchiveHandler)).Methods("POST")
+	apiRouter.HandleFunc("/archive/batches", getArchiveBatchesHandler).Methods("GET")
+	apiRouter.HandleFunc("/archive", getArchiveHandler).Methods("GET")
+	apiRouter.HandleFunc("/maintenance/anonymize-source-ips", mutatingHandler(cfg, anonymizeSourceIPsHandler)).Methods("POST")
+	apiRouter.HandleFunc("/maintenance/rebuild-rollup", mutatingHandler(cfg, rebuildRollupHandler)).Methods("POST")
+	apiRouter.HandleFunc("/maintenance/duplicates", getDuplicatesHandler).Methods("GET")
+	apiRouter.HandleFunc("/maintenance/duplicates", mutatingHandler(cfg, mergeDuplicatesHandler)).Methods("POST")
+	apiRouter.HandleFunc("/admin/integrity-check", integrityCheckHandler).Methods("GET")
+	apiRouter.HandleFunc("/alerts", getAlertRulesHandler).Methods("GET")
+	apiRouter.HandleFunc("/alerts", mutatingHandler(cfg, createAlertRuleHandler)).Methods("POST")
+	apiRouter.HandleFunc("/alerts/{id}", getAlertRuleHandler).Methods("GET")
+	apiRouter.HandleFunc("/alerts/{id}", mutatingHandler(cfg, updateAlertRuleHandler)).Methods("PUT")
+	apiRouter.HandleFunc("/alerts/{id}", mutatingHandler(cfg, deleteAlertRuleHandler)).Methods("DELETE")
+	apiRouter.HandleFunc("/alerts/{id}/test", mutatingHandler(cfg, testAlertRuleHandler)).Methods("POST")
+	apiRouter.HandleFunc("/live/top", getLiveTopHandler).Methods("GET")
+	apiRouter.HandleFunc("/flush", mutatingHandler(cfg, flushHandler)).Methods("POST")
+	apiRouter.HandleFunc("/sync", mutatingHandler(cfg, syncHandler)).Methods("POST")
+	apiRouter.HandleFunc("/rotations", getRotatedDBsHandler).Methods("GET")
+	apiRouter.HandleFunc("/devices", getDevicesHandler).Methods("GET")
+	apiRouter.HandleFunc("/devices", mutatingHandler(cfg, saveDeviceHandler)).Methods("POST")
+	apiRouter.HandleFunc("/devices/{ip}", mutatingHandler(cfg, saveDeviceHandler)).Methods("PUT")
+	apiRouter.HandleFunc("/devices/{ip}", mutatingHandler(cfg, deleteDeviceHandler)).Methods("DELETE")
+	apiRouter.HandleFunc("/version", getVersionHandler).Methods("GET")
+	apiRouter.HandleFunc("/config", getConfigHandler).Methods("GET")
+	apiRouter.HandleFunc("/health", getHealthHandler).Methods("GET")
+	apiRouter.HandleFunc("/metrics", getMetricsHandler).Methods("GET")
+	apiRouter.HandleFunc("/openapi.json", getOpenAPIHandler).Methods("GET")
+	apiRouter.HandleFunc("/docs", getAPIDocsHandler).Methods("GET")
+	return r
+}
+
+// startTLSRedirectServer 在 TLSRedirectPort 上监听 HTTP，把所有请求永久重定向到 HTTPS 端口。
+// 这样用户在浏览器中输入 `http://` 地址时也能自动跳转。它会一直阻塞，应在 Goroutine 中调用。
+func startTLSRedirectServer(cfg *Config) {
+	addr := net.JoinHostPort(cfg.WebHost, cfg.TLSRedirectPort)
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 请求中的 Host 带有重定向端口，需要替换为 HTTPS 端口。
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		target := "https://" + net.JoinHostPort(host, cfg.WebPort) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+	log.Printf("HTTP 重定向服务已启动，正在监听 %s", addr)
+	if err := http.ListenAndServe(addr, redirect); err != nil {
+		log.Printf("启动 HTTP 重定向服务失败: %v", err)
+	}
+}
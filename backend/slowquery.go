@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// 这个文件记录查询接口执行 SQL 的耗时，用于找出仪表盘中异常缓慢的查询。
+// 查询接口通过 timedQuery / timedQueryRow 代替 db.Query / db.QueryRow 执行查询，
+// 耗时从发出查询算到读完结果 (Rows.Close / Row.Scan)：SQLite 在读取第一行时才真正执行语句，只统计 Query 本身几乎总是 0。
+// 超过 SLOW_QUERY_MS 的查询会连同发起它的接口一起记录到日志中，日志中的 SQL 只包含占位符，不包含参数的值；
+// 每个接口的耗时分布通过 `/api/metrics` 提供。
+
+// queryDurationBucketsMs 是耗时分布的区间上限（毫秒），最后还有一个区间统计超过最大值的查询。
+var queryDurationBucketsMs = []int64{10, 50, 100, 500, 1000, 5000}
+
+// slowQueryThreshold 是记录慢查询日志的阈值，0 表示不记录，由 StartWebServer 根据 SLOW_QUERY_MS 设置。
+var slowQueryThreshold time.Duration
+
+// QueryMetrics 是一个接口执行查询的累计统计。
+type QueryMetrics struct {
+	Count   int64   `json:"count"`   // 查询次数。
+	TotalMs int64   `json:"totalMs"` // 累计耗时（毫秒）。
+	MaxMs   int64   `json:"maxMs"`   // 最长的一次耗时（毫秒）。
+	Slow    int64   `json:"slow"`    // 超过 SLOW_QUERY_MS 的查询次数。
+	Buckets []int64 `json:"buckets"` // 耗时分布，第 i 项为不超过 bucketsMs[i] 的查询次数（不累计），最后一项为超过最大值的查询次数。
+}
+
+// queryMetricsTracker 按接口累计查询的耗时。
+type queryMetricsTracker struct {
+	mu        sync.Mutex
+	endpoints map[string]*QueryMetrics
+	totals    map[string]time.Duration // 累计耗时，Snapshot 时才换算为毫秒，避免每次查询都被截断。
+}
+
+// queryMetrics 是全局唯一的查询耗时统计。
+var queryMetrics = &queryMetricsTracker{endpoints: map[string]*QueryMetrics{}, totals: map[string]time.Duration{}}
+
+// Observe 记录 endpoint 执行的一次耗时为 d 的查询，返回它是否为慢查询。
+func (t *queryMetricsTracker) Observe(endpoint string, d time.Duration) bool {
+	slow := slowQueryThreshold > 0 && d >= slowQueryThreshold
+	ms := d.Milliseconds()
+	bucket := len(queryDurationBucketsMs)
+	for i, bound := range queryDurationBucketsMs {
+		if ms <= bound {
+			bucket = i
+			break
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m, ok := t.endpoints[endpoint]
+	if !ok {
+		m = &QueryMetrics{Buckets: make([]int64, len(queryDurationBucketsMs)+1)}
+		t.endpoints[endpoint] = m
+	}
+	m.Count++
+	m.MaxMs = max(m.MaxMs, ms)
+	m.Buckets[bucket]++
+	if slow {
+		m.Slow++
+	}
+	t.totals[endpoint] += d
+	return slow
+}
+
+// Snapshot 返回每个接口的累计统计。
+func (t *queryMetricsTracker) Snapshot() map[string]QueryMetrics {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	snapshot := make(map[string]QueryMetrics, len(t.endpoints))
+	for endpoint, m := range t.endpoints {
+		metrics := *m
+		metrics.Buckets = append([]int64(nil), m.Buckets...)
+		metrics.TotalMs = t.totals[endpoint].Milliseconds()
+		snapshot[endpoint] = metrics
+	}
+	return snapshot
+}
+
+// endpointMiddleware 把匹配到的路由模板（例如 `/api/hosts/{host}/detail`）存入请求的 context，
+// 用于在统计和日志中区分发起查询的接口。使用模板而不是实际路径，同一个接口的统计不会因为路径参数不同而分散。
+func endpointMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				endpoint = template
+			}
+		}
+		ctx := context.WithValue(r.Context(), "endpoint", endpoint)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// observeQuery 记录一次从 started 开始的查询，超过 SLOW_QUERY_MS 时写入日志。
+func observeQuery(ctx context.Context, query string, started time.Time) {
+	d := time.Since(started)
+	endpoint, _ := ctx.Value("endpoint").(string)
+	if endpoint == "" {
+		endpoint = "-"
+	}
+	if queryMetrics.Observe(endpoint, d) {
+		// 压缩 SQL 中的换行和缩进，让一条查询只占一行日志。
+		log.Printf("慢查询 (%s, 耗时 %v): %s", endpoint, d.Round(time.Millisecond), strings.Join(strings.Fields(query), " "))
+	}
+}
+
+// timedRows 是 timedQuery 返回的结果集，Close 时记录查询的耗时。
+type timedRows struct {
+	*sql.Rows
+	ctx     context.Context
+	query   string
+	started time.Time
+	closed  bool
+}
+
+// Close 关闭结果集并记录耗时，重复调用时只记录一次。
+func (r *timedRows) Close() error {
+	err := r.Rows.Close()
+	if !r.closed {
+		r.closed = true
+		observeQuery(r.ctx, r.query, r.started)
+	}
+	return err
+}
+
+// timedQuery 与 db.QueryContext 相同，但在结果集关闭时记录查询的耗时。调用方必须调用 Close（通常通过 defer）。
+func timedQuery(ctx context.Context, db *sql.DB, query string, args ...interface{}) (*timedRows, error) {
+	started := time.Now()
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		observeQuery(ctx, query, started)
+		return nil, err
+	}
+	return &timedRows{Rows: rows, ctx: ctx, query: query, started: started}, nil
+}
+
+// timedRow 是 timedQueryRow 返回的单行结果，Scan 时记录查询的耗时。
+type timedRow struct {
+	row     *sql.Row
+	ctx     context.Context
+	query   string
+	started time.Time
+}
+
+// Scan 与 sql.Row.Scan 相同。
+func (r *timedRow) Scan(dest ...interface{}) error {
+	err := r.row.Scan(dest...)
+	observeQuery(r.ctx, r.query, r.started)
+	return err
+}
+
+// timedQueryRow 与 db.QueryRowContext 相同，但在 Scan 时记录查询的耗时。
+func timedQueryRow(ctx context.Context, db *sql.DB, query string, args ...interface{}) *timedRow {
+	started := time.Now()
+	return &timedRow{row: db.QueryRowContext(ctx, query, args...), ctx: ctx, query: query, started: started}
+}
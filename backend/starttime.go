@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+)
+
+// 这个文件处理连接的开始时间 (Connection.Start)。
+// 它通常来自 Clash 的 `start` 字段，但部分 Clash 分支使用其他格式（Unix 时间戳、不带时区的日期时间），
+// 偶尔还会返回零值，这样的连接会被保存在 1970 年，在按时间汇总时出现在 Unix 纪元所在的时间段。
+// 解析时宽松地接受几种常见格式；解析不了、为零或明显不合理的开始时间，改用第一次同步到这个连接的时间。
+// 也可以通过 START_TIME_SOURCE=ingest 让所有连接都使用第一次同步到的时间，不再信任 Clash 的 start。
+
+// 连接开始时间的来源。
+const (
+	StartTimeSourceClash  = "clash"  // 使用 Clash 的 start 字段，无效时退回同步时间（默认）。
+	StartTimeSourceIngest = "ingest" // 始终使用第一次同步到这个连接的时间。
+)
+
+// maxClashStartSkew 是开始时间允许晚于同步时间的上限。Clash 与本程序通常运行在同一台机器或同一个局域网中，
+// 晚于这个范围的开始时间只可能是解析错误（例如把毫秒当成了秒）。
+const maxClashStartSkew = 24 * time.Hour
+
+// startTimeLayouts 是 start 为字符串时依次尝试的格式。不带时区的格式按本地时间解析。
+var startTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// UnmarshalJSON 解析 Clash 返回的连接。除 start 以外的字段与默认的解析方式相同；
+// start 无法解析时保持为零值，而不是让整个连接被跳过，之后由 resolveConnectionStart 改用同步时间。
+func (c *Connection) UnmarshalJSON(data []byte) error {
+	type plain Connection // 不带 UnmarshalJSON 方法，避免递归。
+	aux := struct {
+		*plain
+		Start json.RawMessage `json:"start"`
+	}{plain: (*plain)(c)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	c.Start = parseClashStart(aux.Start)
+	return nil
+}
+
+// parseClashStart 解析 start 字段，支持 RFC 3339 等日期时间字符串，以及以秒或毫秒为单位的 Unix 时间戳（数字或数字字符串）。
+// 无法解析时返回零值。
+func parseClashStart(raw json.RawMessage) time.Time {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return time.Time{}
+	}
+	value := string(raw)
+	if raw[0] == '"' {
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return time.Time{}
+		}
+		for _, layout := range startTimeLayouts {
+			if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+				return t
+			}
+		}
+	}
+	if n, err := strconv.ParseFloat(value, 64); err == nil && n > 0 {
+		// 1e12 秒远在公元 33000 年之后，大于它的值只可能是毫秒。
+		if n >= 1e12 {
+			return time.UnixMilli(int64(n))
+		}
+		return time.Unix(int64(n), 0)
+	}
+	return time.Time{}
+}
+
+// validClashStart 判断 Clash 报告的开始时间是否可信：不为零、晚于 Unix 纪元，且不明显晚于同步时间 now。
+func validClashStart(start, now time.Time) bool {
+	return !start.IsZero() && start.Unix() > 0 && !start.After(now.Add(maxClashStartSkew))
+}
+
+// resolveConnectionStart 按 source 确定连接的开始时间。需要改用同步时间时（source 为 ingest，或 Clash 的开始时间无效），
+// 上一次同步中已经出现过的连接沿用上一次确定的开始时间，新出现的连接使用这一次同步的时间 now，
+// 这样同一个连接的开始时间不会随每次同步而变化。返回值表示是否因为 Clash 的开始时间无效而改用了同步时间，且这是一个新连接，
+// 调用方据此汇总警告，同一个连接只警告一次。调用方必须持有 clashSyncMu。
+func resolveConnectionStart(conn *Connection, source string, now time.Time) bool {
+	if source != StartTimeSourceIngest && validClashStart(conn.Start, now) {
+		return false
+	}
+	if prev, ok := openConnections[conn.ID]; ok {
+		conn.Start = prev.Start
+		return false
+	}
+	invalid := source != StartTimeSourceIngest
+	if invalid {
+		debugf("连接 %s (%s) 的开始时间 %v 无效，改用同步时间。", conn.ID, conn.Metadata.Host, conn.Start)
+	}
+	conn.Start = now
+	return invalid
+}
+
+// logInvalidStarts 记录一次同步中开始时间无效的新连接数。
+func logInvalidStarts(n int) {
+	if n > 0 {
+		log.Printf("警告: %d 个新连接的开始时间为空或无效，已改用同步时间。如果经常出现，可以设置 START_TIME_SOURCE=ingest。", n)
+	}
+}
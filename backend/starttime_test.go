@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseClashStart(t *testing.T) {
+	const sec = 1714564800 // 2024-05-01 12:00:00 UTC
+	tests := []struct {
+		name string
+		raw  string
+		want time.Time
+	}{
+		{"rfc3339", `"2024-05-01T20:00:00+08:00"`, time.Unix(sec, 0)},
+		{"rfc3339 nano", `"2024-05-01T12:00:00.123456789Z"`, time.Unix(sec, 123456789)},
+		{"without time zone", `"2024-05-01T12:00:00.5"`, time.Date(2024, 5, 1, 12, 0, 0, 5e8, time.Local)},
+		{"space separated with time zone", `"2024-05-01 20:00:00+08:00"`, time.Unix(sec, 0)},
+		{"space separated", `"2024-05-01 12:00:00"`, time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)},
+		{"seconds", `1714564800`, time.Unix(sec, 0)},
+		{"milliseconds", `1714564800123`, time.UnixMilli(sec*1000 + 123)},
+		{"seconds string", `"1714564800"`, time.Unix(sec, 0)},
+		{"milliseconds string", `"1714564800123"`, time.UnixMilli(sec*1000 + 123)},
+		{"fractional seconds", `1714564800.9`, time.Unix(sec, 0)},
+		{"surrounding whitespace", " 1714564800 ", time.Unix(sec, 0)},
+		{"zero", `0`, time.Time{}},
+		{"zero string", `"0"`, time.Time{}},
+		{"negative", `-1714564800`, time.Time{}},
+		{"go zero time", `"0001-01-01T00:00:00Z"`, time.Time{}},
+		{"null", `null`, time.Time{}},
+		{"empty", ``, time.Time{}},
+		{"empty string", `""`, time.Time{}},
+		{"garbage", `"yesterday"`, time.Time{}},
+		{"object", `{}`, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseClashStart(json.RawMessage(tt.raw))
+			if !got.Equal(tt.want) || got.IsZero() != tt.want.IsZero() {
+				t.Errorf("parseClashStart(%s) = %v, want %v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestConnectionUnmarshalJSONInvalidStart 检查 start 无法解析时连接本身仍被保留，开始时间为零值。
+func TestConnectionUnmarshalJSONInvalidStart(t *testing.T) {
+	var conn Connection
+	if err := json.Unmarshal([]byte(`{"id":"a","upload":10,"start":{"bad":true}}`), &conn); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if conn.ID != "a" || conn.Upload != 10 || !conn.Start.IsZero() {
+		t.Errorf("Unmarshal() = %+v, want id a, upload 10 and a zero start", conn)
+	}
+}
+
+func TestValidClashStart(t *testing.T) {
+	now := time.Unix(1714564800, 0)
+	tests := []struct {
+		name  string
+		start time.Time
+		want  bool
+	}{
+		{"zero", time.Time{}, false},
+		{"unix epoch", time.Unix(0, 0), false},
+		{"before epoch", time.Unix(-1, 0), false},
+		{"an hour ago", now.Add(-time.Hour), true},
+		{"a year ago", now.AddDate(-1, 0, 0), true},
+		{"slightly in the future", now.Add(time.Hour), true},
+		{"at the skew limit", now.Add(maxClashStartSkew), true},
+		{"beyond the skew limit", now.Add(maxClashStartSkew + time.Second), false},
+		{"milliseconds read as seconds", time.Unix(1714564800123, 0), false},
+	}
+	for _, tt := range tests {
+		if got := validClashStart(tt.start, now); got != tt.want {
+			t.Errorf("%s: validClashStart(%v) = %v, want %v", tt.name, tt.start, got, tt.want)
+		}
+	}
+}
+
+// TestResolveConnectionStartStableAcrossSyncs 模拟连续几次同步：开始时间无效的连接第一次出现时使用同步时间，
+// 之后的同步沿用第一次确定的时间，而不是每次同步都变成新的同步时间；有效的开始时间原样保留。
+func TestResolveConnectionStartStableAcrossSyncs(t *testing.T) {
+	tests := []struct {
+		source    string
+		validWant func(clashStart, firstSync time.Time) time.Time
+	}{
+		{StartTimeSourceClash, func(clashStart, _ time.Time) time.Time { return clashStart }},
+		{StartTimeSourceIngest, func(_, firstSync time.Time) time.Time { return firstSync }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			resetConnectionsCache(t)
+			openConnections = nil
+			t.Cleanup(func() { openConnections = nil })
+			cfg := &Config{SampleRate: 1, StartTimeSource: tt.source}
+
+			clashStart := time.Unix(1714564000, 0)
+			sync1 := time.Unix(1714564800, 0)
+			sync2 := sync1.Add(time.Second)
+			sync3 := sync2.Add(time.Second)
+			conns := func(ids ...string) *Connections {
+				out := &Connections{}
+				for _, id := range ids {
+					conn := Connection{ID: id, Metadata: Metadata{Host: "example.com"}}
+					if id == "valid" {
+						conn.Start = clashStart
+					}
+					out.Connections = append(out.Connections, conn)
+				}
+				return out
+			}
+			cachedStart := func(id string) time.Time {
+				t.Helper()
+				value, ok := connectionsCache.Load(id)
+				if !ok {
+					t.Fatalf("connection %s is not cached", id)
+				}
+				return value.(*Connection).Start
+			}
+
+			ingestConnections(conns("valid", "zero"), cfg, sync1)
+			ingestConnections(conns("valid", "zero", "late"), cfg, sync2)
+			ingestConnections(conns("valid", "zero", "late"), cfg, sync3)
+
+			if got, want := cachedStart("valid"), tt.validWant(clashStart, sync1); !got.Equal(want) {
+				t.Errorf("valid start = %v, want %v", got, want)
+			}
+			if got := cachedStart("zero"); !got.Equal(sync1) {
+				t.Errorf("zero start = %v, want the first sync time %v", got, sync1)
+			}
+			if got := cachedStart("late"); !got.Equal(sync2) {
+				t.Errorf("start of a connection first seen in the second sync = %v, want %v", got, sync2)
+			}
+		})
+	}
+}
+
+// TestResolveConnectionStartReportsNewInvalidStartsOnce 检查同一个开始时间无效的连接只在第一次出现时被计入警告。
+func TestResolveConnectionStartReportsNewInvalidStartsOnce(t *testing.T) {
+	now := time.Unix(1714564800, 0)
+	openConnections = nil
+	t.Cleanup(func() { openConnections = nil })
+
+	first := &Connection{ID: "a"}
+	if !resolveConnectionStart(first, StartTimeSourceClash, now) {
+		t.Error("resolveConnectionStart() = false for a new connection with a zero start, want true")
+	}
+	openConnections = map[string]*Connection{"a": first}
+	again := &Connection{ID: "a"}
+	if resolveConnectionStart(again, StartTimeSourceClash, now.Add(time.Second)) {
+		t.Error("resolveConnectionStart() = true for a connection already seen, want false")
+	}
+	if !again.Start.Equal(now) {
+		t.Errorf("start = %v, want %v", again.Start, now)
+	}
+	// START_TIME_SOURCE=ingest 时使用同步时间是预期行为，不算无效。
+	if resolveConnectionStart(&Connection{ID: "b"}, StartTimeSourceIngest, now) {
+		t.Error("resolveConnectionStart() = true with START_TIME_SOURCE=ingest, want false")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 这个文件实现了汇总接口的响应缓存 (SUMMARY_CACHE)。
+// 仪表盘每次刷新都会重新计算「最近 30 天」的流量曲线和主机排行，但数据库中的数据只在每个写入周期 (DBWriteInterval) 变化一次，
+// 同一组参数在两次写入之间得到的结果完全相同。缓存以请求路径和参数为键保存序列化后的响应，有效期为一个写入周期；
+// 写入缓存、合并、替换主机名、删除等修改连接记录的操作之后显式清空，因此缓存不会返回过时的数据。
+// 子命令（例如 `infoclash merge`）在另一个进程中修改数据库，无法通知这里，最多在一个写入周期之后才能看到变化。
+
+// maxSummaryCacheEntries 是缓存最多保存的响应数。参数组合通常只有仪表盘上的几种，上限只是为了防止被随意的参数撑大。
+const maxSummaryCacheEntries = 256
+
+// summaryCacheHeaders 是随响应一起缓存的响应头。CORS 等由中间件设置的响应头与具体的请求有关，不能缓存。
+var summaryCacheHeaders = []string{"Content-Type", "X-Sample-Rate", "X-Limit"}
+
+// summaryCacheEntry 是一个缓存的响应。
+type summaryCacheEntry struct {
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// SummaryCacheMetrics 是汇总接口缓存的统计，通过 `/api/metrics` 提供。
+type SummaryCacheMetrics struct {
+	Enabled       bool  `json:"enabled"`       // 是否开启了缓存。
+	TTLSeconds    int64 `json:"ttlSeconds"`    // 缓存的有效期（秒），等于数据库写入间隔。
+	Entries       int   `json:"entries"`       // 当前缓存的响应数（包括已过期但尚未清理的）。
+	Hits          int64 `json:"hits"`          // 命中缓存的请求数。
+	Misses        int64 `json:"misses"`        // 未命中缓存、需要查询数据库的请求数。
+	Invalidations int64 `json:"invalidations"` // 因为数据变化而清空缓存的次数。
+}
+
+// summaryResponseCache 以请求路径和参数为键缓存汇总接口的响应。
+type summaryResponseCache struct {
+	mu         sync.Mutex
+	enabled    bool
+	ttl        time.Duration
+	entries    map[string]summaryCacheEntry
+	generation uint64 // 每次清空时加 1，清空之前开始计算的响应不会被存入缓存。
+
+	hits, misses, invalidations atomic.Int64
+}
+
+// summaryCache 是全局唯一的汇总接口缓存，由 StartWebServer 根据 SUMMARY_CACHE 开启。
+var summaryCache = &summaryResponseCache{}
+
+// Enable 开启缓存，ttl 为缓存的有效期。
+func (c *summaryResponseCache) Enable(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enabled = true
+	c.ttl = ttl
+	c.entries = make(map[string]summaryCacheEntry)
+}
+
+// Invalidate 清空缓存。修改连接记录之后调用。
+func (c *summaryResponseCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.enabled {
+		return
+	}
+	c.generation++
+	clear(c.entries)
+	c.invalidations.Add(1)
+}
+
+// get 返回 key 对应的未过期的响应。缓存未开启时第三个返回值为 false，
+// 否则第二个返回值为当前的 generation，存入缓存时需要传回给 put。
+func (c *summaryResponseCache) get(key string) (summaryCacheEntry, uint64, bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.enabled {
+		return summaryCacheEntry{}, 0, false, false
+	}
+	entry, ok := c.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	return entry, c.generation, true, ok
+}
+
+// put 存入一个响应。generation 与当前不同（计算期间缓存被清空过）时丢弃这个响应，因为它可能是用修改之前的数据计算的。
+func (c *summaryResponseCache) put(key string, generation uint64, header http.Header, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.enabled || generation != c.generation {
+		return
+	}
+	now := time.Now()
+	if len(c.entries) >= maxSummaryCacheEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// 没有过期的响应可以清理时直接清空，下一个写入周期之后缓存本来也会全部过期。
+		if len(c.entries) >= maxSummaryCacheEntries {
+			clear(c.entries)
+		}
+	}
+	c.entries[key] = summaryCacheEntry{header: header, body: body, expires: now.Add(c.ttl)}
+}
+
+// Snapshot 返回当前的缓存统计。
+func (c *summaryResponseCache) Snapshot() SummaryCacheMetrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return SummaryCacheMetrics{
+		Enabled:       c.enabled,
+		TTLSeconds:    int64(c.ttl.Seconds()),
+		Entries:       len(c.entries),
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Invalidations: c.invalidations.Load(),
+	}
+}
+
+// cachingResponseWriter 在写出响应的同时保存状态码和响应体，用于把成功的响应存入缓存。
+type cachingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *cachingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cachingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// cachedSummaryHandler 用于注册汇总接口：开启缓存时先查找相同路径和参数的响应，未命中时调用 h 并缓存 200 的响应。
+// 响应头 `X-Cache` 为 `HIT` 或 `MISS`。参数按名称排序后作为键，参数顺序不同的请求共用同一个缓存。
+func cachedSummaryHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Path + "?" + r.URL.Query().Encode()
+		entry, generation, enabled, ok := summaryCache.get(key)
+		if !enabled {
+			h(w, r)
+			return
+		}
+		if ok {
+			summaryCache.hits.Add(1)
+			for name, values := range entry.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("X-Cache", "HIT")
+			w.Write(entry.body)
+			return
+		}
+
+		summaryCache.misses.Add(1)
+		w.Header().Set("X-Cache", "MISS")
+		cw := &cachingResponseWriter{ResponseWriter: w}
+		h(cw, r)
+		if cw.status == http.StatusOK {
+			header := http.Header{}
+			for _, name := range summaryCacheHeaders {
+				if values := w.Header().Values(name); len(values) > 0 {
+					header[name] = values
+				}
+			}
+			summaryCache.put(key, generation, header, cw.body.Bytes())
+		}
+	}
+}
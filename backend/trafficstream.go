@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 这个文件实现了可选的实时带宽采集 (ENABLE_TRAFFIC_STREAM)。
+// 每条连接只有累计流量，事后只能算出一段时间内的总量，无法还原某一秒的带宽。
+// Clash 的 `/traffic` WebSocket 每秒推送一次 `{"up": 上传字节/秒, "down": 下载字节/秒}`，
+// 这里订阅它并把采样写入 `traffic_samples` 表，供 `/api/summary/bandwidth` 绘制带宽曲线。
+// 为了让表保持很小，旧的采样会被逐级降采样：超过 1 天的按分钟聚合，超过 7 天的按小时聚合。
+
+const (
+	trafficSampleFlushInterval = 30 * time.Second // 内存中的采样写入数据库的间隔。
+	trafficDownsampleInterval  = time.Hour        // 执行降采样的间隔。
+	trafficStreamReadTimeout   = 30 * time.Second // 超过这个时间没有收到推送则认为连接已失效，断开重连。
+	trafficStreamMaxBackoff    = time.Minute      // 重连的最长等待时间。
+	maxBandwidthPoints         = 10000            // `/api/summary/bandwidth` 单次返回的最大数据点数。
+	defaultBandwidthPoints     = 720              // 未指定 interval 时，按这个数据点数自动选择聚合间隔。
+)
+
+// trafficDownsampleTiers 是降采样的各级规则：早于 age 的采样按 resolution 秒聚合为一行。
+var trafficDownsampleTiers = []struct {
+	age        time.Duration
+	resolution int64
+}{
+	{24 * time.Hour, 60},
+	{7 * 24 * time.Hour, 3600},
+}
+
+// TrafficSample 是一个带宽采样点，up 和 down 为该时间段内的平均速率（字节/秒）。
+type TrafficSample struct {
+	Timestamp int64  `json:"timestamp"` // 时间段的开始时间（Unix 时间戳，秒）。
+	Up        uint64 `json:"up"`
+	Down      uint64 `json:"down"`
+}
+
+// trafficStreamCollector 订阅 Clash 的 `/traffic` 推送，先把采样缓存在内存中，再定期批量写入数据库。
+type trafficStreamCollector struct {
+	cfg *Config
+	db  *sql.DB
+
+	mu      sync.Mutex
+	pending []TrafficSample
+}
+
+// trafficStream 是全局的实时带宽采集器。为 nil 时表示未开启。
+var trafficStream *trafficStreamCollector
+
+// newTrafficStreamCollector 创建实时带宽采集器，调用 Run 后开始采集。
+func newTrafficStreamCollector(cfg *Config, db *sql.DB) *trafficStreamCollector {
+	return &trafficStreamCollector{cfg: cfg, db: db}
+}
+
+// trafficStreamURL 根据配置的 `/connections` 地址推导出 `/traffic` 的 WebSocket 地址，
+// 例如 `http://192.168.1.1:9090/connections` → `ws://192.168.1.1:9090/traffic`。查询参数原样保留。
+func trafficStreamURL(connectionsURL *url.URL) (string, error) {
+	u := clashEndpointURL(connectionsURL, "traffic")
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return "", fmt.Errorf("不支持的 Clash API 地址协议: %q", u.Scheme)
+	}
+	return u.String(), nil
+}
+
+// Run 启动采集。它会一直阻塞，应在 Goroutine 中调用。
+// 连接断开后按指数退避重连；连接稳定运行一段时间后，退避时间重新从 1 秒开始。
+func (c *trafficStreamCollector) Run() {
+	go c.flushLoop()
+
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := c.stream()
+		if time.Since(started) > trafficStreamMaxBackoff {
+			backoff = time.Second
+		}
+		log.Printf("Clash 实时流量连接中断: %v，%v 后重连。", err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, trafficStreamMaxBackoff)
+	}
+}
+
+// stream 建立一次 WebSocket 连接并持续接收采样，直到连接出错。
+func (c *trafficStreamCollector) stream() error {
+	// 借用一个普通请求来添加认证信息，与 GetClashConnections 使用相同的认证方式（包括 query 方式的 `?secret=`）。
+	req, err := http.NewRequest("GET", c.cfg.ClashAPIURL, nil)
+	if err != nil {
+		return fmt.Errorf("创建请求失败: %w", err)
+	}
+	setClashAuth(req, c.cfg)
+	wsURL, err := trafficStreamURL(req.URL)
+	if err != nil {
+		return err
+	}
+
+	conn, resp, err := websocket.DefaultDialer.Dial(wsURL, req.Header)
+	if err != nil {
+		if resp != nil {
+			return &ClashStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+		return fmt.Errorf("连接 Clash /traffic 失败: %w", err)
+	}
+	defer conn.Close()
+	log.Println("已连接 Clash 实时流量推送。")
+
+	for {
+		var msg struct {
+			Up   uint64 `json:"up"`
+			Down uint64 `json:"down"`
+		}
+		conn.SetReadDeadline(time.Now().Add(trafficStreamReadTimeout))
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.pending = append(c.pending, TrafficSample{Timestamp: time.Now().Unix(), Up: msg.Up, Down: msg.Down})
+		c.mu.Unlock()
+	}
+}
+
+// flushLoop 定期把内存中的采样写入数据库，并定期执行降采样。
+func (c *trafficStreamCollector) flushLoop() {
+	flushTicker := time.NewTicker(trafficSampleFlushInterval)
+	defer flushTicker.Stop()
+	downsampleTicker := time.NewTicker(trafficDownsampleInterval)
+	defer downsampleTicker.Stop()
+
+	for {
+		select {
+		case <-flushTicker.C:
+			if err := c.Flush(); err != nil {
+				log.Printf("写入带宽采样失败: %v", err)
+			}
+		case now := <-downsampleTicker.C:
+			if err := downsampleTrafficSamples(c.db, now); err != nil {
+				log.Printf("带宽采样降采样失败: %v", err)
+			}
+		}
+	}
+}
+
+// Flush 把内存中的采样写入数据库。写入失败时这批采样会被丢弃，避免在数据库不可用时无限占用内存。
+func (c *trafficStreamCollector) Flush() (err error) {
+	c.mu.Lock()
+	samples := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+	if len(samples) == 0 {
+		return nil
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return fmt.Errorf("开启事务失败: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	stmt, err := tx.Prepare("INSERT INTO traffic_samples (timestamp, up, down, resolution, samples) VALUES (?, ?, ?, 1, 1)")
+	if err != nil {
+		return fmt.Errorf("准备 SQL 语句失败: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, sample := range samples {
+		if _, err = stmt.Exec(sample.Timestamp, sample.Up, sample.Down); err != nil {
+			return fmt.Errorf("写入采样失败: %w", err)
+		}
+	}
+	return nil
+}
+
+// downsampleTrafficSamples 按 trafficDownsampleTiers 把旧的采样聚合为更粗的粒度。
+// 聚合后的速率按原始采样数加权平均，因此多级降采样后平均值依然准确。
+// 截止时间向下对齐到聚合粒度，保证同一个时间段不会被拆成两行。
+func downsampleTrafficSamples(db *sql.DB, now time.Time) error {
+	for _, tier := range trafficDownsampleTiers {
+		cutoff := now.Add(-tier.age).Unix() / tier.resolution * tier.resolution
+		if err := downsampleTrafficTier(db, cutoff, tier.resolution); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downsampleTrafficTier 在一个事务中把早于 cutoff、粒度小于 resolution 的采样聚合为 resolution 秒一行。
+func downsampleTrafficTier(db *sql.DB, cutoff, resolution int64) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("开启事务失败: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	_, err = tx.Exec(`
+		INSERT INTO traffic_samples (timestamp, up, down, resolution, samples)
+		SELECT timestamp / ? * ? AS bucket, SUM(up * samples) / SUM(samples), SUM(down * samples) / SUM(samples), ?, SUM(samples)
+		FROM traffic_samples
+		WHERE timestamp < ? AND resolution < ?
+		GROUP BY bucket`,
+		resolution, resolution, resolution, cutoff, resolution)
+	if err != nil {
+		return fmt.Errorf("聚合采样失败: %w", err)
+	}
+	// 新插入的行 resolution 等于本级粒度，不会被这里删除。
+	if _, err = tx.Exec("DELETE FROM traffic_samples WHERE timestamp < ? AND resolution < ?", cutoff, resolution); err != nil {
+		return fmt.Errorf("删除已聚合的采样失败: %w", err)
+	}
+	return nil
+}
+
+// getBandwidthSummaryHandler 是处理 `/api/summary/bandwidth` GET 请求的 HTTP Handler。
+// 它返回 [startDate, endDate] 范围内按 interval 秒聚合的平均上传、下载速率（字节/秒），用于绘制带宽曲线。
+// 未指定时间范围时返回最近一小时；未指定 interval 时自动选择，使数据点不超过 defaultBandwidthPoints 个。
+func getBandwidthSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := r.Context().Value("db").(*sql.DB)
+	if !ok {
+		http.Error(w, "无法获取数据库连接", http.StatusInternalServerError)
+		return
+	}
+
+	endDate, _ := strconv.ParseInt(r.URL.Query().Get("endDate"), 10, 64)
+	if endDate <= 0 {
+		endDate = time.Now().Unix()
+	}
+	startDate, _ := strconv.ParseInt(r.URL.Query().Get("startDate"), 10, 64)
+	if startDate <= 0 {
+		startDate = endDate - 3600
+	}
+	if startDate >= endDate {
+		writeJSONError(w, http.StatusBadRequest, "startDate", "startDate 必须早于 endDate")
+		return
+	}
+
+	span := endDate - startDate
+	var interval int64
+	if raw := r.URL.Query().Get("interval"); raw != "" {
+		var err error
+		interval, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || interval < 1 {
+			writeJSONError(w, http.StatusBadRequest, "interval", "interval 必须是正整数（秒）")
+			return
+		}
+		if span/interval > maxBandwidthPoints {
+			writeJSONError(w, http.StatusBadRequest, "interval", fmt.Sprintf("数据点过多，请增大 interval，最多返回 %d 个数据点", maxBandwidthPoints))
+			return
+		}
+	} else {
+		interval = max(1, (span+defaultBandwidthPoints-1)/defaultBandwidthPoints)
+	}
+
+	rows, err := timedQuery(r.Context(), db, `
+		SELECT timestamp / ? * ? AS bucket, SUM(up * samples) / SUM(samples), SUM(down * samples) / SUM(samples)
+		FROM traffic_samples
+		WHERE timestamp >= ? AND timestamp <= ?
+		GROUP BY bucket ORDER BY bucket`,
+		interval, interval, startDate, endDate)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("数据库查询失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	samples := []TrafficSample{}
+	for rows.Next() {
+		var sample TrafficSample
+		if err := rows.Scan(&sample.Timestamp, &sample.Up, &sample.Down); err != nil {
+			log.Printf("扫描数据库行失败: %v", err)
+			continue
+		}
+		samples = append(samples, sample)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":  trafficStream != nil,
+		"interval": interval,
+		"data":     samples,
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 这个文件实现了合并、删除和轮转之后回收数据库空间的策略 (VACUUM_MODE)。
+// SQLite 删除数据后不会缩小数据库文件，被删除的数据占用的页只是被标记为空闲。
+// 完整的 VACUUM 会重写整个数据库文件，数据库很大时可能需要很长时间，期间读写都会被阻塞。
+// 因此提供三种策略：
+//   - always（默认）：与之前的版本一样，执行完整的 VACUUM；
+//   - never：从不执行 VACUUM，空闲页留给之后的写入复用，文件大小不会缩小；
+//   - incremental：启动时把数据库设置为 `auto_vacuum = INCREMENTAL`，之后用 `PRAGMA incremental_vacuum`
+//     分批释放空闲页，每批之间释放数据库锁，让同步写入和查询可以穿插执行。
+
+// VACUUM 策略。
+const (
+	VacuumModeAlways      = "always"      // 执行完整的 VACUUM（默认）。
+	VacuumModeNever       = "never"       // 从不执行 VACUUM。
+	VacuumModeIncremental = "incremental" // 使用 `PRAGMA incremental_vacuum` 分批释放空闲页。
+)
+
+// minVacuumDeletedRows 是触发 VACUUM 所需的最少删除行数。
+// 删除的数据太少时，VACUUM 能回收的空间微乎其微，却依然要重写整个数据库文件，得不偿失。
+const minVacuumDeletedRows = 1000
+
+// incrementalVacuumPages 是 incremental 策略下每批释放的页数。默认页大小为 4 KiB 时约 4 MiB，
+// 每批通常只需要几十毫秒，期间被阻塞的写入和查询很快就能继续。
+const incrementalVacuumPages = 1000
+
+// vacuumMode 是当前的 VACUUM 策略，由 main 在打开数据库之前根据 VACUUM_MODE 设置。
+var vacuumMode = VacuumModeAlways
+
+// vacuumRunning 标记当前是否有 VACUUM 正在执行，避免多个 VACUUM 同时排队锁库。
+var vacuumRunning atomic.Bool
+
+// parseVacuumMode 校验 VACUUM_MODE 的取值（不区分大小写）。第二个返回值为 false 表示取值无效。
+func parseVacuumMode(mode string) (string, bool) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case VacuumModeAlways, VacuumModeNever, VacuumModeIncremental:
+		return mode, true
+	}
+	return "", false
+}
+
+// enableIncrementalVacuum 在 incremental 策略下把数据库设置为 `auto_vacuum = INCREMENTAL`。
+// auto_vacuum 只能在建表之前设置，已有数据的数据库需要执行一次完整的 VACUUM 才能生效，
+// 因此从其他策略切换过来后的第一次启动可能较慢。其他策略下什么也不做。
+// `PRAGMA auto_vacuum` 与随后的 VACUUM 必须在同一个连接上执行，这里从连接池中单独取出一个连接。
+func enableIncrementalVacuum(db *sql.DB) error {
+	if vacuumMode != VacuumModeIncremental {
+		return nil
+	}
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var current int
+	if err := conn.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&current); err != nil {
+		return fmt.Errorf("读取 auto_vacuum 失败: %w", err)
+	}
+	const autoVacuumIncremental = 2
+	if current == autoVacuumIncremental {
+		return nil
+	}
+	if _, err := conn.ExecContext(ctx, "PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+		return fmt.Errorf("设置 auto_vacuum 失败: %w", err)
+	}
+	log.Println("正在执行一次完整的 VACUUM 以启用增量 VACUUM (VACUUM_MODE=incremental)，数据库较大时可能需要一些时间...")
+	started := time.Now()
+	if _, err := conn.ExecContext(ctx, "VACUUM"); err != nil {
+		return fmt.Errorf("执行 VACUUM 失败: %w", err)
+	}
+	log.Printf("已启用增量 VACUUM，耗时 %v。", time.Since(started))
+	return nil
+}
+
+// vacuumDB 按 vacuumMode 回收数据库中空闲的空间并记录耗时。
+// 它通常在 Goroutine 中调用；如果已有 VACUUM 在执行，则直接跳过。
+// VACUUM 失败不影响调用方的主操作，仅记录日志。
+func vacuumDB(db *sql.DB) {
+	if vacuumMode == VacuumModeNever {
+		return
+	}
+	if !vacuumRunning.CompareAndSwap(false, true) {
+		log.Println("已有 VACUUM 正在执行，跳过本次 VACUUM。")
+		return
+	}
+	defer vacuumRunning.Store(false)
+
+	if vacuumMode == VacuumModeIncremental {
+		incrementalVacuum(db)
+		return
+	}
+	if err := fullVacuum(db); err != nil {
+		log.Printf("执行 VACUUM 失败: %v", err)
+	}
+}
+
+// fullVacuum 执行一次完整的 VACUUM 并记录耗时。
+func fullVacuum(db *sql.DB) error {
+	log.Println("开始执行 VACUUM...")
+	started := time.Now()
+	if _, err := db.Exec("VACUUM"); err != nil {
+		return err
+	}
+	log.Printf("VACUUM 执行成功，耗时 %v。", time.Since(started))
+	return nil
+}
+
+// incrementalVacuum 每次释放 incrementalVacuumPages 个空闲页，直到没有空闲页为止。
+// 每一批都是一条独立的语句，执行完即释放数据库锁，不会像完整的 VACUUM 那样长时间独占数据库。
+// 空闲页数不再减少时（例如数据库的 auto_vacuum 没有设置成功）停止，避免死循环。
+func incrementalVacuum(db *sql.DB) {
+	started := time.Now()
+	initial, prev := int64(-1), int64(-1)
+	var free int64
+	for {
+		if err := db.QueryRow("PRAGMA freelist_count").Scan(&free); err != nil {
+			log.Printf("读取空闲页数失败: %v", err)
+			return
+		}
+		if initial < 0 {
+			initial = free
+		}
+		if free == 0 {
+			break
+		}
+		if prev >= 0 && free >= prev {
+			log.Printf("增量 VACUUM 未能释放空闲页（剩余 %d 页），数据库可能没有启用 auto_vacuum = INCREMENTAL。", free)
+			break
+		}
+		prev = free
+		if _, err := db.Exec(fmt.Sprintf("PRAGMA incremental_vacuum(%d)", incrementalVacuumPages)); err != nil {
+			log.Printf("执行增量 VACUUM 失败: %v", err)
+			return
+		}
+	}
+	log.Printf("增量 VACUUM 执行完成，释放了 %d 页，耗时 %v。", initial-free, time.Since(started))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+)
+
+// 以下变量在构建时通过 `-ldflags` 注入，例如：
+//
+//	go build -ldflags="-X main.version=v1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// 直接 `go run` 或未注入时保留默认值，便于在报告问题时识别非正式构建。
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// VersionInfo 是 `/api/version` 的响应结构。
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+	Frontend  string `json:"frontend"` // 前端构建方式：prod（嵌入前端）或 dev（由 Vite 开发服务器提供）。
+}
+
+// currentVersionInfo 返回当前可执行文件的版本信息。
+func currentVersionInfo() VersionInfo {
+	return VersionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Frontend:  frontendBuild,
+	}
+}
+
+// String 返回单行的版本描述，用于启动日志和 `-version` 参数。
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("infoclash %s (commit %s, built %s, %s, frontend %s)", v.Version, v.Commit, v.BuildDate, v.GoVersion, v.Frontend)
+}
+
+// getVersionHandler 是处理 `/api/version` GET 请求的 HTTP Handler。
+func getVersionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentVersionInfo())
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// 这个文件实现了从文件加载主机后缀白名单，并在文件变化时热重载。
+// 很长的 CDN 后缀列表写在 HOST_SUFFIX_WHITELIST 环境变量里难以维护，
+// 因此可以通过 HOST_SUFFIX_WHITELIST_FILE 指定一个文件，每行一个后缀，`#` 之后的内容为注释。
+// 文件中的后缀追加在环境变量中的后缀之后，修改文件后无需重启即可生效。
+
+// activeHostSuffixWhitelist 保存当前生效的主机后缀白名单。
+// 采集器每次同步时原子地读取一次，热重载时整体替换，不会读到修改了一半的列表。
+var activeHostSuffixWhitelist atomic.Pointer[[]string]
+
+// currentHostSuffixWhitelist 返回当前生效的主机后缀白名单。
+// 尚未初始化时（例如没有调用 initHostSuffixWhitelist）退回到配置中的静态列表。
+func currentHostSuffixWhitelist(cfg *Config) []string {
+	if list := activeHostSuffixWhitelist.Load(); list != nil {
+		return *list
+	}
+	return cfg.HostSuffixWhitelist
+}
+
+// initHostSuffixWhitelist 加载主机后缀白名单。如果配置了白名单文件，
+// 则读取文件内容并在后台监听文件变化。文件首次读取失败时返回错误。
+func initHostSuffixWhitelist(cfg *Config) error {
+	if cfg.HostSuffixWhitelistFile == "" {
+		list := cfg.HostSuffixWhitelist
+		activeHostSuffixWhitelist.Store(&list)
+		return nil
+	}
+
+	if err := reloadHostSuffixWhitelist(cfg); err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("创建文件监听器失败: %w", err)
+	}
+	// 监听文件所在的目录而不是文件本身：很多编辑器保存时会先写临时文件再重命名覆盖，
+	// 直接监听文件会在第一次保存后失效。
+	if err := watcher.Add(filepath.Dir(cfg.HostSuffixWhitelistFile)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("监听白名单文件失败: %w", err)
+	}
+	go watchHostSuffixWhitelist(watcher, cfg)
+	return nil
+}
+
+// reloadHostSuffixWhitelist 重新读取白名单文件，并与环境变量中的后缀合并后替换当前列表。
+func reloadHostSuffixWhitelist(cfg *Config) error {
+	fileSuffixes, err := loadHostSuffixWhitelistFile(cfg.HostSuffixWhitelistFile)
+	if err != nil {
+		return fmt.Errorf("读取白名单文件失败: %w", err)
+	}
+	list := make([]string, 0, len(cfg.HostSuffixWhitelist)+len(fileSuffixes))
+	list = append(list, cfg.HostSuffixWhitelist...)
+	list = append(list, fileSuffixes...)
+	activeHostSuffixWhitelist.Store(&list)
+	log.Printf("已从 %s 加载 %d 个主机后缀。", cfg.HostSuffixWhitelistFile, len(fileSuffixes))
+	return nil
+}
+
+// watchHostSuffixWhitelist 处理白名单文件的变化事件。它会一直阻塞，应在 Goroutine 中调用。
+// 重新加载失败时保留原有的列表，只记录日志。
+func watchHostSuffixWhitelist(watcher *fsnotify.Watcher, cfg *Config) {
+	defer watcher.Close()
+
+	target := filepath.Clean(cfg.HostSuffixWhitelistFile)
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != target || !event.Has(fsnotify.Write|fsnotify.Create) {
+				continue
+			}
+			if err := reloadHostSuffixWhitelist(cfg); err != nil {
+				log.Printf("热重载主机后缀白名单失败，继续使用原有列表: %v", err)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("监听白名单文件出错: %v", err)
+		}
+	}
+}
+
+// loadHostSuffixWhitelistFile 读取白名单文件，每行一个后缀。
+// 空行被忽略，`#` 及其之后的内容视为注释。
+func loadHostSuffixWhitelistFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var suffixes []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line != "" {
+			suffixes = append(suffixes, line)
+		}
+	}
+	return suffixes, scanner.Err()
+}
@@ -25,7 +25,11 @@ cp -R ./frontend/dist ./backend/dist
 cd backend
 # 使用Go构建命令，生成可执行文件到上级目录，命名为 infoclash。
 # -ldflags="-s -w" 选项用于剥离调试信息和符号表，以减小生成二进制文件的大小。
-go build -ldflags="-s -w" -o ../infoclash .
+# -X 选项注入版本号、Git 提交和构建时间，由 /api/version 和 -version 参数显示。
+VERSION=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
+COMMIT=$(git rev-parse --short HEAD 2>/dev/null || echo unknown)
+BUILD_DATE=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+go build -ldflags="-s -w -X main.version=${VERSION} -X main.commit=${COMMIT} -X main.buildDate=${BUILD_DATE}" -o ../infoclash .
 # 返回到项目根目录
 cd ..
 